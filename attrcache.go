@@ -0,0 +1,109 @@
+// pkcs11mod
+// Copyright (C) 2022  Namecoin Developers
+//
+// pkcs11mod is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// pkcs11mod is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with pkcs11mod; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+
+package pkcs11mod
+
+import (
+	"github.com/miekg/pkcs11"
+)
+
+// attrCacheEntry remembers the backend's answer to a C_GetAttributeValue
+// length query, so that the fetch call that usually follows it can be served
+// without a second backend round trip.  It's only used when
+// PKCS11MOD_CACHE_ATTRIBUTES is set.
+type attrCacheEntry struct {
+	object  pkcs11.ObjectHandle
+	types   []uint
+	results []*pkcs11.Attribute
+	err     error
+}
+
+// matches reports whether the entry answers a query for template on object.
+func (e *attrCacheEntry) matches(object pkcs11.ObjectHandle, template []*pkcs11.Attribute) bool {
+	if e.object != object || len(e.types) != len(template) {
+		return false
+	}
+
+	for i, a := range template {
+		if e.types[i] != a.Type {
+			return false
+		}
+	}
+
+	return true
+}
+
+// takeCachedAttributes returns (and clears) the session's cached entry if it
+// answers a query for template on object, and nil otherwise.  Each entry is
+// used at most once.
+func takeCachedAttributes(sessionHandle pkcs11.SessionHandle, object pkcs11.ObjectHandle, template []*pkcs11.Attribute) *attrCacheEntry {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	session, ok := sessions[sessionHandle]
+	if !ok || session.attrCache == nil {
+		return nil
+	}
+
+	entry := session.attrCache
+	session.attrCache = nil
+
+	if !entry.matches(object, template) {
+		return nil
+	}
+
+	return entry
+}
+
+// storeCachedAttributes caches the results of a length query on object.
+func storeCachedAttributes(sessionHandle pkcs11.SessionHandle, object pkcs11.ObjectHandle, template []*pkcs11.Attribute, results []*pkcs11.Attribute, err error) {
+	types := make([]uint, len(template))
+	for i, a := range template {
+		types[i] = a.Type
+	}
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	session, ok := sessions[sessionHandle]
+	if !ok {
+		return
+	}
+
+	session.attrCache = &attrCacheEntry{
+		object:  object,
+		types:   types,
+		results: results,
+		err:     err,
+	}
+}
+
+// invalidateAttrCaches drops the cached attributes of every session.  It's
+// called whenever an object or the login state might have changed, which is
+// more aggressive than strictly needed but keeps the cache trivially correct.
+func invalidateAttrCaches() {
+	if !cacheAttributes {
+		return
+	}
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	for _, session := range sessions {
+		session.attrCache = nil
+	}
+}
@@ -0,0 +1,90 @@
+// pkcs11mod
+// Copyright (C) 2022  Namecoin Developers
+//
+// pkcs11mod is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// pkcs11mod is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with pkcs11mod; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+
+package pkcs11mod
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/miekg/pkcs11"
+)
+
+// countingAttributeBackend counts the GetAttributeValue calls that reach it.
+type countingAttributeBackend struct {
+	attributeBackend
+	calls *int
+}
+
+func (b countingAttributeBackend) GetAttributeValue(sh pkcs11.SessionHandle, oh pkcs11.ObjectHandle, template []*pkcs11.Attribute) ([]*pkcs11.Attribute, error) {
+	*b.calls++
+
+	return b.attributeBackend.GetAttributeValue(sh, oh, template)
+}
+
+func TestAttributeCacheTwoCall(t *testing.T) {
+	oldCache := cacheAttributes
+	cacheAttributes = true
+
+	t.Cleanup(func() { cacheAttributes = oldCache })
+
+	var calls int
+
+	sh := openTestSession(t, countingAttributeBackend{
+		attributeBackend: attributeBackend{values: map[uint][]byte{
+			pkcs11.CKA_LABEL: []byte("label"),
+			pkcs11.CKA_ID:    {0x01, 0x02, 0x03},
+		}},
+		calls: &calls,
+	})
+
+	getAttributeValue := func(object ckObjectHandle, template []*pkcs11.Attribute) []ckAttribute {
+		t.Helper()
+
+		pTemplate, count := testTemplate(t, template)
+		if rv := goGetAttributeValue(sh, object, pTemplate, count); rv != pkcs11.CKR_OK {
+			t.Fatalf("C_GetAttributeValue: got %s", RVTrace(uint(rv)))
+		}
+
+		return unsafe.Slice(pTemplate, count)
+	}
+
+	lengths := getAttributeValue(1, []*pkcs11.Attribute{{Type: pkcs11.CKA_LABEL}, {Type: pkcs11.CKA_ID}})
+	label, id := make([]byte, lengths[0].ulValueLen), make([]byte, lengths[1].ulValueLen)
+
+	getAttributeValue(1, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_LABEL, label), pkcs11.NewAttribute(pkcs11.CKA_ID, id)})
+
+	if calls != 1 {
+		t.Errorf("the backend was called %d times for the two-call idiom, want 1", calls)
+	}
+
+	if string(label) != "label" || string(id) != "\x01\x02\x03" {
+		t.Errorf("got label %q and ID %x", label, id)
+	}
+
+	// The cached answer is only used for the same object and template,
+	// and only once.
+	calls = 0
+
+	getAttributeValue(1, []*pkcs11.Attribute{{Type: pkcs11.CKA_LABEL}})
+	getAttributeValue(2, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_LABEL, label)})
+	getAttributeValue(1, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_LABEL, label)})
+
+	if calls != 3 {
+		t.Errorf("the backend was called %d times for queries that don't match the cache, want 3", calls)
+	}
+}
@@ -37,8 +37,6 @@ type Backend interface {
 	CloseSession(pkcs11.SessionHandle) error
 	CloseAllSessions(uint) error
 	GetSessionInfo(pkcs11.SessionHandle) (pkcs11.SessionInfo, error)
-	GetOperationState(pkcs11.SessionHandle) ([]byte, error)
-	SetOperationState(pkcs11.SessionHandle, []byte, pkcs11.ObjectHandle, pkcs11.ObjectHandle) error
 	Login(pkcs11.SessionHandle, uint, string) error
 	Logout(pkcs11.SessionHandle) error
 	CreateObject(pkcs11.SessionHandle, []*pkcs11.Attribute) (pkcs11.ObjectHandle, error)
@@ -86,5 +84,56 @@ type Backend interface {
 	DeriveKey(pkcs11.SessionHandle, []*pkcs11.Mechanism, pkcs11.ObjectHandle, []*pkcs11.Attribute) (pkcs11.ObjectHandle, error)
 	SeedRandom(pkcs11.SessionHandle, []byte) error
 	GenerateRandom(pkcs11.SessionHandle, int) ([]byte, error)
+}
+
+// The optional interfaces below cover functions that many backends can't
+// support.  SetBackend probes for them once; the corresponding PKCS#11
+// functions return CKR_FUNCTION_NOT_SUPPORTED if the backend doesn't
+// implement them.  New functions will be added as optional interfaces like
+// these rather than to Backend, so that existing backends keep compiling.
+
+// SlotEventWaiter is an optional interface that a Backend can implement to
+// support C_WaitForSlotEvent.
+type SlotEventWaiter interface {
 	WaitForSlotEvent(uint) chan pkcs11.SlotEvent
 }
+
+// OperationStateManager is an optional interface that a Backend can implement
+// to support C_GetOperationState and C_SetOperationState.  The state is
+// opaque to pkcs11mod: SetOperationState receives exactly the bytes that
+// GetOperationState returned.  pkcs11mod adds its own header to the blob seen
+// by the application, and rejects blobs without it as
+// CKR_SAVED_STATE_INVALID.
+type OperationStateManager interface {
+	GetOperationState(pkcs11.SessionHandle) ([]byte, error)
+	SetOperationState(pkcs11.SessionHandle, []byte, pkcs11.ObjectHandle, pkcs11.ObjectHandle) error
+}
+
+// DefaultTemplater is an optional interface that a Backend can implement to
+// have C_CreateObject fill in the attributes that the application omitted.
+// DefaultTemplate returns the default attributes for objects of the given
+// CKO_* class, or nil if there are none; attributes in the application's
+// template take precedence over them.
+type DefaultTemplater interface {
+	DefaultTemplate(class uint) []*pkcs11.Attribute
+}
+
+// NativeParamsReceiver is an optional interface for backends that pass
+// mechanisms on to a PKCS#11 module through *pkcs11.Ctx, as p11mod does.
+// *pkcs11.Ctx only lays out the miekg/pkcs11 parameter types itself and
+// passes any other Parameter to the module as is, so if ReceivesNativeParams
+// returns true, the parameters that pkcs11mod would otherwise encode with the
+// New*Params functions reach the backend as the application's C structures
+// instead.  The pointers in those structures are only valid as long as the
+// application keeps its CK_MECHANISM.  SetBackend assumes this for a
+// *pkcs11.Ctx.
+type NativeParamsReceiver interface {
+	ReceivesNativeParams() bool
+}
+
+// SelfTester is an optional interface that a Backend can implement to run
+// known-answer tests or other health checks on demand.  It is invoked via the
+// pkcs11mod_SelfTest export; a nil error means the self-test passed.
+type SelfTester interface {
+	SelfTest() error
+}
@@ -0,0 +1,69 @@
+// pkcs11mod
+// Copyright (C) 2022  Namecoin Developers
+//
+// pkcs11mod is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// pkcs11mod is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with pkcs11mod; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+
+package pkcs11mod
+
+/*
+#include "spec/pkcs11go.h"
+#include "pkcs11v3.h"
+#include <stdlib.h>
+
+CK_RV pkcs11mod_register_interface(CK_CHAR *pInterfaceName, CK_VOID_PTR pFunctionList, CK_FLAGS flags);
+*/
+import "C"
+
+import (
+	"unsafe"
+
+	"github.com/miekg/pkcs11"
+)
+
+// FunctionList returns a pointer to this module's CK_FUNCTION_LIST, exactly as
+// C_GetFunctionList would.  It allows a Go program that links pkcs11mod
+// in-process to call into the module's C exports without dlopen'ing its own
+// shared object.  The pointer can be passed to C code that expects a
+// CK_FUNCTION_LIST_PTR; it remains valid for the lifetime of the process.
+func FunctionList() unsafe.Pointer {
+	var list C.CK_FUNCTION_LIST_PTR
+
+	if rv := C.C_GetFunctionList(&list); rv != C.CKR_OK {
+		return nil
+	}
+
+	return unsafe.Pointer(list)
+}
+
+// RegisterInterface adds a vendor-defined interface that C_GetInterfaceList
+// will enumerate after the standard "PKCS 11" interface, and that
+// C_GetInterface can select by name.  functionList must point to C memory
+// that starts with a CK_VERSION (as every PKCS#11 function list does) and
+// stays valid for the lifetime of the process.  Interfaces can't be
+// unregistered, so this is typically called from the backend's init().
+func RegisterInterface(name string, functionList unsafe.Pointer, flags uint) error {
+	// The name is intentionally never freed, since C_GetInterface hands out
+	// pointers to it.
+	cName := C.CString(name)
+
+	rv := C.pkcs11mod_register_interface((*C.CK_CHAR)(unsafe.Pointer(cName)), C.CK_VOID_PTR(functionList), C.CK_FLAGS(flags))
+	if rv != C.CKR_OK {
+		C.free(unsafe.Pointer(cName))
+
+		return pkcs11.Error(rv)
+	}
+
+	return nil
+}
@@ -0,0 +1,177 @@
+// pkcs11mod
+// Copyright (C) 2022  Namecoin Developers
+//
+// pkcs11mod is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// pkcs11mod is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with pkcs11mod; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+
+package pkcs11mod
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+
+	"github.com/namecoin/pkcs11mod/internal/cktest"
+)
+
+type infoBackend struct {
+	testBackend
+}
+
+func (infoBackend) Initialize() error {
+	return nil
+}
+
+func (infoBackend) Finalize() error {
+	return nil
+}
+
+func (infoBackend) GetInfo() (pkcs11.Info, error) {
+	return pkcs11.Info{
+		ManufacturerID:     "Namecoin",
+		LibraryDescription: "pkcs11mod test",
+	}, nil
+}
+
+func TestFunctionListGetInfo(t *testing.T) {
+	oldBackend := backend
+
+	SetBackend(infoBackend{})
+	t.Cleanup(func() { SetBackend(oldBackend) })
+
+	list := FunctionList()
+	if list == nil {
+		t.Fatal("FunctionList returned nil")
+	}
+
+	if rv := cktest.Initialize(list); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_Initialize: got %s", RVTrace(rv))
+	}
+
+	t.Cleanup(func() {
+		if rv := cktest.Finalize(list); rv != pkcs11.CKR_OK {
+			t.Errorf("C_Finalize: got %s", RVTrace(rv))
+		}
+	})
+
+	manufacturerID, libraryDescription, rv := cktest.GetInfo(list)
+	if rv != pkcs11.CKR_OK {
+		t.Fatalf("C_GetInfo: got %s", RVTrace(rv))
+	}
+
+	if manufacturerID != "Namecoin"+strings.Repeat(" ", 24) {
+		t.Errorf("got manufacturer ID %q, want Namecoin padded to 32 bytes", manufacturerID)
+	}
+
+	if strings.TrimRight(libraryDescription, " ") != "pkcs11mod test" {
+		t.Errorf("got library description %q, want pkcs11mod test", libraryDescription)
+	}
+}
+
+func TestRegisterInterface(t *testing.T) {
+	const name = "Vendor pkcs11mod test"
+
+	// Any function list will do, as long as it's in C memory.
+	if err := RegisterInterface(name, FunctionList(), CKF_INTERFACE_FORK_SAFE); err != nil {
+		t.Fatalf("RegisterInterface: %v", err)
+	}
+
+	iface, rv := cktest.GetInterface(name)
+	if rv != pkcs11.CKR_OK {
+		t.Fatalf("C_GetInterface: got %s", RVTrace(rv))
+	}
+
+	if iface.Name != name || iface.FunctionList != FunctionList() || iface.Flags != CKF_INTERFACE_FORK_SAFE {
+		t.Errorf("C_GetInterface: got %+v", iface)
+	}
+
+	// The standard interface is still the default.
+	if iface, rv = cktest.GetInterface(""); rv != pkcs11.CKR_OK || iface.Name != "PKCS 11" {
+		t.Errorf("C_GetInterface with no name: got %+v (%s), want PKCS 11", iface, RVTrace(rv))
+	}
+
+	if _, rv = cktest.GetInterface("Vendor unknown"); rv != pkcs11.CKR_ARGUMENTS_BAD {
+		t.Errorf("C_GetInterface of an unregistered name: got %s, want CKR_ARGUMENTS_BAD", RVTrace(rv))
+	}
+
+	count, rv := cktest.GetInterfaceCount()
+	if rv != pkcs11.CKR_OK {
+		t.Fatalf("C_GetInterfaceList count: got %s", RVTrace(rv))
+	}
+
+	list, _, rv := cktest.GetInterfaceList(count)
+	if rv != pkcs11.CKR_OK {
+		t.Fatalf("C_GetInterfaceList: got %s", RVTrace(rv))
+	}
+
+	if list[0].Name != "PKCS 11" || list[len(list)-1].Name != name {
+		t.Errorf("C_GetInterfaceList: got %+v, want PKCS 11 first and %s last", list, name)
+	}
+}
+
+func TestBeforeInitialize(t *testing.T) {
+	oldBackend := backend
+
+	// Every method of testBackend{} panics, so this also checks that neither
+	// function reaches the backend.
+	SetBackend(testBackend{})
+	t.Cleanup(func() { SetBackend(oldBackend) })
+
+	if initialized {
+		t.Fatal("already initialized")
+	}
+
+	list, rv := cktest.GetFunctionList()
+	if rv != pkcs11.CKR_OK || list != FunctionList() {
+		t.Fatalf("C_GetFunctionList: got %s with %p, want %p", RVTrace(rv), list, FunctionList())
+	}
+
+	if _, _, rv := cktest.GetInfo(list); rv != pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED {
+		t.Errorf("C_GetInfo: got %s, want CKR_CRYPTOKI_NOT_INITIALIZED", RVTrace(rv))
+	}
+}
+
+func TestGetInterfaceListCount(t *testing.T) {
+	const name = "Vendor pkcs11mod count test"
+
+	// Other tests register interfaces too, and registrations can't be
+	// undone, so only the change in the count is checked.
+	before, rv := cktest.GetInterfaceCount()
+	if rv != pkcs11.CKR_OK || before == 0 {
+		t.Fatalf("C_GetInterfaceList count: got %d (%s)", before, RVTrace(rv))
+	}
+
+	if err := RegisterInterface(name, FunctionList(), 0); err != nil {
+		t.Fatalf("RegisterInterface: %v", err)
+	}
+
+	count, rv := cktest.GetInterfaceCount()
+	if rv != pkcs11.CKR_OK || count != before+1 {
+		t.Fatalf("C_GetInterfaceList count after RegisterInterface: got %d (%s), want %d", count, RVTrace(rv), before+1)
+	}
+
+	if _, got, rv := cktest.GetInterfaceList(count - 1); rv != pkcs11.CKR_BUFFER_TOO_SMALL || got != count {
+		t.Errorf("C_GetInterfaceList with room for %d: got %s with count %d, want CKR_BUFFER_TOO_SMALL with %d", count-1, RVTrace(rv), got, count)
+	}
+
+	list, got, rv := cktest.GetInterfaceList(count)
+	if rv != pkcs11.CKR_OK || got != count {
+		t.Fatalf("C_GetInterfaceList: got %s with count %d, want %d", RVTrace(rv), got, count)
+	}
+
+	if list[len(list)-1].Name != name {
+		t.Errorf("C_GetInterfaceList: got %+v, want %s last", list, name)
+	}
+}
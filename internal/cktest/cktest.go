@@ -0,0 +1,156 @@
+// pkcs11mod
+// Copyright (C) 2022  Namecoin Developers
+//
+// pkcs11mod is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// pkcs11mod is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with pkcs11mod; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+
+// Package cktest calls PKCS#11 functions through a module's function list,
+// for pkcs11mod's tests (which can't use cgo themselves).
+package cktest
+
+/*
+#cgo windows CFLAGS: -DPACKED_STRUCTURES
+#include <stdlib.h>
+
+#include "../../spec/pkcs11go.h"
+#include "../../pkcs11v3.h"
+
+// Exported by the module, outside of its function list.
+CK_RV C_GetInterfaceList(CK_INTERFACE_PTR pInterfacesList, CK_ULONG_PTR pulCount);
+CK_RV C_GetInterface(CK_UTF8CHAR_PTR pInterfaceName, CK_VERSION_PTR pVersion, CK_INTERFACE_PTR_PTR ppInterface, CK_FLAGS flags);
+
+static CK_RV callInitialize(CK_FUNCTION_LIST_PTR list)
+{
+	return list->C_Initialize(NULL_PTR);
+}
+
+static CK_RV callFinalize(CK_FUNCTION_LIST_PTR list)
+{
+	return list->C_Finalize(NULL_PTR);
+}
+
+static CK_RV callGetInfo(CK_FUNCTION_LIST_PTR list, CK_INFO_PTR pInfo)
+{
+	return list->C_GetInfo(pInfo);
+}
+*/
+import "C"
+
+import (
+	"unsafe"
+)
+
+func functionList(list unsafe.Pointer) C.CK_FUNCTION_LIST_PTR {
+	return C.CK_FUNCTION_LIST_PTR(list)
+}
+
+// GetFunctionList calls the module's exported C_GetFunctionList.
+func GetFunctionList() (unsafe.Pointer, uint) {
+	var list C.CK_FUNCTION_LIST_PTR
+
+	rv := uint(C.C_GetFunctionList(&list))
+
+	return unsafe.Pointer(list), rv
+}
+
+// Initialize calls C_Initialize with no arguments.
+func Initialize(list unsafe.Pointer) uint {
+	return uint(C.callInitialize(functionList(list)))
+}
+
+// Finalize calls C_Finalize.
+func Finalize(list unsafe.Pointer) uint {
+	return uint(C.callFinalize(functionList(list)))
+}
+
+// GetInfo calls C_GetInfo and returns the manufacturer ID and library
+// description that it reports.
+func GetInfo(list unsafe.Pointer) (manufacturerID, libraryDescription string, rv uint) {
+	var info C.CK_INFO
+
+	rv = uint(C.callGetInfo(functionList(list), &info))
+
+	manufacturerID = C.GoStringN((*C.char)(unsafe.Pointer(&info.manufacturerID[0])), C.int(len(info.manufacturerID)))
+	libraryDescription = C.GoStringN((*C.char)(unsafe.Pointer(&info.libraryDescription[0])), C.int(len(info.libraryDescription)))
+
+	return manufacturerID, libraryDescription, rv
+}
+
+// Interface is a CK_INTERFACE returned by the module.
+type Interface struct {
+	Name         string
+	FunctionList unsafe.Pointer
+	Flags        uint
+}
+
+func toInterface(iface *C.CK_INTERFACE) Interface {
+	return Interface{
+		Name:         C.GoString((*C.char)(unsafe.Pointer(iface.pInterfaceName))),
+		FunctionList: unsafe.Pointer(iface.pFunctionList),
+		Flags:        uint(iface.flags),
+	}
+}
+
+// GetInterfaceCount calls C_GetInterfaceList with a NULL list, which only
+// returns the number of interfaces.
+func GetInterfaceCount() (count uint, rv uint) {
+	var ulCount C.CK_ULONG
+
+	rv = uint(C.C_GetInterfaceList(nil, &ulCount))
+
+	return uint(ulCount), rv
+}
+
+// GetInterfaceList calls C_GetInterfaceList with room for count interfaces,
+// and returns the interfaces it wrote along with the count it returned.
+func GetInterfaceList(count uint) ([]Interface, uint, uint) {
+	// Allocate at least one entry, since a NULL list only asks for the
+	// count.
+	list := (*C.CK_INTERFACE)(C.calloc(C.size_t(count+1), C.sizeof_CK_INTERFACE))
+	defer C.free(unsafe.Pointer(list))
+
+	ulCount := C.CK_ULONG(count)
+
+	rv := uint(C.C_GetInterfaceList(list, &ulCount))
+	if rv != C.CKR_OK {
+		return nil, uint(ulCount), rv
+	}
+
+	result := make([]Interface, 0, ulCount)
+	for _, iface := range unsafe.Slice(list, ulCount) {
+		result = append(result, toInterface(&iface))
+	}
+
+	return result, uint(ulCount), rv
+}
+
+// GetInterface calls C_GetInterface with the given name (or NULL if name is
+// empty), no version and no flags.
+func GetInterface(name string) (Interface, uint) {
+	var cName *C.CK_UTF8CHAR
+
+	if name != "" {
+		cName = (*C.CK_UTF8CHAR)(unsafe.Pointer(C.CString(name)))
+		defer C.free(unsafe.Pointer(cName))
+	}
+
+	var iface C.CK_INTERFACE_PTR
+
+	rv := uint(C.C_GetInterface(cName, nil, &iface, 0))
+	if rv != C.CKR_OK {
+		return Interface{}, rv
+	}
+
+	return toInterface(iface), rv
+}
@@ -0,0 +1,54 @@
+// pkcs11mod
+// Copyright (C) 2022  Namecoin Developers
+//
+// pkcs11mod is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// pkcs11mod is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with pkcs11mod; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+
+package pkcs11mod
+
+/*
+int pkcs11mod_metrics_count(void);
+const char *pkcs11mod_metrics_name(int function);
+unsigned long long pkcs11mod_metrics_get(int function, int failed);
+*/
+import "C"
+
+// FunctionMetrics counts the calls to one PKCS#11 function.
+type FunctionMetrics struct {
+	// Succeeded counts the calls that returned CKR_OK.
+	Succeeded uint64
+	// Failed counts the calls that returned anything else, including
+	// CKR_BUFFER_TOO_SMALL from the fetch half of a two-call idiom.
+	Failed uint64
+}
+
+// Metrics returns a snapshot of the number of calls to each PKCS#11 function
+// (e.g. "C_Sign") since the module was loaded.  The counters are maintained
+// on the C side with atomic increments, so they're always on.  Functions that
+// pkcs11mod answers without calling into Go (e.g. C_InitToken), and calls that
+// fail to take the library lock, aren't counted.  Each counter is read
+// atomically, but the snapshot as a whole isn't taken at a single instant.
+func Metrics() map[string]FunctionMetrics {
+	count := int(C.pkcs11mod_metrics_count())
+	result := make(map[string]FunctionMetrics, count)
+
+	for i := 0; i < count; i++ {
+		result[C.GoString(C.pkcs11mod_metrics_name(C.int(i)))] = FunctionMetrics{
+			Succeeded: uint64(C.pkcs11mod_metrics_get(C.int(i), 0)),
+			Failed:    uint64(C.pkcs11mod_metrics_get(C.int(i), 1)),
+		}
+	}
+
+	return result
+}
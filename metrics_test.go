@@ -0,0 +1,80 @@
+// pkcs11mod
+// Copyright (C) 2022  Namecoin Developers
+//
+// pkcs11mod is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// pkcs11mod is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with pkcs11mod; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+
+package pkcs11mod
+
+import (
+	"testing"
+
+	"github.com/miekg/pkcs11"
+
+	"github.com/namecoin/pkcs11mod/internal/cktest"
+)
+
+func TestMetrics(t *testing.T) {
+	oldBackend := backend
+
+	SetBackend(infoBackend{})
+	t.Cleanup(func() { SetBackend(oldBackend) })
+
+	// The counters live on the C side, so the calls have to go through the
+	// function list.
+	list := FunctionList()
+	before := Metrics()
+
+	if rv := cktest.Initialize(list); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_Initialize: got %s", RVTrace(rv))
+	}
+
+	if rv := cktest.Initialize(list); rv != pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED {
+		t.Errorf("second C_Initialize: got %s, want CKR_CRYPTOKI_ALREADY_INITIALIZED", RVTrace(rv))
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, _, rv := cktest.GetInfo(list); rv != pkcs11.CKR_OK {
+			t.Fatalf("C_GetInfo: got %s", RVTrace(rv))
+		}
+	}
+
+	if rv := cktest.Finalize(list); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_Finalize: got %s", RVTrace(rv))
+	}
+
+	after := Metrics()
+
+	for _, tt := range []struct {
+		function string
+		want     FunctionMetrics
+	}{
+		{"C_Initialize", FunctionMetrics{Succeeded: 1, Failed: 1}},
+		{"C_GetInfo", FunctionMetrics{Succeeded: 3}},
+		{"C_Finalize", FunctionMetrics{Succeeded: 1}},
+		{"C_Sign", FunctionMetrics{}},
+	} {
+		got := FunctionMetrics{
+			Succeeded: after[tt.function].Succeeded - before[tt.function].Succeeded,
+			Failed:    after[tt.function].Failed - before[tt.function].Failed,
+		}
+		if got != tt.want {
+			t.Errorf("%s: counted %+v, want %+v", tt.function, got, tt.want)
+		}
+	}
+
+	if _, ok := after["C_Sign"]; !ok {
+		t.Error("C_Sign is missing from the snapshot")
+	}
+}
@@ -98,6 +98,12 @@ func (ll *llBackend) Finalize() error {
 	return nil
 }
 
+// ReceivesNativeParams implements pkcs11mod.NativeParamsReceiver: the
+// mechanisms end up at the *pkcs11.Ctx behind a p11.Slot.
+func (ll *llBackend) ReceivesNativeParams() bool {
+	return true
+}
+
 func (ll *llBackend) GetInfo() (pkcs11.Info, error) {
 	if trace {
 		log.Printf("p11mod GetInfo")
@@ -730,6 +736,8 @@ func (ll *llBackend) SignInit(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, o
 		return pkcs11.Error(pkcs11.CKR_MECHANISM_INVALID)
 	}
 
+	// The parameter may point into the application's CK_MECHANISM, which
+	// it keeps until C_Sign in practice.
 	session.signMechanism = m[0]
 	session.signKeyIndex = objectIndex
 
@@ -817,6 +825,8 @@ func (ll *llBackend) VerifyInit(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism,
 		return pkcs11.Error(pkcs11.CKR_MECHANISM_INVALID)
 	}
 
+	// As in SignInit, the parameter may point into the application's
+	// CK_MECHANISM.
 	session.verifyMechanism = m[0]
 	session.verifyKeyIndex = objectIndex
 
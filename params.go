@@ -0,0 +1,882 @@
+// pkcs11mod
+// Copyright (C) 2022  Namecoin Developers
+//
+// pkcs11mod is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// pkcs11mod is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with pkcs11mod; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+
+package pkcs11mod
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// This file contains Go representations of mechanism parameter structures
+// that contain pointers and that miekg/pkcs11 has no type for.  toMechanism
+// flattens them into the Mechanism's Parameter with the New*Params
+// functions, and backends decode them with the matching Parse*Params
+// functions.
+//
+// Variable-length fields are encoded as a 4-byte big-endian length followed
+// by the bytes.  Output fields (which the C caller expects to be filled in)
+// are encoded the same way, and the slices returned by Parse*Params alias the
+// Parameter, so that pkcs11mod can copy whatever the backend wrote into them
+// back to the caller once the operation completes.
+
+// appendParamField appends a length-prefixed field to param.
+func appendParamField(param []byte, field []byte) []byte {
+	var length [4]byte
+
+	binary.BigEndian.PutUint32(length[:], uint32(len(field)))
+
+	return append(append(param, length[:]...), field...)
+}
+
+// readParamField reads a length-prefixed field from the start of param.  The
+// returned field aliases param.
+func readParamField(param []byte) ([]byte, []byte, error) {
+	if len(param) < 4 {
+		return nil, nil, fmt.Errorf("invalid length: %d", len(param))
+	}
+
+	length := binary.BigEndian.Uint32(param)
+	param = param[4:]
+
+	if uint64(len(param)) < uint64(length) {
+		return nil, nil, fmt.Errorf("invalid field length: %d", length)
+	}
+
+	return param[:length:length], param[length:], nil
+}
+
+// EDDSAParams is the Go representation of CK_EDDSA_PARAMS.
+type EDDSAParams struct {
+	// PHFlag selects the prehashed variant (Ed25519ph/Ed448ph).
+	PHFlag bool
+	// ContextData is nil if no context was supplied.
+	ContextData []byte
+}
+
+// NewEDDSAParams returns the parameter for CKM_EDDSA: one byte holding the
+// phFlag, followed by the context data.
+func NewEDDSAParams(phFlag bool, contextData []byte) []byte {
+	param := make([]byte, 1, 1+len(contextData))
+
+	if phFlag {
+		param[0] = 1
+	}
+
+	return append(param, contextData...)
+}
+
+// ParseEDDSAParams decodes a parameter produced by NewEDDSAParams.
+func ParseEDDSAParams(param []byte) (*EDDSAParams, error) {
+	if len(param) < 1 {
+		return nil, fmt.Errorf("invalid length: %d", len(param))
+	}
+
+	result := &EDDSAParams{
+		PHFlag: param[0] != 0,
+	}
+
+	if len(param) > 1 {
+		result.ContextData = param[1:]
+	}
+
+	return result, nil
+}
+
+// NormalizeGCMTagBits returns the GCM tag length in bits, given the raw
+// ulTagBits from CK_GCM_PARAMS.  Some applications mistakenly pass the tag
+// length in bytes; values that are only valid as a byte count (4, 8, 12-16)
+// are converted to bits, and anything else is returned unchanged.  toMechanism
+// doesn't apply this, so backends that want the normalization must call it
+// explicitly.
+func NormalizeGCMTagBits(raw uint) uint {
+	switch raw {
+	case 4, 8, 12, 13, 14, 15, 16:
+		return raw * 8
+	default:
+		return raw
+	}
+}
+
+// RSAAESKeyWrapParams is the Go representation of CK_RSA_AES_KEY_WRAP_PARAMS,
+// used with CKM_RSA_AES_KEY_WRAP.
+type RSAAESKeyWrapParams struct {
+	AESKeyBits uint
+	OAEP       *pkcs11.OAEPParams
+}
+
+// NewRSAAESKeyWrapParams returns the parameter for CKM_RSA_AES_KEY_WRAP: the
+// AES key length, the OAEP hashAlg, mgf and source type as 8-byte big-endian
+// integers, followed by the OAEP source data.
+func NewRSAAESKeyWrapParams(aesKeyBits uint, oaep *pkcs11.OAEPParams) []byte {
+	param := make([]byte, 32)
+
+	binary.BigEndian.PutUint64(param[0:], uint64(aesKeyBits))
+	binary.BigEndian.PutUint64(param[8:], uint64(oaep.HashAlg))
+	binary.BigEndian.PutUint64(param[16:], uint64(oaep.MGF))
+	binary.BigEndian.PutUint64(param[24:], uint64(oaep.SourceType))
+
+	return appendParamField(param, oaep.SourceData)
+}
+
+// ParseRSAAESKeyWrapParams decodes a parameter produced by
+// NewRSAAESKeyWrapParams.
+func ParseRSAAESKeyWrapParams(param []byte) (*RSAAESKeyWrapParams, error) {
+	if len(param) < 32 {
+		return nil, fmt.Errorf("invalid length: %d", len(param))
+	}
+
+	sourceData, _, err := readParamField(param[32:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &RSAAESKeyWrapParams{
+		AESKeyBits: uint(binary.BigEndian.Uint64(param[0:])),
+		OAEP: pkcs11.NewOAEPParams(
+			uint(binary.BigEndian.Uint64(param[8:])),
+			uint(binary.BigEndian.Uint64(param[16:])),
+			uint(binary.BigEndian.Uint64(param[24:])),
+			sourceData,
+		),
+	}, nil
+}
+
+// AppendGCMTag returns the output of a single-part CKM_AES_GCM encryption in
+// the layout PKCS#11 requires: the ciphertext followed by the tag.  Backends
+// built on libraries that return the tag separately should use it; pkcs11mod
+// rejects GCM ciphertexts without the tag unless
+// PKCS11MOD_GCM_ALLOW_DETACHED_TAG is set.
+func AppendGCMTag(ciphertext, tag []byte) []byte {
+	result := make([]byte, 0, len(ciphertext)+len(tag))
+
+	return append(append(result, ciphertext...), tag...)
+}
+
+// SplitGCMTag splits the input of a single-part CKM_AES_GCM decryption into
+// the ciphertext and the tag, given the tag length in bits (see
+// NormalizeGCMTagBits).
+func SplitGCMTag(data []byte, tagBits uint) ([]byte, []byte, error) {
+	tagLen := int(tagBits / 8)
+	if tagLen > len(data) {
+		return nil, nil, fmt.Errorf("invalid length: %d", len(data))
+	}
+
+	split := len(data) - tagLen
+
+	return data[:split:split], data[split:], nil
+}
+
+// Poly1305AEADParams is the Go representation of
+// CK_SALSA20_CHACHA20_POLY1305_PARAMS, used with CKM_CHACHA20_POLY1305 and
+// CKM_SALSA20_POLY1305.  As with CKM_AES_GCM, the tag is appended to the
+// ciphertext.
+type Poly1305AEADParams struct {
+	Nonce []byte
+	// AAD is nil if the caller didn't supply any.
+	AAD []byte
+}
+
+// NewPoly1305AEADParams returns the parameter for CKM_CHACHA20_POLY1305 and
+// CKM_SALSA20_POLY1305.
+func NewPoly1305AEADParams(nonce, aad []byte) []byte {
+	return appendParamField(appendParamField(nil, nonce), aad)
+}
+
+// ParsePoly1305AEADParams decodes a parameter produced by
+// NewPoly1305AEADParams.
+func ParsePoly1305AEADParams(param []byte) (*Poly1305AEADParams, error) {
+	var (
+		result Poly1305AEADParams
+		err    error
+	)
+
+	if result.Nonce, param, err = readParamField(param); err != nil {
+		return nil, err
+	}
+
+	if result.AAD, _, err = readParamField(param); err != nil {
+		return nil, err
+	}
+
+	if len(result.AAD) == 0 {
+		result.AAD = nil
+	}
+
+	return &result, nil
+}
+
+// TLSPRFParams is the Go representation of CK_TLS_PRF_PARAMS, used with
+// CKM_TLS_PRF.
+type TLSPRFParams struct {
+	Seed  []byte
+	Label []byte
+	// Output has the length requested by the caller.  The backend must fill
+	// it in; pkcs11mod copies it to the caller's pOutput after DeriveKey
+	// succeeds.
+	Output []byte
+}
+
+// NewTLSPRFParams returns the parameter for CKM_TLS_PRF, with room for
+// outputLen bytes of output.
+func NewTLSPRFParams(seed, label []byte, outputLen int) []byte {
+	param := appendParamField(nil, seed)
+	param = appendParamField(param, label)
+
+	return appendParamField(param, make([]byte, outputLen))
+}
+
+// ParseTLSPRFParams decodes a parameter produced by NewTLSPRFParams.
+func ParseTLSPRFParams(param []byte) (*TLSPRFParams, error) {
+	var (
+		result TLSPRFParams
+		err    error
+	)
+
+	if result.Seed, param, err = readParamField(param); err != nil {
+		return nil, err
+	}
+
+	if result.Label, param, err = readParamField(param); err != nil {
+		return nil, err
+	}
+
+	if result.Output, _, err = readParamField(param); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// TLS12MasterKeyDeriveParams is the Go representation of
+// CK_TLS12_MASTER_KEY_DERIVE_PARAMS, used with CKM_TLS12_MASTER_KEY_DERIVE
+// and CKM_TLS12_MASTER_KEY_DERIVE_DH.  The SSL 3.0 and TLS 1.0/1.1
+// structures (CK_SSL3_MASTER_KEY_DERIVE_PARAMS) aren't supported.
+type TLS12MasterKeyDeriveParams struct {
+	ClientRandom     []byte
+	ServerRandom     []byte
+	PRFHashMechanism uint
+	// Version is nil if the caller didn't supply a pVersion.  Otherwise it
+	// has 2 bytes (major, minor); the backend stores the protocol version
+	// of the pre-master secret in it, and pkcs11mod copies it to the
+	// caller's pVersion after the key is derived.
+	Version []byte
+}
+
+// NewTLS12MasterKeyDeriveParams returns the parameter for
+// CKM_TLS12_MASTER_KEY_DERIVE(_DH).  If hasVersion is set, the parameter has
+// room for the protocol version.
+func NewTLS12MasterKeyDeriveParams(clientRandom, serverRandom []byte, prfHashMechanism uint, hasVersion bool) []byte {
+	var version []byte
+	if hasVersion {
+		version = make([]byte, 2)
+	}
+
+	param := appendParamField(nil, clientRandom)
+	param = appendParamField(param, serverRandom)
+	param = binary.BigEndian.AppendUint64(param, uint64(prfHashMechanism))
+
+	return appendParamField(param, version)
+}
+
+// ParseTLS12MasterKeyDeriveParams decodes a parameter produced by
+// NewTLS12MasterKeyDeriveParams.
+func ParseTLS12MasterKeyDeriveParams(param []byte) (*TLS12MasterKeyDeriveParams, error) {
+	var (
+		result TLS12MasterKeyDeriveParams
+		err    error
+	)
+
+	if result.ClientRandom, param, err = readParamField(param); err != nil {
+		return nil, err
+	}
+
+	if result.ServerRandom, param, err = readParamField(param); err != nil {
+		return nil, err
+	}
+
+	if len(param) < 8 {
+		return nil, fmt.Errorf("invalid length: %d", len(param))
+	}
+
+	result.PRFHashMechanism = uint(binary.BigEndian.Uint64(param))
+
+	if result.Version, _, err = readParamField(param[8:]); err != nil {
+		return nil, err
+	}
+
+	switch len(result.Version) {
+	case 0:
+		result.Version = nil
+	case 2:
+	default:
+		return nil, fmt.Errorf("invalid version length: %d", len(result.Version))
+	}
+
+	return &result, nil
+}
+
+// TLS12KeyMatParams is the Go representation of CK_TLS12_KEY_MAT_PARAMS,
+// used with CKM_TLS12_KEY_AND_MAC_DERIVE.  The SSL 3.0 and TLS 1.0/1.1
+// structure (CK_SSL3_KEY_MAT_PARAMS) isn't supported.
+type TLS12KeyMatParams struct {
+	MacSizeInBits    uint
+	KeySizeInBits    uint
+	IVSizeInBits     uint
+	IsExport         bool
+	ClientRandom     []byte
+	ServerRandom     []byte
+	PRFHashMechanism uint
+	// IVClient and IVServer have IVSizeInBits/8 bytes.  The backend stores
+	// the derived IVs in them, and the key handles with SetReturnedKeys;
+	// pkcs11mod copies both to the caller's pReturnedKeyMaterial after
+	// DeriveKey succeeds.
+	IVClient []byte
+	IVServer []byte
+	keys     []byte
+}
+
+// tls12KeyMatKeysLen is the size of the four key handles of
+// CK_SSL3_KEY_MAT_OUT in the parameter produced by NewTLS12KeyMatParams.
+const tls12KeyMatKeysLen = 4 * 8
+
+// NewTLS12KeyMatParams returns the parameter for
+// CKM_TLS12_KEY_AND_MAC_DERIVE, with room for the returned key material.
+func NewTLS12KeyMatParams(macSizeInBits, keySizeInBits, ivSizeInBits uint, isExport bool, clientRandom, serverRandom []byte, prfHashMechanism uint) []byte {
+	var isExportByte byte
+	if isExport {
+		isExportByte = 1
+	}
+
+	param := binary.BigEndian.AppendUint64(nil, uint64(macSizeInBits))
+	param = binary.BigEndian.AppendUint64(param, uint64(keySizeInBits))
+	param = binary.BigEndian.AppendUint64(param, uint64(ivSizeInBits))
+	param = append(param, isExportByte)
+	param = appendParamField(param, clientRandom)
+	param = appendParamField(param, serverRandom)
+	param = binary.BigEndian.AppendUint64(param, uint64(prfHashMechanism))
+	param = appendParamField(param, make([]byte, tls12KeyMatKeysLen))
+	param = appendParamField(param, make([]byte, ivSizeInBits/8))
+
+	return appendParamField(param, make([]byte, ivSizeInBits/8))
+}
+
+// ParseTLS12KeyMatParams decodes a parameter produced by
+// NewTLS12KeyMatParams.
+func ParseTLS12KeyMatParams(param []byte) (*TLS12KeyMatParams, error) {
+	var (
+		result TLS12KeyMatParams
+		err    error
+	)
+
+	if len(param) < 25 {
+		return nil, fmt.Errorf("invalid length: %d", len(param))
+	}
+
+	result.MacSizeInBits = uint(binary.BigEndian.Uint64(param))
+	result.KeySizeInBits = uint(binary.BigEndian.Uint64(param[8:]))
+	result.IVSizeInBits = uint(binary.BigEndian.Uint64(param[16:]))
+	result.IsExport = param[24] != 0
+
+	if result.ClientRandom, param, err = readParamField(param[25:]); err != nil {
+		return nil, err
+	}
+
+	if result.ServerRandom, param, err = readParamField(param); err != nil {
+		return nil, err
+	}
+
+	if len(param) < 8 {
+		return nil, fmt.Errorf("invalid length: %d", len(param))
+	}
+
+	result.PRFHashMechanism = uint(binary.BigEndian.Uint64(param))
+
+	if result.keys, param, err = readParamField(param[8:]); err != nil {
+		return nil, err
+	}
+
+	if len(result.keys) != tls12KeyMatKeysLen {
+		return nil, fmt.Errorf("invalid key handles length: %d", len(result.keys))
+	}
+
+	if result.IVClient, param, err = readParamField(param); err != nil {
+		return nil, err
+	}
+
+	if result.IVServer, _, err = readParamField(param); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// SetReturnedKeys stores the handles of the derived keys in the parameter.
+func (p *TLS12KeyMatParams) SetReturnedKeys(clientMacSecret, serverMacSecret, clientKey, serverKey pkcs11.ObjectHandle) {
+	binary.BigEndian.PutUint64(p.keys, uint64(clientMacSecret))
+	binary.BigEndian.PutUint64(p.keys[8:], uint64(serverMacSecret))
+	binary.BigEndian.PutUint64(p.keys[16:], uint64(clientKey))
+	binary.BigEndian.PutUint64(p.keys[24:], uint64(serverKey))
+}
+
+// ReturnedKeys returns the handles stored by SetReturnedKeys.
+func (p *TLS12KeyMatParams) ReturnedKeys() (clientMacSecret, serverMacSecret, clientKey, serverKey pkcs11.ObjectHandle) {
+	return pkcs11.ObjectHandle(binary.BigEndian.Uint64(p.keys)),
+		pkcs11.ObjectHandle(binary.BigEndian.Uint64(p.keys[8:])),
+		pkcs11.ObjectHandle(binary.BigEndian.Uint64(p.keys[16:])),
+		pkcs11.ObjectHandle(binary.BigEndian.Uint64(p.keys[24:]))
+}
+
+// CBCEncryptDataParams is the Go representation of the
+// CK_*_CBC_ENCRYPT_DATA_PARAMS structures (e.g.
+// CK_ARIA_CBC_ENCRYPT_DATA_PARAMS), which derive a key by CBC-encrypting
+// Data with IV.
+type CBCEncryptDataParams struct {
+	IV   []byte
+	Data []byte
+}
+
+// NewCBCEncryptDataParams returns the parameter for a *_CBC_ENCRYPT_DATA
+// mechanism.
+func NewCBCEncryptDataParams(iv, data []byte) []byte {
+	return appendParamField(appendParamField(nil, iv), data)
+}
+
+// ParseCBCEncryptDataParams decodes a parameter produced by
+// NewCBCEncryptDataParams.
+func ParseCBCEncryptDataParams(param []byte) (*CBCEncryptDataParams, error) {
+	var (
+		result CBCEncryptDataParams
+		err    error
+	)
+
+	if result.IV, param, err = readParamField(param); err != nil {
+		return nil, err
+	}
+
+	if result.Data, _, err = readParamField(param); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// PBEParams is the Go representation of CK_PBE_PARAMS, used with the
+// CKM_PBE_* and CKM_PBA_SHA1_WITH_SHA1_HMAC mechanisms.
+type PBEParams struct {
+	// InitVector is nil if the caller didn't supply a pInitVector buffer.
+	// Otherwise it has the 8 bytes the spec requires; the backend stores
+	// the generated IV in it, and pkcs11mod copies it to the caller's
+	// pInitVector after the key is generated.
+	InitVector []byte
+	Password   []byte
+	Salt       []byte
+	Iteration  uint
+}
+
+// pbeInitVectorLen is the size of the pInitVector buffer of CK_PBE_PARAMS.
+const pbeInitVectorLen = 8
+
+// NewPBEParams returns the parameter for a password-based mechanism.  If
+// hasInitVector is set, the parameter has room for the generated IV.
+func NewPBEParams(hasInitVector bool, password, salt []byte, iteration uint) []byte {
+	var initVector []byte
+	if hasInitVector {
+		initVector = make([]byte, pbeInitVectorLen)
+	}
+
+	param := appendParamField(nil, initVector)
+	param = appendParamField(param, password)
+	param = appendParamField(param, salt)
+
+	var iterationBytes [8]byte
+
+	binary.BigEndian.PutUint64(iterationBytes[:], uint64(iteration))
+
+	return append(param, iterationBytes[:]...)
+}
+
+// ParsePBEParams decodes a parameter produced by NewPBEParams.
+func ParsePBEParams(param []byte) (*PBEParams, error) {
+	var (
+		result PBEParams
+		err    error
+	)
+
+	if result.InitVector, param, err = readParamField(param); err != nil {
+		return nil, err
+	}
+
+	if len(result.InitVector) == 0 {
+		result.InitVector = nil
+	}
+
+	if result.Password, param, err = readParamField(param); err != nil {
+		return nil, err
+	}
+
+	if result.Salt, param, err = readParamField(param); err != nil {
+		return nil, err
+	}
+
+	if len(param) != 8 {
+		return nil, fmt.Errorf("invalid iteration length: %d", len(param))
+	}
+
+	result.Iteration = uint(binary.BigEndian.Uint64(param))
+
+	return &result, nil
+}
+
+// PBKDF2Params is the Go representation of CK_PKCS5_PBKD2_PARAMS2, used with
+// CKM_PKCS5_PBKD2.  Only the CKZ_SALT_SPECIFIED salt source is supported.
+type PBKDF2Params struct {
+	Salt []byte
+	// Iterations is the PBKDF2 iteration count.
+	Iterations uint
+	// PRF is one of the CKP_PKCS5_PBKD2_* pseudo-random functions, and
+	// PRFData its parameter (if any).
+	PRF     uint
+	PRFData []byte
+	// Password is nil if the caller didn't supply one (so the backend
+	// should use the PIN of the session's login), as opposed to supplying
+	// an empty password.
+	Password []byte
+}
+
+// NewPBKDF2Params returns the parameter for CKM_PKCS5_PBKD2.  A nil password
+// stays nil after ParsePBKDF2Params.
+func NewPBKDF2Params(salt []byte, iterations, prf uint, prfData, password []byte) []byte {
+	var hasPassword byte
+	if password != nil {
+		hasPassword = 1
+	}
+
+	param := appendParamField(nil, salt)
+	param = binary.BigEndian.AppendUint64(param, uint64(iterations))
+	param = binary.BigEndian.AppendUint64(param, uint64(prf))
+	param = appendParamField(param, prfData)
+	param = append(param, hasPassword)
+
+	return appendParamField(param, password)
+}
+
+// ParsePBKDF2Params decodes a parameter produced by NewPBKDF2Params.
+func ParsePBKDF2Params(param []byte) (*PBKDF2Params, error) {
+	var (
+		result PBKDF2Params
+		err    error
+	)
+
+	if result.Salt, param, err = readParamField(param); err != nil {
+		return nil, err
+	}
+
+	if len(param) < 16 {
+		return nil, fmt.Errorf("invalid length: %d", len(param))
+	}
+
+	result.Iterations = uint(binary.BigEndian.Uint64(param))
+	result.PRF = uint(binary.BigEndian.Uint64(param[8:]))
+
+	if result.PRFData, param, err = readParamField(param[16:]); err != nil {
+		return nil, err
+	}
+
+	if len(param) < 1 {
+		return nil, fmt.Errorf("invalid length: %d", len(param))
+	}
+
+	hasPassword := param[0] != 0
+
+	if result.Password, _, err = readParamField(param[1:]); err != nil {
+		return nil, err
+	}
+
+	if !hasPassword {
+		result.Password = nil
+	}
+
+	return &result, nil
+}
+
+// OTPParam is the Go representation of CK_OTP_PARAM.
+type OTPParam struct {
+	// Type is one of the CK_OTP_* parameter types, e.g. CK_OTP_COUNTER.
+	Type  uint
+	Value []byte
+}
+
+// OTPParams is the Go representation of CK_OTP_PARAMS, used with the OTP
+// mechanisms (CKM_HOTP, CKM_SECURID and CKM_ACTI).  The values are as the
+// application supplied them; the Counter, Time and Flags methods decode the
+// common ones.
+type OTPParams struct {
+	Params []OTPParam
+}
+
+// otpTimeLayout is the format of CK_OTP_TIME, a UTC time.
+const otpTimeLayout = "20060102150405"
+
+func appendOTPParamList(param []byte, params []OTPParam) []byte {
+	param = binary.BigEndian.AppendUint64(param, uint64(len(params)))
+
+	for _, otpParam := range params {
+		param = binary.BigEndian.AppendUint64(param, uint64(otpParam.Type))
+		param = appendParamField(param, otpParam.Value)
+	}
+
+	return param
+}
+
+func readOTPParamList(param []byte) ([]OTPParam, error) {
+	if len(param) < 8 {
+		return nil, fmt.Errorf("invalid length: %d", len(param))
+	}
+
+	count := binary.BigEndian.Uint64(param)
+	param = param[8:]
+
+	// Each param takes at least 12 bytes, so a bogus count can't make us
+	// allocate much more than the parameter itself.
+	if count > uint64(len(param))/12 {
+		return nil, fmt.Errorf("invalid param count: %d", count)
+	}
+
+	result := make([]OTPParam, count)
+
+	for i := range result {
+		var err error
+
+		if len(param) < 8 {
+			return nil, fmt.Errorf("invalid length: %d", len(param))
+		}
+
+		result[i].Type = uint(binary.BigEndian.Uint64(param))
+
+		if result[i].Value, param, err = readParamField(param[8:]); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// NewOTPParams returns the parameter for an OTP mechanism: the number of
+// params as an 8-byte big-endian integer, then each param's type (likewise)
+// and length-prefixed value.
+func NewOTPParams(params []OTPParam) []byte {
+	return appendOTPParamList(nil, params)
+}
+
+// ParseOTPParams decodes a parameter produced by NewOTPParams.
+func ParseOTPParams(param []byte) (*OTPParams, error) {
+	params, err := readOTPParamList(param)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OTPParams{Params: params}, nil
+}
+
+// Value returns the value of the first param of type paramType, and whether
+// there is one.
+func (p *OTPParams) Value(paramType uint) ([]byte, bool) {
+	for _, otpParam := range p.Params {
+		if otpParam.Type == paramType {
+			return otpParam.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+// Counter decodes the CK_OTP_COUNTER param, a big-endian counter of up to 8
+// bytes.
+func (p *OTPParams) Counter() (uint64, bool, error) {
+	value, ok := p.Value(pkcs11.CK_OTP_COUNTER)
+	if !ok {
+		return 0, false, nil
+	}
+
+	if len(value) == 0 || len(value) > 8 {
+		return 0, true, fmt.Errorf("invalid counter length: %d", len(value))
+	}
+
+	var counter [8]byte
+
+	copy(counter[8-len(value):], value)
+
+	return binary.BigEndian.Uint64(counter[:]), true, nil
+}
+
+// Time decodes the CK_OTP_TIME param, a UTC time as YYYYMMDDhhmmss.
+func (p *OTPParams) Time() (time.Time, bool, error) {
+	value, ok := p.Value(pkcs11.CK_OTP_TIME)
+	if !ok {
+		return time.Time{}, false, nil
+	}
+
+	t, err := time.Parse(otpTimeLayout, string(value))
+	if err != nil {
+		return time.Time{}, true, err
+	}
+
+	return t, true, nil
+}
+
+// Flags decodes the CK_OTP_FLAGS param (e.g. CKF_NEXT_OTP), a CK_FLAGS.  It
+// returns 0 if there isn't one.
+func (p *OTPParams) Flags() (uint, error) {
+	value, ok := p.Value(pkcs11.CK_OTP_FLAGS)
+	if !ok {
+		return 0, nil
+	}
+
+	return BytesToULong(value)
+}
+
+// NewOTPSignatureInfo returns the signature that a backend's Sign must
+// return for an OTP mechanism, unless the CKF_USER_FRIENDLY_OTP flag was
+// set: the params of the CK_OTP_SIGNATURE_INFO, including the CK_OTP_VALUE.
+// pkcs11mod lays out the structure in the application's buffer.  With
+// CKF_USER_FRIENDLY_OTP, the signature is just the OTP value.
+func NewOTPSignatureInfo(params []OTPParam) []byte {
+	return appendOTPParamList(nil, params)
+}
+
+// ParseOTPSignatureInfo decodes a signature produced by NewOTPSignatureInfo.
+func ParseOTPSignatureInfo(signature []byte) ([]OTPParam, error) {
+	return readOTPParamList(signature)
+}
+
+// PRFDataParam is the Go representation of CK_PRF_DATA_PARAM, one segment of
+// the PRF input of an SP 800-108 KDF.
+type PRFDataParam struct {
+	// Type is one of the CK_SP800_108_* data types.
+	Type uint
+	// Value is the data, for CK_SP800_108_BYTE_ARRAY.
+	Value []byte
+	// LittleEndian and WidthInBits are the encoding of
+	// CK_SP800_108_ITERATION_VARIABLE, CK_SP800_108_OPTIONAL_COUNTER and
+	// CK_SP800_108_DKM_LENGTH.  WidthInBits is 0 for an iteration variable
+	// without a CK_SP800_108_COUNTER_FORMAT (as in feedback and
+	// double-pipeline mode).
+	LittleEndian bool
+	WidthInBits  uint
+	// DKMLengthMethod is the CK_SP800_108_DKM_LENGTH_* method, for
+	// CK_SP800_108_DKM_LENGTH.
+	DKMLengthMethod uint
+}
+
+// SP800108KDFParams is the Go representation of CK_SP800_108_KDF_PARAMS
+// (used with CKM_SP800_108_COUNTER_KDF and
+// CKM_SP800_108_DOUBLE_PIPELINE_KDF) and CK_SP800_108_FEEDBACK_KDF_PARAMS
+// (used with CKM_SP800_108_FEEDBACK_KDF).  Additional derived keys aren't
+// supported: pkcs11mod rejects a parameter whose ulAdditionalDerivedKeys
+// isn't 0 with CKR_MECHANISM_PARAM_INVALID, so only the base key is derived.
+type SP800108KDFParams struct {
+	// PRFType is the mechanism of the PRF, e.g. CKM_SHA256_HMAC.
+	PRFType    uint
+	DataParams []PRFDataParam
+	// IV is the feedback IV; it's nil for the other modes, and may be nil
+	// in feedback mode too.
+	IV []byte
+}
+
+// NewSP800108KDFParams returns the parameter for an SP 800-108 KDF
+// mechanism: the PRF type and the number of data params as 8-byte
+// big-endian integers, then each data param (its type, endianness byte,
+// width, DKM length method and length-prefixed value), then the IV.
+func NewSP800108KDFParams(prfType uint, dataParams []PRFDataParam, iv []byte) []byte {
+	param := binary.BigEndian.AppendUint64(nil, uint64(prfType))
+	param = binary.BigEndian.AppendUint64(param, uint64(len(dataParams)))
+
+	for _, dataParam := range dataParams {
+		var littleEndian byte
+		if dataParam.LittleEndian {
+			littleEndian = 1
+		}
+
+		param = binary.BigEndian.AppendUint64(param, uint64(dataParam.Type))
+		param = append(param, littleEndian)
+		param = binary.BigEndian.AppendUint64(param, uint64(dataParam.WidthInBits))
+		param = binary.BigEndian.AppendUint64(param, uint64(dataParam.DKMLengthMethod))
+		param = appendParamField(param, dataParam.Value)
+	}
+
+	return appendParamField(param, iv)
+}
+
+// ParseSP800108KDFParams decodes a parameter produced by
+// NewSP800108KDFParams.
+func ParseSP800108KDFParams(param []byte) (*SP800108KDFParams, error) {
+	if len(param) < 16 {
+		return nil, fmt.Errorf("invalid length: %d", len(param))
+	}
+
+	result := SP800108KDFParams{
+		PRFType: uint(binary.BigEndian.Uint64(param)),
+	}
+
+	count := binary.BigEndian.Uint64(param[8:])
+	param = param[16:]
+
+	// Each data param takes at least 29 bytes, so a bogus count can't make
+	// us allocate much more than the parameter itself.
+	if count > uint64(len(param))/29 {
+		return nil, fmt.Errorf("invalid data param count: %d", count)
+	}
+
+	result.DataParams = make([]PRFDataParam, count)
+
+	for i := range result.DataParams {
+		var err error
+
+		if len(param) < 25 {
+			return nil, fmt.Errorf("invalid length: %d", len(param))
+		}
+
+		dataParam := &result.DataParams[i]
+		dataParam.Type = uint(binary.BigEndian.Uint64(param))
+		dataParam.LittleEndian = param[8] != 0
+		dataParam.WidthInBits = uint(binary.BigEndian.Uint64(param[9:]))
+		dataParam.DKMLengthMethod = uint(binary.BigEndian.Uint64(param[17:]))
+
+		if dataParam.Value, param, err = readParamField(param[25:]); err != nil {
+			return nil, err
+		}
+
+		if len(dataParam.Value) == 0 {
+			dataParam.Value = nil
+		}
+	}
+
+	iv, _, err := readParamField(param)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(iv) > 0 {
+		result.IV = iv
+	}
+
+	return &result, nil
+}
@@ -0,0 +1,39 @@
+// pkcs11mod
+// Copyright (C) 2022  Namecoin Developers
+//
+// pkcs11mod is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// pkcs11mod is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with pkcs11mod; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+
+package pkcs11mod
+
+import (
+	"testing"
+)
+
+func TestNormalizeGCMTagBits(t *testing.T) {
+	for _, tt := range []struct {
+		raw, want uint
+	}{
+		{128, 128},
+		{96, 96},
+		// A 16-byte tag mistakenly passed as a byte count.
+		{16, 128},
+		{12, 96},
+		{0, 0},
+	} {
+		if got := NormalizeGCMTagBits(tt.raw); got != tt.want {
+			t.Errorf("NormalizeGCMTagBits(%d) = %d, want %d", tt.raw, got, tt.want)
+		}
+	}
+}
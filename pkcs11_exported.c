@@ -20,6 +20,7 @@
 #include <string.h>
 
 #include "spec/pkcs11go.h"
+#include "pkcs11v3.h"
 
 #ifdef PKCS11_THREAD_LOCKING
 #if defined(HAVE_PTHREAD)
@@ -296,7 +297,77 @@ CK_RV goDeriveKey(CK_SESSION_HANDLE,CK_MECHANISM_PTR,CK_OBJECT_HANDLE,CK_ATTRIBU
 CK_RV goSeedRandom(CK_SESSION_HANDLE,CK_BYTE_PTR,CK_ULONG);
 CK_RV goGenerateRandom(CK_SESSION_HANDLE,CK_BYTE_PTR,CK_ULONG);
 CK_RV goWaitForSlotEvent(CK_FLAGS,CK_SLOT_ID_PTR,CK_VOID_PTR);
+CK_RV goSelfTest(void);
 void goLog(const char*);
+void goTraceReturn(int, CK_SESSION_HANDLE_PTR, CK_MECHANISM_PTR, CK_RV);
+
+// Call counters for pkcs11mod.Metrics.  They're updated with relaxed atomic
+// increments (no locking), so that they cost next to nothing.
+#define PKCS11MOD_METRICS_FUNCTIONS(X) \
+	X(C_Initialize) X(C_Finalize) X(C_GetInfo) X(C_GetSlotList) \
+	X(C_GetSlotInfo) X(C_GetTokenInfo) X(C_GetMechanismList) X(C_GetMechanismInfo) \
+	X(C_InitPIN) X(C_SetPIN) X(C_OpenSession) X(C_CloseSession) \
+	X(C_CloseAllSessions) X(C_GetSessionInfo) X(C_GetOperationState) X(C_SetOperationState) \
+	X(C_Login) X(C_Logout) X(C_CreateObject) X(C_CopyObject) \
+	X(C_DestroyObject) X(C_GetObjectSize) X(C_GetAttributeValue) X(C_SetAttributeValue) \
+	X(C_FindObjectsInit) X(C_FindObjects) X(C_FindObjectsFinal) X(C_EncryptInit) \
+	X(C_Encrypt) X(C_EncryptUpdate) X(C_EncryptFinal) X(C_DecryptInit) \
+	X(C_Decrypt) X(C_DecryptUpdate) X(C_DecryptFinal) X(C_DigestInit) \
+	X(C_Digest) X(C_DigestUpdate) X(C_DigestKey) X(C_DigestFinal) \
+	X(C_SignInit) X(C_Sign) X(C_SignUpdate) X(C_SignFinal) \
+	X(C_SignRecoverInit) X(C_SignRecover) X(C_VerifyInit) X(C_Verify) \
+	X(C_VerifyUpdate) X(C_VerifyFinal) X(C_VerifyRecoverInit) X(C_VerifyRecover) \
+	X(C_DigestEncryptUpdate) X(C_DecryptDigestUpdate) X(C_SignEncryptUpdate) X(C_DecryptVerifyUpdate) \
+	X(C_GenerateKey) X(C_GenerateKeyPair) X(C_WrapKey) X(C_UnwrapKey) \
+	X(C_DeriveKey) X(C_SeedRandom) X(C_GenerateRandom) X(C_WaitForSlotEvent)
+
+#define PKCS11MOD_METRICS_ENUM(name) PKCS11MOD_METRICS_##name,
+#define PKCS11MOD_METRICS_NAME(name) #name,
+
+enum {
+	PKCS11MOD_METRICS_FUNCTIONS(PKCS11MOD_METRICS_ENUM)
+	PKCS11MOD_METRICS_COUNT
+};
+
+static const char *pkcs11mod_metrics_names[PKCS11MOD_METRICS_COUNT] = {
+	PKCS11MOD_METRICS_FUNCTIONS(PKCS11MOD_METRICS_NAME)
+};
+
+// Indexed by function, then 0 for calls that returned CKR_OK and 1 for the
+// rest.
+static unsigned long long pkcs11mod_metrics[PKCS11MOD_METRICS_COUNT][2];
+
+// Set by Go when PKCS11MOD_TRACE is enabled, so that the return value of
+// each counted function is traced without calling into Go otherwise.
+int pkcs11mod_trace_returns;
+
+// PKCS11MOD_COUNT_CALL counts a call to the named function, and traces its
+// return value if enabled.  The session handle and mechanism are only used by
+// the trace, and either may be NULL.
+#define PKCS11MOD_COUNT_CALL(name, phSession, pMechanism, rv) do { \
+	__atomic_fetch_add(&pkcs11mod_metrics[PKCS11MOD_METRICS_##name][(rv) == CKR_OK ? 0 : 1], 1, __ATOMIC_RELAXED); \
+	if (pkcs11mod_trace_returns) \
+		goTraceReturn(PKCS11MOD_METRICS_##name, (phSession), (pMechanism), (rv)); \
+} while (0)
+
+#define PKCS11MOD_COUNT(name, rv) PKCS11MOD_COUNT_CALL(name, NULL, NULL, rv)
+#define PKCS11MOD_COUNT_SESSION(name, hSession, rv) PKCS11MOD_COUNT_CALL(name, &(hSession), NULL, rv)
+#define PKCS11MOD_COUNT_MECHANISM(name, hSession, pMechanism, rv) PKCS11MOD_COUNT_CALL(name, &(hSession), (pMechanism), rv)
+
+int pkcs11mod_metrics_count(void)
+{
+	return PKCS11MOD_METRICS_COUNT;
+}
+
+const char *pkcs11mod_metrics_name(int function)
+{
+	return pkcs11mod_metrics_names[function];
+}
+
+unsigned long long pkcs11mod_metrics_get(int function, int failed)
+{
+	return __atomic_load_n(&pkcs11mod_metrics[function][failed ? 1 : 0], __ATOMIC_RELAXED);
+}
 
 CK_FUNCTION_LIST pkcs11_functions = 
 {
@@ -388,8 +459,10 @@ CK_DEFINE_FUNCTION(CK_RV, C_Initialize)(CK_VOID_PTR pInitArgs)
 		return CKR_ARGUMENTS_BAD;
 	}
 	rv = goInitialize();
-	if (rv != CKR_OK) {
-		/* Release and destroy the mutex */
+	PKCS11MOD_COUNT(C_Initialize, rv);
+	if (rv != CKR_OK && rv != CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		/* Release and destroy the mutex (unless it belongs to the
+		 * earlier, still active, initialization) */
 		sc_pkcs11_free_lock();
 	}
 	return rv;
@@ -407,6 +480,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_Finalize)(CK_VOID_PTR pReserved)
 		return rv;
 
 	rv = goFinalize();
+	PKCS11MOD_COUNT(C_Finalize, rv);
 
 	/* Release and destroy the mutex */
 	sc_pkcs11_free_lock();
@@ -429,9 +503,13 @@ CK_DEFINE_FUNCTION(CK_RV, C_GetInfo)(CK_INFO_PTR pInfo)
 		return rv;
 
 	rv = goGetInfo(&goInfo);
+	PKCS11MOD_COUNT(C_GetInfo, rv);
 
 	sc_pkcs11_unlock();
 
+	if (rv != CKR_OK)
+		return rv;
+
 	pInfo->cryptokiVersion = goInfo.cryptokiVersion;
 	memcpy(pInfo->manufacturerID, goInfo.manufacturerID, sizeof(pInfo->manufacturerID));
 	pInfo->flags = goInfo.flags;
@@ -447,6 +525,8 @@ CK_DEFINE_FUNCTION(CK_RV, C_GetInfo)(CK_INFO_PTR pInfo)
 #ifdef _WIN32
 	__declspec(dllexport)
 #endif
+// The spec allows calling C_GetFunctionList before C_Initialize, so it must
+// not touch the Go side (or take the lock).
 CK_DEFINE_FUNCTION(CK_RV, C_GetFunctionList)(CK_FUNCTION_LIST_PTR_PTR ppFunctionList)
 {
 	if (NULL == ppFunctionList)
@@ -458,6 +538,107 @@ CK_DEFINE_FUNCTION(CK_RV, C_GetFunctionList)(CK_FUNCTION_LIST_PTR_PTR ppFunction
 }
 
 
+// PKCS#11 v3.0 interface discovery.  The standard "PKCS 11" interface is
+// always first; backends can add their own with pkcs11mod.RegisterInterface.
+#define PKCS11MOD_MAX_INTERFACES 16
+
+static CK_INTERFACE pkcs11_interfaces[PKCS11MOD_MAX_INTERFACES] = {
+	{(CK_CHAR *)"PKCS 11", &pkcs11_functions, 0},
+};
+static CK_ULONG pkcs11_interfaces_count = 1;
+
+CK_RV pkcs11mod_register_interface(CK_CHAR *pInterfaceName, CK_VOID_PTR pFunctionList, CK_FLAGS flags)
+{
+	if (NULL == pInterfaceName || NULL == pFunctionList)
+		return CKR_ARGUMENTS_BAD;
+
+	if (pkcs11_interfaces_count >= PKCS11MOD_MAX_INTERFACES)
+		return CKR_HOST_MEMORY;
+
+	pkcs11_interfaces[pkcs11_interfaces_count].pInterfaceName = pInterfaceName;
+	pkcs11_interfaces[pkcs11_interfaces_count].pFunctionList = pFunctionList;
+	pkcs11_interfaces[pkcs11_interfaces_count].flags = flags;
+	pkcs11_interfaces_count++;
+
+	return CKR_OK;
+}
+
+#ifdef _WIN32
+	__declspec(dllexport)
+#endif
+CK_DEFINE_FUNCTION(CK_RV, C_GetInterfaceList)(CK_INTERFACE_PTR pInterfacesList, CK_ULONG_PTR pulCount)
+{
+	CK_ULONG requested;
+
+	if (NULL == pulCount)
+		return CKR_ARGUMENTS_BAD;
+
+	// Two-call idiom: a NULL list asks for the count, including any
+	// interfaces added by pkcs11mod.RegisterInterface, and a list that's too
+	// small gets the count back along with CKR_BUFFER_TOO_SMALL.
+	if (NULL == pInterfacesList) {
+		*pulCount = pkcs11_interfaces_count;
+		return CKR_OK;
+	}
+
+	requested = *pulCount;
+	*pulCount = pkcs11_interfaces_count;
+	if (requested < pkcs11_interfaces_count)
+		return CKR_BUFFER_TOO_SMALL;
+
+	memcpy(pInterfacesList, pkcs11_interfaces, pkcs11_interfaces_count * sizeof(CK_INTERFACE));
+
+	return CKR_OK;
+}
+
+#ifdef _WIN32
+	__declspec(dllexport)
+#endif
+CK_DEFINE_FUNCTION(CK_RV, C_GetInterface)(CK_UTF8CHAR_PTR pInterfaceName, CK_VERSION_PTR pVersion, CK_INTERFACE_PTR_PTR ppInterface, CK_FLAGS flags)
+{
+	CK_ULONG i;
+
+	if (NULL == ppInterface)
+		return CKR_ARGUMENTS_BAD;
+
+	for (i = 0; i < pkcs11_interfaces_count; i++) {
+		CK_INTERFACE_PTR iface = &pkcs11_interfaces[i];
+		// Every function list starts with its version.
+		CK_VERSION_PTR version = (CK_VERSION_PTR)iface->pFunctionList;
+
+		if (NULL != pInterfaceName && strcmp((const char *)pInterfaceName, (const char *)iface->pInterfaceName) != 0)
+			continue;
+		if (NULL != pVersion && (pVersion->major != version->major || pVersion->minor != version->minor))
+			continue;
+		if ((iface->flags & flags) != flags)
+			continue;
+
+		*ppInterface = iface;
+		return CKR_OK;
+	}
+
+	return CKR_ARGUMENTS_BAD;
+}
+
+// Vendor extension, not part of the function list: runs the backend's
+// self-test (if it implements pkcs11mod.SelfTester).  Monitoring tools can
+// look it up with dlsym/GetProcAddress.
+#ifdef _WIN32
+	__declspec(dllexport)
+#endif
+CK_DEFINE_FUNCTION(CK_RV, pkcs11mod_SelfTest)(void)
+{
+	CK_RV rv;
+	rv = sc_pkcs11_lock();
+	if (rv != CKR_OK)
+		return rv;
+
+	rv = goSelfTest();
+	sc_pkcs11_unlock();
+	return rv;
+}
+
+
 CK_DEFINE_FUNCTION(CK_RV, C_GetSlotList)(CK_BBOOL tokenPresent, CK_SLOT_ID_PTR pSlotList, CK_ULONG_PTR pulCount)
 {
 	CK_RV rv;
@@ -466,6 +647,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_GetSlotList)(CK_BBOOL tokenPresent, CK_SLOT_ID_PTR p
 		return rv;
 
 	rv = goGetSlotList(tokenPresent, pSlotList, pulCount);
+	PKCS11MOD_COUNT(C_GetSlotList, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -479,6 +661,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_GetSlotInfo)(CK_SLOT_ID slotID, CK_SLOT_INFO_PTR pIn
 		return rv;
 
 	rv = goGetSlotInfo(slotID, pInfo);
+	PKCS11MOD_COUNT(C_GetSlotInfo, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -492,6 +675,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_GetTokenInfo)(CK_SLOT_ID slotID, CK_TOKEN_INFO_PTR p
 		return rv;
 
 	rv = goGetTokenInfo(slotID, pInfo);
+	PKCS11MOD_COUNT(C_GetTokenInfo, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -505,6 +689,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_GetMechanismList)(CK_SLOT_ID slotID, CK_MECHANISM_TY
 		return rv;
 
 	rv = goGetMechanismList(slotID, pMechanismList, pulCount);
+	PKCS11MOD_COUNT(C_GetMechanismList, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -518,6 +703,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_GetMechanismInfo)(CK_SLOT_ID slotID, CK_MECHANISM_TY
 		return rv;
 
 	rv = goGetMechanismInfo(slotID, type, pInfo);
+	PKCS11MOD_COUNT(C_GetMechanismInfo, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -537,6 +723,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_InitPIN)(CK_SESSION_HANDLE hSession, CK_UTF8CHAR_PTR
 		return rv;
 
 	rv = goInitPIN(hSession, pPin, ulPinLen);
+	PKCS11MOD_COUNT_SESSION(C_InitPIN, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -550,6 +737,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_SetPIN)(CK_SESSION_HANDLE hSession, CK_UTF8CHAR_PTR
 		return rv;
 
 	rv = goSetPIN(hSession, pOldPin, ulOldLen, pNewPin, ulNewLen);
+	PKCS11MOD_COUNT_SESSION(C_SetPIN, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -563,6 +751,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_OpenSession)(CK_SLOT_ID slotID, CK_FLAGS flags, CK_V
 		return rv;
 
 	rv = goOpenSession(slotID, flags, phSession);
+	PKCS11MOD_COUNT_CALL(C_OpenSession, rv == CKR_OK ? phSession : NULL, NULL, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -576,6 +765,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_CloseSession)(CK_SESSION_HANDLE hSession)
 		return rv;
 
 	rv = goCloseSession(hSession);
+	PKCS11MOD_COUNT_SESSION(C_CloseSession, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -589,6 +779,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_CloseAllSessions)(CK_SLOT_ID slotID)
 		return rv;
 
 	rv = goCloseAllSessions(slotID);
+	PKCS11MOD_COUNT(C_CloseAllSessions, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -602,6 +793,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_GetSessionInfo)(CK_SESSION_HANDLE hSession, CK_SESSI
 		return rv;
 
 	rv = goGetSessionInfo(hSession, pInfo);
+	PKCS11MOD_COUNT_SESSION(C_GetSessionInfo, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -615,6 +807,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_GetOperationState)(CK_SESSION_HANDLE hSession, CK_BY
 		return rv;
 
 	rv = goGetOperationState(hSession, pOperationState, pulOperationStateLen);
+	PKCS11MOD_COUNT_SESSION(C_GetOperationState, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -629,6 +822,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_SetOperationState)(CK_SESSION_HANDLE hSession, CK_BY
 		return rv;
 
 	rv = goSetOperationState(hSession, pOperationState, ulOperationStateLen, hEncryptionKey, hAuthenticationKey);
+	PKCS11MOD_COUNT_SESSION(C_SetOperationState, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -642,6 +836,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_Login)(CK_SESSION_HANDLE hSession, CK_USER_TYPE user
 		return rv;
 
 	rv = goLogin(hSession, userType, pPin, ulPinLen);
+	PKCS11MOD_COUNT_SESSION(C_Login, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -655,6 +850,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_Logout)(CK_SESSION_HANDLE hSession)
 		return rv;
 
 	rv = goLogout(hSession);
+	PKCS11MOD_COUNT_SESSION(C_Logout, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -668,6 +864,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_CreateObject)(CK_SESSION_HANDLE hSession, CK_ATTRIBU
 		return rv;
 
 	rv = goCreateObject(hSession, pTemplate, ulCount, phObject);
+	PKCS11MOD_COUNT_SESSION(C_CreateObject, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -681,6 +878,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_CopyObject)(CK_SESSION_HANDLE hSession, CK_OBJECT_HA
 		return rv;
 
 	rv = goCopyObject(hSession, hObject, pTemplate, ulCount, phNewObject);
+	PKCS11MOD_COUNT_SESSION(C_CopyObject, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -694,6 +892,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_DestroyObject)(CK_SESSION_HANDLE hSession, CK_OBJECT
 		return rv;
 
 	rv = goDestroyObject(hSession, hObject);
+	PKCS11MOD_COUNT_SESSION(C_DestroyObject, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -707,6 +906,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_GetObjectSize)(CK_SESSION_HANDLE hSession, CK_OBJECT
 		return rv;
 
 	rv = goGetObjectSize(hSession, hObject, pulSize);
+	PKCS11MOD_COUNT_SESSION(C_GetObjectSize, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -720,6 +920,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_GetAttributeValue)(CK_SESSION_HANDLE hSession, CK_OB
 		return rv;
 
 	rv = goGetAttributeValue(hSession, hObject, pTemplate, ulCount);
+	PKCS11MOD_COUNT_SESSION(C_GetAttributeValue, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -733,6 +934,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_SetAttributeValue)(CK_SESSION_HANDLE hSession, CK_OB
 		return rv;
 
 	rv = goSetAttributeValue(hSession, hObject, pTemplate, ulCount);
+	PKCS11MOD_COUNT_SESSION(C_SetAttributeValue, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -746,6 +948,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_FindObjectsInit)(CK_SESSION_HANDLE hSession, CK_ATTR
 		return rv;
 
 	rv = goFindObjectsInit(hSession, pTemplate, ulCount);
+	PKCS11MOD_COUNT_SESSION(C_FindObjectsInit, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -759,6 +962,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_FindObjects)(CK_SESSION_HANDLE hSession, CK_OBJECT_H
 		return rv;
 
 	rv = goFindObjects(hSession, phObject, ulMaxObjectCount, pulObjectCount);
+	PKCS11MOD_COUNT_SESSION(C_FindObjects, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -772,6 +976,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_FindObjectsFinal)(CK_SESSION_HANDLE hSession)
 		return rv;
 
 	rv = goFindObjectsFinal(hSession);
+	PKCS11MOD_COUNT_SESSION(C_FindObjectsFinal, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -785,6 +990,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_EncryptInit)(CK_SESSION_HANDLE hSession, CK_MECHANIS
 		return rv;
 
 	rv = goEncryptInit(hSession, pMechanism, hKey);
+	PKCS11MOD_COUNT_MECHANISM(C_EncryptInit, hSession, pMechanism, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -798,6 +1004,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_Encrypt)(CK_SESSION_HANDLE hSession, CK_BYTE_PTR pDa
 		return rv;
 
 	rv = goEncrypt(hSession, pData, ulDataLen, pEncryptedData, pulEncryptedDataLen);
+	PKCS11MOD_COUNT_SESSION(C_Encrypt, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -811,6 +1018,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_EncryptUpdate)(CK_SESSION_HANDLE hSession, CK_BYTE_P
 		return rv;
 
 	rv = goEncryptUpdate(hSession, pPart, ulPartLen, pEncryptedPart, pulEncryptedPartLen);
+	PKCS11MOD_COUNT_SESSION(C_EncryptUpdate, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -824,6 +1032,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_EncryptFinal)(CK_SESSION_HANDLE hSession, CK_BYTE_PT
 		return rv;
 
 	rv = goEncryptFinal(hSession, pLastEncryptedPart, pulLastEncryptedPartLen);
+	PKCS11MOD_COUNT_SESSION(C_EncryptFinal, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -837,6 +1046,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_DecryptInit)(CK_SESSION_HANDLE hSession, CK_MECHANIS
 		return rv;
 
 	rv = goDecryptInit(hSession, pMechanism, hKey);
+	PKCS11MOD_COUNT_MECHANISM(C_DecryptInit, hSession, pMechanism, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -850,6 +1060,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_Decrypt)(CK_SESSION_HANDLE hSession, CK_BYTE_PTR pEn
 		return rv;
 
 	rv = goDecrypt(hSession, pEncryptedData, ulEncryptedDataLen, pData, pulDataLen);
+	PKCS11MOD_COUNT_SESSION(C_Decrypt, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -863,6 +1074,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_DecryptUpdate)(CK_SESSION_HANDLE hSession, CK_BYTE_P
 		return rv;
 
 	rv = goDecryptUpdate(hSession, pEncryptedPart, ulEncryptedPartLen, pPart, pulPartLen);
+	PKCS11MOD_COUNT_SESSION(C_DecryptUpdate, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -876,6 +1088,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_DecryptFinal)(CK_SESSION_HANDLE hSession, CK_BYTE_PT
 		return rv;
 
 	rv = goDecryptFinal(hSession, pLastPart, pulLastPartLen);
+	PKCS11MOD_COUNT_SESSION(C_DecryptFinal, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -889,6 +1102,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_DigestInit)(CK_SESSION_HANDLE hSession, CK_MECHANISM
 		return rv;
 
 	rv = goDigestInit(hSession, pMechanism);
+	PKCS11MOD_COUNT_MECHANISM(C_DigestInit, hSession, pMechanism, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -902,6 +1116,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_Digest)(CK_SESSION_HANDLE hSession, CK_BYTE_PTR pDat
 		return rv;
 
 	rv = goDigest(hSession, pData, ulDataLen, pDigest, pulDigestLen);
+	PKCS11MOD_COUNT_SESSION(C_Digest, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -915,6 +1130,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_DigestUpdate)(CK_SESSION_HANDLE hSession, CK_BYTE_PT
 		return rv;
 
 	rv = goDigestUpdate(hSession, pPart, ulPartLen);
+	PKCS11MOD_COUNT_SESSION(C_DigestUpdate, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -928,6 +1144,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_DigestKey)(CK_SESSION_HANDLE hSession, CK_OBJECT_HAN
 		return rv;
 
 	rv = goDigestKey(hSession, hKey);
+	PKCS11MOD_COUNT_SESSION(C_DigestKey, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -941,6 +1158,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_DigestFinal)(CK_SESSION_HANDLE hSession, CK_BYTE_PTR
 		return rv;
 
 	rv = goDigestFinal(hSession, pDigest, pulDigestLen);
+	PKCS11MOD_COUNT_SESSION(C_DigestFinal, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -954,6 +1172,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_SignInit)(CK_SESSION_HANDLE hSession, CK_MECHANISM_P
 		return rv;
 
 	rv = goSignInit(hSession, pMechanism, hKey);
+	PKCS11MOD_COUNT_MECHANISM(C_SignInit, hSession, pMechanism, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -967,6 +1186,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_Sign)(CK_SESSION_HANDLE hSession, CK_BYTE_PTR pData,
 		return rv;
 
 	rv = goSign(hSession, pData, ulDataLen, pSignature, pulSignatureLen);
+	PKCS11MOD_COUNT_SESSION(C_Sign, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -980,6 +1200,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_SignUpdate)(CK_SESSION_HANDLE hSession, CK_BYTE_PTR
 		return rv;
 
 	rv = goSignUpdate(hSession, pPart, ulPartLen);
+	PKCS11MOD_COUNT_SESSION(C_SignUpdate, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -993,6 +1214,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_SignFinal)(CK_SESSION_HANDLE hSession, CK_BYTE_PTR p
 		return rv;
 
 	rv = goSignFinal(hSession, pSignature, pulSignatureLen);
+	PKCS11MOD_COUNT_SESSION(C_SignFinal, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -1006,6 +1228,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_SignRecoverInit)(CK_SESSION_HANDLE hSession, CK_MECH
 		return rv;
 
 	rv = goSignRecoverInit(hSession, pMechanism, hKey);
+	PKCS11MOD_COUNT_MECHANISM(C_SignRecoverInit, hSession, pMechanism, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -1019,6 +1242,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_SignRecover)(CK_SESSION_HANDLE hSession, CK_BYTE_PTR
 		return rv;
 
 	rv = goSignRecover(hSession, pData, ulDataLen, pSignature, pulSignatureLen);
+	PKCS11MOD_COUNT_SESSION(C_SignRecover, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -1032,6 +1256,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_VerifyInit)(CK_SESSION_HANDLE hSession, CK_MECHANISM
 		return rv;
 
 	rv = goVerifyInit(hSession, pMechanism, hKey);
+	PKCS11MOD_COUNT_MECHANISM(C_VerifyInit, hSession, pMechanism, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -1045,6 +1270,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_Verify)(CK_SESSION_HANDLE hSession, CK_BYTE_PTR pDat
 		return rv;
 
 	rv = goVerify(hSession, pData, ulDataLen, pSignature, ulSignatureLen);
+	PKCS11MOD_COUNT_SESSION(C_Verify, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -1058,6 +1284,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_VerifyUpdate)(CK_SESSION_HANDLE hSession, CK_BYTE_PT
 		return rv;
 
 	rv = goVerifyUpdate(hSession, pPart, ulPartLen);
+	PKCS11MOD_COUNT_SESSION(C_VerifyUpdate, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -1071,6 +1298,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_VerifyFinal)(CK_SESSION_HANDLE hSession, CK_BYTE_PTR
 		return rv;
 
 	rv = goVerifyFinal(hSession, pSignature, ulSignatureLen);
+	PKCS11MOD_COUNT_SESSION(C_VerifyFinal, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -1084,6 +1312,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_VerifyRecoverInit)(CK_SESSION_HANDLE hSession, CK_ME
 		return rv;
 
 	rv = goVerifyRecoverInit(hSession, pMechanism, hKey);
+	PKCS11MOD_COUNT_MECHANISM(C_VerifyRecoverInit, hSession, pMechanism, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -1097,6 +1326,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_VerifyRecover)(CK_SESSION_HANDLE hSession, CK_BYTE_P
 		return rv;
 
 	rv = goVerifyRecover(hSession, pSignature, ulSignatureLen, pData, pulDataLen);
+	PKCS11MOD_COUNT_SESSION(C_VerifyRecover, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -1110,6 +1340,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_DigestEncryptUpdate)(CK_SESSION_HANDLE hSession, CK_
 		return rv;
 
 	rv = goDigestEncryptUpdate(hSession, pPart, ulPartLen, pEncryptedPart, pulEncryptedPartLen);
+	PKCS11MOD_COUNT_SESSION(C_DigestEncryptUpdate, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -1123,6 +1354,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_DecryptDigestUpdate)(CK_SESSION_HANDLE hSession, CK_
 		return rv;
 
 	rv = goDecryptDigestUpdate(hSession, pEncryptedPart, ulEncryptedPartLen, pPart, pulPartLen);
+	PKCS11MOD_COUNT_SESSION(C_DecryptDigestUpdate, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -1136,6 +1368,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_SignEncryptUpdate)(CK_SESSION_HANDLE hSession, CK_BY
 		return rv;
 
 	rv = goSignEncryptUpdate(hSession, pPart, ulPartLen, pEncryptedPart, pulEncryptedPartLen);
+	PKCS11MOD_COUNT_SESSION(C_SignEncryptUpdate, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -1149,6 +1382,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_DecryptVerifyUpdate)(CK_SESSION_HANDLE hSession, CK_
 		return rv;
 
 	rv = goDecryptVerifyUpdate(hSession, pEncryptedPart, ulEncryptedPartLen, pPart, pulPartLen);
+	PKCS11MOD_COUNT_SESSION(C_DecryptVerifyUpdate, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -1162,6 +1396,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_GenerateKey)(CK_SESSION_HANDLE hSession, CK_MECHANIS
 		return rv;
 
 	rv = goGenerateKey(hSession, pMechanism, pTemplate, ulCount, phKey);
+	PKCS11MOD_COUNT_MECHANISM(C_GenerateKey, hSession, pMechanism, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -1175,6 +1410,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_GenerateKeyPair)(CK_SESSION_HANDLE hSession, CK_MECH
 		return rv;
 
 	rv = goGenerateKeyPair(hSession, pMechanism, pPublicKeyTemplate, ulPublicKeyAttributeCount, pPrivateKeyTemplate, ulPrivateKeyAttributeCount, phPublicKey, phPrivateKey);
+	PKCS11MOD_COUNT_MECHANISM(C_GenerateKeyPair, hSession, pMechanism, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -1188,6 +1424,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_WrapKey)(CK_SESSION_HANDLE hSession, CK_MECHANISM_PT
 		return rv;
 
 	rv = goWrapKey(hSession, pMechanism, hWrappingKey, hKey, pWrappedKey, pulWrappedKeyLen);
+	PKCS11MOD_COUNT_MECHANISM(C_WrapKey, hSession, pMechanism, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -1201,6 +1438,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_UnwrapKey)(CK_SESSION_HANDLE hSession, CK_MECHANISM_
 		return rv;
 
 	rv = goUnwrapKey(hSession, pMechanism, hUnwrappingKey, pWrappedKey, ulWrappedKeyLen, pTemplate, ulAttributeCount, phKey);
+	PKCS11MOD_COUNT_MECHANISM(C_UnwrapKey, hSession, pMechanism, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -1214,6 +1452,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_DeriveKey)(CK_SESSION_HANDLE hSession, CK_MECHANISM_
 		return rv;
 
 	rv = goDeriveKey(hSession, pMechanism, hBaseKey, pTemplate, ulAttributeCount, phKey);
+	PKCS11MOD_COUNT_MECHANISM(C_DeriveKey, hSession, pMechanism, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -1227,6 +1466,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_SeedRandom)(CK_SESSION_HANDLE hSession, CK_BYTE_PTR
 		return rv;
 
 	rv = goSeedRandom(hSession, pSeed, ulSeedLen);
+	PKCS11MOD_COUNT_SESSION(C_SeedRandom, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -1240,6 +1480,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_GenerateRandom)(CK_SESSION_HANDLE hSession, CK_BYTE_
 		return rv;
 
 	rv = goGenerateRandom(hSession, RandomData, ulRandomLen);
+	PKCS11MOD_COUNT_SESSION(C_GenerateRandom, hSession, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
@@ -1265,6 +1506,7 @@ CK_DEFINE_FUNCTION(CK_RV, C_WaitForSlotEvent)(CK_FLAGS flags, CK_SLOT_ID_PTR pSl
 		return rv;
 
 	rv = goWaitForSlotEvent(flags, pSlot, pReserved);
+	PKCS11MOD_COUNT(C_WaitForSlotEvent, rv);
 	sc_pkcs11_unlock();
 	return rv;
 }
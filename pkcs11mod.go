@@ -35,6 +35,9 @@ package pkcs11mod
 #include <unistd.h>
 #include "spec/pkcs11go.h"
 
+extern int pkcs11mod_trace_returns;
+const char *pkcs11mod_metrics_name(int function);
+
 static inline CK_RV bridge_CK_CREATEMUTEX(CK_CREATEMUTEX f, CK_VOID_PTR_PTR ppMutex) {
 	return f(ppMutex);
 }
@@ -54,12 +57,15 @@ static inline CK_RV bridge_CK_UNLOCKMUTEX(CK_UNLOCKMUTEX f, CK_VOID_PTR pMutex)
 import "C"
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"unicode/utf8"
 	"unsafe"
 
 	"github.com/miekg/pkcs11"
@@ -68,9 +74,60 @@ import (
 var (
 	trace          bool
 	traceSensitive bool
+	traceTiming    bool
+	traceJSON      bool
+
+	// sunpkcs11Compat works around assumptions made by Java's SunPKCS11
+	// provider, which refuses to load a module if any of these are violated.
+	sunpkcs11Compat bool
+
+	// ecdh1UnwrapPoint unwraps DER-encoded public points passed to
+	// CKM_ECDH1_DERIVE, so that the backend always sees a raw point.
+	ecdh1UnwrapPoint bool
+
+	// oaepAllowMGFMismatch accepts OAEP parameters whose MGF uses a
+	// different hash than hashAlg, as generated by Windows CNG.
+	oaepAllowMGFMismatch bool
+
+	// gcmAllowDetachedTag skips the check that AEAD (e.g. GCM) ciphertexts
+	// returned by the backend have the tag appended.
+	gcmAllowDetachedTag bool
+
+	// strictValidation rejects common application mistakes that the spec
+	// leaves to the token, before they reach the backend.
+	strictValidation bool
+
+	// cacheAttributes serves the fetch half of the C_GetAttributeValue
+	// two-call idiom from the results of the length half.
+	cacheAttributes bool
 
 	logfile io.Closer
 	backend Backend
+
+	// The optional interfaces that backend implements, or nil; see
+	// SetBackend.
+	slotEventWaiter       SlotEventWaiter
+	operationStateManager OperationStateManager
+	selfTester            SelfTester
+	defaultTemplater      DefaultTemplater
+
+	// initialized tracks whether C_Initialize has succeeded (and C_Finalize
+	// hasn't been called since).  initMutex makes the transitions atomic.
+	initialized bool
+	initMutex   sync.Mutex
+
+	slotHasToken      func(slotID uint) bool
+	mechanismRewriter MechanismRewriter
+	randomReader      io.Reader
+	tokenLabelPrefix  string
+
+	// enforceAlwaysAuthenticate makes signing require a
+	// CKU_CONTEXT_SPECIFIC login for CKA_ALWAYS_AUTHENTICATE keys.
+	enforceAlwaysAuthenticate bool
+
+	// enforceUniqueID makes C_CreateObject and C_GenerateKeyPair reject a
+	// CKA_ID that another object of the same class already has.
+	enforceUniqueID bool
 )
 
 func init() {
@@ -102,24 +159,378 @@ func init() {
 
 	if os.Getenv("PKCS11MOD_TRACE") == "1" {
 		trace = true
+		C.pkcs11mod_trace_returns = 1
+	}
+
+	if funcs := os.Getenv("PKCS11MOD_TRACE_FUNCS"); funcs != "" {
+		traceFuncs = make(map[string]bool)
+		for _, function := range strings.Split(funcs, ",") {
+			traceFuncs[strings.TrimSpace(function)] = true
+		}
 	}
 
 	if os.Getenv("PKCS11MOD_TRACE_SENSITIVE") == "1" {
 		traceSensitive = true
 	}
 
+	if os.Getenv("PKCS11MOD_TRACE_TIMING") == "1" {
+		traceTiming = true
+	}
+
+	if os.Getenv("PKCS11MOD_TRACE_JSON") == "1" {
+		traceJSON = true
+	}
+
+	if os.Getenv("PKCS11MOD_SUNPKCS11_COMPAT") == "1" {
+		sunpkcs11Compat = true
+	}
+
+	if os.Getenv("PKCS11MOD_ECDH1_UNWRAP_POINT") == "1" {
+		ecdh1UnwrapPoint = true
+	}
+
+	if os.Getenv("PKCS11MOD_OAEP_ALLOW_MGF_MISMATCH") == "1" {
+		oaepAllowMGFMismatch = true
+	}
+
+	if os.Getenv("PKCS11MOD_GCM_ALLOW_DETACHED_TAG") == "1" {
+		gcmAllowDetachedTag = true
+	}
+
+	if os.Getenv("PKCS11MOD_STRICT") == "1" {
+		strictValidation = true
+	}
+
+	if os.Getenv("PKCS11MOD_CACHE_ATTRIBUTES") == "1" {
+		cacheAttributes = true
+	}
+
 	preventUnload()
 }
 
+// traceFuncs is the set of functions named by PKCS11MOD_TRACE_FUNCS, or nil
+// to trace every function.
+var traceFuncs map[string]bool
+
+// traceFunction reports whether the trace is enabled for the named PKCS#11
+// function (e.g. "C_SignInit").  Callers check it before doing any of the
+// formatting work for a trace line.
+func traceFunction(function string) bool {
+	return trace && (traceFuncs == nil || traceFuncs[function])
+}
+
+// traceShared reports whether to trace from helpers that don't know which
+// PKCS#11 function they're serving.  They're only traced when the trace
+// isn't restricted by PKCS11MOD_TRACE_FUNCS.
+func traceShared() bool {
+	return trace && traceFuncs == nil
+}
+
+// traceOutput is the logger installed by SetTraceOutput, or nil to trace
+// to the standard logger.
+var traceOutput atomic.Pointer[log.Logger]
+
+// SetTraceOutput sends the trace enabled by PKCS11MOD_TRACE to w instead of
+// the module's log file, with the standard logger's flags.  Passing nil
+// restores the default.  It's safe to call while PKCS#11 calls are in flight;
+// each trace line goes to either the old or the new destination.
+func SetTraceOutput(w io.Writer) {
+	if w == nil {
+		traceOutput.Store(nil)
+
+		return
+	}
+
+	traceOutput.Store(log.New(w, "", log.Flags()))
+}
+
+// traceLog returns the logger that trace lines are written to.  In
+// PKCS11MOD_TRACE_JSON mode, each line is wrapped in a JSON record.
+func traceLog() *log.Logger {
+	if traceJSON {
+		return traceJSONLogger
+	}
+
+	if l := traceOutput.Load(); l != nil {
+		return l
+	}
+
+	return log.Default()
+}
+
 func SetBackend(b Backend) {
+	slotEventWaiter, _ = b.(SlotEventWaiter)
+	operationStateManager, _ = b.(OperationStateManager)
+	selfTester, _ = b.(SelfTester)
+	defaultTemplater, _ = b.(DefaultTemplater)
+
+	_, isCtx := b.(*pkcs11.Ctx)
+	receiver, _ := b.(NativeParamsReceiver)
+	nativeParams = isCtx || receiver != nil && receiver.ReceivesNativeParams()
+
+	if traceTiming {
+		t := &timingBackend{b: b}
+		b = t
+
+		// timingBackend implements every optional interface, so only
+		// substitute it for the ones that the real backend implements.
+		if slotEventWaiter != nil {
+			slotEventWaiter = t
+		}
+
+		if operationStateManager != nil {
+			operationStateManager = t
+		}
+
+		if selfTester != nil {
+			selfTester = t
+		}
+	}
+
 	backend = b
 }
 
+// SetSlotHasToken installs a hook that reports whether a token is present in
+// the given slot.  When set, C_OpenSession, C_GetTokenInfo and
+// C_GetMechanismList return CKR_TOKEN_NOT_PRESENT for slots whose token is
+// absent, without calling the backend, and C_GetSlotInfo sets
+// CKF_TOKEN_PRESENT to match it.  Passing nil removes the hook.
+func SetSlotHasToken(f func(slotID uint) bool) {
+	slotHasToken = f
+}
+
+// RandomSeeder can optionally be implemented by the io.Reader passed to
+// SetRandomReader, to support C_SeedRandom.
+type RandomSeeder interface {
+	Seed(seed []byte) error
+}
+
+// SetRandomReader makes C_GenerateRandom read from r (e.g. crypto/rand.Reader)
+// instead of calling the backend's GenerateRandom.  C_SeedRandom is then
+// forwarded to r's Seed method if it implements RandomSeeder, and returns
+// CKR_RANDOM_SEED_NOT_SUPPORTED otherwise.  Passing nil restores the default
+// of calling the backend.
+func SetRandomReader(r io.Reader) {
+	randomReader = r
+}
+
+// SetTokenLabelPrefix makes C_GetTokenInfo prepend prefix to the label
+// reported by the backend, so that the tokens of several pkcs11mod-based
+// modules loaded side by side (e.g. by p11-kit) can be told apart.  The
+// result is truncated to the 32 bytes of the label field.  An empty prefix
+// (the default) leaves labels alone.
+func SetTokenLabelPrefix(prefix string) {
+	tokenLabelPrefix = prefix
+}
+
+// SetEnforceAlwaysAuthenticate makes pkcs11mod enforce CKA_ALWAYS_AUTHENTICATE
+// on behalf of backends that don't: after C_SignInit or C_SignRecoverInit with
+// a key whose CKA_ALWAYS_AUTHENTICATE is CK_TRUE, C_Sign, C_SignUpdate,
+// C_SignFinal and C_SignRecover fail with CKR_USER_NOT_LOGGED_IN until the
+// application calls C_Login with CKU_CONTEXT_SPECIFIC.  It's off by default,
+// since backends that enforce it themselves (or whose tokens do) don't need
+// it.
+func SetEnforceAlwaysAuthenticate(enforce bool) {
+	enforceAlwaysAuthenticate = enforce
+}
+
+// SetEnforceUniqueID makes pkcs11mod reject C_CreateObject and
+// C_GenerateKeyPair templates whose CKA_ID is already used by an object of the
+// same class with CKR_ATTRIBUTE_VALUE_INVALID, for middleware that assumes
+// CKA_ID identifies a key or certificate.  (A key and its certificate sharing
+// a CKA_ID is fine.)  It's off by default, since PKCS#11 allows duplicates.
+// The check searches with the backend's FindObjects* functions in the
+// application's session, so it only sees the objects visible to that session.
+// If the backend can't start the search (typically with CKR_OPERATION_ACTIVE,
+// because the session already has a search active), the object isn't created
+// and the application gets that error.
+func SetEnforceUniqueID(enforce bool) {
+	enforceUniqueID = enforce
+}
+
+// truncateUTF8 returns the longest prefix of s that is at most n bytes long
+// and doesn't split a UTF-8 sequence.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return s[:n]
+}
+
+// MechanismRewriter is called with the name of the PKCS#11 function (e.g.
+// "C_SignInit") and the mechanism requested by the application.  It returns
+// the mechanism to pass to the backend instead (m itself to leave it alone),
+// or an error (typically pkcs11.Error(pkcs11.CKR_MECHANISM_INVALID)) to veto
+// the operation.  Returning a nil mechanism also vetoes it.
+type MechanismRewriter func(function string, m *pkcs11.Mechanism) (*pkcs11.Mechanism, error)
+
+// SetMechanismRewriter installs a hook that can substitute the mechanisms
+// passed to the C_*Init functions, e.g. to adapt an application that insists
+// on a mechanism the backend doesn't implement.  Passing nil removes the
+// hook.
+func SetMechanismRewriter(f MechanismRewriter) {
+	mechanismRewriter = f
+}
+
+func rewriteMechanism(function string, m *pkcs11.Mechanism) (*pkcs11.Mechanism, error) {
+	if traceFunction(function) {
+		traceLog().Printf("pkcs11mod %s: mechanism %s", function, MechTrace(m))
+	}
+
+	if mechanismRewriter == nil {
+		return m, nil
+	}
+
+	rewritten, err := mechanismRewriter(function, m)
+	if err != nil {
+		return nil, err
+	}
+
+	if rewritten == nil {
+		return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_INVALID)
+	}
+
+	if traceFunction(function) && rewritten.Mechanism != m.Mechanism {
+		traceLog().Printf("pkcs11mod %s: rewrote mechanism %s to %s", function, MechTrace(m), MechTrace(rewritten))
+	}
+
+	return rewritten, nil
+}
+
+// MechanismDecoder converts the raw pParameter bytes of a mechanism (nil if
+// the application passed no parameter) into the Mechanism passed to the
+// backend.  Returning an error (typically
+// pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)) fails the call.
+type MechanismDecoder func(raw []byte) (*pkcs11.Mechanism, error)
+
+var (
+	mechanismDecoders = map[uint]MechanismDecoder{}
+
+	// mechanismDecodersMutex also guards mechanismEncoders.
+	mechanismDecodersMutex sync.RWMutex
+)
+
+// RegisterMechanismDecoder teaches pkcs11mod how to decode the parameter of a
+// mechanism it has no built-in support for, e.g. a vendor-defined mechanism
+// whose parameter is a custom structure.  Without a decoder, such parameters
+// are passed to the backend as raw bytes, whether or not the mechanism is
+// vendor-defined.  Decoders aren't consulted for mechanisms that pkcs11mod
+// decodes itself.  Passing a nil decode removes the registration.
+func RegisterMechanismDecoder(mech uint, decode MechanismDecoder) {
+	mechanismDecodersMutex.Lock()
+	defer mechanismDecodersMutex.Unlock()
+
+	if decode == nil {
+		delete(mechanismDecoders, mech)
+
+		return
+	}
+
+	mechanismDecoders[mech] = decode
+}
+
+func lookupMechanismDecoder(mech uint) (MechanismDecoder, bool) {
+	mechanismDecodersMutex.RLock()
+	defer mechanismDecodersMutex.RUnlock()
+
+	decode, ok := mechanismDecoders[mech]
+
+	return decode, ok
+}
+
+// MechanismEncoder is the counterpart of MechanismDecoder: it's called with
+// the Mechanism that was passed to the backend, after the backend call that
+// used it succeeded, and with raw aliasing the caller's pParameter (nil if
+// there's none).  It writes any output fields of the parameter (such as a
+// generated IV) into raw.  Returning an error fails the call.
+type MechanismEncoder func(m *pkcs11.Mechanism, raw []byte) error
+
+var mechanismEncoders = map[uint]MechanismEncoder{}
+
+// RegisterMechanismEncoder installs the MechanismEncoder for a mechanism that
+// pkcs11mod has no built-in support for; it's typically registered together
+// with a decoder (see RegisterMechanismDecoder).  Passing a nil encode
+// removes the registration.
+func RegisterMechanismEncoder(mech uint, encode MechanismEncoder) {
+	mechanismDecodersMutex.Lock()
+	defer mechanismDecodersMutex.Unlock()
+
+	if encode == nil {
+		delete(mechanismEncoders, mech)
+
+		return
+	}
+
+	mechanismEncoders[mech] = encode
+}
+
+func lookupMechanismEncoder(mech uint) (MechanismEncoder, bool) {
+	mechanismDecodersMutex.RLock()
+	defer mechanismDecodersMutex.RUnlock()
+
+	encode, ok := mechanismEncoders[mech]
+
+	return encode, ok
+}
+
+// tokenNotPresent reports whether the SlotHasToken hook says the token in
+// slotID is absent.  function is the calling PKCS#11 function, for tracing.
+func tokenNotPresent(function string, slotID uint) bool {
+	if slotHasToken == nil {
+		return false
+	}
+
+	if slotHasToken(slotID) {
+		return false
+	}
+
+	if traceFunction(function) {
+		traceLog().Printf("pkcs11mod %s: token not present in %s", function, slotTrace(slotID))
+	}
+
+	return true
+}
+
 //export goLog
 func goLog(s unsafe.Pointer) {
 	log.Println(C.GoString((*C.char)(s)))
 }
 
+// goTraceReturn is called by the C wrappers when tracing is enabled, with
+// the function's index in Metrics and the value it's about to return.  The
+// session handle and mechanism are nil when the function doesn't take them;
+// they're only used for JSON records.
+//
+//export goTraceReturn
+func goTraceReturn(function C.int, phSession C.CK_SESSION_HANDLE_PTR, pMechanism C.CK_MECHANISM_PTR, rv C.CK_RV) {
+	name := C.GoString(C.pkcs11mod_metrics_name(function))
+	if !traceFunction(name) {
+		return
+	}
+
+	if traceJSON {
+		record := traceRecord{Func: name, RV: RVTrace(uint(rv))}
+		if phSession != nil {
+			record.Session = sessionTrace(pkcs11.SessionHandle(*phSession))
+		}
+
+		if pMechanism != nil {
+			record.Mechanism = traceValueName(uint(pMechanism.mechanism), strCKM)
+		}
+
+		logTraceJSON(record)
+
+		return
+	}
+
+	traceLog().Printf("pkcs11mod %s: returning %s", name, RVTrace(uint(rv)))
+}
+
 //export goInitialize
 func goInitialize() C.CK_RV {
 	if backend == nil {
@@ -128,23 +539,53 @@ func goInitialize() C.CK_RV {
 		return C.CKR_GENERAL_ERROR
 	}
 
-	if trace {
-		log.Println("pkcs11mod Initialize")
+	if traceFunction("C_Initialize") {
+		traceLog().Println("pkcs11mod Initialize")
+	}
+
+	// Serialize against a concurrent C_Finalize, so that the backend never
+	// sees Initialize and Finalize interleaved.
+	initMutex.Lock()
+	defer initMutex.Unlock()
+
+	if initialized {
+		return C.CKR_CRYPTOKI_ALREADY_INITIALIZED
 	}
 
 	err := backend.Initialize()
+	if err == nil {
+		initialized = true
+	}
 
 	return fromError(err)
 }
 
 //export goFinalize
 func goFinalize() C.CK_RV {
-	if trace {
-		log.Println("pkcs11mod Finalize")
+	if traceFunction("C_Finalize") {
+		traceLog().Println("pkcs11mod Finalize")
+	}
+
+	initMutex.Lock()
+	defer initMutex.Unlock()
+
+	if !initialized {
+		return C.CKR_CRYPTOKI_NOT_INITIALIZED
 	}
 
 	err := backend.Finalize()
 
+	// Finalizing implicitly closes every session, so the module is back in
+	// its pristine state even if the backend complained.
+	initialized = false
+
+	sessionsMutex.Lock()
+	for _, session := range sessions {
+		session.encryptGCMParams.Free()
+	}
+	sessions = map[pkcs11.SessionHandle]*sessionInfo{}
+	sessionsMutex.Unlock()
+
 	exitSoon()
 
 	return fromError(err)
@@ -156,6 +597,16 @@ func goGetInfo(p C.ckInfoPtr) C.CK_RV {
 		return C.CKR_ARGUMENTS_BAD
 	}
 
+	// Some applications call C_GetInfo before C_Initialize, when the backend
+	// may not be usable (or even set).
+	initMutex.Lock()
+	isInitialized := initialized
+	initMutex.Unlock()
+
+	if !isInitialized {
+		return C.CKR_CRYPTOKI_NOT_INITIALIZED
+	}
+
 	info, err := backend.GetInfo()
 	if err != nil {
 		return fromError(err)
@@ -213,7 +664,13 @@ func goGetSlotList(tokenPresent C.CK_BBOOL, pSlotList C.CK_SLOT_ID_PTR, pulCount
 			return C.CKR_BUFFER_TOO_SMALL
 		}
 
-		fromList(slotList, C.CK_ULONG_PTR(pSlotList), goCount)
+		// A backend with no slots may return a nil slice; in that case
+		// there's nothing to write and pSlotList is left untouched.
+		if goCount > 0 {
+			if err := fromList(slotList, C.CK_ULONG_PTR(pSlotList), goCount); err != nil {
+				return fromError(err)
+			}
+		}
 	}
 
 	return fromError(nil)
@@ -232,7 +689,7 @@ func goGetSlotInfo(slotID C.CK_SLOT_ID, pInfo C.CK_SLOT_INFO_PTR) C.CK_RV {
 		return fromError(err)
 	}
 
-	pInfo.flags = C.CK_FLAGS(slotInfo.Flags)
+	pInfo.flags = C.CK_FLAGS(slotFlags(goSlotID, slotInfo.Flags))
 	pInfo.hardwareVersion.major = C.CK_BYTE(slotInfo.HardwareVersion.Major)
 	pInfo.hardwareVersion.minor = C.CK_BYTE(slotInfo.HardwareVersion.Minor)
 	pInfo.firmwareVersion.major = C.CK_BYTE(slotInfo.FirmwareVersion.Major)
@@ -256,6 +713,58 @@ func goGetSlotInfo(slotID C.CK_SLOT_ID, pInfo C.CK_SLOT_INFO_PTR) C.CK_RV {
 	return fromError(nil)
 }
 
+// slotFlags makes the CK_SLOT_INFO flags from the backend consistent.  If the
+// SlotHasToken hook is set, it decides CKF_TOKEN_PRESENT.  In strict mode,
+// undefined flags are cleared, and a slot without a token is marked
+// CKF_REMOVABLE_DEVICE, since the spec requires non-removable slots to always
+// have a token.  Whether CKF_HW_SLOT is right is up to the backend.
+func slotFlags(slotID, flags uint) uint {
+	if slotHasToken != nil {
+		if slotHasToken(slotID) {
+			flags |= pkcs11.CKF_TOKEN_PRESENT
+		} else {
+			flags &^= pkcs11.CKF_TOKEN_PRESENT
+		}
+	}
+
+	if !strictValidation {
+		return flags
+	}
+
+	const validFlags = pkcs11.CKF_TOKEN_PRESENT | pkcs11.CKF_REMOVABLE_DEVICE | pkcs11.CKF_HW_SLOT
+
+	if flags&^validFlags != 0 {
+		if traceFunction("C_GetSlotInfo") {
+			traceLog().Printf("pkcs11mod GetSlotInfo: clearing undefined flags 0x%x of %s\n", flags&^validFlags, slotTrace(slotID))
+		}
+
+		flags &= validFlags
+	}
+
+	if flags&pkcs11.CKF_TOKEN_PRESENT == 0 && flags&pkcs11.CKF_REMOVABLE_DEVICE == 0 {
+		if traceFunction("C_GetSlotInfo") {
+			traceLog().Printf("pkcs11mod GetSlotInfo: %s has no token but isn't CKF_REMOVABLE_DEVICE, setting it\n", slotTrace(slotID))
+		}
+
+		flags |= pkcs11.CKF_REMOVABLE_DEVICE
+	}
+
+	return flags
+}
+
+// tokenMemory converts a CK_TOKEN_INFO memory size from the backend.  Backends
+// that don't know a size report it as pkcs11.CK_UNAVAILABLE_INFORMATION (which
+// is also what a *pkcs11.Ctx backend passes through from its token); any other
+// value, including 0 for a full token, is reported as is.  A size too large
+// for a CK_ULONG is reported as unavailable rather than truncated.
+func tokenMemory(size uint) C.CK_ULONG {
+	if size == pkcs11.CK_UNAVAILABLE_INFORMATION || uint64(size) > maxCKULong {
+		return C.CK_UNAVAILABLE_INFORMATION
+	}
+
+	return C.CK_ULONG(size)
+}
+
 //export goGetTokenInfo
 func goGetTokenInfo(slotID C.CK_SLOT_ID, pInfo C.CK_TOKEN_INFO_PTR) C.CK_RV {
 	if pInfo == nil {
@@ -264,6 +773,10 @@ func goGetTokenInfo(slotID C.CK_SLOT_ID, pInfo C.CK_TOKEN_INFO_PTR) C.CK_RV {
 
 	goSlotID := uint(slotID)
 
+	if tokenNotPresent("C_GetTokenInfo", goSlotID) {
+		return C.CKR_TOKEN_NOT_PRESENT
+	}
+
 	tokenInfo, err := backend.GetTokenInfo(goSlotID)
 	if err != nil {
 		return fromError(err)
@@ -276,10 +789,10 @@ func goGetTokenInfo(slotID C.CK_SLOT_ID, pInfo C.CK_TOKEN_INFO_PTR) C.CK_RV {
 	pInfo.ulRwSessionCount = C.CK_ULONG(tokenInfo.RwSessionCount)
 	pInfo.ulMaxPinLen = C.CK_ULONG(tokenInfo.MaxPinLen)
 	pInfo.ulMinPinLen = C.CK_ULONG(tokenInfo.MinPinLen)
-	pInfo.ulTotalPublicMemory = C.CK_ULONG(tokenInfo.TotalPublicMemory)
-	pInfo.ulFreePublicMemory = C.CK_ULONG(tokenInfo.FreePublicMemory)
-	pInfo.ulTotalPrivateMemory = C.CK_ULONG(tokenInfo.TotalPrivateMemory)
-	pInfo.ulFreePrivateMemory = C.CK_ULONG(tokenInfo.FreePrivateMemory)
+	pInfo.ulTotalPublicMemory = tokenMemory(tokenInfo.TotalPublicMemory)
+	pInfo.ulFreePublicMemory = tokenMemory(tokenInfo.FreePublicMemory)
+	pInfo.ulTotalPrivateMemory = tokenMemory(tokenInfo.TotalPrivateMemory)
+	pInfo.ulFreePrivateMemory = tokenMemory(tokenInfo.FreePrivateMemory)
 	pInfo.hardwareVersion.major = C.CK_BYTE(tokenInfo.HardwareVersion.Major)
 	pInfo.hardwareVersion.minor = C.CK_BYTE(tokenInfo.HardwareVersion.Minor)
 	pInfo.firmwareVersion.major = C.CK_BYTE(tokenInfo.FirmwareVersion.Major)
@@ -288,15 +801,16 @@ func goGetTokenInfo(slotID C.CK_SLOT_ID, pInfo C.CK_TOKEN_INFO_PTR) C.CK_RV {
 	// CK_TOKEN_INFO strings have a max length, must be padded with the space
 	// character (except for utcTime which is padded with '0'), and must not be
 	// null-terminated, as per Sec. 3.2 of the PKCS#11 spec.
-	tokenInfo.Label = fmt.Sprintf("%-32.32s", tokenInfo.Label)
+	tokenInfo.Label = truncateUTF8(tokenLabelPrefix+tokenInfo.Label, 32)
+	tokenInfo.Label += strings.Repeat(" ", 32-len(tokenInfo.Label))
 	tokenInfo.ManufacturerID = fmt.Sprintf("%-32.32s", tokenInfo.ManufacturerID)
 	tokenInfo.Model = fmt.Sprintf("%-16.16s", tokenInfo.Model)
 	tokenInfo.SerialNumber = fmt.Sprintf("%-16.16s", tokenInfo.SerialNumber)
 	tokenInfo.UTCTime = strings.ReplaceAll(fmt.Sprintf("%-16.16s", tokenInfo.UTCTime), " ", "0")
 
-	// Copy the Label
-	for i, ch := range tokenInfo.Label {
-		pInfo.label[i] = C.CK_UTF8CHAR(ch)
+	// Copy the Label (byte by byte, since it may contain UTF-8)
+	for i := 0; i < len(tokenInfo.Label); i++ {
+		pInfo.label[i] = C.CK_UTF8CHAR(tokenInfo.Label[i])
 	}
 	// Copy the ManufacturerID
 	for i, ch := range tokenInfo.ManufacturerID {
@@ -326,6 +840,10 @@ func goGetMechanismList(slotID C.CK_SLOT_ID, pMechanismList C.CK_MECHANISM_TYPE_
 
 	goSlotID := uint(slotID)
 
+	if tokenNotPresent("C_GetMechanismList", goSlotID) {
+		return C.CKR_TOKEN_NOT_PRESENT
+	}
+
 	mechanismList, err := backend.GetMechanismList(goSlotID)
 	if err != nil {
 		return fromError(err)
@@ -346,7 +864,9 @@ func goGetMechanismList(slotID C.CK_SLOT_ID, pMechanismList C.CK_MECHANISM_TYPE_
 			return C.CKR_BUFFER_TOO_SMALL
 		}
 
-		fromMechanismList(mechanismList, C.CK_ULONG_PTR(pMechanismList), goCount)
+		if err := fromMechanismList(mechanismList, C.CK_ULONG_PTR(pMechanismList), goCount); err != nil {
+			return fromError(err)
+		}
 	}
 
 	return fromError(nil)
@@ -369,6 +889,10 @@ func goGetMechanismInfo(slotID C.CK_SLOT_ID, mechType C.CK_MECHANISM_TYPE, pInfo
 
 	mi, err := backend.GetMechanismInfo(goSlotID, m)
 	if err != nil {
+		if sunpkcs11Compat && err == pkcs11.Error(pkcs11.CKR_FUNCTION_NOT_SUPPORTED) {
+			return mechanismInfoCompat(goSlotID, goMechType, pInfo)
+		}
+
 		return fromError(err)
 	}
 
@@ -379,6 +903,37 @@ func goGetMechanismInfo(slotID C.CK_SLOT_ID, mechType C.CK_MECHANISM_TYPE, pInfo
 	return fromError(nil)
 }
 
+// mechanismInfoCompat is used in SunPKCS11 compatibility mode when the
+// backend doesn't implement GetMechanismInfo.  SunPKCS11 queries the info of
+// every mechanism in the list and gives up entirely on
+// CKR_FUNCTION_NOT_SUPPORTED, so for listed mechanisms we report empty info
+// (which SunPKCS11 treats as an unusable mechanism), and for unlisted ones we
+// return the spec-mandated CKR_MECHANISM_INVALID.
+func mechanismInfoCompat(slotID uint, mechType uint, pInfo C.CK_MECHANISM_INFO_PTR) C.CK_RV {
+	mechanisms, err := backend.GetMechanismList(slotID)
+	if err != nil {
+		return fromError(err)
+	}
+
+	for _, mechanism := range mechanisms {
+		if mechanism.Mechanism != mechType {
+			continue
+		}
+
+		if traceFunction("C_GetMechanismInfo") {
+			traceLog().Printf("pkcs11mod GetMechanismInfo: reporting empty info for mechanism %d", mechType)
+		}
+
+		pInfo.ulMinKeySize = 0
+		pInfo.ulMaxKeySize = 0
+		pInfo.flags = 0
+
+		return fromError(nil)
+	}
+
+	return C.CKR_MECHANISM_INVALID
+}
+
 //export goInitPIN
 func goInitPIN(sessionHandle C.CK_SESSION_HANDLE, pPin C.CK_UTF8CHAR_PTR, ulPinLen C.CK_ULONG) C.CK_RV {
 	if pPin == nil {
@@ -390,7 +945,7 @@ func goInitPIN(sessionHandle C.CK_SESSION_HANDLE, pPin C.CK_UTF8CHAR_PTR, ulPinL
 
 	err := backend.InitPIN(goSessionHandle, goPin)
 
-	return fromError(err)
+	return fromSessionError(goSessionHandle, err)
 }
 
 //export goSetPIN
@@ -405,14 +960,60 @@ func goSetPIN(sessionHandle C.CK_SESSION_HANDLE, pOldPin C.CK_UTF8CHAR_PTR, ulOl
 
 	err := backend.SetPIN(goSessionHandle, goOldPin, goNewPin)
 
-	return fromError(err)
+	return fromSessionError(goSessionHandle, err)
 }
 
 type sessionInfo struct {
+	slotID uint
+
+	// readWrite records whether the session was opened with
+	// CKF_RW_SESSION.
+	readWrite bool
+
+	// signNeedsContextLogin is set by C_SignInit or C_SignRecoverInit with
+	// a CKA_ALWAYS_AUTHENTICATE key (if SetEnforceAlwaysAuthenticate is
+	// on), and cleared by a CKU_CONTEXT_SPECIFIC login.
+	signNeedsContextLogin bool
+
+	// signOTPSignatureInfo is set by C_SignInit with an OTP mechanism
+	// whose signature is a CK_OTP_SIGNATURE_INFO, which the backend
+	// returns as produced by NewOTPSignatureInfo.
+	signOTPSignatureInfo bool
+
 	encryptData []byte
 	decryptData []byte
 	digestData  []byte
 	signData    []byte
+
+	signRecoverData   []byte
+	verifyRecoverData []byte
+
+	// encryptTagLen and decryptTagLen are the AEAD tag lengths (in bytes)
+	// of the active single-part encryption and decryption, or 0 for other
+	// mechanisms; see aeadTagLen.
+	encryptTagLen int
+	decryptTagLen int
+
+	// encryptGCMParams holds the parameters of the active CKM_AES_GCM
+	// encryption, which must stay allocated until the operation is done
+	// because the token may write the IV it generates into them.
+	encryptGCMParams *pkcs11.GCMParams
+
+	// decryptPartData holds a plaintext part returned by the backend
+	// during a multi-part decryption that has not yet been delivered to
+	// the caller, either because the caller only asked for its length or
+	// because the caller's buffer was too small.
+	decryptPartData []byte
+
+	attrCache *attrCacheEntry
+
+	// lastError is the Go error behind the most recent failed call on the
+	// session; see LastError.
+	lastError error
+
+	// traceLabel names the session in the trace (e.g. "sess#3").  It's
+	// only set if tracing was on when the session was opened.
+	traceLabel string
 }
 
 var (
@@ -432,6 +1033,75 @@ func getSession(sessionHandle pkcs11.SessionHandle) (*sessionInfo, error) {
 	return session, nil
 }
 
+var (
+	// traceSessionCount numbers the sessions opened while tracing, so
+	// that a session handle that the backend reuses gets a new label.
+	traceSessionCount atomic.Uint64
+
+	traceSlotLabels      = map[uint]string{}
+	traceSlotLabelsMutex sync.Mutex
+)
+
+// sessionTrace renders a session handle for the trace, as the label
+// allocated when the session was opened if it has one.
+func sessionTrace(sessionHandle pkcs11.SessionHandle) string {
+	session, err := getSession(sessionHandle)
+	if err != nil || session.traceLabel == "" {
+		return fmt.Sprintf("%d", sessionHandle)
+	}
+
+	return session.traceLabel
+}
+
+// slotTrace renders a slot ID for the trace as a label (e.g. "slot#0"),
+// allocated the first time the slot is traced.
+func slotTrace(slotID uint) string {
+	traceSlotLabelsMutex.Lock()
+	defer traceSlotLabelsMutex.Unlock()
+
+	label, ok := traceSlotLabels[slotID]
+	if !ok {
+		label = fmt.Sprintf("slot#%d", len(traceSlotLabels))
+		traceSlotLabels[slotID] = label
+	}
+
+	return label
+}
+
+// fromSessionError is like fromError, but also remembers a non-nil err as
+// the session's LastError.
+func fromSessionError(sessionHandle pkcs11.SessionHandle, err error) C.CK_RV {
+	if err == nil {
+		return fromError(nil)
+	}
+
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+
+	if session, ok := sessions[sessionHandle]; ok {
+		session.lastError = err
+	}
+
+	return fromError(err)
+}
+
+// LastError returns the full Go error from the most recent failed call on the
+// given session, before it was collapsed into a CK_RV.  It returns nil if no
+// call has failed or the session doesn't exist.  It is intended for Go
+// programs that embed the module (e.g. tests), and isn't exposed through the
+// C ABI.
+func LastError(session uint) error {
+	sessionsMutex.RLock()
+	defer sessionsMutex.RUnlock()
+
+	s, ok := sessions[pkcs11.SessionHandle(session)]
+	if !ok {
+		return nil
+	}
+
+	return s.lastError
+}
+
 //export goOpenSession
 func goOpenSession(slotID C.CK_SLOT_ID, flags C.CK_FLAGS, phSession C.CK_SESSION_HANDLE_PTR) C.CK_RV {
 	if phSession == nil {
@@ -441,15 +1111,38 @@ func goOpenSession(slotID C.CK_SLOT_ID, flags C.CK_FLAGS, phSession C.CK_SESSION
 	goSlotID := uint(slotID)
 	goFlags := uint(flags)
 
+	// Parallel sessions were removed from the spec long ago, and
+	// CKF_SERIAL_SESSION must always be set for backward compatibility.
+	if goFlags&pkcs11.CKF_SERIAL_SESSION == 0 {
+		return C.CKR_SESSION_PARALLEL_NOT_SUPPORTED
+	}
+
+	if tokenNotPresent("C_OpenSession", goSlotID) {
+		return C.CKR_TOKEN_NOT_PRESENT
+	}
+
 	sessionHandle, err := backend.OpenSession(goSlotID, goFlags)
 	if err != nil {
 		return fromError(err)
 	}
 
+	session := &sessionInfo{
+		slotID:    goSlotID,
+		readWrite: goFlags&pkcs11.CKF_RW_SESSION != 0,
+	}
+
+	if trace || traceTiming {
+		session.traceLabel = fmt.Sprintf("sess#%d", traceSessionCount.Add(1))
+	}
+
 	sessionsMutex.Lock()
-	sessions[sessionHandle] = &sessionInfo{}
+	sessions[sessionHandle] = session
 	sessionsMutex.Unlock()
 
+	if traceFunction("C_OpenSession") {
+		traceLog().Printf("pkcs11mod OpenSession: %s on %s is handle %d", session.traceLabel, slotTrace(goSlotID), sessionHandle)
+	}
+
 	*phSession = C.CK_SESSION_HANDLE(sessionHandle)
 
 	return fromError(nil)
@@ -459,7 +1152,24 @@ func goOpenSession(slotID C.CK_SLOT_ID, flags C.CK_FLAGS, phSession C.CK_SESSION
 func goCloseSession(sessionHandle C.CK_SESSION_HANDLE) C.CK_RV {
 	goSessionHandle := pkcs11.SessionHandle(sessionHandle)
 
+	// Unknown handles (including sessions that were already closed) are
+	// rejected without bothering the backend.
+	if _, err := getSession(goSessionHandle); err != nil {
+		return fromError(err)
+	}
+
 	err := backend.CloseSession(goSessionHandle)
+	if err != nil && fromError(err) != C.CKR_SESSION_HANDLE_INVALID {
+		return fromSessionError(goSessionHandle, err)
+	}
+
+	// Drop all per-session state along with the session.
+	sessionsMutex.Lock()
+	if session, ok := sessions[goSessionHandle]; ok {
+		session.encryptGCMParams.Free()
+	}
+	delete(sessions, goSessionHandle)
+	sessionsMutex.Unlock()
 
 	return fromError(err)
 }
@@ -469,48 +1179,93 @@ func goCloseAllSessions(slotID C.CK_SLOT_ID) C.CK_RV {
 	goSlotID := uint(slotID)
 
 	err := backend.CloseAllSessions(goSlotID)
+	if err != nil {
+		return fromError(err)
+	}
 
-	return fromError(err)
+	sessionsMutex.Lock()
+	for sessionHandle, session := range sessions {
+		if session.slotID == goSlotID {
+			session.encryptGCMParams.Free()
+			delete(sessions, sessionHandle)
+		}
+	}
+	sessionsMutex.Unlock()
+
+	return fromError(nil)
 }
 
+// operationStateHeader is prepended to the backend's opaque state by
+// C_GetOperationState, and checked and stripped again by
+// C_SetOperationState, so that a blob that didn't come from this version of
+// pkcs11mod is rejected with CKR_SAVED_STATE_INVALID before the backend tries
+// to parse it.  The last byte is the format version.
+const operationStateHeader = "pkcs11mod\x00\x01"
+
 //export goGetOperationState
 func goGetOperationState(sessionHandle C.CK_SESSION_HANDLE, pOperationState C.CK_BYTE_PTR, pulOperationStateLen C.CK_ULONG_PTR) C.CK_RV {
-	if pOperationState == nil || pulOperationStateLen == nil {
+	if pulOperationStateLen == nil {
 		return C.CKR_ARGUMENTS_BAD
 	}
 
+	if operationStateManager == nil {
+		return C.CKR_FUNCTION_NOT_SUPPORTED
+	}
+
 	goSessionHandle := pkcs11.SessionHandle(sessionHandle)
-	goOperationState := (*[1 << 30]byte)(unsafe.Pointer(pOperationState))[:*pulOperationStateLen:*pulOperationStateLen]
 
-	result, err := backend.GetOperationState(goSessionHandle)
+	result, err := operationStateManager.GetOperationState(goSessionHandle)
 	if err != nil {
-		return fromError(err)
+		return fromSessionError(goSessionHandle, err)
 	}
 
-	if int(*pulOperationStateLen) < len(result) {
+	size := len(operationStateHeader) + len(result)
+
+	// Saving the state doesn't change it, so a length query can simply
+	// ask the backend again on the next call.
+	if pOperationState == nil {
+		*pulOperationStateLen = C.CK_ULONG(size)
+
+		return fromError(nil)
+	}
+
+	if int(*pulOperationStateLen) < size {
+		*pulOperationStateLen = C.CK_ULONG(size)
+
 		return C.CKR_BUFFER_TOO_SMALL
 	}
 
-	copy(goOperationState, result)
-	*pulOperationStateLen = C.CK_ULONG(len(result))
+	goOperationState := (*[1 << 30]byte)(unsafe.Pointer(pOperationState))[:size:size]
+	copy(goOperationState[copy(goOperationState, operationStateHeader):], result)
+	*pulOperationStateLen = C.CK_ULONG(size)
 
 	return fromError(nil)
 }
 
 //export goSetOperationState
 func goSetOperationState(sessionHandle C.CK_SESSION_HANDLE, pOperationState C.CK_BYTE_PTR, ulOperationStateLen C.CK_LONG, hEncryptionKey, hAuthenticationKey C.CK_OBJECT_HANDLE) C.CK_RV {
-	if pOperationState == nil {
+	if pOperationState == nil || ulOperationStateLen < 0 {
 		return C.CKR_ARGUMENTS_BAD
 	}
 
+	if operationStateManager == nil {
+		return C.CKR_FUNCTION_NOT_SUPPORTED
+	}
+
 	goSessionHandle := pkcs11.SessionHandle(sessionHandle)
 	goEncryptionKey := pkcs11.ObjectHandle(hEncryptionKey)
 	goAuthenticationKey := pkcs11.ObjectHandle(hAuthenticationKey)
 	goOperationState := C.GoBytes(unsafe.Pointer(pOperationState), C.int(ulOperationStateLen))
 
-	err := backend.SetOperationState(goSessionHandle, goOperationState, goEncryptionKey, goAuthenticationKey)
+	if !strings.HasPrefix(string(goOperationState), operationStateHeader) {
+		return C.CKR_SAVED_STATE_INVALID
+	}
 
-	return fromError(err)
+	goOperationState = goOperationState[len(operationStateHeader):]
+
+	err := operationStateManager.SetOperationState(goSessionHandle, goOperationState, goEncryptionKey, goAuthenticationKey)
+
+	return fromSessionError(goSessionHandle, err)
 }
 
 //export goGetSessionInfo
@@ -523,7 +1278,7 @@ func goGetSessionInfo(sessionHandle C.CK_SESSION_HANDLE, pInfo C.CK_SESSION_INFO
 
 	info, err := backend.GetSessionInfo(goSessionHandle)
 	if err != nil {
-		return fromError(err)
+		return fromSessionError(goSessionHandle, err)
 	}
 
 	pInfo.slotID = C.CK_SLOT_ID(info.SlotID)
@@ -544,9 +1299,28 @@ func goLogin(sessionHandle C.CK_SESSION_HANDLE, userType C.CK_USER_TYPE, pPin C.
 	goUserType := uint(userType)
 	goPin := string(C.GoBytes(unsafe.Pointer(pPin), C.int(ulPinLen)))
 
+	// The PIN itself is never traced, not even with PKCS11MOD_TRACE_SENSITIVE.
+	if traceFunction("C_Login") {
+		traceLog().Printf("pkcs11mod Login: %s user type %s, %d-byte PIN", sessionTrace(goSessionHandle), traceValueName(goUserType, strCKU), len(goPin))
+	}
+
+	// Logging in doesn't end any active operation, whether it's a normal
+	// CKU_USER/CKU_SO login or a CKU_CONTEXT_SPECIFIC re-authentication.
+	// The per-session output buffers used for the two-call length idiom are
+	// therefore deliberately left alone, so that e.g. a digest started
+	// before C_Login can still be finalized after it.
 	err := backend.Login(goSessionHandle, goUserType, goPin)
 
-	return fromError(err)
+	if err == nil && goUserType == pkcs11.CKU_CONTEXT_SPECIFIC {
+		if session, serr := getSession(goSessionHandle); serr == nil {
+			session.signNeedsContextLogin = false
+		}
+	}
+
+	// The login state affects which attributes are readable, though.
+	invalidateAttrCaches()
+
+	return fromSessionError(goSessionHandle, err)
 }
 
 //export goLogout
@@ -555,7 +1329,9 @@ func goLogout(sessionHandle C.CK_SESSION_HANDLE) C.CK_RV {
 
 	err := backend.Logout(goSessionHandle)
 
-	return fromError(err)
+	invalidateAttrCaches()
+
+	return fromSessionError(goSessionHandle, err)
 }
 
 //export goCreateObject
@@ -565,11 +1341,19 @@ func goCreateObject(sessionHandle C.CK_SESSION_HANDLE, pTemplate C.CK_ATTRIBUTE_
 	}
 
 	goSessionHandle := pkcs11.SessionHandle(sessionHandle)
-	goTemplate := toTemplate(pTemplate, ulCount)
+	goTemplate := applyDefaultTemplate(toTemplate(pTemplate, ulCount))
+
+	if enforceUniqueID {
+		if class, ok := templateClass(goTemplate); ok {
+			if err := checkUniqueID("C_CreateObject", goSessionHandle, class, goTemplate); err != nil {
+				return fromSessionError(goSessionHandle, err)
+			}
+		}
+	}
 
 	goHandle, err := backend.CreateObject(goSessionHandle, goTemplate)
 	if err != nil {
-		return fromError(err)
+		return fromSessionError(goSessionHandle, err)
 	}
 
 	*phObject = C.CK_OBJECT_HANDLE(goHandle)
@@ -577,6 +1361,96 @@ func goCreateObject(sessionHandle C.CK_SESSION_HANDLE, pTemplate C.CK_ATTRIBUTE_
 	return fromError(nil)
 }
 
+// checkUniqueID returns CKR_ATTRIBUTE_VALUE_INVALID if the template has a
+// CKA_ID that the backend already has an object of the given class with; see
+// SetEnforceUniqueID.  function is the calling PKCS#11 function, for tracing.
+func checkUniqueID(function string, sessionHandle pkcs11.SessionHandle, class uint, template []*pkcs11.Attribute) error {
+	var id []byte
+
+	for _, a := range template {
+		if a.Type == pkcs11.CKA_ID {
+			id = a.Value
+		}
+	}
+
+	if id == nil {
+		return nil
+	}
+
+	search := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}
+
+	if err := backend.FindObjectsInit(sessionHandle, search); err != nil {
+		// Most likely the application has a search of its own active
+		// (CKR_OPERATION_ACTIVE), which mustn't be disturbed.  The object
+		// isn't created unchecked, though.
+		if traceFunction(function) {
+			traceLog().Printf("pkcs11mod %s: can't check that CKA_ID is unique: %v", function, err)
+		}
+
+		return fmt.Errorf("can't check that CKA_ID is unique: %w", err)
+	}
+
+	objects, _, err := backend.FindObjects(sessionHandle, 1)
+	if finalErr := backend.FindObjectsFinal(sessionHandle); err == nil {
+		err = finalErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(objects) != 0 {
+		return fmt.Errorf("%s with this CKA_ID already exists (object %d): %w",
+			traceValueName(class, strCKO), objects[0], pkcs11.Error(pkcs11.CKR_ATTRIBUTE_VALUE_INVALID))
+	}
+
+	return nil
+}
+
+// applyDefaultTemplate appends the backend's default attributes for the
+// template's object class to template, skipping any that the template
+// already has.  Templates without a valid CKA_CLASS are left alone, so that
+// the backend reports the error.
+func applyDefaultTemplate(template []*pkcs11.Attribute) []*pkcs11.Attribute {
+	if defaultTemplater == nil {
+		return template
+	}
+
+	class, ok := templateClass(template)
+	if !ok {
+		return template
+	}
+
+	present := make(map[uint]bool, len(template))
+	for _, a := range template {
+		present[a.Type] = true
+	}
+
+	var defaults []*pkcs11.Attribute
+
+	for _, a := range defaultTemplater.DefaultTemplate(class) {
+		if a == nil || present[a.Type] {
+			continue
+		}
+
+		if traceFunction("C_CreateObject") && !traceJSON {
+			traceLog().Printf("pkcs11mod CreateObject: default %s", AttrTrace(a))
+		}
+
+		defaults = append(defaults, a)
+		present[a.Type] = true
+	}
+
+	if traceFunction("C_CreateObject") && traceJSON && len(defaults) > 0 {
+		logTraceJSON(traceRecord{Func: "C_CreateObject", Defaults: traceAttributes(defaults)})
+	}
+
+	return append(template, defaults...)
+}
+
 //export goCopyObject
 func goCopyObject(sessionHandle C.CK_SESSION_HANDLE, hObject C.CK_OBJECT_HANDLE, pTemplate C.CK_ATTRIBUTE_PTR, ulCount C.CK_ULONG, phNewObject C.CK_OBJECT_HANDLE_PTR) C.CK_RV {
 	if pTemplate == nil && ulCount > 0 || phNewObject == nil {
@@ -589,7 +1463,7 @@ func goCopyObject(sessionHandle C.CK_SESSION_HANDLE, hObject C.CK_OBJECT_HANDLE,
 
 	goHandle, err := backend.CopyObject(goSessionHandle, goObjectHandle, goTemplate)
 	if err != nil {
-		return fromError(err)
+		return fromSessionError(goSessionHandle, err)
 	}
 
 	*phNewObject = C.CK_OBJECT_HANDLE(goHandle)
@@ -604,7 +1478,9 @@ func goDestroyObject(sessionHandle C.CK_SESSION_HANDLE, hObject C.CK_OBJECT_HAND
 
 	err := backend.DestroyObject(goSessionHandle, goObjectHandle)
 
-	return fromError(err)
+	invalidateAttrCaches()
+
+	return fromSessionError(goSessionHandle, err)
 }
 
 //export goGetObjectSize
@@ -618,7 +1494,7 @@ func goGetObjectSize(sessionHandle C.CK_SESSION_HANDLE, objectHandle C.CK_OBJECT
 
 	goSize, err := backend.GetObjectSize(goSessionHandle, goObjectHandle)
 	if err != nil {
-		return fromError(err)
+		return fromSessionError(goSessionHandle, err)
 	}
 
 	*pulSize = C.CK_ULONG(goSize)
@@ -626,11 +1502,133 @@ func goGetObjectSize(sessionHandle C.CK_SESSION_HANDLE, objectHandle C.CK_OBJECT
 	return fromError(nil)
 }
 
+// getAttributeValuePartial asks the backend for template.  If the backend
+// reports CKR_ATTRIBUTE_SENSITIVE or CKR_ATTRIBUTE_TYPE_INVALID, it retries
+// the attributes one-by-one to retrieve partial results, and returns them
+// along with that error.  On any other error, the results are nil.
+func getAttributeValuePartial(sessionHandle pkcs11.SessionHandle, objectHandle pkcs11.ObjectHandle, template []*pkcs11.Attribute) ([]*pkcs11.Attribute, error) {
+	results, errFinal := backend.GetAttributeValue(sessionHandle, objectHandle, template)
+	if fromError(errFinal) != pkcs11.CKR_ATTRIBUTE_SENSITIVE && fromError(errFinal) != pkcs11.CKR_ATTRIBUTE_TYPE_INVALID {
+		if errFinal != nil {
+			return nil, errFinal
+		}
+
+		return results, nil
+	}
+
+	// If we get these error codes in a one-shot, we need to try the
+	// attributes one-by-one to retrieve partial results.
+	results = make([]*pkcs11.Attribute, len(template))
+
+	sensitive := false
+	typeInvalid := false
+
+	for i, t := range template {
+		templateSingle := []*pkcs11.Attribute{t}
+
+		resultsSingle, err := backend.GetAttributeValue(sessionHandle, objectHandle, templateSingle)
+
+		switch {
+		case fromError(err) == pkcs11.CKR_ATTRIBUTE_SENSITIVE || fromError(err) == pkcs11.CKR_ATTRIBUTE_TYPE_INVALID:
+			sensitive = sensitive || fromError(err) == pkcs11.CKR_ATTRIBUTE_SENSITIVE
+			typeInvalid = typeInvalid || fromError(err) == pkcs11.CKR_ATTRIBUTE_TYPE_INVALID
+			results[i] = &pkcs11.Attribute{
+				Type:  t.Type,
+				Value: nil,
+			}
+		case err != nil:
+			return nil, err
+		default:
+			results[i] = resultsSingle[0]
+		}
+	}
+
+	return results, attributeValueError(false, sensitive, typeInvalid)
+}
+
+// attributeValueError returns the C_GetAttributeValue result for a template
+// in which some attributes could not be returned.  Every attribute is still
+// processed, so several conditions can apply at once; the precedence is
+// CKR_BUFFER_TOO_SMALL, then CKR_ATTRIBUTE_SENSITIVE, then
+// CKR_ATTRIBUTE_TYPE_INVALID.  If none apply, the result is CKR_OK.
+func attributeValueError(bufferTooSmall, sensitive, typeInvalid bool) error {
+	switch {
+	case bufferTooSmall:
+		return pkcs11.Error(pkcs11.CKR_BUFFER_TOO_SMALL)
+	case sensitive:
+		return pkcs11.Error(pkcs11.CKR_ATTRIBUTE_SENSITIVE)
+	case typeInvalid:
+		return pkcs11.Error(pkcs11.CKR_ATTRIBUTE_TYPE_INVALID)
+	default:
+		return nil
+	}
+}
+
+// alignAttributeResults returns results reordered so that each element
+// corresponds to the template entry at the same position.  Templates may
+// legitimately contain the same type more than once; if the backend answered
+// positionally, its results are used as-is, otherwise each template entry is
+// matched to a result of the same type (reusing a result for duplicate
+// types if needed).  Entries with no matching result are marked unavailable,
+// and reported in unmatched.
+func alignAttributeResults(template []*pkcs11.Attribute, results []*pkcs11.Attribute) (aligned []*pkcs11.Attribute, unmatched []bool) {
+	unmatched = make([]bool, len(template))
+	positional := len(results) == len(template)
+
+	for i := 0; positional && i < len(results); i++ {
+		positional = results[i] != nil && results[i].Type == template[i].Type
+	}
+
+	if positional {
+		// Copied, so that the caller can replace elements without
+		// touching the backend's slice.
+		return append([]*pkcs11.Attribute(nil), results...), unmatched
+	}
+
+	aligned = make([]*pkcs11.Attribute, len(template))
+	used := make([]bool, len(results))
+
+	for i, t := range template {
+		match := -1
+
+		for j, r := range results {
+			if r == nil || r.Type != t.Type {
+				continue
+			}
+
+			if !used[j] {
+				match = j
+
+				break
+			}
+
+			if match == -1 {
+				match = j
+			}
+		}
+
+		if match == -1 {
+			aligned[i] = &pkcs11.Attribute{
+				Type:  t.Type,
+				Value: nil,
+			}
+			unmatched[i] = true
+
+			continue
+		}
+
+		used[match] = true
+		aligned[i] = results[match]
+	}
+
+	return aligned, unmatched
+}
+
 //export goGetAttributeValue
 func goGetAttributeValue(sessionHandle C.CK_SESSION_HANDLE, objectHandle C.CK_OBJECT_HANDLE, pTemplate C.CK_ATTRIBUTE_PTR, ulCount C.CK_ULONG) C.CK_RV {
 	if pTemplate == nil && ulCount > 0 {
-		if trace {
-			log.Println("pkcs11mod GetAttributeValue: CKR_ARGUMENTS_BAD")
+		if traceFunction("C_GetAttributeValue") {
+			traceLog().Println("pkcs11mod GetAttributeValue: CKR_ARGUMENTS_BAD")
 		}
 
 		return C.CKR_ARGUMENTS_BAD
@@ -640,51 +1638,83 @@ func goGetAttributeValue(sessionHandle C.CK_SESSION_HANDLE, objectHandle C.CK_OB
 	goObjectHandle := pkcs11.ObjectHandle(objectHandle)
 	goTemplate := toTemplate(pTemplate, ulCount)
 
-	goResults, errFinal := backend.GetAttributeValue(goSessionHandle, goObjectHandle, goTemplate)
-	if fromError(errFinal) == pkcs11.CKR_ATTRIBUTE_SENSITIVE || fromError(errFinal) == pkcs11.CKR_ATTRIBUTE_TYPE_INVALID {
-		// If we get these error codes in a one-shot, we need to try the
-		// attributes one-by-one to retrieve partial results.
-		goResults = make([]*pkcs11.Attribute, len(goTemplate))
+	var (
+		goResults []*pkcs11.Attribute
+		errFinal  error
+	)
 
-		for i, t := range goTemplate {
-			goTemplateSingle := []*pkcs11.Attribute{t}
+	var cached *attrCacheEntry
+	if cacheAttributes {
+		cached = takeCachedAttributes(goSessionHandle, goObjectHandle, goTemplate)
+	}
 
-			goResultsSingle, err := backend.GetAttributeValue(goSessionHandle, goObjectHandle, goTemplateSingle)
+	if cached != nil {
+		if traceFunction("C_GetAttributeValue") {
+			traceLog().Println("pkcs11mod GetAttributeValue: using cached results")
+		}
 
-			switch {
-			case fromError(err) == pkcs11.CKR_ATTRIBUTE_SENSITIVE || fromError(err) == pkcs11.CKR_ATTRIBUTE_TYPE_INVALID:
-				goResults[i] = &pkcs11.Attribute{
-					Type:  t.Type,
-					Value: nil,
-				}
-			case err != nil:
-				if trace {
-					log.Printf("pkcs11mod GetAttributeValue: %v", err)
-				}
+		goResults, errFinal = cached.results, cached.err
+	} else {
+		goResults, errFinal = getAttributeValuePartial(goSessionHandle, goObjectHandle, goTemplate)
+		if goResults == nil && errFinal != nil {
+			if traceFunction("C_GetAttributeValue") {
+				traceLog().Printf("pkcs11mod GetAttributeValue: %v", errFinal)
+			}
 
-				return fromError(err)
-			default:
-				goResults[i] = goResultsSingle[0]
+			return fromSessionError(goSessionHandle, errFinal)
+		}
+
+		var unmatched []bool
+
+		goResults, unmatched = alignAttributeResults(goTemplate, goResults)
+
+		// An attribute the backend silently left out is reported the
+		// same way as one it rejected as invalid.  One that it returned
+		// with a nil value is merely empty, unless the backend failed
+		// it in getAttributeValuePartial.
+		if errFinal == nil {
+			for i, a := range goResults {
+				switch {
+				case unmatched[i]:
+					errFinal = attributeValueError(false, false, true)
+				case a.Value == nil:
+					goResults[i] = &pkcs11.Attribute{Type: a.Type, Value: []byte{}}
+				}
 			}
 		}
-	} else if errFinal != nil {
-		if trace {
-			log.Printf("pkcs11mod GetAttributeValue: %v", errFinal)
+
+		if cacheAttributes && templateIsLengthQuery(pTemplate, ulCount) {
+			storeCachedAttributes(goSessionHandle, goObjectHandle, goTemplate, goResults, errFinal)
 		}
+	}
 
-		return fromError(errFinal)
+	if traceFunction("C_GetAttributeValue") {
+		for _, a := range goResults {
+			if a.Type == CKA_UNIQUE_ID && a.Value == nil {
+				traceLog().Println("pkcs11mod GetAttributeValue: warning: backend didn't supply CKA_UNIQUE_ID, which PKCS#11 v3.0 requires for every object")
+			}
+		}
 	}
 
 	errFromTemplate := fromTemplate(goResults, pTemplate)
-	if errFromTemplate != nil {
+
+	if fromError(errFromTemplate) == pkcs11.CKR_ATTRIBUTE_VALUE_INVALID {
+		// The backend returned a value too large to describe to the
+		// caller, which trumps the per-attribute conditions.
 		errFinal = errFromTemplate
+	} else {
+		errFinal = attributeValueError(
+			fromError(errFromTemplate) == pkcs11.CKR_BUFFER_TOO_SMALL,
+			fromError(errFinal) == pkcs11.CKR_ATTRIBUTE_SENSITIVE,
+			fromError(errFinal) == pkcs11.CKR_ATTRIBUTE_TYPE_INVALID,
+		)
 	}
 
-	if trace {
-		log.Printf("pkcs11mod GetAttributeValue: %v", errFinal)
+	if traceFunction("C_GetAttributeValue") {
+		traceLog().Printf("pkcs11mod GetAttributeValue: %v", errFinal)
 	}
 
-	return fromError(errFinal)
+	return fromSessionError(goSessionHandle, errFinal)
 }
 
 //export goSetAttributeValue
@@ -697,20 +1727,35 @@ func goSetAttributeValue(sessionHandle C.CK_SESSION_HANDLE, hObject C.CK_OBJECT_
 	goObjectHandle := pkcs11.ObjectHandle(hObject)
 	goTemplate := toTemplate(pTemplate, ulCount)
 
+	if traceFunction("C_SetAttributeValue") && traceJSON {
+		logTraceJSON(traceRecord{
+			Func:     "C_SetAttributeValue",
+			Session:  sessionTrace(goSessionHandle),
+			Object:   uint(goObjectHandle),
+			Template: traceAttributes(goTemplate),
+		})
+	} else if traceFunction("C_SetAttributeValue") {
+		for _, attr := range goTemplate {
+			traceLog().Printf("pkcs11mod SetAttributeValue: object %d template %s", goObjectHandle, AttrTrace(attr))
+		}
+	}
+
 	err := backend.SetAttributeValue(goSessionHandle, goObjectHandle, goTemplate)
 
-	return fromError(err)
+	invalidateAttrCaches()
+
+	return fromSessionError(goSessionHandle, err)
 }
 
 //export goFindObjectsInit
 func goFindObjectsInit(sessionHandle C.CK_SESSION_HANDLE, pTemplate C.CK_ATTRIBUTE_PTR, ulCount C.CK_ULONG) C.CK_RV {
-	if trace {
-		log.Println("pkcs11mod FindObjectsInit")
+	if traceFunction("C_FindObjectsInit") {
+		traceLog().Println("pkcs11mod FindObjectsInit")
 	}
 
 	if pTemplate == nil && ulCount > 0 {
-		if trace {
-			log.Println("pkcs11mod FindObjectsInit: CKR_ARGUMENTS_BAD")
+		if traceFunction("C_FindObjectsInit") {
+			traceLog().Println("pkcs11mod FindObjectsInit: CKR_ARGUMENTS_BAD")
 		}
 
 		return C.CKR_ARGUMENTS_BAD
@@ -719,25 +1764,43 @@ func goFindObjectsInit(sessionHandle C.CK_SESSION_HANDLE, pTemplate C.CK_ATTRIBU
 	goSessionHandle := pkcs11.SessionHandle(sessionHandle)
 	goTemplate := toTemplate(pTemplate, ulCount)
 
-	if trace {
+	if traceFunction("C_FindObjectsInit") && traceJSON {
+		logTraceJSON(traceRecord{
+			Func:     "C_FindObjectsInit",
+			Session:  sessionTrace(goSessionHandle),
+			Template: traceAttributes(goTemplate),
+		})
+	} else if traceFunction("C_FindObjectsInit") {
 		for _, attr := range goTemplate {
-			log.Printf("pkcs11mod FindObjectsInit: template %s", AttrTrace(attr))
+			traceLog().Printf("pkcs11mod FindObjectsInit: template %s", AttrTrace(attr))
 		}
 	}
 
 	err := backend.FindObjectsInit(goSessionHandle, goTemplate)
 
-	return fromError(err)
+	return fromSessionError(goSessionHandle, err)
 }
 
+// maxFindObjectsCount is the most object handles that a single C_FindObjects
+// call will ask the backend for.
+const maxFindObjectsCount = 65536
+
 //export goFindObjects
 func goFindObjects(sessionHandle C.CK_SESSION_HANDLE, phObject C.CK_OBJECT_HANDLE_PTR, ulMaxObjectCount C.CK_ULONG, pulObjectCount C.CK_ULONG_PTR) C.CK_RV {
 	goSessionHandle := pkcs11.SessionHandle(sessionHandle)
-	goMax := int(ulMaxObjectCount)
+
+	// Backends (e.g. *pkcs11.Ctx) may allocate based on the requested max,
+	// so don't let a garbage ulMaxObjectCount cause a huge allocation (or
+	// overflow int).  Returning fewer handles than requested is fine, since
+	// callers repeat C_FindObjects until it returns no more.
+	goMax := maxFindObjectsCount
+	if ulMaxObjectCount < C.CK_ULONG(maxFindObjectsCount) {
+		goMax = int(ulMaxObjectCount)
+	}
 
 	if (phObject == nil && goMax > 0) || pulObjectCount == nil {
-		if trace {
-			log.Println("pkcs11mod FindObjects: CKR_ARGUMENTS_BAD")
+		if traceFunction("C_FindObjects") {
+			traceLog().Println("pkcs11mod FindObjects: CKR_ARGUMENTS_BAD")
 		}
 
 		return C.CKR_ARGUMENTS_BAD
@@ -745,20 +1808,32 @@ func goFindObjects(sessionHandle C.CK_SESSION_HANDLE, phObject C.CK_OBJECT_HANDL
 
 	objectHandles, _, err := backend.FindObjects(goSessionHandle, goMax)
 	if err != nil {
-		if trace {
-			log.Printf("pkcs11mod FindObjects: %v", err)
+		if traceFunction("C_FindObjects") {
+			traceLog().Printf("pkcs11mod FindObjects: %v", err)
 		}
 
-		return fromError(err)
+		return fromSessionError(goSessionHandle, err)
 	}
 
-	if trace {
-		log.Printf("pkcs11mod FindObjects: %d objects returned", len(objectHandles))
+	if traceFunction("C_FindObjects") {
+		traceLog().Printf("pkcs11mod FindObjects: %d objects returned", len(objectHandles))
+	}
+
+	// Never write past the end of the caller's buffer, even if the backend
+	// returned more handles than requested.
+	if len(objectHandles) > goMax {
+		objectHandles = objectHandles[:goMax]
 	}
 
 	goCount := uint(len(objectHandles))
+
+	if err := fromObjectHandleList(objectHandles, C.CK_ULONG_PTR(phObject), goCount); err != nil {
+		*pulObjectCount = 0
+
+		return fromSessionError(goSessionHandle, err)
+	}
+
 	*pulObjectCount = C.CK_ULONG(goCount)
-	fromObjectHandleList(objectHandles, C.CK_ULONG_PTR(phObject), goCount)
 
 	return fromError(nil)
 }
@@ -769,7 +1844,7 @@ func goFindObjectsFinal(sessionHandle C.CK_SESSION_HANDLE) C.CK_RV {
 
 	err := backend.FindObjectsFinal(goSessionHandle)
 
-	return fromError(err)
+	return fromSessionError(goSessionHandle, err)
 }
 
 //export goEncryptInit
@@ -780,11 +1855,57 @@ func goEncryptInit(sessionHandle C.CK_SESSION_HANDLE, pMechanism C.CK_MECHANISM_
 
 	goSessionHandle := pkcs11.SessionHandle(sessionHandle)
 	goObjectHandle := pkcs11.ObjectHandle(hKey)
-	goMechanism := toMechanism(pMechanism)
 
-	err := backend.EncryptInit(goSessionHandle, []*pkcs11.Mechanism{goMechanism}, goObjectHandle)
+	var (
+		goMechanism *pkcs11.Mechanism
+		goGCMParams *pkcs11.GCMParams
+		err         error
+	)
 
-	return fromError(err)
+	if pMechanism.mechanism == C.CKM_AES_GCM {
+		goMechanism, goGCMParams, err = toGCMMechanism(pMechanism)
+	} else {
+		goMechanism, err = toMechanism(pMechanism)
+	}
+
+	if err != nil {
+		return fromSessionError(goSessionHandle, err)
+	}
+
+	goMechanism, err = rewriteMechanism("C_EncryptInit", goMechanism)
+	if err != nil {
+		return fromSessionError(goSessionHandle, err)
+	}
+
+	session, err := getSession(goSessionHandle)
+	if err != nil {
+		return fromSessionError(goSessionHandle, err)
+	}
+
+	err = backend.EncryptInit(goSessionHandle, []*pkcs11.Mechanism{goMechanism}, goObjectHandle)
+	if err != nil {
+		goGCMParams.Free()
+
+		return fromSessionError(goSessionHandle, err)
+	}
+
+	session.encryptTagLen = aeadTagLen(goMechanism, pMechanism)
+	session.encryptData = nil
+
+	session.encryptGCMParams.Free()
+	session.encryptGCMParams = goGCMParams
+
+	if goGCMParams != nil {
+		if err := fromGCMParams(goGCMParams, pMechanism); err != nil {
+			return fromSessionError(goSessionHandle, err)
+		}
+	}
+
+	if err := fromMechanism(goMechanism, pMechanism); err != nil {
+		return fromSessionError(goSessionHandle, err)
+	}
+
+	return fromError(nil)
 }
 
 //export goEncrypt
@@ -803,13 +1924,17 @@ func goEncrypt(sessionHandle C.CK_SESSION_HANDLE, pData C.CK_BYTE_PTR, ulDataLen
 
 	session, err := getSession(goSessionHandle)
 	if err != nil {
-		return fromError(err)
+		return fromSessionError(goSessionHandle, err)
 	}
 
 	if pEncryptedData == nil {
 		encryptedData, err = backend.Encrypt(goSessionHandle, goData)
 		if err != nil {
-			return fromError(err)
+			return fromSessionError(goSessionHandle, err)
+		}
+
+		if err := checkAEADLayout("C_Encrypt", len(goData), len(encryptedData), session.encryptTagLen); err != nil {
+			return fromSessionError(goSessionHandle, err)
 		}
 
 		session.encryptData = encryptedData
@@ -828,7 +1953,11 @@ func goEncrypt(sessionHandle C.CK_SESSION_HANDLE, pData C.CK_BYTE_PTR, ulDataLen
 	} else {
 		encryptedData, err = backend.Encrypt(goSessionHandle, goData)
 		if err != nil {
-			return fromError(err)
+			return fromSessionError(goSessionHandle, err)
+		}
+
+		if err := checkAEADLayout("C_Encrypt", len(goData), len(encryptedData), session.encryptTagLen); err != nil {
+			return fromSessionError(goSessionHandle, err)
 		}
 	}
 
@@ -842,6 +1971,42 @@ func goEncrypt(sessionHandle C.CK_SESSION_HANDLE, pData C.CK_BYTE_PTR, ulDataLen
 	return fromError(nil)
 }
 
+// traceAEADDecryptError traces why a single-part AEAD decryption (see
+// aeadTagLen) failed in the backend.  Backends must report a tag that doesn't
+// verify as pkcs11.Error(CKR_ENCRYPTED_DATA_INVALID) (or
+// CKR_AEAD_DECRYPT_FAILED for PKCS#11 v3.0 applications); any other Go error
+// reaches the application as CKR_FUNCTION_FAILED, which it can't tell apart
+// from a broken token.
+func traceAEADDecryptError(tagLen int, err error) {
+	if tagLen == 0 || !traceFunction("C_Decrypt") {
+		return
+	}
+
+	var pe pkcs11.Error
+	if errors.As(err, &pe) {
+		traceLog().Printf("pkcs11mod Decrypt: backend AEAD decryption failed: %s\n", RVTrace(uint(pe)))
+	} else {
+		traceLog().Printf("pkcs11mod Decrypt: backend AEAD decryption failed with a non-PKCS#11 error, returning CKR_FUNCTION_FAILED: %v\n", err)
+	}
+}
+
+// checkAEADLayout verifies that a single-part AEAD operation in the backend
+// used the layout PKCS#11 requires, where the ciphertext is the encrypted
+// data followed by the tag.  A backend that keeps the tag separate would
+// otherwise silently produce ciphertexts that no other token can decrypt.
+// tagLen is 0 for mechanisms that aeadTagLen doesn't know.
+func checkAEADLayout(function string, dataLen, ciphertextLen, tagLen int) error {
+	if tagLen == 0 || gcmAllowDetachedTag || ciphertextLen == dataLen+tagLen {
+		return nil
+	}
+
+	if traceFunction(function) {
+		traceLog().Printf("pkcs11mod %s: backend AEAD ciphertext is %d bytes for %d bytes of data, expected the %d-byte tag appended", function, ciphertextLen, dataLen, tagLen)
+	}
+
+	return pkcs11.Error(pkcs11.CKR_GENERAL_ERROR)
+}
+
 //export goEncryptUpdate
 func goEncryptUpdate(sessionHandle C.CK_SESSION_HANDLE, pPart C.CK_BYTE_PTR, ulPartLen C.CK_ULONG, pEncryptedPart C.CK_BYTE_PTR, pulEncryptedPartLen C.CK_ULONG_PTR) C.CK_RV {
 	if pPart == nil || pEncryptedPart == nil || pulEncryptedPartLen == nil {
@@ -854,7 +2019,7 @@ func goEncryptUpdate(sessionHandle C.CK_SESSION_HANDLE, pPart C.CK_BYTE_PTR, ulP
 
 	encryptedPart, err := backend.Encrypt(goSessionHandle, goData)
 	if err != nil {
-		return fromError(err)
+		return fromSessionError(goSessionHandle, err)
 	}
 
 	if int(*pulEncryptedPartLen) < len(encryptedPart) {
@@ -878,7 +2043,7 @@ func goEncryptFinal(sessionHandle C.CK_SESSION_HANDLE, pLastEncryptedPart C.CK_B
 
 	lastEncryptedPart, err := backend.EncryptFinal(goSessionHandle)
 	if err != nil {
-		return fromError(err)
+		return fromSessionError(goSessionHandle, err)
 	}
 
 	if int(*pulLastEncryptedPartLen) < len(lastEncryptedPart) {
@@ -899,11 +2064,28 @@ func goDecryptInit(sessionHandle C.CK_SESSION_HANDLE, pMechanism C.CK_MECHANISM_
 
 	goSessionHandle := pkcs11.SessionHandle(sessionHandle)
 	goObjectHandle := pkcs11.ObjectHandle(hKey)
-	goMechanism := toMechanism(pMechanism)
+	goMechanism, err := toMechanism(pMechanism)
+	if err != nil {
+		return fromSessionError(goSessionHandle, err)
+	}
+
+	goMechanism, err = rewriteMechanism("C_DecryptInit", goMechanism)
+	if err != nil {
+		return fromSessionError(goSessionHandle, err)
+	}
 
-	err := backend.DecryptInit(goSessionHandle, []*pkcs11.Mechanism{goMechanism}, goObjectHandle)
+	err = backend.DecryptInit(goSessionHandle, []*pkcs11.Mechanism{goMechanism}, goObjectHandle)
+	if err == nil {
+		if session, serr := getSession(goSessionHandle); serr == nil {
+			session.decryptTagLen = aeadTagLen(goMechanism, pMechanism)
+			session.decryptData = nil
+			session.decryptPartData = nil
+		}
 
-	return fromError(err)
+		err = fromMechanism(goMechanism, pMechanism)
+	}
+
+	return fromSessionError(goSessionHandle, err)
 }
 
 //export goDecrypt
@@ -922,16 +2104,27 @@ func goDecrypt(sessionHandle C.CK_SESSION_HANDLE, pEncryptedData C.CK_BYTE_PTR,
 
 	session, err := getSession(goSessionHandle)
 	if err != nil {
-		return fromError(err)
+		return fromSessionError(goSessionHandle, err)
+	}
+
+	if len(goEncryptedData) < session.decryptTagLen && !gcmAllowDetachedTag {
+		// Too short to even hold the tag that PKCS#11 appends.
+		return C.CKR_ENCRYPTED_DATA_LEN_RANGE
 	}
 
 	if pData == nil {
 		data, err = backend.Decrypt(goSessionHandle, goEncryptedData)
 		if err != nil {
-			return fromError(err)
+			traceAEADDecryptError(session.decryptTagLen, err)
+
+			return fromSessionError(goSessionHandle, err)
+		}
+
+		if err := checkAEADLayout("C_Decrypt", len(data), len(goEncryptedData), session.decryptTagLen); err != nil {
+			return fromSessionError(goSessionHandle, err)
 		}
 
-		session.decryptData = data
+		session.decryptData = nonNilBytes(data)
 
 		size := len(data)
 		*pulDataLen = C.CK_ULONG(size)
@@ -947,11 +2140,23 @@ func goDecrypt(sessionHandle C.CK_SESSION_HANDLE, pEncryptedData C.CK_BYTE_PTR,
 	} else {
 		data, err = backend.Decrypt(goSessionHandle, goEncryptedData)
 		if err != nil {
-			return fromError(err)
+			traceAEADDecryptError(session.decryptTagLen, err)
+
+			return fromSessionError(goSessionHandle, err)
+		}
+
+		if err := checkAEADLayout("C_Decrypt", len(data), len(goEncryptedData), session.decryptTagLen); err != nil {
+			return fromSessionError(goSessionHandle, err)
 		}
 	}
 
 	if int(*pulDataLen) < len(data) {
+		// The backend has already finished the operation, and for OAEP
+		// the first call may only have reported an upper bound, so keep
+		// the recovered plaintext for the retry and report its exact length.
+		session.decryptData = nonNilBytes(data)
+		*pulDataLen = C.CK_ULONG(len(data))
+
 		return C.CKR_BUFFER_TOO_SMALL
 	}
 
@@ -963,51 +2168,91 @@ func goDecrypt(sessionHandle C.CK_SESSION_HANDLE, pEncryptedData C.CK_BYTE_PTR,
 
 //export goDecryptUpdate
 func goDecryptUpdate(sessionHandle C.CK_SESSION_HANDLE, pEncryptedPart C.CK_BYTE_PTR, ulEncryptedPartLen C.CK_ULONG, pPart C.CK_BYTE_PTR, pulPartLen C.CK_ULONG_PTR) C.CK_RV {
-	if pEncryptedPart == nil || pPart == nil || pulPartLen == nil {
+	if pEncryptedPart == nil || pulPartLen == nil {
 		return C.CKR_ARGUMENTS_BAD
 	}
 
 	goSessionHandle := pkcs11.SessionHandle(sessionHandle)
-	goData := C.GoBytes(unsafe.Pointer(pPart), C.int(ulEncryptedPartLen))
-	goPart := (*[1 << 30]byte)(unsafe.Pointer(pPart))[:*pulPartLen:*pulPartLen]
 
-	decryptedPart, err := backend.Decrypt(goSessionHandle, goData)
+	session, err := getSession(goSessionHandle)
 	if err != nil {
-		return fromError(err)
+		return fromSessionError(goSessionHandle, err)
 	}
 
-	if int(*pulPartLen) < len(decryptedPart) {
-		return C.CKR_BUFFER_TOO_SMALL
-	}
+	part := session.decryptPartData
+	if part == nil {
+		goEncryptedPart := C.GoBytes(unsafe.Pointer(pEncryptedPart), C.int(ulEncryptedPartLen))
 
-	copy(goPart, decryptedPart)
-	*pulPartLen = C.CK_ULONG(len(decryptedPart))
+		part, err = backend.DecryptUpdate(goSessionHandle, goEncryptedPart)
+		if err != nil {
+			return fromSessionError(goSessionHandle, err)
+		}
+	}
 
-	return fromError(nil)
+	return deliverDecryptPart(session, part, pPart, pulPartLen)
 }
 
 //export goDecryptFinal
 func goDecryptFinal(sessionHandle C.CK_SESSION_HANDLE, pLastPart C.CK_BYTE_PTR, pulLastPartLen C.CK_ULONG_PTR) C.CK_RV {
-	if pLastPart == nil || pulLastPartLen == nil {
+	if pulLastPartLen == nil {
 		return C.CKR_ARGUMENTS_BAD
 	}
 
 	goSessionHandle := pkcs11.SessionHandle(sessionHandle)
-	goLastPart := (*[1 << 30]byte)(unsafe.Pointer(pLastPart))[:*pulLastPartLen:*pulLastPartLen]
 
-	lastDataPart, err := backend.DecryptFinal(goSessionHandle)
+	session, err := getSession(goSessionHandle)
 	if err != nil {
-		return fromError(err)
+		return fromSessionError(goSessionHandle, err)
+	}
+
+	lastPart := session.decryptPartData
+	if lastPart == nil {
+		lastPart, err = backend.DecryptFinal(goSessionHandle)
+		if err != nil {
+			return fromSessionError(goSessionHandle, err)
+		}
+	}
+
+	return deliverDecryptPart(session, lastPart, pLastPart, pulLastPartLen)
+}
+
+// deliverDecryptPart copies a plaintext part produced by C_DecryptUpdate or
+// C_DecryptFinal straight into the caller's buffer.  A length query (NULL
+// pPart) or a buffer that is too small leaves the part pending in the
+// session, so that the caller's follow-up call receives it without the
+// backend being asked to decrypt the same ciphertext twice.
+func deliverDecryptPart(session *sessionInfo, part []byte, pPart C.CK_BYTE_PTR, pulPartLen C.CK_ULONG_PTR) C.CK_RV {
+	if pPart == nil {
+		session.decryptPartData = nonNilBytes(part)
+		*pulPartLen = C.CK_ULONG(len(part))
+
+		return fromError(nil)
 	}
 
-	if int(*pulLastPartLen) < len(lastDataPart) {
+	if int(*pulPartLen) < len(part) {
+		session.decryptPartData = nonNilBytes(part)
+		*pulPartLen = C.CK_ULONG(len(part))
+
 		return C.CKR_BUFFER_TOO_SMALL
 	}
 
-	copy(goLastPart, lastDataPart)
-	*pulLastPartLen = C.CK_ULONG(len(lastDataPart))
+	session.decryptPartData = nil
 
-	return fromError(err)
+	goPart := (*[1 << 30]byte)(unsafe.Pointer(pPart))[:*pulPartLen:*pulPartLen]
+	copy(goPart, part)
+	*pulPartLen = C.CK_ULONG(len(part))
+
+	return fromError(nil)
+}
+
+// nonNilBytes returns b, or an empty non-nil slice if b is nil, so that an
+// empty pending result can be told apart from no pending result.
+func nonNilBytes(b []byte) []byte {
+	if b == nil {
+		return []byte{}
+	}
+
+	return b
 }
 
 //export goDigestInit
@@ -1017,10 +2262,26 @@ func goDigestInit(sessionHandle C.CK_SESSION_HANDLE, pMechanism C.CK_MECHANISM_P
 	}
 
 	goSessionHandle := pkcs11.SessionHandle(sessionHandle)
-	goMechanism := toMechanism(pMechanism)
-	err := backend.DigestInit(goSessionHandle, []*pkcs11.Mechanism{goMechanism})
+	goMechanism, err := toMechanism(pMechanism)
+	if err != nil {
+		return fromSessionError(goSessionHandle, err)
+	}
 
-	return fromError(err)
+	goMechanism, err = rewriteMechanism("C_DigestInit", goMechanism)
+	if err != nil {
+		return fromSessionError(goSessionHandle, err)
+	}
+
+	err = backend.DigestInit(goSessionHandle, []*pkcs11.Mechanism{goMechanism})
+	if err == nil {
+		if session, serr := getSession(goSessionHandle); serr == nil {
+			session.digestData = nil
+		}
+
+		err = fromMechanism(goMechanism, pMechanism)
+	}
+
+	return fromSessionError(goSessionHandle, err)
 }
 
 //export goDigest
@@ -1039,13 +2300,13 @@ func goDigest(sessionHandle C.CK_SESSION_HANDLE, pData C.CK_BYTE_PTR, ulDataLen
 
 	session, err := getSession(goSessionHandle)
 	if err != nil {
-		return fromError(err)
+		return fromSessionError(goSessionHandle, err)
 	}
 
 	if pDigest == nil {
 		digest, err = backend.Digest(goSessionHandle, goData)
 		if err != nil {
-			return fromError(err)
+			return fromSessionError(goSessionHandle, err)
 		}
 
 		session.digestData = digest
@@ -1064,7 +2325,7 @@ func goDigest(sessionHandle C.CK_SESSION_HANDLE, pData C.CK_BYTE_PTR, ulDataLen
 	} else {
 		digest, err = backend.Digest(goSessionHandle, goData)
 		if err != nil {
-			return fromError(err)
+			return fromSessionError(goSessionHandle, err)
 		}
 	}
 
@@ -1089,7 +2350,7 @@ func goDigestUpdate(sessionHandle C.CK_SESSION_HANDLE, pPart C.CK_BYTE_PTR, ulPa
 
 	err := backend.DigestUpdate(goSessionHandle, goPart)
 
-	return fromError(err)
+	return fromSessionError(goSessionHandle, err)
 }
 
 //export goDigestKey
@@ -1099,7 +2360,7 @@ func goDigestKey(sessionHandle C.CK_SESSION_HANDLE, hKey C.CK_OBJECT_HANDLE) C.C
 
 	err := backend.DigestKey(goSessionHandle, goKeyHandle)
 
-	return fromError(err)
+	return fromSessionError(goSessionHandle, err)
 }
 
 //export goDigestFinal
@@ -1113,7 +2374,7 @@ func goDigestFinal(sessionHandle C.CK_SESSION_HANDLE, pDigest C.CK_BYTE_PTR, pul
 
 	digest, err := backend.DigestFinal(goSessionHandle)
 	if err != nil {
-		return fromError(err)
+		return fromSessionError(goSessionHandle, err)
 	}
 
 	if int(*pulDigestLen) < len(digest) {
@@ -1134,21 +2395,62 @@ func goSignInit(sessionHandle C.CK_SESSION_HANDLE, pMechanism C.CK_MECHANISM_PTR
 
 	goSessionHandle := pkcs11.SessionHandle(sessionHandle)
 	goObjectHandle := pkcs11.ObjectHandle(hKey)
-	goMechanism := toMechanism(pMechanism)
+	goMechanism, err := toMechanism(pMechanism)
+	if err != nil {
+		return fromSessionError(goSessionHandle, err)
+	}
+
+	goMechanism, err = rewriteMechanism("C_SignInit", goMechanism)
+	if err != nil {
+		return fromSessionError(goSessionHandle, err)
+	}
 
-	err := backend.SignInit(goSessionHandle, []*pkcs11.Mechanism{goMechanism}, goObjectHandle)
+	err = backend.SignInit(goSessionHandle, []*pkcs11.Mechanism{goMechanism}, goObjectHandle)
+	if err == nil {
+		err = fromMechanism(goMechanism, pMechanism)
+	}
 
-	return fromError(err)
+	if err == nil {
+		if session, serr := getSession(goSessionHandle); serr == nil {
+			session.signNeedsContextLogin = enforceAlwaysAuthenticate && keyAlwaysAuthenticate(goSessionHandle, goObjectHandle)
+			session.signData = nil
+			session.signOTPSignatureInfo = goMechanism.Mechanism == uint(pMechanism.mechanism) && otpSignatureInfo(goMechanism)
+		}
+	}
+
+	return fromSessionError(goSessionHandle, err)
+}
+
+// keyAlwaysAuthenticate reports whether the backend says the key has
+// CKA_ALWAYS_AUTHENTICATE set.  Keys that don't have the attribute (e.g.
+// secret keys) don't require it.
+func keyAlwaysAuthenticate(sessionHandle pkcs11.SessionHandle, keyHandle pkcs11.ObjectHandle) bool {
+	template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_ALWAYS_AUTHENTICATE, nil)}
+
+	results, err := backend.GetAttributeValue(sessionHandle, keyHandle, template)
+	if err != nil || len(results) != 1 {
+		return false
+	}
+
+	alwaysAuthenticate, err := BytesToBool(results[0].Value)
+
+	return err == nil && alwaysAuthenticate
 }
 
 //export goSign
 func goSign(sessionHandle C.CK_SESSION_HANDLE, pData C.CK_BYTE_PTR, ulDataLen C.CK_ULONG, pSignature C.CK_BYTE_PTR, pulSignatureLen C.CK_ULONG_PTR) C.CK_RV {
-	if pData == nil || pulSignatureLen == nil {
+	if (pData == nil && ulDataLen > 0) || pulSignatureLen == nil {
 		return C.CKR_ARGUMENTS_BAD
 	}
 
 	goSessionHandle := pkcs11.SessionHandle(sessionHandle)
-	goData := C.GoBytes(unsafe.Pointer(pData), C.int(ulDataLen))
+
+	// Signing empty data is valid for some mechanisms (e.g. HMAC), in which
+	// case pData may be NULL.  Always pass the backend a non-nil slice.
+	goData := []byte{}
+	if ulDataLen > 0 {
+		goData = C.GoBytes(unsafe.Pointer(pData), C.int(ulDataLen))
+	}
 
 	var (
 		signature []byte
@@ -1157,18 +2459,32 @@ func goSign(sessionHandle C.CK_SESSION_HANDLE, pData C.CK_BYTE_PTR, ulDataLen C.
 
 	session, err := getSession(goSessionHandle)
 	if err != nil {
-		return fromError(err)
+		return fromSessionError(goSessionHandle, err)
+	}
+
+	if session.signNeedsContextLogin {
+		return C.CKR_USER_NOT_LOGGED_IN
 	}
 
 	if pSignature == nil {
 		signature, err = backend.Sign(goSessionHandle, goData)
 		if err != nil {
-			return fromError(err)
+			return fromSessionError(goSessionHandle, err)
 		}
 
 		session.signData = signature
 
 		size := len(signature)
+
+		if session.signOTPSignatureInfo {
+			otpParams, err := ParseOTPSignatureInfo(signature)
+			if err != nil {
+				return fromSessionError(goSessionHandle, err)
+			}
+
+			size = otpSignatureInfoLen(otpParams)
+		}
+
 		*pulSignatureLen = C.CK_ULONG(size)
 
 		return fromError(nil)
@@ -1182,8 +2498,28 @@ func goSign(sessionHandle C.CK_SESSION_HANDLE, pData C.CK_BYTE_PTR, ulDataLen C.
 	} else {
 		signature, err = backend.Sign(goSessionHandle, goData)
 		if err != nil {
-			return fromError(err)
+			return fromSessionError(goSessionHandle, err)
+		}
+	}
+
+	if session.signOTPSignatureInfo {
+		otpParams, err := ParseOTPSignatureInfo(signature)
+		if err != nil {
+			return fromSessionError(goSessionHandle, err)
+		}
+
+		size := otpSignatureInfoLen(otpParams)
+		if int(*pulSignatureLen) < size {
+			// Keep the signature for the retry with a bigger buffer.
+			session.signData = signature
+
+			return C.CKR_BUFFER_TOO_SMALL
 		}
+
+		fromOTPSignatureInfo(otpParams, pSignature)
+		*pulSignatureLen = C.CK_ULONG(size)
+
+		return fromError(nil)
 	}
 
 	if int(*pulSignatureLen) < len(signature) {
@@ -1205,23 +2541,56 @@ func goSignUpdate(sessionHandle C.CK_SESSION_HANDLE, pPart C.CK_BYTE_PTR, ulPart
 	goSessionHandle := pkcs11.SessionHandle(sessionHandle)
 	goPart := C.GoBytes(unsafe.Pointer(pPart), C.int(ulPartLen))
 
+	if session, err := getSession(goSessionHandle); err == nil && session.signNeedsContextLogin {
+		return C.CKR_USER_NOT_LOGGED_IN
+	}
+
 	err := backend.SignUpdate(goSessionHandle, goPart)
 
-	return fromError(err)
+	return fromSessionError(goSessionHandle, err)
 }
 
 //export goSignFinal
 func goSignFinal(sessionHandle C.CK_SESSION_HANDLE, pSignature C.CK_BYTE_PTR, pulSignatureLen C.CK_ULONG_PTR) C.CK_RV {
-	if pSignature == nil || pulSignatureLen == nil {
+	if pulSignatureLen == nil {
 		return C.CKR_ARGUMENTS_BAD
 	}
 
 	goSessionHandle := pkcs11.SessionHandle(sessionHandle)
-	goSignature := (*[1 << 30]byte)(unsafe.Pointer(pSignature))[:*pulSignatureLen:*pulSignatureLen]
 
-	signature, err := backend.SignFinal(goSessionHandle)
+	session, err := getSession(goSessionHandle)
 	if err != nil {
-		return fromError(err)
+		return fromSessionError(goSessionHandle, err)
+	}
+
+	if session.signNeedsContextLogin {
+		return C.CKR_USER_NOT_LOGGED_IN
+	}
+
+	// The backend is called even if no C_SignUpdate happened, so that a
+	// signature over empty data can be produced.
+	if pSignature == nil {
+		signature, err := backend.SignFinal(goSessionHandle)
+		if err != nil {
+			return fromSessionError(goSessionHandle, err)
+		}
+
+		session.signData = signature
+		*pulSignatureLen = C.CK_ULONG(len(signature))
+
+		return fromError(nil)
+	}
+
+	goSignature := (*[1 << 30]byte)(unsafe.Pointer(pSignature))[:*pulSignatureLen:*pulSignatureLen]
+
+	signature := session.signData
+	if signature != nil {
+		session.signData = nil
+	} else {
+		signature, err = backend.SignFinal(goSessionHandle)
+		if err != nil {
+			return fromSessionError(goSessionHandle, err)
+		}
 	}
 
 	if int(*pulSignatureLen) < len(signature) {
@@ -1242,29 +2611,79 @@ func goSignRecoverInit(sessionHandle C.CK_SESSION_HANDLE, pMechanism C.CK_MECHAN
 
 	goSessionHandle := pkcs11.SessionHandle(sessionHandle)
 	goObjectHandle := pkcs11.ObjectHandle(hKey)
-	goMechanism := toMechanism(pMechanism)
+	goMechanism, err := toMechanism(pMechanism)
+	if err != nil {
+		return fromSessionError(goSessionHandle, err)
+	}
 
-	err := backend.SignRecoverInit(goSessionHandle, []*pkcs11.Mechanism{goMechanism}, goObjectHandle)
+	goMechanism, err = rewriteMechanism("C_SignRecoverInit", goMechanism)
+	if err != nil {
+		return fromSessionError(goSessionHandle, err)
+	}
 
-	return fromError(err)
+	err = backend.SignRecoverInit(goSessionHandle, []*pkcs11.Mechanism{goMechanism}, goObjectHandle)
+	if err == nil {
+		err = fromMechanism(goMechanism, pMechanism)
+	}
+
+	if err == nil {
+		if session, serr := getSession(goSessionHandle); serr == nil {
+			session.signNeedsContextLogin = enforceAlwaysAuthenticate && keyAlwaysAuthenticate(goSessionHandle, goObjectHandle)
+			session.signRecoverData = nil
+		}
+	}
+
+	return fromSessionError(goSessionHandle, err)
 }
 
 //export goSignRecover
 func goSignRecover(sessionHandle C.CK_SESSION_HANDLE, pData C.CK_BYTE_PTR, ulDataLen C.CK_ULONG, pSignature C.CK_BYTE_PTR, pulSignatureLen C.CK_ULONG_PTR) C.CK_RV {
-	if pData == nil || pSignature == nil || pulSignatureLen == nil {
+	if pData == nil || pulSignatureLen == nil {
 		return C.CKR_ARGUMENTS_BAD
 	}
 
 	goSessionHandle := pkcs11.SessionHandle(sessionHandle)
 	goData := C.GoBytes(unsafe.Pointer(pData), C.int(ulDataLen))
-	goSignature := (*[1 << 30]byte)(unsafe.Pointer(pSignature))[:*pulSignatureLen:*pulSignatureLen]
 
-	signature, err := backend.SignRecover(goSessionHandle, goData)
+	session, err := getSession(goSessionHandle)
 	if err != nil {
-		return fromError(err)
+		return fromSessionError(goSessionHandle, err)
+	}
+
+	if session.signNeedsContextLogin {
+		return C.CKR_USER_NOT_LOGGED_IN
+	}
+
+	if pSignature == nil {
+		signature, err := backend.SignRecover(goSessionHandle, goData)
+		if err != nil {
+			return fromSessionError(goSessionHandle, err)
+		}
+
+		session.signRecoverData = nonNilBytes(signature)
+		*pulSignatureLen = C.CK_ULONG(len(signature))
+
+		return fromError(nil)
+	}
+
+	goSignature := (*[1 << 30]byte)(unsafe.Pointer(pSignature))[:*pulSignatureLen:*pulSignatureLen]
+
+	signature := session.signRecoverData
+	if signature != nil {
+		session.signRecoverData = nil
+	} else {
+		signature, err = backend.SignRecover(goSessionHandle, goData)
+		if err != nil {
+			return fromSessionError(goSessionHandle, err)
+		}
 	}
 
 	if int(*pulSignatureLen) < len(signature) {
+		// The backend has already finished the operation, so keep the
+		// signature for the retry.
+		session.signRecoverData = nonNilBytes(signature)
+		*pulSignatureLen = C.CK_ULONG(len(signature))
+
 		return C.CKR_BUFFER_TOO_SMALL
 	}
 
@@ -1282,11 +2701,22 @@ func goVerifyInit(sessionHandle C.CK_SESSION_HANDLE, pMechanism C.CK_MECHANISM_P
 
 	goSessionHandle := pkcs11.SessionHandle(sessionHandle)
 	goObjectHandle := pkcs11.ObjectHandle(hKey)
-	goMechanism := toMechanism(pMechanism)
+	goMechanism, err := toMechanism(pMechanism)
+	if err != nil {
+		return fromSessionError(goSessionHandle, err)
+	}
 
-	err := backend.VerifyInit(goSessionHandle, []*pkcs11.Mechanism{goMechanism}, goObjectHandle)
+	goMechanism, err = rewriteMechanism("C_VerifyInit", goMechanism)
+	if err != nil {
+		return fromSessionError(goSessionHandle, err)
+	}
 
-	return fromError(err)
+	err = backend.VerifyInit(goSessionHandle, []*pkcs11.Mechanism{goMechanism}, goObjectHandle)
+	if err == nil {
+		err = fromMechanism(goMechanism, pMechanism)
+	}
+
+	return fromSessionError(goSessionHandle, err)
 }
 
 //export goVerify
@@ -1301,7 +2731,7 @@ func goVerify(sessionHandle C.CK_SESSION_HANDLE, pData C.CK_BYTE_PTR, ulDataLen
 
 	err := backend.Verify(goSessionHandle, goData, goSignature)
 
-	return fromError(err)
+	return fromSessionError(goSessionHandle, err)
 }
 
 //export goVerifyUpdate
@@ -1315,7 +2745,7 @@ func goVerifyUpdate(sessionHandle C.CK_SESSION_HANDLE, pPart C.CK_BYTE_PTR, ulPa
 
 	err := backend.VerifyUpdate(goSessionHandle, goPart)
 
-	return fromError(err)
+	return fromSessionError(goSessionHandle, err)
 }
 
 //export goVerifyFinal
@@ -1329,7 +2759,7 @@ func goVerifyFinal(sessionHandle C.CK_SESSION_HANDLE, pSignature C.CK_BYTE_PTR,
 
 	err := backend.VerifyFinal(goSessionHandle, goSignature)
 
-	return fromError(err)
+	return fromSessionError(goSessionHandle, err)
 }
 
 //export goVerifyRecoverInit
@@ -1340,29 +2770,71 @@ func goVerifyRecoverInit(sessionHandle C.CK_SESSION_HANDLE, pMechanism C.CK_MECH
 
 	goSessionHandle := pkcs11.SessionHandle(sessionHandle)
 	goObjectHandle := pkcs11.ObjectHandle(hKey)
-	goMechanism := toMechanism(pMechanism)
+	goMechanism, err := toMechanism(pMechanism)
+	if err != nil {
+		return fromSessionError(goSessionHandle, err)
+	}
 
-	err := backend.VerifyRecoverInit(goSessionHandle, []*pkcs11.Mechanism{goMechanism}, goObjectHandle)
+	goMechanism, err = rewriteMechanism("C_VerifyRecoverInit", goMechanism)
+	if err != nil {
+		return fromSessionError(goSessionHandle, err)
+	}
 
-	return fromError(err)
+	err = backend.VerifyRecoverInit(goSessionHandle, []*pkcs11.Mechanism{goMechanism}, goObjectHandle)
+	if err == nil {
+		if session, serr := getSession(goSessionHandle); serr == nil {
+			session.verifyRecoverData = nil
+		}
+
+		err = fromMechanism(goMechanism, pMechanism)
+	}
+
+	return fromSessionError(goSessionHandle, err)
 }
 
 //export goVerifyRecover
 func goVerifyRecover(sessionHandle C.CK_SESSION_HANDLE, pSignature C.CK_BYTE_PTR, ulSignatureLen C.CK_ULONG, pData C.CK_BYTE_PTR, pulDataLen C.CK_ULONG_PTR) C.CK_RV {
-	if pData == nil || pSignature == nil || pulDataLen == nil {
+	if pSignature == nil || pulDataLen == nil {
 		return C.CKR_ARGUMENTS_BAD
 	}
 
 	goSessionHandle := pkcs11.SessionHandle(sessionHandle)
 	goSignature := C.GoBytes(unsafe.Pointer(pSignature), C.int(ulSignatureLen))
-	goData := (*[1 << 30]byte)(unsafe.Pointer(pData))[:*pulDataLen:*pulDataLen]
 
-	data, err := backend.VerifyRecover(goSessionHandle, goSignature)
+	session, err := getSession(goSessionHandle)
 	if err != nil {
-		return fromError(err)
+		return fromSessionError(goSessionHandle, err)
+	}
+
+	if pData == nil {
+		data, err := backend.VerifyRecover(goSessionHandle, goSignature)
+		if err != nil {
+			return fromSessionError(goSessionHandle, err)
+		}
+
+		session.verifyRecoverData = nonNilBytes(data)
+		*pulDataLen = C.CK_ULONG(len(data))
+
+		return fromError(nil)
+	}
+
+	goData := (*[1 << 30]byte)(unsafe.Pointer(pData))[:*pulDataLen:*pulDataLen]
+
+	data := session.verifyRecoverData
+	if data != nil {
+		session.verifyRecoverData = nil
+	} else {
+		data, err = backend.VerifyRecover(goSessionHandle, goSignature)
+		if err != nil {
+			return fromSessionError(goSessionHandle, err)
+		}
 	}
 
 	if int(*pulDataLen) < len(data) {
+		// As for C_SignRecover, keep the recovered data for the retry.
+		session.verifyRecoverData = nonNilBytes(data)
+		*pulDataLen = C.CK_ULONG(len(data))
+
 		return C.CKR_BUFFER_TOO_SMALL
 	}
 
@@ -1384,7 +2856,7 @@ func goDigestEncryptUpdate(sessionHandle C.CK_SESSION_HANDLE, pPart C.CK_BYTE_PT
 
 	encryptedPart, err := backend.DigestEncryptUpdate(goSessionHandle, goPart)
 	if err != nil {
-		return fromError(err)
+		return fromSessionError(goSessionHandle, err)
 	}
 
 	if int(*pulEncryptedPartLen) < len(encryptedPart) {
@@ -1409,7 +2881,7 @@ func goDecryptDigestUpdate(sessionHandle C.CK_SESSION_HANDLE, pEncryptedPart C.C
 
 	part, err := backend.DecryptDigestUpdate(goSessionHandle, goEncryptedPart)
 	if err != nil {
-		return fromError(err)
+		return fromSessionError(goSessionHandle, err)
 	}
 
 	if int(*pulPartLen) < len(part) {
@@ -1434,7 +2906,7 @@ func goSignEncryptUpdate(sessionHandle C.CK_SESSION_HANDLE, pPart C.CK_BYTE_PTR,
 
 	encryptedPart, err := backend.SignEncryptUpdate(goSessionHandle, goPart)
 	if err != nil {
-		return fromError(err)
+		return fromSessionError(goSessionHandle, err)
 	}
 
 	if int(*pulEncryptedPartLen) < len(encryptedPart) {
@@ -1459,7 +2931,7 @@ func goDecryptVerifyUpdate(sessionHandle C.CK_SESSION_HANDLE, pEncryptedPart C.C
 
 	part, err := backend.DecryptVerifyUpdate(goSessionHandle, goEncryptedPart)
 	if err != nil {
-		return fromError(err)
+		return fromSessionError(goSessionHandle, err)
 	}
 
 	if int(*pulPartLen) < len(part) {
@@ -1479,12 +2951,30 @@ func goGenerateKey(sessionHandle C.CK_SESSION_HANDLE, pMechanism C.CK_MECHANISM_
 	}
 
 	goSessionHandle := pkcs11.SessionHandle(sessionHandle)
-	goMechanism := toMechanism(pMechanism)
+	goMechanism, err := toMechanism(pMechanism)
+	if err != nil {
+		return fromSessionError(goSessionHandle, err)
+	}
+
 	goTemplate := toTemplate(pTemplate, ulCount)
 
+	if strictValidation {
+		if err := checkKeySize(goTemplate); err != nil {
+			if traceFunction("C_GenerateKey") {
+				traceLog().Printf("pkcs11mod GenerateKey: %v\n", err)
+			}
+
+			return fromError(err)
+		}
+	}
+
 	keyHandle, err := backend.GenerateKey(goSessionHandle, []*pkcs11.Mechanism{goMechanism}, goTemplate)
 	if err != nil {
-		return fromError(err)
+		return fromSessionError(goSessionHandle, err)
+	}
+
+	if err := fromMechanism(goMechanism, pMechanism); err != nil {
+		return fromSessionError(goSessionHandle, err)
 	}
 
 	*phKey = C.CK_OBJECT_HANDLE(keyHandle)
@@ -1492,6 +2982,59 @@ func goGenerateKey(sessionHandle C.CK_SESSION_HANDLE, pMechanism C.CK_MECHANISM_
 	return fromError(nil)
 }
 
+// templateClass returns the template's CKA_CLASS.  The boolean result is false
+// if the template doesn't have a valid one.
+func templateClass(template []*pkcs11.Attribute) (uint, bool) {
+	for _, a := range template {
+		if a.Type != pkcs11.CKA_CLASS {
+			continue
+		}
+
+		class, err := BytesToULong(a.Value)
+
+		return class, err == nil
+	}
+
+	return 0, false
+}
+
+// templateClassIs reports whether every CKA_CLASS in template (there's
+// usually at most one) is class.  A template without CKA_CLASS matches any
+// class.
+func templateClassIs(template []*pkcs11.Attribute, class uint) bool {
+	for _, a := range template {
+		if a.Type != pkcs11.CKA_CLASS {
+			continue
+		}
+
+		vint, err := BytesToULong(a.Value)
+		if err != nil || vint != class {
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkKeySize rejects key generation templates whose CKA_VALUE_LEN or
+// CKA_MODULUS_BITS can't be valid for any key: CKR_ATTRIBUTE_VALUE_INVALID if
+// the value isn't a CK_ULONG, and CKR_KEY_SIZE_RANGE if it's 0.  Other sizes
+// are left to the backend, which knows what it supports.
+func checkKeySize(template []*pkcs11.Attribute) error {
+	for _, attrType := range []uint{pkcs11.CKA_VALUE_LEN, pkcs11.CKA_MODULUS_BITS} {
+		size, ok, err := TemplateULong(template, attrType)
+		if err != nil {
+			return fmt.Errorf("%s: %w", strCKA[attrType], pkcs11.Error(pkcs11.CKR_ATTRIBUTE_VALUE_INVALID))
+		}
+
+		if ok && size == 0 {
+			return fmt.Errorf("%s is 0: %w", strCKA[attrType], pkcs11.Error(pkcs11.CKR_KEY_SIZE_RANGE))
+		}
+	}
+
+	return nil
+}
+
 //export goGenerateKeyPair
 func goGenerateKeyPair(sessionHandle C.CK_SESSION_HANDLE, pMechanism C.CK_MECHANISM_PTR, pPublicKeyTemplate C.CK_ATTRIBUTE_PTR, ulPublicKeyAttributeCount C.CK_ULONG, pPrivateKeyTemplate C.CK_ATTRIBUTE_PTR, ulPrivateKeyAttributeCount C.CK_ULONG, phPublicKey, phPrivateKey C.CK_OBJECT_HANDLE_PTR) C.CK_RV {
 	if pMechanism == nil || pPublicKeyTemplate == nil || pPrivateKeyTemplate == nil {
@@ -1499,13 +3042,51 @@ func goGenerateKeyPair(sessionHandle C.CK_SESSION_HANDLE, pMechanism C.CK_MECHAN
 	}
 
 	goSessionHandle := pkcs11.SessionHandle(sessionHandle)
-	goMechanism := toMechanism(pMechanism)
+	goMechanism, err := toMechanism(pMechanism)
+	if err != nil {
+		return fromSessionError(goSessionHandle, err)
+	}
+
 	goPublicTemplate := toTemplate(pPublicKeyTemplate, ulPublicKeyAttributeCount)
 	goPrivateTemplate := toTemplate(pPrivateKeyTemplate, ulPrivateKeyAttributeCount)
 
+	if strictValidation {
+		if !templateClassIs(goPublicTemplate, pkcs11.CKO_PUBLIC_KEY) || !templateClassIs(goPrivateTemplate, pkcs11.CKO_PRIVATE_KEY) {
+			if traceFunction("C_GenerateKeyPair") {
+				traceLog().Println("pkcs11mod GenerateKeyPair: CKA_CLASS doesn't match template")
+			}
+
+			return C.CKR_TEMPLATE_INCONSISTENT
+		}
+
+		for _, goTemplate := range [][]*pkcs11.Attribute{goPublicTemplate, goPrivateTemplate} {
+			if err := checkKeySize(goTemplate); err != nil {
+				if traceFunction("C_GenerateKeyPair") {
+					traceLog().Printf("pkcs11mod GenerateKeyPair: %v\n", err)
+				}
+
+				return fromError(err)
+			}
+		}
+	}
+
+	if enforceUniqueID {
+		if err := checkUniqueID("C_GenerateKeyPair", goSessionHandle, pkcs11.CKO_PUBLIC_KEY, goPublicTemplate); err != nil {
+			return fromSessionError(goSessionHandle, err)
+		}
+
+		if err := checkUniqueID("C_GenerateKeyPair", goSessionHandle, pkcs11.CKO_PRIVATE_KEY, goPrivateTemplate); err != nil {
+			return fromSessionError(goSessionHandle, err)
+		}
+	}
+
 	pubKeyHandle, privKeyHandle, err := backend.GenerateKeyPair(goSessionHandle, []*pkcs11.Mechanism{goMechanism}, goPublicTemplate, goPrivateTemplate)
 	if err != nil {
-		return fromError(err)
+		return fromSessionError(goSessionHandle, err)
+	}
+
+	if err := fromMechanism(goMechanism, pMechanism); err != nil {
+		return fromSessionError(goSessionHandle, err)
 	}
 
 	*phPublicKey = C.CK_OBJECT_HANDLE(pubKeyHandle)
@@ -1521,14 +3102,22 @@ func goWrapKey(sessionHandle C.CK_SESSION_HANDLE, pMechanism C.CK_MECHANISM_PTR,
 	}
 
 	goSessionHandle := pkcs11.SessionHandle(sessionHandle)
-	goMechanism := toMechanism(pMechanism)
+	goMechanism, err := toMechanism(pMechanism)
+	if err != nil {
+		return fromSessionError(goSessionHandle, err)
+	}
+
 	goWrappingKey := pkcs11.ObjectHandle(hWrappingKey)
 	goKeyHandle := pkcs11.ObjectHandle(hKey)
 	goWrappedKey := (*[1 << 30]byte)(unsafe.Pointer(pWrappedKey))[:*pulWrappedKeyLen:*pulWrappedKeyLen]
 
 	wrappedKey, err := backend.WrapKey(goSessionHandle, []*pkcs11.Mechanism{goMechanism}, goWrappingKey, goKeyHandle)
 	if err != nil {
-		return fromError(nil)
+		return fromSessionError(goSessionHandle, err)
+	}
+
+	if err := fromMechanism(goMechanism, pMechanism); err != nil {
+		return fromSessionError(goSessionHandle, err)
 	}
 
 	if int(*pulWrappedKeyLen) < len(wrappedKey) {
@@ -1548,14 +3137,22 @@ func goUnwrapKey(sessionHandle C.CK_SESSION_HANDLE, pMechanism C.CK_MECHANISM_PT
 	}
 
 	goSessionHandle := pkcs11.SessionHandle(sessionHandle)
-	goMechanism := toMechanism(pMechanism)
+	goMechanism, err := toMechanism(pMechanism)
+	if err != nil {
+		return fromSessionError(goSessionHandle, err)
+	}
+
 	goTemplate := toTemplate(pTemplate, ulAttributeCount)
 	goUnwrappingKey := pkcs11.ObjectHandle(hUnwrappingKey)
 	goWrappedKey := C.GoBytes(unsafe.Pointer(pWrappedKey), C.int(ulWrappedKeyLen))
 
 	keyHandle, err := backend.UnwrapKey(goSessionHandle, []*pkcs11.Mechanism{goMechanism}, goUnwrappingKey, goWrappedKey, goTemplate)
 	if err != nil {
-		return fromError(nil)
+		return fromSessionError(goSessionHandle, err)
+	}
+
+	if err := fromMechanism(goMechanism, pMechanism); err != nil {
+		return fromSessionError(goSessionHandle, err)
 	}
 
 	*phKey = C.CK_OBJECT_HANDLE(keyHandle)
@@ -1570,13 +3167,21 @@ func goDeriveKey(sessionHandle C.CK_SESSION_HANDLE, pMechanism C.CK_MECHANISM_PT
 	}
 
 	goSessionHandle := pkcs11.SessionHandle(sessionHandle)
-	goMechanism := toMechanism(pMechanism)
+	goMechanism, err := toMechanism(pMechanism)
+	if err != nil {
+		return fromSessionError(goSessionHandle, err)
+	}
+
 	goTemplate := toTemplate(pTemplate, ulAttributeCount)
 	goBaseKey := pkcs11.ObjectHandle(hBaseKey)
 
 	keyHandle, err := backend.DeriveKey(goSessionHandle, []*pkcs11.Mechanism{goMechanism}, goBaseKey, goTemplate)
 	if err != nil {
-		return fromError(nil)
+		return fromSessionError(goSessionHandle, err)
+	}
+
+	if err := fromMechanism(goMechanism, pMechanism); err != nil {
+		return fromSessionError(goSessionHandle, err)
 	}
 
 	*phKey = C.CK_OBJECT_HANDLE(keyHandle)
@@ -1593,9 +3198,22 @@ func goSeedRandom(sessionHandle C.CK_SESSION_HANDLE, pSeed C.CK_BYTE_PTR, ulSeed
 	goSessionHandle := pkcs11.SessionHandle(sessionHandle)
 	goSeed := C.GoBytes(unsafe.Pointer(pSeed), C.int(ulSeedLen))
 
+	if randomReader != nil {
+		if _, err := getSession(goSessionHandle); err != nil {
+			return fromError(err)
+		}
+
+		seeder, ok := randomReader.(RandomSeeder)
+		if !ok {
+			return C.CKR_RANDOM_SEED_NOT_SUPPORTED
+		}
+
+		return fromSessionError(goSessionHandle, seeder.Seed(goSeed))
+	}
+
 	err := backend.SeedRandom(goSessionHandle, goSeed)
 
-	return fromError(err)
+	return fromSessionError(goSessionHandle, err)
 }
 
 //export goGenerateRandom
@@ -1608,9 +3226,21 @@ func goGenerateRandom(sessionHandle C.CK_SESSION_HANDLE, pRandomData C.CK_BYTE_P
 	goRandomData := (*[1 << 30]byte)(unsafe.Pointer(pRandomData))[:ulRandomLen:ulRandomLen]
 	goRandomDataLen := int(ulRandomLen)
 
+	if randomReader != nil {
+		if _, err := getSession(goSessionHandle); err != nil {
+			return fromError(err)
+		}
+
+		if _, err := io.ReadFull(randomReader, goRandomData); err != nil {
+			return fromSessionError(goSessionHandle, err)
+		}
+
+		return fromError(nil)
+	}
+
 	randomData, err := backend.GenerateRandom(goSessionHandle, goRandomDataLen)
 	if err != nil {
-		return fromError(err)
+		return fromSessionError(goSessionHandle, err)
 	}
 
 	copy(goRandomData, randomData)
@@ -1624,11 +3254,30 @@ func goWaitForSlotEvent(flags C.CK_FLAGS, pSlot C.CK_SLOT_ID_PTR, pReserved C.CK
 		return C.CKR_ARGUMENTS_BAD
 	}
 
+	if slotEventWaiter == nil {
+		return C.CKR_FUNCTION_NOT_SUPPORTED
+	}
+
 	goFlags := uint(flags)
 
-	slotEvent := <-backend.WaitForSlotEvent(goFlags)
+	slotEvent := <-slotEventWaiter.WaitForSlotEvent(goFlags)
 
 	*pSlot = C.CK_SLOT_ID(slotEvent.SlotID)
 
 	return fromError(nil)
 }
+
+//export goSelfTest
+func goSelfTest() C.CK_RV {
+	if selfTester == nil {
+		return C.CKR_FUNCTION_NOT_SUPPORTED
+	}
+
+	err := selfTester.SelfTest()
+
+	if traceFunction("pkcs11mod_SelfTest") {
+		traceLog().Printf("pkcs11mod SelfTest: %v", err)
+	}
+
+	return fromError(err)
+}
@@ -0,0 +1,3680 @@
+// pkcs11mod
+// Copyright (C) 2022  Namecoin Developers
+//
+// pkcs11mod is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// pkcs11mod is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with pkcs11mod; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+
+package pkcs11mod
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+
+	"github.com/miekg/pkcs11"
+)
+
+// cgo can't be used in test files, so the tests refer to the C types through
+// the names that cgo generates for the package's own uses of them.
+type (
+	ckULong         = _Ctype_CK_ULONG
+	ckByte          = _Ctype_CK_BYTE
+	ckSessionHandle = _Ctype_CK_SESSION_HANDLE
+	ckObjectHandle  = _Ctype_CK_OBJECT_HANDLE
+	ckMechanism     = _Ctype_CK_MECHANISM
+	ckAttribute     = _Ctype_CK_ATTRIBUTE
+	ckRV            = _Ctype_CK_RV
+)
+
+const testSessionHandle = 1
+
+// testBackend is a Backend with a single session, testSessionHandle.  It embeds
+// a nil Backend, so tests embed it in turn and override only the methods they
+// need; calling any other method panics.
+type testBackend struct {
+	Backend
+}
+
+func (testBackend) OpenSession(uint, uint) (pkcs11.SessionHandle, error) {
+	return testSessionHandle, nil
+}
+
+func (testBackend) CloseSession(pkcs11.SessionHandle) error {
+	return nil
+}
+
+// openTestSession installs b as the backend and opens a session on it.  The
+// session is closed and the previous backend restored when the test ends.
+func openTestSession(t *testing.T, b Backend) ckSessionHandle {
+	t.Helper()
+
+	oldBackend := backend
+
+	SetBackend(b)
+
+	var h ckSessionHandle
+	if rv := goOpenSession(0, pkcs11.CKF_SERIAL_SESSION, &h); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_OpenSession returned %s", RVTrace(uint(rv)))
+	}
+
+	t.Cleanup(func() {
+		goCloseSession(h)
+		SetBackend(oldBackend)
+	})
+
+	return h
+}
+
+// bytePtr returns a pointer to the first byte of b, or nil if b is empty.
+func bytePtr(b []byte) *ckByte {
+	if len(b) == 0 {
+		return nil
+	}
+
+	return (*ckByte)(unsafe.Pointer(&b[0]))
+}
+
+// testMechanism builds a CK_MECHANISM whose parameter is param, pinning param
+// so that the mechanism can be passed to C until the test ends.
+func testMechanism(t *testing.T, mech uint, param unsafe.Pointer, paramLen uintptr) *ckMechanism {
+	t.Helper()
+
+	m := &ckMechanism{mechanism: _Ctype_CK_MECHANISM_TYPE(mech), ulParameterLen: ckULong(paramLen)}
+
+	if param != nil {
+		var pinner runtime.Pinner
+
+		pinner.Pin(param)
+		t.Cleanup(pinner.Unpin)
+
+		m.pParameter = _Ctype_CK_VOID_PTR(param)
+	}
+
+	return m
+}
+
+// testTemplate builds a CK_ATTRIBUTE array from template, pinning the values
+// so that the array can be passed to C until the test ends.
+func testTemplate(t *testing.T, template []*pkcs11.Attribute) (*ckAttribute, ckULong) {
+	t.Helper()
+
+	if len(template) == 0 {
+		return nil, 0
+	}
+
+	var pinner runtime.Pinner
+
+	t.Cleanup(pinner.Unpin)
+
+	attrs := make([]ckAttribute, len(template))
+	for i, a := range template {
+		attrs[i]._type = _Ctype_CK_ATTRIBUTE_TYPE(a.Type)
+		attrs[i].ulValueLen = ckULong(len(a.Value))
+
+		if len(a.Value) != 0 {
+			pinner.Pin(&a.Value[0])
+			attrs[i].pValue = _Ctype_CK_VOID_PTR(&a.Value[0])
+		}
+	}
+
+	return &attrs[0], ckULong(len(attrs))
+}
+
+// captureTrace enables the trace, in JSON mode if asJSON is set, and returns
+// the buffer it's written to until the test ends.
+func captureTrace(t *testing.T, asJSON bool) *bytes.Buffer {
+	t.Helper()
+
+	oldTrace, oldTraceJSON := trace, traceJSON
+	trace, traceJSON = true, asJSON
+
+	var buf bytes.Buffer
+
+	SetTraceOutput(&buf)
+
+	t.Cleanup(func() {
+		trace, traceJSON = oldTrace, oldTraceJSON
+
+		SetTraceOutput(nil)
+	})
+
+	return &buf
+}
+
+type wrapKeyFailBackend struct {
+	testBackend
+}
+
+func (wrapKeyFailBackend) WrapKey(pkcs11.SessionHandle, []*pkcs11.Mechanism, pkcs11.ObjectHandle, pkcs11.ObjectHandle) ([]byte, error) {
+	return nil, pkcs11.Error(pkcs11.CKR_KEY_NOT_WRAPPABLE)
+}
+
+func TestWrapKeyBackendError(t *testing.T) {
+	h := openTestSession(t, wrapKeyFailBackend{})
+
+	wrapped := make([]byte, 32)
+	wrappedLen := ckULong(len(wrapped))
+
+	rv := goWrapKey(h, testMechanism(t, pkcs11.CKM_RSA_PKCS, nil, 0), 2, 3, bytePtr(wrapped), &wrappedLen)
+	if rv != pkcs11.CKR_KEY_NOT_WRAPPABLE {
+		t.Errorf("C_WrapKey returned %s, want CKR_KEY_NOT_WRAPPABLE", RVTrace(uint(rv)))
+	}
+
+	if wrappedLen != ckULong(len(wrapped)) {
+		t.Errorf("C_WrapKey changed the length to %d", wrappedLen)
+	}
+
+	if LastError(testSessionHandle) == nil {
+		t.Error("C_WrapKey didn't record the backend's error")
+	}
+}
+
+// alwaysAuthenticateBackend has a single key, with CKA_ALWAYS_AUTHENTICATE
+// set, which it signs with without checking the login state itself.
+type alwaysAuthenticateBackend struct {
+	testBackend
+}
+
+func (alwaysAuthenticateBackend) GetAttributeValue(_ pkcs11.SessionHandle, _ pkcs11.ObjectHandle, template []*pkcs11.Attribute) ([]*pkcs11.Attribute, error) {
+	return []*pkcs11.Attribute{pkcs11.NewAttribute(template[0].Type, true)}, nil
+}
+
+func (alwaysAuthenticateBackend) Login(pkcs11.SessionHandle, uint, string) error {
+	return nil
+}
+
+func (alwaysAuthenticateBackend) SignInit(pkcs11.SessionHandle, []*pkcs11.Mechanism, pkcs11.ObjectHandle) error {
+	return nil
+}
+
+func (alwaysAuthenticateBackend) Sign(pkcs11.SessionHandle, []byte) ([]byte, error) {
+	return []byte("signature"), nil
+}
+
+func (alwaysAuthenticateBackend) SignUpdate(pkcs11.SessionHandle, []byte) error {
+	return nil
+}
+
+func (alwaysAuthenticateBackend) SignFinal(pkcs11.SessionHandle) ([]byte, error) {
+	return []byte("signature"), nil
+}
+
+func (alwaysAuthenticateBackend) SignRecoverInit(pkcs11.SessionHandle, []*pkcs11.Mechanism, pkcs11.ObjectHandle) error {
+	return nil
+}
+
+func (alwaysAuthenticateBackend) SignRecover(pkcs11.SessionHandle, []byte) ([]byte, error) {
+	return []byte("signature"), nil
+}
+
+func TestEnforceAlwaysAuthenticate(t *testing.T) {
+	SetEnforceAlwaysAuthenticate(true)
+	t.Cleanup(func() { SetEnforceAlwaysAuthenticate(false) })
+
+	h := openTestSession(t, alwaysAuthenticateBackend{})
+	pin := []byte("1234")
+	data := []byte("data")
+	signature := make([]byte, 16)
+
+	login := func() {
+		t.Helper()
+
+		if rv := goLogin(h, pkcs11.CKU_CONTEXT_SPECIFIC, (*_Ctype_CK_UTF8CHAR)(bytePtr(pin)), ckULong(len(pin))); rv != pkcs11.CKR_OK {
+			t.Fatalf("C_Login returned %s", RVTrace(uint(rv)))
+		}
+	}
+
+	steps := []struct {
+		name string
+		init func() _Ctype_CK_RV
+		sign func() _Ctype_CK_RV
+	}{
+		{
+			"C_Sign",
+			func() _Ctype_CK_RV { return goSignInit(h, testMechanism(t, pkcs11.CKM_RSA_PKCS, nil, 0), 2) },
+			func() _Ctype_CK_RV {
+				signatureLen := ckULong(len(signature))
+
+				return goSign(h, bytePtr(data), ckULong(len(data)), bytePtr(signature), &signatureLen)
+			},
+		},
+		{
+			"C_SignUpdate",
+			func() _Ctype_CK_RV { return goSignInit(h, testMechanism(t, pkcs11.CKM_SHA256_RSA_PKCS, nil, 0), 2) },
+			func() _Ctype_CK_RV { return goSignUpdate(h, bytePtr(data), ckULong(len(data))) },
+		},
+		{
+			// Without any C_SignUpdate, C_SignFinal signs empty data.
+			"C_SignFinal",
+			func() _Ctype_CK_RV { return goSignInit(h, testMechanism(t, pkcs11.CKM_SHA256_RSA_PKCS, nil, 0), 2) },
+			func() _Ctype_CK_RV {
+				signatureLen := ckULong(len(signature))
+
+				return goSignFinal(h, bytePtr(signature), &signatureLen)
+			},
+		},
+		{
+			"C_SignRecover",
+			func() _Ctype_CK_RV { return goSignRecoverInit(h, testMechanism(t, pkcs11.CKM_RSA_X_509, nil, 0), 2) },
+			func() _Ctype_CK_RV {
+				signatureLen := ckULong(len(signature))
+
+				return goSignRecover(h, bytePtr(data), ckULong(len(data)), bytePtr(signature), &signatureLen)
+			},
+		},
+	}
+
+	for _, step := range steps {
+		if rv := step.init(); rv != pkcs11.CKR_OK {
+			t.Fatalf("%s: init returned %s", step.name, RVTrace(uint(rv)))
+		}
+
+		if rv := step.sign(); rv != pkcs11.CKR_USER_NOT_LOGGED_IN {
+			t.Errorf("%s without re-authentication returned %s, want CKR_USER_NOT_LOGGED_IN", step.name, RVTrace(uint(rv)))
+		}
+
+		login()
+
+		if rv := step.sign(); rv != pkcs11.CKR_OK {
+			t.Errorf("%s after re-authentication returned %s", step.name, RVTrace(uint(rv)))
+		}
+	}
+}
+
+// rawRSABackend implements CKM_RSA_X_509 C_SignRecover and C_VerifyRecover
+// with a single key.  Like a real token, it ends the operation after the
+// first call that returns a result.
+type rawRSABackend struct {
+	testBackend
+	key    *rsa.PrivateKey
+	active bool
+}
+
+func (b *rawRSABackend) SignRecoverInit(pkcs11.SessionHandle, []*pkcs11.Mechanism, pkcs11.ObjectHandle) error {
+	b.active = true
+
+	return nil
+}
+
+func (b *rawRSABackend) SignRecover(_ pkcs11.SessionHandle, data []byte) ([]byte, error) {
+	if !b.active {
+		return nil, pkcs11.Error(pkcs11.CKR_OPERATION_NOT_INITIALIZED)
+	}
+
+	b.active = false
+
+	return new(big.Int).Exp(new(big.Int).SetBytes(data), b.key.D, b.key.N).Bytes(), nil
+}
+
+func (b *rawRSABackend) VerifyRecoverInit(pkcs11.SessionHandle, []*pkcs11.Mechanism, pkcs11.ObjectHandle) error {
+	b.active = true
+
+	return nil
+}
+
+func (b *rawRSABackend) VerifyRecover(_ pkcs11.SessionHandle, signature []byte) ([]byte, error) {
+	if !b.active {
+		return nil, pkcs11.Error(pkcs11.CKR_OPERATION_NOT_INITIALIZED)
+	}
+
+	b.active = false
+
+	return new(big.Int).Exp(new(big.Int).SetBytes(signature), big.NewInt(int64(b.key.E)), b.key.N).Bytes(), nil
+}
+
+func TestSignRecoverVerifyRecoverRawRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := openTestSession(t, &rawRSABackend{key: key})
+	data := []byte("recoverable message")
+
+	if rv := goSignRecoverInit(h, testMechanism(t, pkcs11.CKM_RSA_X_509, nil, 0), 2); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_SignRecoverInit returned %s", RVTrace(uint(rv)))
+	}
+
+	// Each call of the two-call idiom, including one with a buffer that's
+	// too small, must be served by the single backend call.
+	var signatureLen ckULong
+	if rv := goSignRecover(h, bytePtr(data), ckULong(len(data)), nil, &signatureLen); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_SignRecover length query returned %s", RVTrace(uint(rv)))
+	}
+
+	signature := make([]byte, signatureLen)
+	tooSmall := ckULong(1)
+
+	if rv := goSignRecover(h, bytePtr(data), ckULong(len(data)), bytePtr(signature), &tooSmall); rv != pkcs11.CKR_BUFFER_TOO_SMALL || tooSmall != signatureLen {
+		t.Fatalf("C_SignRecover with a short buffer returned %s and length %d, want CKR_BUFFER_TOO_SMALL and %d", RVTrace(uint(rv)), tooSmall, signatureLen)
+	}
+
+	if rv := goSignRecover(h, bytePtr(data), ckULong(len(data)), bytePtr(signature), &signatureLen); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_SignRecover returned %s", RVTrace(uint(rv)))
+	}
+
+	if rv := goVerifyRecoverInit(h, testMechanism(t, pkcs11.CKM_RSA_X_509, nil, 0), 3); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_VerifyRecoverInit returned %s", RVTrace(uint(rv)))
+	}
+
+	recovered := make([]byte, len(data))
+	recoveredLen := ckULong(1)
+
+	if rv := goVerifyRecover(h, bytePtr(signature), signatureLen, bytePtr(recovered), &recoveredLen); rv != pkcs11.CKR_BUFFER_TOO_SMALL || recoveredLen != ckULong(len(data)) {
+		t.Fatalf("C_VerifyRecover with a short buffer returned %s and length %d, want CKR_BUFFER_TOO_SMALL and %d", RVTrace(uint(rv)), recoveredLen, len(data))
+	}
+
+	if rv := goVerifyRecover(h, bytePtr(signature), signatureLen, bytePtr(recovered), &recoveredLen); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_VerifyRecover returned %s", RVTrace(uint(rv)))
+	}
+
+	if !bytes.Equal(recovered[:recoveredLen], data) {
+		t.Errorf("recovered %q, want %q", recovered[:recoveredLen], data)
+	}
+
+	// A new operation mustn't be served from a result left over from an
+	// abandoned one.
+	if rv := goSignRecoverInit(h, testMechanism(t, pkcs11.CKM_RSA_X_509, nil, 0), 2); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_SignRecoverInit returned %s", RVTrace(uint(rv)))
+	}
+
+	if rv := goSignRecover(h, bytePtr(data), ckULong(len(data)), nil, &signatureLen); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_SignRecover length query returned %s", RVTrace(uint(rv)))
+	}
+
+	other := []byte("another message")
+	signature = make([]byte, key.Size())
+	signatureLen = ckULong(len(signature))
+
+	if rv := goSignRecoverInit(h, testMechanism(t, pkcs11.CKM_RSA_X_509, nil, 0), 2); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_SignRecoverInit returned %s", RVTrace(uint(rv)))
+	}
+
+	if rv := goSignRecover(h, bytePtr(other), ckULong(len(other)), bytePtr(signature), &signatureLen); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_SignRecover returned %s", RVTrace(uint(rv)))
+	}
+
+	want := new(big.Int).Exp(new(big.Int).SetBytes(other), key.D, key.N).Bytes()
+	if !bytes.Equal(signature[:signatureLen], want) {
+		t.Error("C_SignRecover returned the abandoned operation's signature")
+	}
+}
+
+// oaepBackend implements CKM_RSA_PKCS_OAEP C_Decrypt with SHA-256, ending the
+// operation after the first call.
+type oaepBackend struct {
+	testBackend
+	key    *rsa.PrivateKey
+	active bool
+}
+
+func (b *oaepBackend) DecryptInit(_ pkcs11.SessionHandle, m []*pkcs11.Mechanism, _ pkcs11.ObjectHandle) error {
+	if m[0].Mechanism != pkcs11.CKM_RSA_PKCS_OAEP {
+		return pkcs11.Error(pkcs11.CKR_MECHANISM_INVALID)
+	}
+
+	b.active = true
+
+	return nil
+}
+
+func (b *oaepBackend) Decrypt(_ pkcs11.SessionHandle, ciphertext []byte) ([]byte, error) {
+	if !b.active {
+		return nil, pkcs11.Error(pkcs11.CKR_OPERATION_NOT_INITIALIZED)
+	}
+
+	b.active = false
+
+	return rsa.DecryptOAEP(sha256.New(), nil, b.key, ciphertext, nil)
+}
+
+func TestDecryptOAEPTwoCall(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := openTestSession(t, &oaepBackend{key: key})
+
+	params := _Ctype_CK_RSA_PKCS_OAEP_PARAMS{
+		hashAlg: pkcs11.CKM_SHA256,
+		mgf:     pkcs11.CKG_MGF1_SHA256,
+		source:  pkcs11.CKZ_DATA_SPECIFIED,
+	}
+
+	decryptInit := func() {
+		t.Helper()
+
+		m := testMechanism(t, pkcs11.CKM_RSA_PKCS_OAEP, unsafe.Pointer(&params), unsafe.Sizeof(params))
+		if rv := goDecryptInit(h, m, 2); rv != pkcs11.CKR_OK {
+			t.Fatalf("C_DecryptInit returned %s", RVTrace(uint(rv)))
+		}
+	}
+
+	encrypt := func(plaintext []byte) []byte {
+		t.Helper()
+
+		ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, &key.PublicKey, plaintext, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return ciphertext
+	}
+
+	plaintext := []byte("two-call plaintext")
+	ciphertext := encrypt(plaintext)
+
+	decryptInit()
+
+	var dataLen ckULong
+	if rv := goDecrypt(h, bytePtr(ciphertext), ckULong(len(ciphertext)), nil, &dataLen); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_Decrypt length query returned %s", RVTrace(uint(rv)))
+	}
+
+	if dataLen < ckULong(len(plaintext)) {
+		t.Fatalf("C_Decrypt reported length %d, want at least %d", dataLen, len(plaintext))
+	}
+
+	data := make([]byte, key.Size())
+	tooSmall := ckULong(len(plaintext) - 1)
+
+	if rv := goDecrypt(h, bytePtr(ciphertext), ckULong(len(ciphertext)), bytePtr(data), &tooSmall); rv != pkcs11.CKR_BUFFER_TOO_SMALL || tooSmall != ckULong(len(plaintext)) {
+		t.Fatalf("C_Decrypt with a short buffer returned %s and length %d, want CKR_BUFFER_TOO_SMALL and %d", RVTrace(uint(rv)), tooSmall, len(plaintext))
+	}
+
+	dataLen = ckULong(len(data))
+	if rv := goDecrypt(h, bytePtr(ciphertext), ckULong(len(ciphertext)), bytePtr(data), &dataLen); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_Decrypt returned %s", RVTrace(uint(rv)))
+	}
+
+	if !bytes.Equal(data[:dataLen], plaintext) {
+		t.Errorf("decrypted %q, want %q", data[:dataLen], plaintext)
+	}
+
+	// An operation abandoned after the length query mustn't leak its
+	// plaintext into the next one.
+	decryptInit()
+
+	if rv := goDecrypt(h, bytePtr(ciphertext), ckULong(len(ciphertext)), nil, &dataLen); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_Decrypt length query returned %s", RVTrace(uint(rv)))
+	}
+
+	other := []byte("another plaintext")
+	otherCiphertext := encrypt(other)
+
+	decryptInit()
+
+	dataLen = ckULong(len(data))
+	if rv := goDecrypt(h, bytePtr(otherCiphertext), ckULong(len(otherCiphertext)), bytePtr(data), &dataLen); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_Decrypt returned %s", RVTrace(uint(rv)))
+	}
+
+	if !bytes.Equal(data[:dataLen], other) {
+		t.Errorf("decrypted %q, want %q", data[:dataLen], other)
+	}
+}
+
+type tokenMemoryBackend struct {
+	testBackend
+}
+
+func (tokenMemoryBackend) GetTokenInfo(uint) (pkcs11.TokenInfo, error) {
+	return pkcs11.TokenInfo{
+		TotalPublicMemory:  pkcs11.CK_UNAVAILABLE_INFORMATION,
+		FreePublicMemory:   0,
+		TotalPrivateMemory: 4096,
+		FreePrivateMemory:  pkcs11.CK_UNAVAILABLE_INFORMATION,
+	}, nil
+}
+
+func TestGetTokenInfoMemory(t *testing.T) {
+	openTestSession(t, tokenMemoryBackend{})
+
+	var info _Ctype_CK_TOKEN_INFO
+	if rv := goGetTokenInfo(0, &info); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_GetTokenInfo returned %s", RVTrace(uint(rv)))
+	}
+
+	unavailable := ^ckULong(0)
+
+	for _, tt := range []struct {
+		name      string
+		got, want ckULong
+	}{
+		{"ulTotalPublicMemory", info.ulTotalPublicMemory, unavailable},
+		{"ulFreePublicMemory", info.ulFreePublicMemory, 0},
+		{"ulTotalPrivateMemory", info.ulTotalPrivateMemory, 4096},
+		{"ulFreePrivateMemory", info.ulFreePrivateMemory, unavailable},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s is 0x%x, want 0x%x", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+// defaultTemplateBackend has defaults for data objects, and records the
+// template of the last object created.
+type defaultTemplateBackend struct {
+	testBackend
+	created []*pkcs11.Attribute
+}
+
+func (*defaultTemplateBackend) DefaultTemplate(class uint) []*pkcs11.Attribute {
+	if class != pkcs11.CKO_DATA {
+		return nil
+	}
+
+	return []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, "default label"),
+	}
+}
+
+func (b *defaultTemplateBackend) CreateObject(_ pkcs11.SessionHandle, template []*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	b.created = template
+
+	return 2, nil
+}
+
+func TestCreateObjectDefaultTemplate(t *testing.T) {
+	b := &defaultTemplateBackend{}
+	h := openTestSession(t, b)
+
+	pTemplate, ulCount := testTemplate(t, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_DATA),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, "my label"),
+	})
+
+	var object ckObjectHandle
+	if rv := goCreateObject(h, pTemplate, ulCount, &object); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_CreateObject returned %s", RVTrace(uint(rv)))
+	}
+
+	// The omitted CKA_TOKEN is filled in, but the application's CKA_LABEL
+	// takes precedence over the default.
+	want := map[uint][]byte{
+		pkcs11.CKA_CLASS: pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_DATA).Value,
+		pkcs11.CKA_LABEL: []byte("my label"),
+		pkcs11.CKA_TOKEN: {1},
+	}
+
+	if len(b.created) != len(want) {
+		t.Errorf("the backend got %d attributes, want %d", len(b.created), len(want))
+	}
+
+	for _, a := range b.created {
+		if !bytes.Equal(a.Value, want[a.Type]) {
+			t.Errorf("the backend got %s", AttrTrace(a))
+		}
+	}
+}
+
+// objectStoreBackend keeps the objects created in it, and supports searching
+// them by exact attribute values.
+type objectStoreBackend struct {
+	testBackend
+	objects [][]*pkcs11.Attribute
+	search  []pkcs11.ObjectHandle
+	active  bool
+}
+
+func (b *objectStoreBackend) CreateObject(_ pkcs11.SessionHandle, template []*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	b.objects = append(b.objects, template)
+
+	return pkcs11.ObjectHandle(len(b.objects)), nil
+}
+
+func (b *objectStoreBackend) GenerateKeyPair(_ pkcs11.SessionHandle, _ []*pkcs11.Mechanism, public, private []*pkcs11.Attribute) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	b.objects = append(b.objects, public, private)
+
+	return pkcs11.ObjectHandle(len(b.objects) - 1), pkcs11.ObjectHandle(len(b.objects)), nil
+}
+
+func (b *objectStoreBackend) FindObjectsInit(_ pkcs11.SessionHandle, template []*pkcs11.Attribute) error {
+	if b.active {
+		return pkcs11.Error(pkcs11.CKR_OPERATION_ACTIVE)
+	}
+
+	b.active = true
+	b.search = nil
+
+	for i, object := range b.objects {
+		if matchesTemplate(object, template) {
+			b.search = append(b.search, pkcs11.ObjectHandle(i+1))
+		}
+	}
+
+	return nil
+}
+
+// matchesTemplate reports whether object has every attribute in template,
+// with the same value.
+func matchesTemplate(object, template []*pkcs11.Attribute) bool {
+	for _, want := range template {
+		found := false
+
+		for _, a := range object {
+			if a.Type == want.Type && bytes.Equal(a.Value, want.Value) {
+				found = true
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (b *objectStoreBackend) FindObjects(_ pkcs11.SessionHandle, max int) ([]pkcs11.ObjectHandle, bool, error) {
+	if !b.active {
+		return nil, false, pkcs11.Error(pkcs11.CKR_OPERATION_NOT_INITIALIZED)
+	}
+
+	n := min(max, len(b.search))
+	found := b.search[:n]
+	b.search = b.search[n:]
+
+	return found, false, nil
+}
+
+func (b *objectStoreBackend) FindObjectsFinal(pkcs11.SessionHandle) error {
+	if !b.active {
+		return pkcs11.Error(pkcs11.CKR_OPERATION_NOT_INITIALIZED)
+	}
+
+	b.active = false
+
+	return nil
+}
+
+func TestEnforceUniqueID(t *testing.T) {
+	SetEnforceUniqueID(true)
+	t.Cleanup(func() { SetEnforceUniqueID(false) })
+
+	b := &objectStoreBackend{}
+	h := openTestSession(t, b)
+
+	createObject := func(class uint, id string) _Ctype_CK_RV {
+		t.Helper()
+
+		pTemplate, ulCount := testTemplate(t, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+			pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+		})
+
+		var object ckObjectHandle
+
+		return goCreateObject(h, pTemplate, ulCount, &object)
+	}
+
+	if rv := createObject(pkcs11.CKO_PRIVATE_KEY, "key 1"); rv != pkcs11.CKR_OK {
+		t.Fatalf("creating the first key returned %s", RVTrace(uint(rv)))
+	}
+
+	if rv := createObject(pkcs11.CKO_PRIVATE_KEY, "key 1"); rv != pkcs11.CKR_ATTRIBUTE_VALUE_INVALID {
+		t.Errorf("creating a second key with the same CKA_ID returned %s, want CKR_ATTRIBUTE_VALUE_INVALID", RVTrace(uint(rv)))
+	}
+
+	// The key's certificate can share its CKA_ID.
+	if rv := createObject(pkcs11.CKO_CERTIFICATE, "key 1"); rv != pkcs11.CKR_OK {
+		t.Errorf("creating a certificate with the key's CKA_ID returned %s", RVTrace(uint(rv)))
+	}
+
+	pPublicTemplate, ulPublicCount := testTemplate(t, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_ID, "key 2")})
+	pPrivateTemplate, ulPrivateCount := testTemplate(t, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_ID, "key 1")})
+
+	var public, private ckObjectHandle
+	if rv := goGenerateKeyPair(h, testMechanism(t, pkcs11.CKM_EC_KEY_PAIR_GEN, nil, 0), pPublicTemplate, ulPublicCount, pPrivateTemplate, ulPrivateCount, &public, &private); rv != pkcs11.CKR_ATTRIBUTE_VALUE_INVALID {
+		t.Errorf("generating a key pair with a used private CKA_ID returned %s, want CKR_ATTRIBUTE_VALUE_INVALID", RVTrace(uint(rv)))
+	}
+
+	// The check can't run while the application is searching, so the
+	// object mustn't be created unchecked.
+	pTemplate, ulCount := testTemplate(t, nil)
+	if rv := goFindObjectsInit(h, pTemplate, ulCount); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_FindObjectsInit returned %s", RVTrace(uint(rv)))
+	}
+
+	created := len(b.objects)
+
+	if rv := createObject(pkcs11.CKO_PRIVATE_KEY, "key 1"); rv != pkcs11.CKR_OPERATION_ACTIVE {
+		t.Errorf("creating a key during a search returned %s, want CKR_OPERATION_ACTIVE", RVTrace(uint(rv)))
+	}
+
+	if len(b.objects) != created {
+		t.Error("a key was created without checking its CKA_ID")
+	}
+
+	if rv := goFindObjectsFinal(h); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_FindObjectsFinal returned %s", RVTrace(uint(rv)))
+	}
+}
+
+// gcmBackend records the CKM_AES_GCM parameters of each C_Encrypt, as seen by
+// the backend at that point.
+type gcmBackend struct {
+	testBackend
+	mechanism *pkcs11.Mechanism
+	iv, aad   []byte
+}
+
+func (b *gcmBackend) EncryptInit(_ pkcs11.SessionHandle, m []*pkcs11.Mechanism, _ pkcs11.ObjectHandle) error {
+	b.mechanism = m[0]
+
+	return nil
+}
+
+func (b *gcmBackend) Encrypt(_ pkcs11.SessionHandle, data []byte) ([]byte, error) {
+	// pkcs11.GCMParams doesn't export its IV and AAD until it's serialized
+	// for a token, so read them with reflection.
+	params := reflect.ValueOf(b.mechanism).Elem().FieldByName("generator").Elem().Elem()
+	b.iv = append([]byte(nil), params.FieldByName("iv").Bytes()...)
+	b.aad = append([]byte(nil), params.FieldByName("aad").Bytes()...)
+
+	return append(append([]byte(nil), data...), make([]byte, 16)...), nil
+}
+
+func TestEncryptInitCopiesGCMParams(t *testing.T) {
+	b := &gcmBackend{}
+	h := openTestSession(t, b)
+
+	iv := []byte("0123456789ab")
+	aad := []byte("associated data")
+	wantIV := append([]byte(nil), iv...)
+	wantAAD := append([]byte(nil), aad...)
+
+	var pinner runtime.Pinner
+
+	pinner.Pin(&iv[0])
+	pinner.Pin(&aad[0])
+	t.Cleanup(pinner.Unpin)
+
+	params := _Ctype_CK_GCM_PARAMS{
+		pIv:       bytePtr(iv),
+		ulIvLen:   ckULong(len(iv)),
+		ulIvBits:  ckULong(len(iv) * 8),
+		pAAD:      bytePtr(aad),
+		ulAADLen:  ckULong(len(aad)),
+		ulTagBits: 128,
+	}
+
+	if rv := goEncryptInit(h, testMechanism(t, pkcs11.CKM_AES_GCM, unsafe.Pointer(&params), unsafe.Sizeof(params)), 2); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_EncryptInit returned %s", RVTrace(uint(rv)))
+	}
+
+	// The application may reuse its parameters as soon as C_EncryptInit
+	// returns.
+	copy(iv, "XXXXXXXXXXXX")
+	copy(aad, "YYYYYYYYYYYYYYY")
+	params = _Ctype_CK_GCM_PARAMS{}
+
+	data := []byte("plaintext")
+	ciphertext := make([]byte, len(data)+16)
+	ciphertextLen := ckULong(len(ciphertext))
+
+	if rv := goEncrypt(h, bytePtr(data), ckULong(len(data)), bytePtr(ciphertext), &ciphertextLen); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_Encrypt returned %s", RVTrace(uint(rv)))
+	}
+
+	if !bytes.Equal(b.iv, wantIV) {
+		t.Errorf("the backend used IV %q, want %q", b.iv, wantIV)
+	}
+
+	if !bytes.Equal(b.aad, wantAAD) {
+		t.Errorf("the backend used AAD %q, want %q", b.aad, wantAAD)
+	}
+}
+
+// attributeBackend answers GetAttributeValue the way a typical token does:
+// a template with a sensitive or unknown attribute fails as a whole, and the
+// attributes in it have to be fetched one at a time.
+type attributeBackend struct {
+	testBackend
+	values map[uint][]byte
+	// dropped attributes are left out of the results without an error.
+	dropped map[uint]bool
+	// empty attributes are returned with a nil Value.
+	empty map[uint]bool
+}
+
+func (b attributeBackend) GetAttributeValue(_ pkcs11.SessionHandle, _ pkcs11.ObjectHandle, template []*pkcs11.Attribute) ([]*pkcs11.Attribute, error) {
+	results := make([]*pkcs11.Attribute, 0, len(template))
+
+	for _, a := range template {
+		switch {
+		case b.dropped[a.Type]:
+			continue
+		case b.empty[a.Type]:
+			results = append(results, &pkcs11.Attribute{Type: a.Type})
+
+			continue
+		case a.Type == pkcs11.CKA_VALUE:
+			return nil, pkcs11.Error(pkcs11.CKR_ATTRIBUTE_SENSITIVE)
+		case b.values[a.Type] == nil:
+			return nil, pkcs11.Error(pkcs11.CKR_ATTRIBUTE_TYPE_INVALID)
+		}
+
+		results = append(results, pkcs11.NewAttribute(a.Type, b.values[a.Type]))
+	}
+
+	return results, nil
+}
+
+func TestGetAttributeValueErrors(t *testing.T) {
+	const unknownType = pkcs11.CKA_VENDOR_DEFINED | 0x42
+
+	unavailable := ckULong(pkcs11.CK_UNAVAILABLE_INFORMATION)
+
+	b := attributeBackend{values: map[uint][]byte{
+		pkcs11.CKA_LABEL: []byte("a long label"),
+		pkcs11.CKA_ID:    {0x01, 0x02},
+	}}
+	sh := openTestSession(t, b)
+
+	// Every condition at once: the label's buffer is too small, CKA_VALUE
+	// is sensitive and the vendor type is unknown.  CKA_ID still gets
+	// its value.
+	pTemplate, count := testTemplate(t, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, make([]byte, 4)),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, make([]byte, 4)),
+		pkcs11.NewAttribute(unknownType, make([]byte, 4)),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, make([]byte, 4)),
+	})
+
+	if rv := goGetAttributeValue(sh, 1, pTemplate, count); rv != pkcs11.CKR_BUFFER_TOO_SMALL {
+		t.Errorf("got %s, want CKR_BUFFER_TOO_SMALL", RVTrace(uint(rv)))
+	}
+
+	attrs := unsafe.Slice(pTemplate, count)
+	for i, want := range []ckULong{unavailable, unavailable, unavailable, 2} {
+		if attrs[i].ulValueLen != want {
+			t.Errorf("attribute %d: got length 0x%x, want 0x%x", i, attrs[i].ulValueLen, want)
+		}
+	}
+
+	// Without the short buffer, CKR_ATTRIBUTE_SENSITIVE takes precedence
+	// over CKR_ATTRIBUTE_TYPE_INVALID.
+	pTemplate, count = testTemplate(t, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(unknownType, make([]byte, 4)),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, make([]byte, 4)),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, make([]byte, 16)),
+	})
+
+	if rv := goGetAttributeValue(sh, 1, pTemplate, count); rv != pkcs11.CKR_ATTRIBUTE_SENSITIVE {
+		t.Errorf("got %s, want CKR_ATTRIBUTE_SENSITIVE", RVTrace(uint(rv)))
+	}
+
+	// A backend that leaves an attribute out without an error gets it
+	// reported as CKR_ATTRIBUTE_TYPE_INVALID.
+	b.dropped = map[uint]bool{pkcs11.CKA_ID: true}
+	sh = openTestSession(t, b)
+	pTemplate, count = testTemplate(t, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, make([]byte, 16)),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, make([]byte, 4)),
+	})
+
+	if rv := goGetAttributeValue(sh, 1, pTemplate, count); rv != pkcs11.CKR_ATTRIBUTE_TYPE_INVALID {
+		t.Errorf("dropped attribute: got %s, want CKR_ATTRIBUTE_TYPE_INVALID", RVTrace(uint(rv)))
+	}
+
+	attrs = unsafe.Slice(pTemplate, count)
+	if attrs[0].ulValueLen != ckULong(len("a long label")) || attrs[1].ulValueLen != unavailable {
+		t.Errorf("dropped attribute: got lengths 0x%x and 0x%x", attrs[0].ulValueLen, attrs[1].ulValueLen)
+	}
+
+	// An empty CKA_LABEL is returned as such, whether or not the backend
+	// answers positionally.
+	b.dropped = map[uint]bool{pkcs11.CKA_ID: true}
+	b.empty = map[uint]bool{pkcs11.CKA_LABEL: true}
+	sh = openTestSession(t, b)
+
+	for _, template := range [][]*pkcs11.Attribute{
+		{pkcs11.NewAttribute(pkcs11.CKA_LABEL, make([]byte, 16))},
+		{pkcs11.NewAttribute(pkcs11.CKA_ID, make([]byte, 4)), pkcs11.NewAttribute(pkcs11.CKA_LABEL, make([]byte, 16))},
+	} {
+		pTemplate, count = testTemplate(t, template)
+		wantRV := uint(pkcs11.CKR_OK)
+
+		if len(template) > 1 {
+			wantRV = pkcs11.CKR_ATTRIBUTE_TYPE_INVALID
+		}
+
+		if rv := goGetAttributeValue(sh, 1, pTemplate, count); uint(rv) != wantRV {
+			t.Errorf("empty label in a %d-attribute template: got %s, want %s", count, RVTrace(uint(rv)), RVTrace(wantRV))
+		}
+
+		if label := unsafe.Slice(pTemplate, count)[count-1]; label.ulValueLen != 0 {
+			t.Errorf("empty label in a %d-attribute template: got length 0x%x, want 0", count, label.ulValueLen)
+		}
+	}
+}
+
+type noSlotsBackend struct {
+	testBackend
+}
+
+func (noSlotsBackend) GetSlotList(bool) ([]uint, error) {
+	return nil, nil
+}
+
+func TestGetSlotListNoSlots(t *testing.T) {
+	oldBackend := backend
+
+	SetBackend(noSlotsBackend{})
+	t.Cleanup(func() { SetBackend(oldBackend) })
+
+	count := ckULong(5)
+	if rv := goGetSlotList(pkcs11.CK_TRUE, nil, &count); rv != pkcs11.CKR_OK || count != 0 {
+		t.Errorf("count call: got %s with count %d, want CKR_OK with 0", RVTrace(uint(rv)), count)
+	}
+
+	slots := []_Ctype_CK_SLOT_ID{0x42, 0x42}
+	count = ckULong(len(slots))
+
+	if rv := goGetSlotList(pkcs11.CK_TRUE, &slots[0], &count); rv != pkcs11.CKR_OK || count != 0 {
+		t.Errorf("list call: got %s with count %d, want CKR_OK with 0", RVTrace(uint(rv)), count)
+	}
+
+	if slots[0] != 0x42 || slots[1] != 0x42 {
+		t.Errorf("list call wrote to the slot list: %v", slots)
+	}
+}
+
+// sunpkcs11Backend lists mechanisms, but doesn't implement
+// GetMechanismInfo.
+type sunpkcs11Backend struct {
+	testBackend
+}
+
+func (sunpkcs11Backend) GetSlotList(bool) ([]uint, error) {
+	return []uint{0}, nil
+}
+
+func (sunpkcs11Backend) GetTokenInfo(uint) (pkcs11.TokenInfo, error) {
+	return pkcs11.TokenInfo{Label: "test"}, nil
+}
+
+func (sunpkcs11Backend) GetMechanismList(uint) ([]*pkcs11.Mechanism, error) {
+	return []*pkcs11.Mechanism{
+		pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil),
+		pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil),
+	}, nil
+}
+
+func (sunpkcs11Backend) GetMechanismInfo(uint, []*pkcs11.Mechanism) (pkcs11.MechanismInfo, error) {
+	return pkcs11.MechanismInfo{}, pkcs11.Error(pkcs11.CKR_FUNCTION_NOT_SUPPORTED)
+}
+
+func TestSunPKCS11Probe(t *testing.T) {
+	oldBackend, oldCompat := backend, sunpkcs11Compat
+
+	SetBackend(sunpkcs11Backend{})
+
+	sunpkcs11Compat = true
+
+	t.Cleanup(func() {
+		SetBackend(oldBackend)
+
+		sunpkcs11Compat = oldCompat
+	})
+
+	// SunPKCS11 finds the slot, reads its token info, fetches the mechanism
+	// list with the two-call idiom and then queries each mechanism's info.
+	var count ckULong
+	if rv := goGetSlotList(pkcs11.CK_TRUE, nil, &count); rv != pkcs11.CKR_OK || count != 1 {
+		t.Fatalf("C_GetSlotList count: got %s with %d slots", RVTrace(uint(rv)), count)
+	}
+
+	slots := make([]_Ctype_CK_SLOT_ID, count)
+	if rv := goGetSlotList(pkcs11.CK_TRUE, &slots[0], &count); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_GetSlotList: got %s", RVTrace(uint(rv)))
+	}
+
+	var tokenInfo _Ctype_CK_TOKEN_INFO
+	if rv := goGetTokenInfo(slots[0], &tokenInfo); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_GetTokenInfo: got %s", RVTrace(uint(rv)))
+	}
+
+	if rv := goGetMechanismList(slots[0], nil, &count); rv != pkcs11.CKR_OK || count != 2 {
+		t.Fatalf("C_GetMechanismList count: got %s with %d mechanisms", RVTrace(uint(rv)), count)
+	}
+
+	mechanisms := make([]_Ctype_CK_MECHANISM_TYPE, count)
+	if rv := goGetMechanismList(slots[0], &mechanisms[0], &count); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_GetMechanismList: got %s", RVTrace(uint(rv)))
+	}
+
+	for _, mechanism := range mechanisms {
+		info := _Ctype_CK_MECHANISM_INFO{ulMinKeySize: 1, ulMaxKeySize: 1, flags: pkcs11.CKF_SIGN}
+		if rv := goGetMechanismInfo(slots[0], mechanism, &info); rv != pkcs11.CKR_OK {
+			t.Errorf("C_GetMechanismInfo(%s): got %s, want CKR_OK", traceValueName(uint(mechanism), strCKM), RVTrace(uint(rv)))
+		}
+
+		if info.ulMinKeySize != 0 || info.ulMaxKeySize != 0 || info.flags != 0 {
+			t.Errorf("C_GetMechanismInfo(%s): got %+v, want empty info", traceValueName(uint(mechanism), strCKM), info)
+		}
+	}
+
+	var info _Ctype_CK_MECHANISM_INFO
+	if rv := goGetMechanismInfo(slots[0], pkcs11.CKM_AES_GCM, &info); rv != pkcs11.CKR_MECHANISM_INVALID {
+		t.Errorf("C_GetMechanismInfo of an unlisted mechanism: got %s, want CKR_MECHANISM_INVALID", RVTrace(uint(rv)))
+	}
+}
+
+// removedTokenBackend records which functions reached it.
+type removedTokenBackend struct {
+	testBackend
+	called map[string]bool
+}
+
+func (b removedTokenBackend) GetTokenInfo(uint) (pkcs11.TokenInfo, error) {
+	b.called["GetTokenInfo"] = true
+
+	return pkcs11.TokenInfo{}, nil
+}
+
+func (b removedTokenBackend) GetMechanismList(uint) ([]*pkcs11.Mechanism, error) {
+	b.called["GetMechanismList"] = true
+
+	return nil, nil
+}
+
+func (b removedTokenBackend) OpenSession(slotID uint, flags uint) (pkcs11.SessionHandle, error) {
+	b.called["OpenSession"] = true
+
+	return b.testBackend.OpenSession(slotID, flags)
+}
+
+func TestTokenNotPresent(t *testing.T) {
+	const removedSlot = 1
+
+	b := removedTokenBackend{called: map[string]bool{}}
+	oldBackend, oldSlotHasToken := backend, slotHasToken
+
+	SetBackend(b)
+	SetSlotHasToken(func(slotID uint) bool { return slotID != removedSlot })
+
+	t.Cleanup(func() {
+		SetBackend(oldBackend)
+		SetSlotHasToken(oldSlotHasToken)
+	})
+
+	var tokenInfo _Ctype_CK_TOKEN_INFO
+	if rv := goGetTokenInfo(removedSlot, &tokenInfo); rv != pkcs11.CKR_TOKEN_NOT_PRESENT {
+		t.Errorf("C_GetTokenInfo: got %s, want CKR_TOKEN_NOT_PRESENT", RVTrace(uint(rv)))
+	}
+
+	var count ckULong
+	if rv := goGetMechanismList(removedSlot, nil, &count); rv != pkcs11.CKR_TOKEN_NOT_PRESENT {
+		t.Errorf("C_GetMechanismList: got %s, want CKR_TOKEN_NOT_PRESENT", RVTrace(uint(rv)))
+	}
+
+	var h ckSessionHandle
+	if rv := goOpenSession(removedSlot, pkcs11.CKF_SERIAL_SESSION, &h); rv != pkcs11.CKR_TOKEN_NOT_PRESENT {
+		t.Errorf("C_OpenSession: got %s, want CKR_TOKEN_NOT_PRESENT", RVTrace(uint(rv)))
+	}
+
+	if len(b.called) != 0 {
+		t.Errorf("the backend was called for the removed token: %v", b.called)
+	}
+
+	// The slot with a token still reaches the backend.
+	if rv := goGetTokenInfo(0, &tokenInfo); rv != pkcs11.CKR_OK || !b.called["GetTokenInfo"] {
+		t.Errorf("C_GetTokenInfo with a token: got %s, called %v", RVTrace(uint(rv)), b.called)
+	}
+}
+
+// slotInfoBackend reports flags for every slot.
+type slotInfoBackend struct {
+	testBackend
+	flags uint
+}
+
+func (b slotInfoBackend) GetSlotInfo(uint) (pkcs11.SlotInfo, error) {
+	return pkcs11.SlotInfo{Flags: b.flags}, nil
+}
+
+func TestGetSlotInfoInconsistentFlags(t *testing.T) {
+	const undefinedFlag = 0x100
+
+	oldBackend, oldSlotHasToken, oldStrict := backend, slotHasToken, strictValidation
+
+	// The backend claims a token the hook says was removed, from a slot that
+	// isn't removable, and sets a flag the spec doesn't define.
+	SetBackend(slotInfoBackend{flags: pkcs11.CKF_TOKEN_PRESENT | pkcs11.CKF_HW_SLOT | undefinedFlag})
+	SetSlotHasToken(func(uint) bool { return false })
+
+	t.Cleanup(func() {
+		SetBackend(oldBackend)
+		SetSlotHasToken(oldSlotHasToken)
+		strictValidation = oldStrict
+	})
+
+	tests := []struct {
+		strict bool
+		want   uint
+	}{
+		{false, pkcs11.CKF_HW_SLOT | undefinedFlag},
+		{true, pkcs11.CKF_HW_SLOT | pkcs11.CKF_REMOVABLE_DEVICE},
+	}
+
+	for _, tt := range tests {
+		strictValidation = tt.strict
+
+		var info _Ctype_CK_SLOT_INFO
+		if rv := goGetSlotInfo(0, &info); rv != pkcs11.CKR_OK {
+			t.Fatalf("strict %v: C_GetSlotInfo: %s", tt.strict, RVTrace(uint(rv)))
+		}
+
+		if got := uint(info.flags); got != tt.want {
+			t.Errorf("strict %v: got flags 0x%x, want 0x%x", tt.strict, got, tt.want)
+		}
+	}
+}
+
+func TestGetAttributeValueUniqueID(t *testing.T) {
+	b := attributeBackend{values: map[uint][]byte{CKA_UNIQUE_ID: []byte("object-7")}}
+	sh := openTestSession(t, b)
+
+	// The first call only asks for the length.
+	pTemplate, count := testTemplate(t, []*pkcs11.Attribute{{Type: CKA_UNIQUE_ID}})
+	if rv := goGetAttributeValue(sh, 1, pTemplate, count); rv != pkcs11.CKR_OK {
+		t.Fatalf("length query: got %s", RVTrace(uint(rv)))
+	}
+
+	length := unsafe.Slice(pTemplate, count)[0].ulValueLen
+	if length != ckULong(len("object-7")) {
+		t.Fatalf("length query: got length %d, want %d", length, len("object-7"))
+	}
+
+	value := make([]byte, length)
+	pTemplate, count = testTemplate(t, []*pkcs11.Attribute{pkcs11.NewAttribute(CKA_UNIQUE_ID, value)})
+
+	if rv := goGetAttributeValue(sh, 1, pTemplate, count); rv != pkcs11.CKR_OK {
+		t.Fatalf("fetch: got %s", RVTrace(uint(rv)))
+	}
+
+	if string(value) != "object-7" {
+		t.Errorf("fetch: got %q, want object-7", value)
+	}
+
+	oldSensitive := traceSensitive
+	traceSensitive = true
+
+	t.Cleanup(func() { traceSensitive = oldSensitive })
+
+	if got := AttrTrace(pkcs11.NewAttribute(CKA_UNIQUE_ID, value)); got != `CKA_UNIQUE_ID: "object-7"` {
+		t.Errorf("AttrTrace: got %q", got)
+	}
+
+	// A backend that leaves it out gets a warning in the trace.
+	buf := captureTrace(t, false)
+	b.dropped = map[uint]bool{CKA_UNIQUE_ID: true}
+	sh = openTestSession(t, b)
+
+	pTemplate, count = testTemplate(t, []*pkcs11.Attribute{{Type: CKA_UNIQUE_ID}})
+	if rv := goGetAttributeValue(sh, 1, pTemplate, count); rv != pkcs11.CKR_ATTRIBUTE_TYPE_INVALID {
+		t.Errorf("missing CKA_UNIQUE_ID: got %s, want CKR_ATTRIBUTE_TYPE_INVALID", RVTrace(uint(rv)))
+	}
+
+	if !strings.Contains(buf.String(), "didn't supply CKA_UNIQUE_ID") {
+		t.Errorf("no warning in the trace:\n%s", buf.String())
+	}
+}
+
+type selfTestBackend struct {
+	testBackend
+	err error
+}
+
+func (b selfTestBackend) SelfTest() error {
+	return b.err
+}
+
+func TestSelfTest(t *testing.T) {
+	oldBackend := backend
+
+	t.Cleanup(func() { SetBackend(oldBackend) })
+
+	for _, tt := range []struct {
+		name string
+		b    Backend
+		want ckRV
+	}{
+		{"failing", selfTestBackend{err: pkcs11.Error(pkcs11.CKR_DEVICE_ERROR)}, pkcs11.CKR_DEVICE_ERROR},
+		{"passing", selfTestBackend{}, pkcs11.CKR_OK},
+		{"unimplemented", testBackend{}, pkcs11.CKR_FUNCTION_NOT_SUPPORTED},
+	} {
+		SetBackend(tt.b)
+
+		if rv := goSelfTest(); rv != tt.want {
+			t.Errorf("%s self-test: got %s, want %s", tt.name, RVTrace(uint(rv)), RVTrace(uint(tt.want)))
+		}
+	}
+}
+
+// digestBackend implements SHA-256 digests.  Like a token, it ends the
+// operation once the digest has been returned.
+type digestBackend struct {
+	testBackend
+	h      hash.Hash
+	logins int
+}
+
+func (b *digestBackend) DigestInit(pkcs11.SessionHandle, []*pkcs11.Mechanism) error {
+	b.h = sha256.New()
+
+	return nil
+}
+
+func (b *digestBackend) Digest(_ pkcs11.SessionHandle, data []byte) ([]byte, error) {
+	if b.h == nil {
+		return nil, pkcs11.Error(pkcs11.CKR_OPERATION_NOT_INITIALIZED)
+	}
+
+	b.h.Write(data)
+	digest := b.h.Sum(nil)
+	b.h = nil
+
+	return digest, nil
+}
+
+func (b *digestBackend) DigestUpdate(_ pkcs11.SessionHandle, data []byte) error {
+	if b.h == nil {
+		return pkcs11.Error(pkcs11.CKR_OPERATION_NOT_INITIALIZED)
+	}
+
+	b.h.Write(data)
+
+	return nil
+}
+
+func (b *digestBackend) DigestFinal(sh pkcs11.SessionHandle) ([]byte, error) {
+	return b.Digest(sh, nil)
+}
+
+func (b *digestBackend) Login(pkcs11.SessionHandle, uint, string) error {
+	b.logins++
+
+	return nil
+}
+
+func TestLoginDuringDigest(t *testing.T) {
+	b := &digestBackend{}
+	h := openTestSession(t, b)
+	pin := []byte("1234")
+	first, second := []byte("before login, "), []byte("after login")
+	want := sha256.Sum256(append(append([]byte(nil), first...), second...))
+
+	digestInit := func() {
+		t.Helper()
+
+		if rv := goDigestInit(h, testMechanism(t, pkcs11.CKM_SHA256, nil, 0)); rv != pkcs11.CKR_OK {
+			t.Fatalf("C_DigestInit: got %s", RVTrace(uint(rv)))
+		}
+	}
+
+	login := func() {
+		t.Helper()
+
+		if rv := goLogin(h, pkcs11.CKU_USER, (*_Ctype_CK_UTF8CHAR)(bytePtr(pin)), ckULong(len(pin))); rv != pkcs11.CKR_OK {
+			t.Fatalf("C_Login: got %s", RVTrace(uint(rv)))
+		}
+	}
+
+	// A multi-part digest.
+	digestInit()
+
+	if rv := goDigestUpdate(h, bytePtr(first), ckULong(len(first))); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_DigestUpdate: got %s", RVTrace(uint(rv)))
+	}
+
+	login()
+
+	if rv := goDigestUpdate(h, bytePtr(second), ckULong(len(second))); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_DigestUpdate after C_Login: got %s", RVTrace(uint(rv)))
+	}
+
+	digest := make([]byte, sha256.Size)
+	digestLen := ckULong(len(digest))
+
+	if rv := goDigestFinal(h, bytePtr(digest), &digestLen); rv != pkcs11.CKR_OK || !bytes.Equal(digest[:digestLen], want[:]) {
+		t.Errorf("C_DigestFinal after C_Login: got %s with %x, want %x", RVTrace(uint(rv)), digest[:digestLen], want)
+	}
+
+	// A single-part digest whose length was queried before logging in.
+	data := append(append([]byte(nil), first...), second...)
+
+	digestInit()
+
+	digestLen = 0
+	if rv := goDigest(h, bytePtr(data), ckULong(len(data)), nil, &digestLen); rv != pkcs11.CKR_OK || digestLen != sha256.Size {
+		t.Fatalf("C_Digest length query: got %s with length %d", RVTrace(uint(rv)), digestLen)
+	}
+
+	login()
+
+	clear(digest)
+
+	if rv := goDigest(h, bytePtr(data), ckULong(len(data)), bytePtr(digest), &digestLen); rv != pkcs11.CKR_OK || !bytes.Equal(digest, want[:]) {
+		t.Errorf("C_Digest after C_Login: got %s with %x, want %x", RVTrace(uint(rv)), digest, want)
+	}
+
+	if b.logins != 2 {
+		t.Errorf("the backend saw %d logins, want 2", b.logins)
+	}
+}
+
+// fewObjectsBackend always finds the same three objects, ignoring the
+// requested maximum, and records that maximum.
+type fewObjectsBackend struct {
+	testBackend
+	max *int
+}
+
+func (b fewObjectsBackend) FindObjects(_ pkcs11.SessionHandle, max int) ([]pkcs11.ObjectHandle, bool, error) {
+	*b.max = max
+
+	return []pkcs11.ObjectHandle{11, 12, 13}, false, nil
+}
+
+func TestFindObjectsHugeMax(t *testing.T) {
+	var max int
+
+	h := openTestSession(t, fewObjectsBackend{max: &max})
+	objects := make([]ckObjectHandle, 8)
+
+	var count ckULong
+	if rv := goFindObjects(h, &objects[0], ^ckULong(0), &count); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_FindObjects: got %s", RVTrace(uint(rv)))
+	}
+
+	if max <= 0 || max > maxFindObjectsCount {
+		t.Errorf("the backend was asked for %d objects, want at most %d", max, maxFindObjectsCount)
+	}
+
+	if count != 3 || objects[0] != 11 || objects[1] != 12 || objects[2] != 13 || objects[3] != 0 {
+		t.Errorf("got %d objects %v, want [11 12 13]", count, objects)
+	}
+
+	// Handles beyond the caller's maximum are never written.
+	clear(objects)
+
+	if rv := goFindObjects(h, &objects[0], 2, &count); rv != pkcs11.CKR_OK || count != 2 || objects[2] != 0 {
+		t.Errorf("C_FindObjects with a maximum of 2: got %s with %d objects %v", RVTrace(uint(rv)), count, objects)
+	}
+}
+
+// dedupAttributeBackend answers each attribute type only once, however many
+// times the template asks for it, and records the templates it receives.
+type dedupAttributeBackend struct {
+	attributeBackend
+	templates *[][]*pkcs11.Attribute
+}
+
+func (b dedupAttributeBackend) GetAttributeValue(sh pkcs11.SessionHandle, oh pkcs11.ObjectHandle, template []*pkcs11.Attribute) ([]*pkcs11.Attribute, error) {
+	*b.templates = append(*b.templates, template)
+
+	seen := map[uint]bool{}
+	unique := make([]*pkcs11.Attribute, 0, len(template))
+
+	for _, a := range template {
+		if !seen[a.Type] {
+			seen[a.Type] = true
+			unique = append(unique, a)
+		}
+	}
+
+	return b.attributeBackend.GetAttributeValue(sh, oh, unique)
+}
+
+func TestGetAttributeValueDuplicateTypes(t *testing.T) {
+	values := attributeBackend{values: map[uint][]byte{
+		pkcs11.CKA_LABEL: []byte("label"),
+		pkcs11.CKA_ID:    {0x01, 0x02},
+	}}
+
+	var templates [][]*pkcs11.Attribute
+
+	for _, b := range []Backend{values, dedupAttributeBackend{values, &templates}} {
+		sh := openTestSession(t, b)
+		label1, id, label2 := make([]byte, 8), make([]byte, 8), make([]byte, 8)
+
+		pTemplate, count := testTemplate(t, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, label1),
+			pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, label2),
+		})
+
+		if rv := goGetAttributeValue(sh, 1, pTemplate, count); rv != pkcs11.CKR_OK {
+			t.Fatalf("%T: got %s", b, RVTrace(uint(rv)))
+		}
+
+		attrs := unsafe.Slice(pTemplate, count)
+		if attrs[0].ulValueLen != 5 || attrs[1].ulValueLen != 2 || attrs[2].ulValueLen != 5 ||
+			string(label1[:5]) != "label" || !bytes.Equal(id[:2], []byte{0x01, 0x02}) || string(label2[:5]) != "label" {
+			t.Errorf("%T: got %q, %x and %q", b, label1, id, label2)
+		}
+	}
+
+	if len(templates) != 1 || len(templates[0]) != 3 {
+		t.Errorf("the backend didn't receive both CKA_LABEL entries: %v", templates)
+	}
+}
+
+// signInitBackend records the mechanism passed to SignInit.
+type signInitBackend struct {
+	testBackend
+	mechanism *uint
+}
+
+func (b signInitBackend) SignInit(_ pkcs11.SessionHandle, m []*pkcs11.Mechanism, _ pkcs11.ObjectHandle) error {
+	*b.mechanism = m[0].Mechanism
+
+	return nil
+}
+
+func TestMechanismRewriter(t *testing.T) {
+	var mechanism uint
+
+	h := openTestSession(t, signInitBackend{mechanism: &mechanism})
+
+	// The application hashes with SHA-256 itself, so the backend only has
+	// to implement raw PKCS #1 v1.5 signatures; MD5 is refused outright.
+	SetMechanismRewriter(func(function string, m *pkcs11.Mechanism) (*pkcs11.Mechanism, error) {
+		switch {
+		case function == "C_SignInit" && m.Mechanism == pkcs11.CKM_SHA256_RSA_PKCS:
+			return pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil), nil
+		case m.Mechanism == pkcs11.CKM_MD5_RSA_PKCS:
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_INVALID)
+		default:
+			return m, nil
+		}
+	})
+	t.Cleanup(func() { SetMechanismRewriter(nil) })
+
+	if rv := goSignInit(h, testMechanism(t, pkcs11.CKM_SHA256_RSA_PKCS, nil, 0), 2); rv != pkcs11.CKR_OK || mechanism != pkcs11.CKM_RSA_PKCS {
+		t.Errorf("CKM_SHA256_RSA_PKCS: got %s with %s reaching the backend, want CKM_RSA_PKCS", RVTrace(uint(rv)), traceValueName(mechanism, strCKM))
+	}
+
+	if rv := goSignInit(h, testMechanism(t, pkcs11.CKM_ECDSA, nil, 0), 2); rv != pkcs11.CKR_OK || mechanism != pkcs11.CKM_ECDSA {
+		t.Errorf("CKM_ECDSA: got %s with %s reaching the backend", RVTrace(uint(rv)), traceValueName(mechanism, strCKM))
+	}
+
+	mechanism = 0
+	if rv := goSignInit(h, testMechanism(t, pkcs11.CKM_MD5_RSA_PKCS, nil, 0), 2); rv != pkcs11.CKR_MECHANISM_INVALID || mechanism != 0 {
+		t.Errorf("CKM_MD5_RSA_PKCS: got %s with %s reaching the backend, want a veto", RVTrace(uint(rv)), traceValueName(mechanism, strCKM))
+	}
+}
+
+// hmacBackend implements CKM_SHA256_HMAC with a fixed key.  It fails if it's
+// given nil data, so that callers can tell that apart from empty data.
+type hmacBackend struct {
+	testBackend
+	mac hash.Hash
+}
+
+var hmacTestKey = []byte("pkcs11mod test key")
+
+func (b *hmacBackend) SignInit(pkcs11.SessionHandle, []*pkcs11.Mechanism, pkcs11.ObjectHandle) error {
+	b.mac = hmac.New(sha256.New, hmacTestKey)
+
+	return nil
+}
+
+func (b *hmacBackend) Sign(sh pkcs11.SessionHandle, data []byte) ([]byte, error) {
+	if err := b.SignUpdate(sh, data); err != nil {
+		return nil, err
+	}
+
+	return b.SignFinal(sh)
+}
+
+func (b *hmacBackend) SignUpdate(_ pkcs11.SessionHandle, data []byte) error {
+	if data == nil {
+		return pkcs11.Error(pkcs11.CKR_ARGUMENTS_BAD)
+	}
+
+	b.mac.Write(data)
+
+	return nil
+}
+
+func (b *hmacBackend) SignFinal(pkcs11.SessionHandle) ([]byte, error) {
+	return b.mac.Sum(nil), nil
+}
+
+func TestSignEmptyData(t *testing.T) {
+	h := openTestSession(t, &hmacBackend{})
+	want := hmac.New(sha256.New, hmacTestKey).Sum(nil)
+
+	signInit := func() {
+		t.Helper()
+
+		if rv := goSignInit(h, testMechanism(t, pkcs11.CKM_SHA256_HMAC, nil, 0), 2); rv != pkcs11.CKR_OK {
+			t.Fatalf("C_SignInit: got %s", RVTrace(uint(rv)))
+		}
+	}
+
+	// C_Sign with pData NULL and ulDataLen 0.
+	signInit()
+
+	signature := make([]byte, sha256.Size)
+	signatureLen := ckULong(len(signature))
+
+	if rv := goSign(h, nil, 0, bytePtr(signature), &signatureLen); rv != pkcs11.CKR_OK || !bytes.Equal(signature[:signatureLen], want) {
+		t.Errorf("C_Sign: got %s with %x, want %x", RVTrace(uint(rv)), signature[:signatureLen], want)
+	}
+
+	// C_SignFinal without any C_SignUpdate, with a length query first.
+	signInit()
+
+	signatureLen = 0
+	if rv := goSignFinal(h, nil, &signatureLen); rv != pkcs11.CKR_OK || signatureLen != sha256.Size {
+		t.Fatalf("C_SignFinal length query: got %s with length %d", RVTrace(uint(rv)), signatureLen)
+	}
+
+	clear(signature)
+
+	if rv := goSignFinal(h, bytePtr(signature), &signatureLen); rv != pkcs11.CKR_OK || !bytes.Equal(signature[:signatureLen], want) {
+		t.Errorf("C_SignFinal: got %s with %x, want %x", RVTrace(uint(rv)), signature[:signatureLen], want)
+	}
+}
+
+// errSlotOffline is the root cause of failingSignInitBackend's errors.
+var errSlotOffline = errors.New("HSM slot 7 is offline")
+
+type failingSignInitBackend struct {
+	testBackend
+}
+
+func (failingSignInitBackend) SignInit(pkcs11.SessionHandle, []*pkcs11.Mechanism, pkcs11.ObjectHandle) error {
+	return fmt.Errorf("loading key: %w: %w", errSlotOffline, pkcs11.Error(pkcs11.CKR_DEVICE_ERROR))
+}
+
+func TestLastError(t *testing.T) {
+	h := openTestSession(t, failingSignInitBackend{})
+
+	if err := LastError(uint(h)); err != nil {
+		t.Errorf("before any failure: got %v, want nil", err)
+	}
+
+	if rv := goSignInit(h, testMechanism(t, pkcs11.CKM_ECDSA, nil, 0), 2); rv != pkcs11.CKR_DEVICE_ERROR {
+		t.Fatalf("C_SignInit: got %s, want CKR_DEVICE_ERROR", RVTrace(uint(rv)))
+	}
+
+	err := LastError(uint(h))
+	if !errors.Is(err, errSlotOffline) || !errors.Is(err, pkcs11.Error(pkcs11.CKR_DEVICE_ERROR)) {
+		t.Errorf("got %v, want the backend's whole error chain", err)
+	}
+
+	if err := LastError(uint(h) + 1); err != nil {
+		t.Errorf("unknown session: got %v, want nil", err)
+	}
+}
+
+// closeCountingBackend counts the CloseSession calls that reach it.
+type closeCountingBackend struct {
+	testBackend
+	closes *int
+}
+
+func (b closeCountingBackend) CloseSession(sh pkcs11.SessionHandle) error {
+	*b.closes++
+
+	return b.testBackend.CloseSession(sh)
+}
+
+func TestCloseSession(t *testing.T) {
+	var closes int
+
+	h := openTestSession(t, closeCountingBackend{closes: &closes})
+
+	if rv := goCloseSession(h); rv != pkcs11.CKR_OK || closes != 1 {
+		t.Fatalf("close: got %s with %d backend calls, want CKR_OK with 1", RVTrace(uint(rv)), closes)
+	}
+
+	if _, err := getSession(pkcs11.SessionHandle(h)); err == nil {
+		t.Error("the closed session is still registered")
+	}
+
+	if rv := goCloseSession(h); rv != pkcs11.CKR_SESSION_HANDLE_INVALID {
+		t.Errorf("double close: got %s, want CKR_SESSION_HANDLE_INVALID", RVTrace(uint(rv)))
+	}
+
+	if rv := goCloseSession(h + 1000); rv != pkcs11.CKR_SESSION_HANDLE_INVALID {
+		t.Errorf("close of an unknown handle: got %s, want CKR_SESSION_HANDLE_INVALID", RVTrace(uint(rv)))
+	}
+
+	if closes != 1 {
+		t.Errorf("invalid handles reached the backend: %d calls, want 1", closes)
+	}
+}
+
+// ckmVendorRawImport is a made-up vendor mechanism that unwraps by importing
+// the "wrapped" bytes as they are.
+const ckmVendorRawImport = pkcs11.CKM_VENDOR_DEFINED | 0x1001
+
+// rawImportBackend records what UnwrapKey receives.
+type rawImportBackend struct {
+	testBackend
+	mechanism *pkcs11.Mechanism
+	key       []byte
+	template  []*pkcs11.Attribute
+}
+
+func (b *rawImportBackend) UnwrapKey(_ pkcs11.SessionHandle, m []*pkcs11.Mechanism, _ pkcs11.ObjectHandle, wrappedKey []byte, template []*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	b.mechanism, b.key, b.template = m[0], wrappedKey, template
+
+	return 42, nil
+}
+
+func TestUnwrapKeyVendorRawImport(t *testing.T) {
+	b := &rawImportBackend{}
+	h := openTestSession(t, b)
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+
+	param := []byte("import-v1")
+	m := testMechanism(t, ckmVendorRawImport, unsafe.Pointer(&param[0]), uintptr(len(param)))
+	pTemplate, count := testTemplate(t, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+	})
+
+	var imported ckObjectHandle
+	if rv := goUnwrapKey(h, m, 0, bytePtr(key), ckULong(len(key)), pTemplate, count, &imported); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_UnwrapKey: got %s", RVTrace(uint(rv)))
+	}
+
+	if imported != 42 {
+		t.Errorf("got key handle %d, want 42", imported)
+	}
+
+	if b.mechanism.Mechanism != ckmVendorRawImport || !bytes.Equal(b.mechanism.Parameter, param) {
+		t.Errorf("the backend got mechanism 0x%x with parameter %q, want 0x%x with %q", b.mechanism.Mechanism, b.mechanism.Parameter, uint(ckmVendorRawImport), param)
+	}
+
+	if !bytes.Equal(b.key, key) || len(b.template) != 2 {
+		t.Errorf("the backend got key %x and %d attributes, want %x and 2", b.key, len(b.template), key)
+	}
+}
+
+// tlsPRFSecret is the secret of the base key of tlsPRFBackend.
+var tlsPRFSecret = []byte("pkcs11mod TLS PRF test secret!!")
+
+// pHash is P_hash from RFC 2246, section 5.
+func pHash(out []byte, h func() hash.Hash, secret, seed []byte) {
+	mac := hmac.New(h, secret)
+	mac.Write(seed)
+	a := mac.Sum(nil)
+
+	for len(out) > 0 {
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		out = out[copy(out, mac.Sum(nil)):]
+
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+	}
+}
+
+// tls10PRF computes the TLS 1.0 PRF from RFC 2246, section 5, into out.
+func tls10PRF(out, secret, label, seed []byte) {
+	half := (len(secret) + 1) / 2
+	labelAndSeed := append(append([]byte{}, label...), seed...)
+	sha1Out := make([]byte, len(out))
+
+	pHash(out, md5.New, secret[:half], labelAndSeed)
+	pHash(sha1Out, sha1.New, secret[len(secret)-half:], labelAndSeed)
+
+	for i := range out {
+		out[i] ^= sha1Out[i]
+	}
+}
+
+// tlsPRFBackend computes CKM_TLS_PRF with tlsPRFSecret.
+type tlsPRFBackend struct {
+	testBackend
+}
+
+func (b *tlsPRFBackend) DeriveKey(_ pkcs11.SessionHandle, m []*pkcs11.Mechanism, _ pkcs11.ObjectHandle, _ []*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	params, err := ParseTLSPRFParams(m[0].Parameter)
+	if err != nil {
+		return 0, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+	}
+
+	tls10PRF(params.Output, tlsPRFSecret, params.Label, params.Seed)
+
+	return 0, nil
+}
+
+func TestDeriveKeyTLSPRF(t *testing.T) {
+	h := openTestSession(t, &tlsPRFBackend{})
+
+	seed := []byte("0123456789abcdef0123456789abcdef")
+	label := []byte("key expansion")
+	output := make([]byte, 40)
+	outputLen := ckULong(len(output))
+
+	want, _ := hex.DecodeString("973bf478ec6fb04da8de21d5fa9886d6dbadbc05c8cd1f301fafabd0648174c12a0995eacd362f16")
+
+	var pinner runtime.Pinner
+
+	t.Cleanup(pinner.Unpin)
+	pinner.Pin(&seed[0])
+	pinner.Pin(&label[0])
+	pinner.Pin(&output[0])
+	pinner.Pin(&outputLen)
+
+	params := &_Ctype_CK_TLS_PRF_PARAMS{
+		pSeed:        bytePtr(seed),
+		ulSeedLen:    ckULong(len(seed)),
+		pLabel:       bytePtr(label),
+		ulLabelLen:   ckULong(len(label)),
+		pOutput:      bytePtr(output),
+		pulOutputLen: &outputLen,
+	}
+	m := testMechanism(t, pkcs11.CKM_TLS_PRF, unsafe.Pointer(params), unsafe.Sizeof(*params))
+	pTemplate, count := testTemplate(t, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_DATA),
+	})
+
+	var hKey ckObjectHandle
+	if rv := goDeriveKey(h, m, 1, pTemplate, count, &hKey); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_DeriveKey: got %s", RVTrace(uint(rv)))
+	}
+
+	if outputLen != ckULong(len(want)) {
+		t.Errorf("got output length %d, want %d", outputLen, len(want))
+	}
+
+	if !bytes.Equal(output, want) {
+		t.Errorf("got output %x, want %x", output, want)
+	}
+}
+
+// lifecycleBackend tracks whether it's initialized, and counts Initialize and
+// Finalize calls that overlap.
+type lifecycleBackend struct {
+	testBackend
+	inside      atomic.Int32
+	overlaps    atomic.Int32
+	initialized atomic.Bool
+}
+
+func (b *lifecycleBackend) enter() {
+	if b.inside.Add(1) != 1 {
+		b.overlaps.Add(1)
+	}
+}
+
+func (b *lifecycleBackend) Initialize() error {
+	b.enter()
+	defer b.inside.Add(-1)
+
+	if !b.initialized.CompareAndSwap(false, true) {
+		return pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED)
+	}
+
+	return nil
+}
+
+func (b *lifecycleBackend) Finalize() error {
+	b.enter()
+	defer b.inside.Add(-1)
+
+	if !b.initialized.CompareAndSwap(true, false) {
+		return pkcs11.Error(pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED)
+	}
+
+	return nil
+}
+
+// TestInitializeFinalizeRace is meant to be run with -race.
+func TestInitializeFinalizeRace(t *testing.T) {
+	b := &lifecycleBackend{}
+	oldBackend := backend
+
+	SetBackend(b)
+	t.Cleanup(func() {
+		if initialized {
+			goFinalize()
+		}
+
+		SetBackend(oldBackend)
+	})
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func(init bool) {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				var rv ckRV
+				if init {
+					rv = goInitialize()
+				} else {
+					rv = goFinalize()
+				}
+
+				switch rv {
+				case pkcs11.CKR_OK, pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED, pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED:
+				default:
+					t.Errorf("got %s", RVTrace(uint(rv)))
+				}
+			}
+		}(i%2 == 0)
+	}
+
+	wg.Wait()
+
+	if n := b.overlaps.Load(); n != 0 {
+		t.Errorf("the backend saw %d overlapping Initialize and Finalize calls", n)
+	}
+
+	if initialized != b.initialized.Load() {
+		t.Errorf("pkcs11mod thinks initialized=%v, but the backend thinks %v", initialized, b.initialized.Load())
+	}
+}
+
+func TestSignInitDeterministicECDSA(t *testing.T) {
+	var mechanism uint
+
+	h := openTestSession(t, signInitBackend{mechanism: &mechanism})
+
+	for _, want := range []uint{pkcs11.CKM_ECDSA, CKM_PKCS11MOD_ECDSA_DETERMINISTIC} {
+		mechanism = 0
+		if rv := goSignInit(h, testMechanism(t, want, nil, 0), 2); rv != pkcs11.CKR_OK || mechanism != want {
+			t.Errorf("%s: got %s with %s reaching the backend", traceValueName(want, strCKM), RVTrace(uint(rv)), traceValueName(mechanism, strCKM))
+		}
+	}
+
+	if name := traceValueName(CKM_PKCS11MOD_ECDSA_DETERMINISTIC, strCKM); name != "CKM_PKCS11MOD_ECDSA_DETERMINISTIC" {
+		t.Errorf("got name %q", name)
+	}
+
+	// Like CKM_ECDSA, the deterministic variant takes no parameter.
+	param := []byte{0}
+	if rv := goSignInit(h, testMechanism(t, CKM_PKCS11MOD_ECDSA_DETERMINISTIC, unsafe.Pointer(&param[0]), 1), 2); rv != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+		t.Errorf("with a parameter: got %s, want CKR_MECHANISM_PARAM_INVALID", RVTrace(uint(rv)))
+	}
+}
+
+// countingReader is a deterministic random source: it returns 0, 1, 2, ...
+type countingReader struct {
+	next byte
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = r.next
+		r.next++
+	}
+
+	return len(p), nil
+}
+
+func TestSetRandomReader(t *testing.T) {
+	// testBackend panics if GenerateRandom or SeedRandom reaches it.
+	h := openTestSession(t, testBackend{})
+
+	SetRandomReader(&countingReader{})
+	t.Cleanup(func() { SetRandomReader(nil) })
+
+	random := make([]byte, 4)
+	for _, want := range [][]byte{{0, 1, 2, 3}, {4, 5, 6, 7}} {
+		if rv := goGenerateRandom(h, bytePtr(random), ckULong(len(random))); rv != pkcs11.CKR_OK {
+			t.Fatalf("C_GenerateRandom: got %s", RVTrace(uint(rv)))
+		}
+
+		if !bytes.Equal(random, want) {
+			t.Errorf("C_GenerateRandom: got %x, want %x", random, want)
+		}
+	}
+
+	// countingReader can't be seeded.
+	seed := []byte{1}
+	if rv := goSeedRandom(h, bytePtr(seed), ckULong(len(seed))); rv != pkcs11.CKR_RANDOM_SEED_NOT_SUPPORTED {
+		t.Errorf("C_SeedRandom: got %s, want CKR_RANDOM_SEED_NOT_SUPPORTED", RVTrace(uint(rv)))
+	}
+
+	if rv := goGenerateRandom(h+1, bytePtr(random), ckULong(len(random))); rv != pkcs11.CKR_SESSION_HANDLE_INVALID {
+		t.Errorf("C_GenerateRandom on an unknown session: got %s, want CKR_SESSION_HANDLE_INVALID", RVTrace(uint(rv)))
+	}
+}
+
+// keyPairBackend records the mechanism passed to GenerateKeyPair and returns
+// handles 1 and 2.
+type keyPairBackend struct {
+	testBackend
+	mechanism *pkcs11.Mechanism
+}
+
+func (b *keyPairBackend) GenerateKeyPair(_ pkcs11.SessionHandle, m []*pkcs11.Mechanism, _, _ []*pkcs11.Attribute) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	b.mechanism = m[0]
+
+	return 1, 2, nil
+}
+
+func TestGenerateKeyPairSwappedClasses(t *testing.T) {
+	b := &keyPairBackend{}
+	h := openTestSession(t, b)
+
+	oldStrict := strictValidation
+
+	t.Cleanup(func() { strictValidation = oldStrict })
+
+	// The application has put each class in the other's template.
+	pPublicTemplate, publicCount := testTemplate(t, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+	})
+	pPrivateTemplate, privateCount := testTemplate(t, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+	})
+	m := testMechanism(t, pkcs11.CKM_EC_KEY_PAIR_GEN, nil, 0)
+
+	var hPublic, hPrivate ckObjectHandle
+
+	strictValidation = true
+	if rv := goGenerateKeyPair(h, m, pPublicTemplate, publicCount, pPrivateTemplate, privateCount, &hPublic, &hPrivate); rv != pkcs11.CKR_TEMPLATE_INCONSISTENT || b.mechanism != nil {
+		t.Errorf("strict: got %s, reaching the backend=%v, want CKR_TEMPLATE_INCONSISTENT", RVTrace(uint(rv)), b.mechanism != nil)
+	}
+
+	// Without strict validation, it's up to the backend.
+	strictValidation = false
+	if rv := goGenerateKeyPair(h, m, pPublicTemplate, publicCount, pPrivateTemplate, privateCount, &hPublic, &hPrivate); rv != pkcs11.CKR_OK || b.mechanism == nil {
+		t.Errorf("not strict: got %s, reaching the backend=%v, want CKR_OK", RVTrace(uint(rv)), b.mechanism != nil)
+	}
+}
+
+func TestGenerateKeyPairEd25519(t *testing.T) {
+	b := &keyPairBackend{}
+	h := openTestSession(t, b)
+
+	ed25519Params, err := asn1.Marshal(asn1.ObjectIdentifier{1, 3, 101, 112})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecParams := pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, ed25519Params)
+	pPublicTemplate, publicCount := testTemplate(t, []*pkcs11.Attribute{ecParams})
+	pPrivateTemplate, privateCount := testTemplate(t, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+	})
+
+	var hPublic, hPrivate ckObjectHandle
+
+	m := testMechanism(t, CKM_EC_EDWARDS_KEY_PAIR_GEN, nil, 0)
+	if rv := goGenerateKeyPair(h, m, pPublicTemplate, publicCount, pPrivateTemplate, privateCount, &hPublic, &hPrivate); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_GenerateKeyPair: got %s", RVTrace(uint(rv)))
+	}
+
+	if b.mechanism.Mechanism != CKM_EC_EDWARDS_KEY_PAIR_GEN || b.mechanism.Parameter != nil {
+		t.Errorf("got %s with parameter %x reaching the backend, want CKM_EC_EDWARDS_KEY_PAIR_GEN", traceValueName(b.mechanism.Mechanism, strCKM), b.mechanism.Parameter)
+	}
+
+	if name := traceValueName(CKM_EC_EDWARDS_KEY_PAIR_GEN, strCKM); name != "CKM_EC_EDWARDS_KEY_PAIR_GEN" {
+		t.Errorf("got name %q", name)
+	}
+
+	oldSensitive := traceSensitive
+	traceSensitive = true
+
+	t.Cleanup(func() { traceSensitive = oldSensitive })
+
+	if got, want := AttrTrace(ecParams), "CKA_ECDSA_PARAMS: Ed25519"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// xorDecryptBackend "decrypts" by XORing with 0x5a, and counts the parts it
+// decrypts.
+type xorDecryptBackend struct {
+	testBackend
+	updates int
+}
+
+func (b *xorDecryptBackend) DecryptInit(pkcs11.SessionHandle, []*pkcs11.Mechanism, pkcs11.ObjectHandle) error {
+	return nil
+}
+
+func (b *xorDecryptBackend) DecryptUpdate(_ pkcs11.SessionHandle, ciphertext []byte) ([]byte, error) {
+	b.updates++
+
+	plaintext := make([]byte, len(ciphertext))
+	for i := range ciphertext {
+		plaintext[i] = ciphertext[i] ^ 0x5a
+	}
+
+	return plaintext, nil
+}
+
+func (b *xorDecryptBackend) DecryptFinal(pkcs11.SessionHandle) ([]byte, error) {
+	return nil, nil
+}
+
+func TestDecryptUpdateStreaming(t *testing.T) {
+	const partLen = 64 << 10
+
+	b := &xorDecryptBackend{}
+	h := openTestSession(t, b)
+
+	want := make([]byte, 16*partLen)
+	if _, err := rand.Read(want); err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext := make([]byte, len(want))
+	for i := range want {
+		ciphertext[i] = want[i] ^ 0x5a
+	}
+
+	if rv := goDecryptInit(h, testMechanism(t, pkcs11.CKM_AES_ECB, nil, 0), 2); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_DecryptInit: got %s", RVTrace(uint(rv)))
+	}
+
+	// Each part is decrypted straight into its place in plaintext, after
+	// asking for its length and then offering a buffer that's too small.
+	plaintext := make([]byte, len(want))
+	for offset := 0; offset < len(ciphertext); offset += partLen {
+		encryptedPart := ciphertext[offset : offset+partLen]
+
+		var ulPartLen ckULong
+		if rv := goDecryptUpdate(h, bytePtr(encryptedPart), ckULong(len(encryptedPart)), nil, &ulPartLen); rv != pkcs11.CKR_OK || int(ulPartLen) != len(encryptedPart) {
+			t.Fatalf("C_DecryptUpdate length query: got %s with length %d", RVTrace(uint(rv)), ulPartLen)
+		}
+
+		ulPartLen = 1
+		if rv := goDecryptUpdate(h, bytePtr(encryptedPart), ckULong(len(encryptedPart)), bytePtr(plaintext[offset:]), &ulPartLen); rv != pkcs11.CKR_BUFFER_TOO_SMALL {
+			t.Fatalf("C_DecryptUpdate with a short buffer: got %s", RVTrace(uint(rv)))
+		}
+
+		if rv := goDecryptUpdate(h, bytePtr(encryptedPart), ckULong(len(encryptedPart)), bytePtr(plaintext[offset:]), &ulPartLen); rv != pkcs11.CKR_OK || int(ulPartLen) != len(encryptedPart) {
+			t.Fatalf("C_DecryptUpdate: got %s with length %d", RVTrace(uint(rv)), ulPartLen)
+		}
+	}
+
+	var lastPart [1]byte
+
+	lastPartLen := ckULong(len(lastPart))
+	if rv := goDecryptFinal(h, bytePtr(lastPart[:]), &lastPartLen); rv != pkcs11.CKR_OK || lastPartLen != 0 {
+		t.Fatalf("C_DecryptFinal: got %s with length %d", RVTrace(uint(rv)), lastPartLen)
+	}
+
+	if !bytes.Equal(plaintext, want) {
+		t.Error("the plaintext doesn't match")
+	}
+
+	if want := len(ciphertext) / partLen; b.updates != want {
+		t.Errorf("the backend decrypted %d parts, want %d", b.updates, want)
+	}
+}
+
+// pbeBackend records the CK_PBE_PARAMS passed to GenerateKey, and generates
+// the IV 1, 2, ..., 8.
+type pbeBackend struct {
+	testBackend
+	params *PBEParams
+}
+
+func (b *pbeBackend) GenerateKey(_ pkcs11.SessionHandle, m []*pkcs11.Mechanism, _ []*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	params, err := ParsePBEParams(m[0].Parameter)
+	if err != nil {
+		return 0, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+	}
+
+	b.params = params
+
+	for i := range params.InitVector {
+		params.InitVector[i] = byte(i + 1)
+	}
+
+	return 3, nil
+}
+
+func TestGenerateKeyPBE(t *testing.T) {
+	b := &pbeBackend{}
+	h := openTestSession(t, b)
+
+	password := []byte("correct horse")
+	salt := []byte("NaCl")
+	initVector := make([]byte, 8)
+
+	var pinner runtime.Pinner
+
+	t.Cleanup(pinner.Unpin)
+	pinner.Pin(&password[0])
+	pinner.Pin(&salt[0])
+	pinner.Pin(&initVector[0])
+
+	params := &_Ctype_CK_PBE_PARAMS{
+		pInitVector:   bytePtr(initVector),
+		pPassword:     (*_Ctype_CK_UTF8CHAR)(unsafe.Pointer(&password[0])),
+		ulPasswordLen: ckULong(len(password)),
+		pSalt:         bytePtr(salt),
+		ulSaltLen:     ckULong(len(salt)),
+		ulIteration:   2048,
+	}
+	m := testMechanism(t, pkcs11.CKM_PBE_SHA1_DES3_EDE_CBC, unsafe.Pointer(params), unsafe.Sizeof(*params))
+	pTemplate, count := testTemplate(t, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+	})
+
+	var hKey ckObjectHandle
+	if rv := goGenerateKey(h, m, pTemplate, count, &hKey); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_GenerateKey: got %s", RVTrace(uint(rv)))
+	}
+
+	if !bytes.Equal(b.params.Password, password) || !bytes.Equal(b.params.Salt, salt) || b.params.Iteration != 2048 {
+		t.Errorf("the backend got password %q, salt %q and %d iterations", b.params.Password, b.params.Salt, b.params.Iteration)
+	}
+
+	if want := []byte{1, 2, 3, 4, 5, 6, 7, 8}; !bytes.Equal(initVector, want) {
+		t.Errorf("got IV %x, want %x", initVector, want)
+	}
+}
+
+// labelBackend has a single token labelled label.
+type labelBackend struct {
+	testBackend
+	label string
+}
+
+func (b labelBackend) GetTokenInfo(uint) (pkcs11.TokenInfo, error) {
+	return pkcs11.TokenInfo{Label: b.label}, nil
+}
+
+func TestSetTokenLabelPrefix(t *testing.T) {
+	t.Cleanup(func() { SetTokenLabelPrefix("") })
+
+	for _, tt := range []struct {
+		prefix, label, want string
+	}{
+		{"", "Token", "Token"},
+		{"pkcs11proxy: ", "Token", "pkcs11proxy: Token"},
+		{"pkcs11proxy: ", "A label that is much too long", "pkcs11proxy: A label that is muc"},
+		// The 2-byte "é" doesn't fit in the last byte, so it's dropped
+		// rather than split.
+		{strings.Repeat("p", 31), "é", strings.Repeat("p", 31)},
+	} {
+		openTestSession(t, labelBackend{label: tt.label})
+		SetTokenLabelPrefix(tt.prefix)
+
+		var info _Ctype_CK_TOKEN_INFO
+		if rv := goGetTokenInfo(0, &info); rv != pkcs11.CKR_OK {
+			t.Fatalf("C_GetTokenInfo returned %s", RVTrace(uint(rv)))
+		}
+
+		label := make([]byte, len(info.label))
+		for i, ch := range info.label {
+			label[i] = byte(ch)
+		}
+
+		if want := fmt.Sprintf("%-32s", tt.want); string(label) != want {
+			t.Errorf("prefix %q, label %q: got %q, want %q", tt.prefix, tt.label, label, want)
+		}
+	}
+}
+
+// aesGCMBackend implements single-part CKM_AES_GCM with aesGCMTestKey, using
+// a library (crypto/cipher, as far as it knows) that returns the tag
+// separately.  If detached is set, it forgets to append the tag.
+type aesGCMBackend struct {
+	testBackend
+	mechanism *pkcs11.Mechanism
+	detached  bool
+}
+
+var aesGCMTestKey = []byte("0123456789abcdef")
+
+// aead returns the cipher, IV and AAD of the active operation.
+func (b *aesGCMBackend) aead() (cipher.AEAD, []byte, []byte) {
+	block, err := aes.NewCipher(aesGCMTestKey)
+	if err != nil {
+		panic(err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+
+	params := mechanismGenerator(b.mechanism)
+
+	return aead, params.FieldByName("iv").Bytes(), params.FieldByName("aad").Bytes()
+}
+
+func (b *aesGCMBackend) EncryptInit(_ pkcs11.SessionHandle, m []*pkcs11.Mechanism, _ pkcs11.ObjectHandle) error {
+	b.mechanism = m[0]
+
+	return nil
+}
+
+func (b *aesGCMBackend) Encrypt(_ pkcs11.SessionHandle, data []byte) ([]byte, error) {
+	aead, iv, aad := b.aead()
+	sealed := aead.Seal(nil, iv, data, aad)
+	ciphertext, tag := sealed[:len(data)], sealed[len(data):]
+
+	if b.detached {
+		return ciphertext, nil
+	}
+
+	return AppendGCMTag(ciphertext, tag), nil
+}
+
+func (b *aesGCMBackend) DecryptInit(_ pkcs11.SessionHandle, m []*pkcs11.Mechanism, _ pkcs11.ObjectHandle) error {
+	b.mechanism = m[0]
+
+	return nil
+}
+
+func (b *aesGCMBackend) Decrypt(_ pkcs11.SessionHandle, data []byte) ([]byte, error) {
+	aead, iv, aad := b.aead()
+
+	ciphertext, tag, err := SplitGCMTag(data, 128)
+	if err != nil {
+		return nil, pkcs11.Error(pkcs11.CKR_ENCRYPTED_DATA_LEN_RANGE)
+	}
+
+	plaintext, err := aead.Open(nil, iv, AppendGCMTag(ciphertext, tag), aad)
+	if err != nil {
+		return nil, pkcs11.Error(pkcs11.CKR_ENCRYPTED_DATA_INVALID)
+	}
+
+	return plaintext, nil
+}
+
+// testGCMMechanism builds a CKM_AES_GCM mechanism with a 128-bit tag.
+func testGCMMechanism(t *testing.T, iv, aad []byte) *ckMechanism {
+	t.Helper()
+
+	var pinner runtime.Pinner
+
+	t.Cleanup(pinner.Unpin)
+	pinner.Pin(&iv[0])
+	pinner.Pin(&aad[0])
+
+	params := &_Ctype_CK_GCM_PARAMS{
+		pIv:       bytePtr(iv),
+		ulIvLen:   ckULong(len(iv)),
+		ulIvBits:  ckULong(len(iv) * 8),
+		pAAD:      bytePtr(aad),
+		ulAADLen:  ckULong(len(aad)),
+		ulTagBits: 128,
+	}
+
+	return testMechanism(t, pkcs11.CKM_AES_GCM, unsafe.Pointer(params), unsafe.Sizeof(*params))
+}
+
+func TestAESGCMAppendedTag(t *testing.T) {
+	b := &aesGCMBackend{}
+	h := openTestSession(t, b)
+
+	oldAllow := gcmAllowDetachedTag
+
+	t.Cleanup(func() { gcmAllowDetachedTag = oldAllow })
+
+	gcmAllowDetachedTag = false
+
+	iv := []byte("0123456789ab")
+	aad := []byte("associated data")
+	plaintext := []byte("attack at dawn")
+
+	encrypt := func() ([]byte, ckRV) {
+		if rv := goEncryptInit(h, testGCMMechanism(t, iv, aad), 2); rv != pkcs11.CKR_OK {
+			t.Fatalf("C_EncryptInit: got %s", RVTrace(uint(rv)))
+		}
+
+		ciphertext := make([]byte, len(plaintext)+16)
+		ciphertextLen := ckULong(len(ciphertext))
+		rv := goEncrypt(h, bytePtr(plaintext), ckULong(len(plaintext)), bytePtr(ciphertext), &ciphertextLen)
+
+		return ciphertext[:ciphertextLen], rv
+	}
+
+	ciphertext, rv := encrypt()
+	if rv != pkcs11.CKR_OK {
+		t.Fatalf("C_Encrypt: got %s", RVTrace(uint(rv)))
+	}
+
+	aead, _, _ := b.aead()
+	if want := aead.Seal(nil, iv, plaintext, aad); !bytes.Equal(ciphertext, want) {
+		t.Errorf("got ciphertext %x, want ciphertext||tag %x", ciphertext, want)
+	}
+
+	if rv := goDecryptInit(h, testGCMMechanism(t, iv, aad), 2); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_DecryptInit: got %s", RVTrace(uint(rv)))
+	}
+
+	decrypted := make([]byte, len(ciphertext))
+	decryptedLen := ckULong(len(decrypted))
+
+	if rv := goDecrypt(h, bytePtr(ciphertext), ckULong(len(ciphertext)), bytePtr(decrypted), &decryptedLen); rv != pkcs11.CKR_OK || !bytes.Equal(decrypted[:decryptedLen], plaintext) {
+		t.Errorf("C_Decrypt: got %s with %q, want %q", RVTrace(uint(rv)), decrypted[:decryptedLen], plaintext)
+	}
+
+	// A backend that keeps the tag to itself is caught, unless the
+	// compatibility flag is set.
+	b.detached = true
+	if _, rv := encrypt(); rv != pkcs11.CKR_GENERAL_ERROR {
+		t.Errorf("detached tag: got %s, want CKR_GENERAL_ERROR", RVTrace(uint(rv)))
+	}
+
+	gcmAllowDetachedTag = true
+	if ciphertext, rv := encrypt(); rv != pkcs11.CKR_OK || len(ciphertext) != len(plaintext) {
+		t.Errorf("detached tag allowed: got %s with %d bytes", RVTrace(uint(rv)), len(ciphertext))
+	}
+}
+
+// ckmVendorGeneratedIV is a made-up vendor key generation mechanism whose
+// parameter is a buffer that receives an IV generated along with the key.
+const ckmVendorGeneratedIV = pkcs11.CKM_VENDOR_DEFINED | 0x1002
+
+// generatedIVBackend generates the IV 0xa0, 0xa1, ... into the (raw,
+// passed-through) parameter of ckmVendorGeneratedIV.
+type generatedIVBackend struct {
+	testBackend
+}
+
+func (generatedIVBackend) GenerateKey(_ pkcs11.SessionHandle, m []*pkcs11.Mechanism, _ []*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	for i := range m[0].Parameter {
+		m[0].Parameter[i] = byte(0xa0 + i)
+	}
+
+	return 3, nil
+}
+
+func TestRegisterMechanismEncoder(t *testing.T) {
+	h := openTestSession(t, generatedIVBackend{})
+
+	var encoded *pkcs11.Mechanism
+
+	RegisterMechanismEncoder(ckmVendorGeneratedIV, func(m *pkcs11.Mechanism, raw []byte) error {
+		encoded = m
+		if len(raw) != len(m.Parameter) {
+			return pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		copy(raw, m.Parameter)
+
+		return nil
+	})
+	t.Cleanup(func() { RegisterMechanismEncoder(ckmVendorGeneratedIV, nil) })
+
+	iv := make([]byte, 8)
+	m := testMechanism(t, ckmVendorGeneratedIV, unsafe.Pointer(&iv[0]), uintptr(len(iv)))
+	pTemplate, count := testTemplate(t, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+	})
+
+	var hKey ckObjectHandle
+	if rv := goGenerateKey(h, m, pTemplate, count, &hKey); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_GenerateKey: got %s", RVTrace(uint(rv)))
+	}
+
+	if encoded == nil || encoded.Mechanism != ckmVendorGeneratedIV {
+		t.Fatal("the encoder wasn't called with the mechanism")
+	}
+
+	if want := []byte{0xa0, 0xa1, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7}; !bytes.Equal(iv, want) {
+		t.Errorf("got IV %x, want %x", iv, want)
+	}
+}
+
+// openCountingBackend counts the sessions it opens.
+type openCountingBackend struct {
+	testBackend
+	opened int
+}
+
+func (b *openCountingBackend) OpenSession(slotID, flags uint) (pkcs11.SessionHandle, error) {
+	b.opened++
+
+	return b.testBackend.OpenSession(slotID, flags)
+}
+
+func TestOpenSessionWithoutSerialFlag(t *testing.T) {
+	b := &openCountingBackend{}
+	oldBackend := backend
+
+	SetBackend(b)
+	t.Cleanup(func() { SetBackend(oldBackend) })
+
+	var h ckSessionHandle
+	if rv := goOpenSession(0, pkcs11.CKF_RW_SESSION, &h); rv != pkcs11.CKR_SESSION_PARALLEL_NOT_SUPPORTED || b.opened != 0 {
+		t.Errorf("without CKF_SERIAL_SESSION: got %s with %d sessions opened, want CKR_SESSION_PARALLEL_NOT_SUPPORTED", RVTrace(uint(rv)), b.opened)
+	}
+
+	for _, readWrite := range []bool{false, true} {
+		flags := _Ctype_CK_FLAGS(pkcs11.CKF_SERIAL_SESSION)
+		if readWrite {
+			flags |= pkcs11.CKF_RW_SESSION
+		}
+
+		if rv := goOpenSession(0, flags, &h); rv != pkcs11.CKR_OK {
+			t.Fatalf("C_OpenSession: got %s", RVTrace(uint(rv)))
+		}
+
+		session, err := getSession(pkcs11.SessionHandle(h))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if session.readWrite != readWrite {
+			t.Errorf("CKF_RW_SESSION=%v: the session has readWrite=%v", readWrite, session.readWrite)
+		}
+
+		goCloseSession(h)
+	}
+}
+
+// deriveBackend records the mechanism passed to DeriveKey.
+type deriveBackend struct {
+	testBackend
+	mechanism *pkcs11.Mechanism
+}
+
+func (b *deriveBackend) DeriveKey(_ pkcs11.SessionHandle, m []*pkcs11.Mechanism, _ pkcs11.ObjectHandle, _ []*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	b.mechanism = m[0]
+
+	return 4, nil
+}
+
+func TestDeriveKeySHA256KeyDerivation(t *testing.T) {
+	b := &deriveBackend{}
+	h := openTestSession(t, b)
+
+	pTemplate, count := testTemplate(t, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+	})
+
+	var hKey ckObjectHandle
+	if rv := goDeriveKey(h, testMechanism(t, pkcs11.CKM_SHA256_KEY_DERIVATION, nil, 0), 1, pTemplate, count, &hKey); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_DeriveKey: got %s", RVTrace(uint(rv)))
+	}
+
+	if b.mechanism.Mechanism != pkcs11.CKM_SHA256_KEY_DERIVATION || b.mechanism.Parameter != nil {
+		t.Errorf("got %s with parameter %x reaching the backend, want CKM_SHA256_KEY_DERIVATION", traceValueName(b.mechanism.Mechanism, strCKM), b.mechanism.Parameter)
+	}
+
+	if name := traceValueName(pkcs11.CKM_SHA256_KEY_DERIVATION, strCKM); name != "CKM_SHA256_KEY_DERIVATION" {
+		t.Errorf("got name %q", name)
+	}
+
+	b.mechanism = nil
+	param := []byte{0}
+
+	if rv := goDeriveKey(h, testMechanism(t, pkcs11.CKM_SHA256_KEY_DERIVATION, unsafe.Pointer(&param[0]), 1), 1, pTemplate, count, &hKey); rv != pkcs11.CKR_MECHANISM_PARAM_INVALID || b.mechanism != nil {
+		t.Errorf("with a parameter: got %s, want CKR_MECHANISM_PARAM_INVALID", RVTrace(uint(rv)))
+	}
+}
+
+// keySizeBackend generates AES keys, refusing a CKA_VALUE_LEN other than 16,
+// 24 or 32 the way a real token would, and counting the keys it's asked for.
+type keySizeBackend struct {
+	testBackend
+	calls int
+}
+
+func (b *keySizeBackend) GenerateKey(_ pkcs11.SessionHandle, _ []*pkcs11.Mechanism, template []*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	b.calls++
+
+	size, _, err := TemplateULong(template, pkcs11.CKA_VALUE_LEN)
+	if err != nil {
+		return 0, fmt.Errorf("CKA_VALUE_LEN: %w", pkcs11.Error(pkcs11.CKR_ATTRIBUTE_VALUE_INVALID))
+	}
+
+	switch size {
+	case 16, 24, 32:
+		return 5, nil
+	default:
+		return 0, pkcs11.Error(pkcs11.CKR_KEY_SIZE_RANGE)
+	}
+}
+
+func TestGenerateKeySizeErrors(t *testing.T) {
+	b := &keySizeBackend{}
+	h := openTestSession(t, b)
+
+	oldStrict := strictValidation
+
+	t.Cleanup(func() { strictValidation = oldStrict })
+
+	// valueLen is anything pkcs11.NewAttribute accepts.
+	generate := func(valueLen any) ckRV {
+		pTemplate, count := testTemplate(t, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, valueLen),
+		})
+
+		var hKey ckObjectHandle
+
+		return goGenerateKey(h, testMechanism(t, pkcs11.CKM_AES_KEY_GEN, nil, 0), pTemplate, count, &hKey)
+	}
+
+	for _, strict := range []bool{false, true} {
+		strictValidation = strict
+
+		for _, tt := range []struct {
+			name     string
+			valueLen any
+			want     ckRV
+		}{
+			{"16 bytes", 16, pkcs11.CKR_OK},
+			{"17 bytes", 17, pkcs11.CKR_KEY_SIZE_RANGE},
+			{"0 bytes", 0, pkcs11.CKR_KEY_SIZE_RANGE},
+			{"a 3-byte CKA_VALUE_LEN", []byte{1, 2, 3}, pkcs11.CKR_ATTRIBUTE_VALUE_INVALID},
+		} {
+			if rv := generate(tt.valueLen); rv != tt.want {
+				t.Errorf("strict=%v, %s: got %s, want %s", strict, tt.name, RVTrace(uint(rv)), RVTrace(uint(tt.want)))
+			}
+		}
+	}
+
+	// Strict validation caught the 0 and the 3-byte value itself, so the
+	// backend saw 4 calls without it and only 2 with it.
+	if b.calls != 6 {
+		t.Errorf("the backend was called %d times, want 6", b.calls)
+	}
+}
+
+// stateBackend implements the core Backend plus OperationStateManager, but not
+// SlotEventWaiter or SelfTester.
+type stateBackend struct {
+	testBackend
+}
+
+func (stateBackend) GetOperationState(pkcs11.SessionHandle) ([]byte, error) {
+	return []byte("state"), nil
+}
+
+func (stateBackend) SetOperationState(pkcs11.SessionHandle, []byte, pkcs11.ObjectHandle, pkcs11.ObjectHandle) error {
+	return nil
+}
+
+func TestOptionalBackendInterfaces(t *testing.T) {
+	oldTiming := traceTiming
+
+	for _, timing := range []bool{false, true} {
+		// The timing wrapper implements every optional interface, so it
+		// mustn't hide which ones the backend really implements.
+		traceTiming = timing
+		h := openTestSession(t, stateBackend{})
+		traceTiming = oldTiming
+
+		var stateLen ckULong
+		if rv := goGetOperationState(h, nil, &stateLen); rv != pkcs11.CKR_OK || int(stateLen) != len(operationStateHeader)+len("state") {
+			t.Errorf("timing=%v: C_GetOperationState: got %s with length %d", timing, RVTrace(uint(rv)), stateLen)
+		}
+
+		var slot _Ctype_CK_SLOT_ID
+		if rv := goWaitForSlotEvent(0, &slot, nil); rv != pkcs11.CKR_FUNCTION_NOT_SUPPORTED {
+			t.Errorf("timing=%v: C_WaitForSlotEvent: got %s, want CKR_FUNCTION_NOT_SUPPORTED", timing, RVTrace(uint(rv)))
+		}
+
+		if rv := goSelfTest(); rv != pkcs11.CKR_FUNCTION_NOT_SUPPORTED {
+			t.Errorf("timing=%v: self-test: got %s, want CKR_FUNCTION_NOT_SUPPORTED", timing, RVTrace(uint(rv)))
+		}
+	}
+}
+
+func TestAESGCMTamperedCiphertext(t *testing.T) {
+	b := &aesGCMBackend{}
+	h := openTestSession(t, b)
+
+	iv := []byte("0123456789ab")
+	aad := []byte("associated data")
+
+	if rv := goDecryptInit(h, testGCMMechanism(t, iv, aad), 2); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_DecryptInit: got %s", RVTrace(uint(rv)))
+	}
+
+	aead, _, _ := b.aead()
+	ciphertext := aead.Seal(nil, iv, []byte("attack at dawn"), aad)
+	ciphertext[0] ^= 1
+
+	plaintext := make([]byte, len(ciphertext))
+	plaintextLen := ckULong(len(plaintext))
+
+	if rv := goDecrypt(h, bytePtr(ciphertext), ckULong(len(ciphertext)), bytePtr(plaintext), &plaintextLen); rv != pkcs11.CKR_ENCRYPTED_DATA_INVALID {
+		t.Errorf("C_Decrypt: got %s, want CKR_ENCRYPTED_DATA_INVALID", RVTrace(uint(rv)))
+	}
+
+	if name := RVTrace(CKR_AEAD_DECRYPT_FAILED); name != "CKR_AEAD_DECRYPT_FAILED" {
+		t.Errorf("got name %q", name)
+	}
+}
+
+// otpBackend returns a CK_OTP_SIGNATURE_INFO whose CK_OTP_VALUE is derived
+// from the counter (CKM_HOTP) or the time (CKM_SECURID) the application
+// passed, so that tests can check that both the inputs and the output survive.
+type otpBackend struct {
+	testBackend
+	mechanism uint
+	params    *OTPParams
+}
+
+func (b *otpBackend) SignInit(_ pkcs11.SessionHandle, m []*pkcs11.Mechanism, _ pkcs11.ObjectHandle) error {
+	params, err := ParseOTPParams(m[0].Parameter)
+	if err != nil {
+		return err
+	}
+
+	b.mechanism, b.params = m[0].Mechanism, params
+
+	return nil
+}
+
+func (b *otpBackend) Sign(pkcs11.SessionHandle, []byte) ([]byte, error) {
+	var value string
+
+	switch b.mechanism {
+	case pkcs11.CKM_HOTP:
+		counter, ok, err := b.params.Counter()
+		if !ok || err != nil {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		value = fmt.Sprintf("%06d", counter%1000000)
+	default:
+		t, ok, err := b.params.Time()
+		if !ok || err != nil {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		value = t.Format("150405")
+	}
+
+	return NewOTPSignatureInfo([]OTPParam{
+		{Type: pkcs11.CK_OTP_VALUE, Value: []byte(value)},
+		{Type: pkcs11.CK_OTP_FLAGS, Value: []byte{}},
+	}), nil
+}
+
+func TestSignOTP(t *testing.T) {
+	h := openTestSession(t, &otpBackend{})
+
+	for _, tt := range []struct {
+		mechanism uint
+		input     OTPParam
+		want      string
+	}{
+		{pkcs11.CKM_HOTP, OTPParam{Type: pkcs11.CK_OTP_COUNTER, Value: []byte{0, 0, 0, 0, 0, 0x0f, 0x42, 0x47}}, "000007"},
+		{pkcs11.CKM_SECURID, OTPParam{Type: pkcs11.CK_OTP_TIME, Value: []byte("20260102030405")}, "030405"},
+	} {
+		name := traceValueName(tt.mechanism, strCKM)
+
+		var pinner runtime.Pinner
+
+		pinner.Pin(&tt.input.Value[0])
+
+		inputs := []_Ctype_CK_OTP_PARAM{{
+			_type:      ckULong(tt.input.Type),
+			pValue:     _Ctype_CK_VOID_PTR(&tt.input.Value[0]),
+			ulValueLen: ckULong(len(tt.input.Value)),
+		}}
+		pinner.Pin(&inputs[0])
+
+		params := &_Ctype_CK_OTP_PARAMS{pParams: &inputs[0], ulCount: ckULong(len(inputs))}
+
+		if rv := goSignInit(h, testMechanism(t, tt.mechanism, unsafe.Pointer(params), unsafe.Sizeof(*params)), 2); rv != pkcs11.CKR_OK {
+			pinner.Unpin()
+			t.Fatalf("%s: C_SignInit: got %s", name, RVTrace(uint(rv)))
+		}
+
+		pinner.Unpin()
+
+		var signatureLen ckULong
+		if rv := goSign(h, nil, 0, nil, &signatureLen); rv != pkcs11.CKR_OK {
+			t.Fatalf("%s: C_Sign length query: got %s", name, RVTrace(uint(rv)))
+		}
+
+		// The buffer holds pointers into itself, so it has to be pinned
+		// while the module writes it, and 8-byte aligned.
+		buf := make([]uint64, (int(signatureLen)+7)/8)
+		pinner.Pin(&buf[0])
+
+		signature := unsafe.Slice((*byte)(unsafe.Pointer(&buf[0])), len(buf)*8)
+
+		if rv := goSign(h, nil, 0, bytePtr(signature), &signatureLen); rv != pkcs11.CKR_OK {
+			pinner.Unpin()
+			t.Fatalf("%s: C_Sign: got %s", name, RVTrace(uint(rv)))
+		}
+
+		info := (*_Ctype_CK_OTP_SIGNATURE_INFO)(unsafe.Pointer(&buf[0]))
+		outputs := unsafe.Slice((*_Ctype_CK_OTP_PARAM)(info.pParams), info.ulCount)
+
+		if len(outputs) != 2 || outputs[0]._type != pkcs11.CK_OTP_VALUE || outputs[1]._type != pkcs11.CK_OTP_FLAGS {
+			t.Errorf("%s: got %d output params", name, len(outputs))
+		} else if got := string(unsafe.Slice((*byte)(outputs[0].pValue), outputs[0].ulValueLen)); got != tt.want {
+			t.Errorf("%s: got CK_OTP_VALUE %q, want %q", name, got, tt.want)
+		} else if outputs[1].ulValueLen != 0 {
+			t.Errorf("%s: got a %d-byte CK_OTP_FLAGS, want an empty one", name, outputs[1].ulValueLen)
+		}
+
+		pinner.Unpin()
+	}
+}
+
+func TestInitNullMechanism(t *testing.T) {
+	// testBackend panics if any of these reach it.
+	h := openTestSession(t, testBackend{})
+
+	for _, tt := range []struct {
+		function string
+		rv       _Ctype_CK_RV
+	}{
+		{"C_EncryptInit", goEncryptInit(h, nil, 2)},
+		{"C_DecryptInit", goDecryptInit(h, nil, 2)},
+		{"C_DigestInit", goDigestInit(h, nil)},
+		{"C_SignInit", goSignInit(h, nil, 2)},
+		{"C_VerifyInit", goVerifyInit(h, nil, 2)},
+	} {
+		if tt.rv != pkcs11.CKR_ARGUMENTS_BAD {
+			t.Errorf("%s: got %s, want CKR_ARGUMENTS_BAD", tt.function, RVTrace(uint(tt.rv)))
+		}
+	}
+
+	if _, err := toMechanism(nil); fromError(err) != pkcs11.CKR_ARGUMENTS_BAD {
+		t.Errorf("toMechanism: got %v, want CKR_ARGUMENTS_BAD", err)
+	}
+}
+
+type setAttributeBackend struct {
+	testBackend
+}
+
+func (setAttributeBackend) SetAttributeValue(pkcs11.SessionHandle, pkcs11.ObjectHandle, []*pkcs11.Attribute) error {
+	return nil
+}
+
+func TestSetAttributeValueTrace(t *testing.T) {
+	oldSensitive := traceSensitive
+	traceSensitive = false
+
+	t.Cleanup(func() { traceSensitive = oldSensitive })
+
+	buf := captureTrace(t, false)
+	h := openTestSession(t, setAttributeBackend{})
+	secret := "not for the trace log"
+
+	pTemplate, count := testTemplate(t, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, "renamed"),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, secret),
+	})
+	if rv := goSetAttributeValue(h, 7, pTemplate, count); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_SetAttributeValue: got %s", RVTrace(uint(rv)))
+	}
+
+	for _, name := range []string{"CKA_LABEL", "CKA_VALUE"} {
+		if !strings.Contains(buf.String(), "SetAttributeValue: object 7 template "+name) {
+			t.Errorf("%s isn't in the trace:\n%s", name, buf.String())
+		}
+	}
+
+	if strings.Contains(buf.String(), secret) || strings.Contains(buf.String(), hex.EncodeToString([]byte(secret))) {
+		t.Errorf("the CKA_VALUE leaked into the trace:\n%s", buf.String())
+	}
+}
+
+func TestLoginTraceOmitsPIN(t *testing.T) {
+	oldSensitive := traceSensitive
+
+	t.Cleanup(func() { traceSensitive = oldSensitive })
+
+	pin := []byte("pkcs11mod-pin-31337")
+
+	for _, sensitive := range []bool{false, true} {
+		traceSensitive = sensitive
+
+		buf := captureTrace(t, false)
+		h := openTestSession(t, alwaysAuthenticateBackend{})
+
+		if rv := goLogin(h, pkcs11.CKU_USER, (*_Ctype_CK_UTF8CHAR)(bytePtr(pin)), ckULong(len(pin))); rv != pkcs11.CKR_OK {
+			t.Fatalf("sensitive=%v: C_Login: got %s", sensitive, RVTrace(uint(rv)))
+		}
+
+		if !strings.Contains(buf.String(), fmt.Sprintf("user type CKU_USER, %d-byte PIN", len(pin))) {
+			t.Errorf("sensitive=%v: no C_Login line in the trace:\n%s", sensitive, buf.String())
+		}
+
+		if strings.Contains(buf.String(), string(pin)) || strings.Contains(buf.String(), hex.EncodeToString(pin)) {
+			t.Errorf("sensitive=%v: the PIN leaked into the trace:\n%s", sensitive, buf.String())
+		}
+	}
+}
+
+// savedStateBackend saves a fixed state, and records the state it's asked to
+// restore.
+type savedStateBackend struct {
+	stateBackend
+	restored *[]byte
+}
+
+func (b savedStateBackend) SetOperationState(_ pkcs11.SessionHandle, state []byte, _ pkcs11.ObjectHandle, _ pkcs11.ObjectHandle) error {
+	*b.restored = state
+
+	return nil
+}
+
+func TestOperationStateHeader(t *testing.T) {
+	var restored []byte
+
+	h := openTestSession(t, savedStateBackend{restored: &restored})
+
+	state := make([]byte, 64)
+	stateLen := ckULong(len(state))
+
+	if rv := goGetOperationState(h, bytePtr(state), &stateLen); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_GetOperationState: got %s", RVTrace(uint(rv)))
+	}
+
+	state = state[:stateLen]
+
+	// The backend gets back exactly what it saved.
+	if rv := goSetOperationState(h, bytePtr(state), _Ctype_CK_LONG(len(state)), 0, 0); rv != pkcs11.CKR_OK || string(restored) != "state" {
+		t.Errorf("C_SetOperationState: got %s with %q restored, want %q", RVTrace(uint(rv)), restored, "state")
+	}
+
+	wrongMagic := bytes.Clone(state)
+	wrongMagic[0] ^= 0xff
+
+	for _, tt := range []struct {
+		name  string
+		state []byte
+	}{
+		{"wrong magic", wrongMagic},
+		{"truncated header", state[:len(operationStateHeader)-1]},
+	} {
+		restored = nil
+		if rv := goSetOperationState(h, bytePtr(tt.state), _Ctype_CK_LONG(len(tt.state)), 0, 0); rv != pkcs11.CKR_SAVED_STATE_INVALID || restored != nil {
+			t.Errorf("%s: got %s with %q reaching the backend, want CKR_SAVED_STATE_INVALID", tt.name, RVTrace(uint(rv)), restored)
+		}
+	}
+}
+
+// poly1305Backend implements CKM_CHACHA20_POLY1305 with AES-GCM standing in
+// for ChaCha20-Poly1305, which the standard library doesn't export.  All that
+// matters to pkcs11mod is the appended 16-byte tag and the error for one that
+// doesn't verify.
+type poly1305Backend struct {
+	testBackend
+	params *Poly1305AEADParams
+}
+
+func (b *poly1305Backend) aead() cipher.AEAD {
+	block, err := aes.NewCipher(aesGCMTestKey)
+	if err != nil {
+		panic(err)
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+
+	return aead
+}
+
+func (b *poly1305Backend) EncryptInit(_ pkcs11.SessionHandle, m []*pkcs11.Mechanism, _ pkcs11.ObjectHandle) error {
+	params, err := ParsePoly1305AEADParams(m[0].Parameter)
+	b.params = params
+
+	return err
+}
+
+func (b *poly1305Backend) Encrypt(_ pkcs11.SessionHandle, data []byte) ([]byte, error) {
+	return b.aead().Seal(nil, b.params.Nonce, data, b.params.AAD), nil
+}
+
+func (b *poly1305Backend) DecryptInit(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, o pkcs11.ObjectHandle) error {
+	return b.EncryptInit(sh, m, o)
+}
+
+func (b *poly1305Backend) Decrypt(_ pkcs11.SessionHandle, data []byte) ([]byte, error) {
+	plaintext, err := b.aead().Open(nil, b.params.Nonce, data, b.params.AAD)
+	if err != nil {
+		return nil, pkcs11.Error(pkcs11.CKR_ENCRYPTED_DATA_INVALID)
+	}
+
+	return plaintext, nil
+}
+
+func TestChaCha20Poly1305TamperedTag(t *testing.T) {
+	h := openTestSession(t, &poly1305Backend{})
+
+	nonce := []byte("0123456789ab")
+	aad := []byte("associated data")
+
+	var pinner runtime.Pinner
+
+	t.Cleanup(pinner.Unpin)
+	pinner.Pin(&nonce[0])
+	pinner.Pin(&aad[0])
+
+	params := &_Ctype_CK_SALSA20_CHACHA20_POLY1305_PARAMS{
+		pNonce:     bytePtr(nonce),
+		ulNonceLen: ckULong(len(nonce)),
+		pAAD:       bytePtr(aad),
+		ulAADLen:   ckULong(len(aad)),
+	}
+	m := testMechanism(t, CKM_CHACHA20_POLY1305, unsafe.Pointer(params), unsafe.Sizeof(*params))
+
+	data := []byte("attack at dawn")
+
+	if rv := goEncryptInit(h, m, 2); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_EncryptInit: got %s", RVTrace(uint(rv)))
+	}
+
+	ciphertext := make([]byte, len(data)+16)
+	ciphertextLen := ckULong(len(ciphertext))
+
+	if rv := goEncrypt(h, bytePtr(data), ckULong(len(data)), bytePtr(ciphertext), &ciphertextLen); rv != pkcs11.CKR_OK || int(ciphertextLen) != len(ciphertext) {
+		t.Fatalf("C_Encrypt: got %s with length %d, want %d", RVTrace(uint(rv)), ciphertextLen, len(ciphertext))
+	}
+
+	decrypt := func(ciphertext []byte) ([]byte, _Ctype_CK_RV) {
+		t.Helper()
+
+		if rv := goDecryptInit(h, m, 2); rv != pkcs11.CKR_OK {
+			t.Fatalf("C_DecryptInit: got %s", RVTrace(uint(rv)))
+		}
+
+		plaintext := make([]byte, len(ciphertext))
+		plaintextLen := ckULong(len(plaintext))
+		rv := goDecrypt(h, bytePtr(ciphertext), ckULong(len(ciphertext)), bytePtr(plaintext), &plaintextLen)
+
+		return plaintext[:plaintextLen], rv
+	}
+
+	if plaintext, rv := decrypt(ciphertext); rv != pkcs11.CKR_OK || !bytes.Equal(plaintext, data) {
+		t.Errorf("C_Decrypt: got %s with %q, want %q", RVTrace(uint(rv)), plaintext, data)
+	}
+
+	ciphertext[len(ciphertext)-1] ^= 1
+
+	if _, rv := decrypt(ciphertext); rv != pkcs11.CKR_ENCRYPTED_DATA_INVALID {
+		t.Errorf("C_Decrypt with a tampered tag: got %s, want CKR_ENCRYPTED_DATA_INVALID", RVTrace(uint(rv)))
+	}
+}
+
+// nativeParamsBackend stands in for a *pkcs11.Ctx, and so receives mechanism
+// parameters as C structures.  module checks them during the backend call,
+// the way the PKCS#11 module behind the Ctx would.
+type nativeParamsBackend struct {
+	testBackend
+	module func(m *pkcs11.Mechanism) error
+}
+
+func (nativeParamsBackend) ReceivesNativeParams() bool {
+	return true
+}
+
+func (b nativeParamsBackend) SignInit(_ pkcs11.SessionHandle, m []*pkcs11.Mechanism, _ pkcs11.ObjectHandle) error {
+	return b.module(m[0])
+}
+
+func (b nativeParamsBackend) EncryptInit(_ pkcs11.SessionHandle, m []*pkcs11.Mechanism, _ pkcs11.ObjectHandle) error {
+	return b.module(m[0])
+}
+
+func (b nativeParamsBackend) WrapKey(_ pkcs11.SessionHandle, m []*pkcs11.Mechanism, _, _ pkcs11.ObjectHandle) ([]byte, error) {
+	return []byte("wrapped"), b.module(m[0])
+}
+
+func (b nativeParamsBackend) DeriveKey(_ pkcs11.SessionHandle, m []*pkcs11.Mechanism, _ pkcs11.ObjectHandle, _ []*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	return 0, b.module(m[0])
+}
+
+func (b nativeParamsBackend) GenerateKey(_ pkcs11.SessionHandle, m []*pkcs11.Mechanism, _ []*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	return 0, b.module(m[0])
+}
+
+// nativeParam returns the parameter of m as the C structure T.
+func nativeParam[T any](t *testing.T, m *pkcs11.Mechanism) *T {
+	t.Helper()
+
+	if size := unsafe.Sizeof(*new(T)); uintptr(len(m.Parameter)) != size {
+		t.Fatalf("got a %d-byte parameter, want %d bytes", len(m.Parameter), size)
+	}
+
+	return (*T)(unsafe.Pointer(&m.Parameter[0]))
+}
+
+func TestSetBackendNativeParams(t *testing.T) {
+	oldBackend := backend
+	t.Cleanup(func() { SetBackend(oldBackend) })
+
+	for _, tt := range []struct {
+		name string
+		b    Backend
+		want bool
+	}{
+		{"*pkcs11.Ctx", new(pkcs11.Ctx), true},
+		{"NativeParamsReceiver", nativeParamsBackend{}, true},
+		{"other backend", testBackend{}, false},
+	} {
+		SetBackend(tt.b)
+
+		if nativeParams != tt.want {
+			t.Errorf("%s: got nativeParams %t, want %t", tt.name, nativeParams, tt.want)
+		}
+	}
+}
+
+func TestNativeParamsEDDSA(t *testing.T) {
+	context := []byte("context")
+
+	var (
+		gotPHFlag  bool
+		gotContext []byte
+	)
+
+	h := openTestSession(t, nativeParamsBackend{module: func(m *pkcs11.Mechanism) error {
+		params := nativeParam[_Ctype_CK_EDDSA_PARAMS](t, m)
+		gotPHFlag = params.phFlag == pkcs11.CK_TRUE
+		gotContext = bytes.Clone(unsafe.Slice((*byte)(unsafe.Pointer(params.pContextData)), params.ulContextDataLen))
+
+		return nil
+	}})
+
+	if rv := goSignInit(h, testEDDSAMechanism(t, true, len(context), context), 2); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_SignInit: got %s", RVTrace(uint(rv)))
+	}
+
+	if !gotPHFlag || !bytes.Equal(gotContext, context) {
+		t.Errorf("the module got phFlag %t and context %q, want true and %q", gotPHFlag, gotContext, context)
+	}
+
+	// The parameter is still checked before it reaches the module.
+	var short _Ctype_CK_EDDSA_PARAMS
+	if rv := goSignInit(h, testMechanism(t, CKM_EDDSA, unsafe.Pointer(&short), 1), 2); rv != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+		t.Errorf("1-byte parameter: got %s, want CKR_MECHANISM_PARAM_INVALID", RVTrace(uint(rv)))
+	}
+}
+
+func TestNativeParamsTLSPRF(t *testing.T) {
+	seed := []byte("seed")
+	label := []byte("label")
+	output := make([]byte, 16)
+	outputLen := ckULong(len(output))
+	want := []byte("derived")
+
+	var pinner runtime.Pinner
+
+	t.Cleanup(pinner.Unpin)
+	pinner.Pin(&seed[0])
+	pinner.Pin(&label[0])
+	pinner.Pin(&output[0])
+	pinner.Pin(&outputLen)
+
+	var gotSeed, gotLabel []byte
+
+	h := openTestSession(t, nativeParamsBackend{module: func(m *pkcs11.Mechanism) error {
+		params := nativeParam[_Ctype_CK_TLS_PRF_PARAMS](t, m)
+		gotSeed = bytes.Clone(unsafe.Slice((*byte)(unsafe.Pointer(params.pSeed)), params.ulSeedLen))
+		gotLabel = bytes.Clone(unsafe.Slice((*byte)(unsafe.Pointer(params.pLabel)), params.ulLabelLen))
+
+		// The module writes the output to the application's buffer.
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(params.pOutput)), *params.pulOutputLen), want)
+		*params.pulOutputLen = ckULong(len(want))
+
+		return nil
+	}})
+
+	params := &_Ctype_CK_TLS_PRF_PARAMS{
+		pSeed:        bytePtr(seed),
+		ulSeedLen:    ckULong(len(seed)),
+		pLabel:       bytePtr(label),
+		ulLabelLen:   ckULong(len(label)),
+		pOutput:      bytePtr(output),
+		pulOutputLen: &outputLen,
+	}
+	m := testMechanism(t, pkcs11.CKM_TLS_PRF, unsafe.Pointer(params), unsafe.Sizeof(*params))
+	pTemplate, count := testTemplate(t, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_DATA),
+	})
+
+	var hKey ckObjectHandle
+	if rv := goDeriveKey(h, m, 1, pTemplate, count, &hKey); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_DeriveKey: got %s", RVTrace(uint(rv)))
+	}
+
+	if !bytes.Equal(gotSeed, seed) || !bytes.Equal(gotLabel, label) {
+		t.Errorf("the module got seed %q and label %q, want %q and %q", gotSeed, gotLabel, seed, label)
+	}
+
+	if got := output[:outputLen]; !bytes.Equal(got, want) {
+		t.Errorf("got output %q, want %q", got, want)
+	}
+}
+
+func TestNativeParamsCBCEncryptData(t *testing.T) {
+	data := []byte("0123456789abcdef")
+
+	var pinner runtime.Pinner
+
+	t.Cleanup(pinner.Unpin)
+	pinner.Pin(&data[0])
+
+	var gotIV, gotData []byte
+
+	h := openTestSession(t, nativeParamsBackend{module: func(m *pkcs11.Mechanism) error {
+		// CK_SEED_CBC_ENCRYPT_DATA_PARAMS has the same layout.
+		params := nativeParam[_Ctype_CK_ARIA_CBC_ENCRYPT_DATA_PARAMS](t, m)
+		gotIV = bytes.Clone(unsafe.Slice((*byte)(unsafe.Pointer(&params.iv[0])), len(params.iv)))
+		gotData = bytes.Clone(unsafe.Slice((*byte)(unsafe.Pointer(params.pData)), params.length))
+
+		return nil
+	}})
+	pTemplate, count := testTemplate(t, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+	})
+
+	for _, mech := range []uint{pkcs11.CKM_ARIA_CBC_ENCRYPT_DATA, pkcs11.CKM_SEED_CBC_ENCRYPT_DATA} {
+		params := &_Ctype_CK_ARIA_CBC_ENCRYPT_DATA_PARAMS{pData: bytePtr(data), length: ckULong(len(data))}
+		for i := range params.iv {
+			params.iv[i] = ckByte(i)
+		}
+
+		var hKey ckObjectHandle
+		if rv := goDeriveKey(h, testMechanism(t, mech, unsafe.Pointer(params), unsafe.Sizeof(*params)), 1, pTemplate, count, &hKey); rv != pkcs11.CKR_OK {
+			t.Fatalf("%s: C_DeriveKey: got %s", traceValueName(mech, strCKM), RVTrace(uint(rv)))
+		}
+
+		if !bytes.Equal(gotIV, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}) || !bytes.Equal(gotData, data) {
+			t.Errorf("%s: the module got IV %x and data %q", traceValueName(mech, strCKM), gotIV, gotData)
+		}
+	}
+}
+
+func TestNativeParamsPBE(t *testing.T) {
+	password := []byte("correct horse")
+	salt := []byte("NaCl")
+	initVector := make([]byte, 8)
+
+	var pinner runtime.Pinner
+
+	t.Cleanup(pinner.Unpin)
+	pinner.Pin(&password[0])
+	pinner.Pin(&salt[0])
+	pinner.Pin(&initVector[0])
+
+	var (
+		gotPassword, gotSalt []byte
+		gotIteration         ckULong
+	)
+
+	h := openTestSession(t, nativeParamsBackend{module: func(m *pkcs11.Mechanism) error {
+		params := nativeParam[_Ctype_CK_PBE_PARAMS](t, m)
+		gotPassword = bytes.Clone(unsafe.Slice((*byte)(unsafe.Pointer(params.pPassword)), params.ulPasswordLen))
+		gotSalt = bytes.Clone(unsafe.Slice((*byte)(unsafe.Pointer(params.pSalt)), params.ulSaltLen))
+		gotIteration = params.ulIteration
+
+		// The module writes the IV to the application's buffer.
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(params.pInitVector)), 8), "IV-12345")
+
+		return nil
+	}})
+
+	params := &_Ctype_CK_PBE_PARAMS{
+		pInitVector:   bytePtr(initVector),
+		pPassword:     (*_Ctype_CK_UTF8CHAR)(unsafe.Pointer(&password[0])),
+		ulPasswordLen: ckULong(len(password)),
+		pSalt:         bytePtr(salt),
+		ulSaltLen:     ckULong(len(salt)),
+		ulIteration:   2048,
+	}
+	m := testMechanism(t, pkcs11.CKM_PBE_SHA1_DES3_EDE_CBC, unsafe.Pointer(params), unsafe.Sizeof(*params))
+	pTemplate, count := testTemplate(t, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+	})
+
+	var hKey ckObjectHandle
+	if rv := goGenerateKey(h, m, pTemplate, count, &hKey); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_GenerateKey: got %s", RVTrace(uint(rv)))
+	}
+
+	if !bytes.Equal(gotPassword, password) || !bytes.Equal(gotSalt, salt) || gotIteration != 2048 {
+		t.Errorf("the module got password %q, salt %q and %d iterations", gotPassword, gotSalt, gotIteration)
+	}
+
+	if want := []byte("IV-12345"); !bytes.Equal(initVector, want) {
+		t.Errorf("got IV %q, want %q", initVector, want)
+	}
+}
+
+func TestNativeParamsAESCTR(t *testing.T) {
+	var (
+		gotCounterBits  ckULong
+		gotCounterBlock []byte
+	)
+
+	h := openTestSession(t, nativeParamsBackend{module: func(m *pkcs11.Mechanism) error {
+		params := nativeParam[_Ctype_CK_AES_CTR_PARAMS](t, m)
+		gotCounterBits = params.ulCounterBits
+		gotCounterBlock = bytes.Clone(unsafe.Slice((*byte)(unsafe.Pointer(&params.cb[0])), len(params.cb)))
+
+		return nil
+	}})
+
+	params := &_Ctype_CK_AES_CTR_PARAMS{ulCounterBits: 32}
+	for i := range params.cb {
+		params.cb[i] = ckByte(0xf0 + i)
+	}
+
+	if rv := goEncryptInit(h, testMechanism(t, pkcs11.CKM_AES_CTR, unsafe.Pointer(params), unsafe.Sizeof(*params)), 2); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_EncryptInit: got %s", RVTrace(uint(rv)))
+	}
+
+	if gotCounterBits != 32 || gotCounterBlock[0] != 0xf0 || gotCounterBlock[15] != 0xff {
+		t.Errorf("the module got %d counter bits and counter block %x", gotCounterBits, gotCounterBlock)
+	}
+}
+
+func TestNativeParamsRSAAESKeyWrap(t *testing.T) {
+	label := []byte("label")
+
+	var pinner runtime.Pinner
+
+	t.Cleanup(pinner.Unpin)
+
+	oaepParams := &_Ctype_CK_RSA_PKCS_OAEP_PARAMS{
+		hashAlg:         pkcs11.CKM_SHA256,
+		mgf:             pkcs11.CKG_MGF1_SHA256,
+		source:          pkcs11.CKZ_DATA_SPECIFIED,
+		pSourceData:     _Ctype_CK_VOID_PTR(&label[0]),
+		ulSourceDataLen: ckULong(len(label)),
+	}
+	pinner.Pin(&label[0])
+	pinner.Pin(oaepParams)
+
+	var (
+		gotAESKeyBits ckULong
+		gotHashAlg    _Ctype_CK_MECHANISM_TYPE
+		gotLabel      []byte
+	)
+
+	h := openTestSession(t, nativeParamsBackend{module: func(m *pkcs11.Mechanism) error {
+		params := nativeParam[_Ctype_CK_RSA_AES_KEY_WRAP_PARAMS](t, m)
+		gotAESKeyBits = params.ulAESKeyBits
+		gotHashAlg = params.pOAEPParams.hashAlg
+		gotLabel = bytes.Clone(unsafe.Slice((*byte)(params.pOAEPParams.pSourceData), params.pOAEPParams.ulSourceDataLen))
+
+		return nil
+	}})
+
+	params := &_Ctype_CK_RSA_AES_KEY_WRAP_PARAMS{
+		ulAESKeyBits: 256,
+		pOAEPParams:  oaepParams,
+	}
+	wrapped := make([]byte, 32)
+	wrappedLen := ckULong(len(wrapped))
+
+	if rv := goWrapKey(h, testMechanism(t, pkcs11.CKM_RSA_AES_KEY_WRAP, unsafe.Pointer(params), unsafe.Sizeof(*params)), 2, 3, bytePtr(wrapped), &wrappedLen); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_WrapKey: got %s", RVTrace(uint(rv)))
+	}
+
+	if gotAESKeyBits != 256 || gotHashAlg != pkcs11.CKM_SHA256 || !bytes.Equal(gotLabel, label) {
+		t.Errorf("the module got %d AES key bits, hash %d and label %q", gotAESKeyBits, gotHashAlg, gotLabel)
+	}
+}
+
+func TestNativeParamsSP800108(t *testing.T) {
+	label := []byte("label")
+	iv := []byte("feedback IV")
+	counterFormat := &_Ctype_CK_SP800_108_COUNTER_FORMAT{ulWidthInBits: 32}
+	dataParams := []_Ctype_CK_PRF_DATA_PARAM{
+		{_type: CK_SP800_108_ITERATION_VARIABLE, pValue: _Ctype_CK_VOID_PTR(unsafe.Pointer(counterFormat)), ulValueLen: ckULong(unsafe.Sizeof(*counterFormat))},
+		{_type: CK_SP800_108_BYTE_ARRAY, pValue: _Ctype_CK_VOID_PTR(unsafe.Pointer(&label[0])), ulValueLen: ckULong(len(label))},
+	}
+
+	var pinner runtime.Pinner
+
+	t.Cleanup(pinner.Unpin)
+	pinner.Pin(&label[0])
+	pinner.Pin(&iv[0])
+	pinner.Pin(counterFormat)
+	pinner.Pin(&dataParams[0])
+
+	var (
+		gotPRFType _Ctype_CK_MECHANISM_TYPE
+		gotWidth   ckULong
+		gotLabel   []byte
+		gotIV      []byte
+	)
+
+	// The module only looks at the fields that the two structures share,
+	// and at the feedback IV.
+	h := openTestSession(t, nativeParamsBackend{module: func(m *pkcs11.Mechanism) error {
+		var params *_Ctype_CK_SP800_108_KDF_PARAMS
+
+		gotIV = nil
+
+		if m.Mechanism == CKM_SP800_108_FEEDBACK_KDF {
+			feedback := nativeParam[_Ctype_CK_SP800_108_FEEDBACK_KDF_PARAMS](t, m)
+			params = &_Ctype_CK_SP800_108_KDF_PARAMS{prfType: feedback.prfType, ulNumberOfDataParams: feedback.ulNumberOfDataParams, pDataParams: feedback.pDataParams}
+			gotIV = bytes.Clone(unsafe.Slice((*byte)(unsafe.Pointer(feedback.pIV)), feedback.ulIVLen))
+		} else {
+			params = nativeParam[_Ctype_CK_SP800_108_KDF_PARAMS](t, m)
+		}
+
+		got := unsafe.Slice(params.pDataParams, params.ulNumberOfDataParams)
+		gotPRFType = params.prfType
+		gotWidth = (*_Ctype_CK_SP800_108_COUNTER_FORMAT)(got[0].pValue).ulWidthInBits
+		gotLabel = bytes.Clone(unsafe.Slice((*byte)(got[1].pValue), got[1].ulValueLen))
+
+		return nil
+	}})
+	pTemplate, count := testTemplate(t, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+	})
+
+	for _, tt := range []struct {
+		mech  uint
+		param unsafe.Pointer
+		size  uintptr
+	}{
+		{CKM_SP800_108_COUNTER_KDF, unsafe.Pointer(&_Ctype_CK_SP800_108_KDF_PARAMS{
+			prfType:              pkcs11.CKM_SHA256_HMAC,
+			ulNumberOfDataParams: ckULong(len(dataParams)),
+			pDataParams:          &dataParams[0],
+		}), unsafe.Sizeof(_Ctype_CK_SP800_108_KDF_PARAMS{})},
+		{CKM_SP800_108_FEEDBACK_KDF, unsafe.Pointer(&_Ctype_CK_SP800_108_FEEDBACK_KDF_PARAMS{
+			prfType:              pkcs11.CKM_SHA256_HMAC,
+			ulNumberOfDataParams: ckULong(len(dataParams)),
+			pDataParams:          &dataParams[0],
+			ulIVLen:              ckULong(len(iv)),
+			pIV:                  bytePtr(iv),
+		}), unsafe.Sizeof(_Ctype_CK_SP800_108_FEEDBACK_KDF_PARAMS{})},
+	} {
+		name := traceValueName(tt.mech, strCKM)
+
+		var hKey ckObjectHandle
+		if rv := goDeriveKey(h, testMechanism(t, tt.mech, tt.param, tt.size), 1, pTemplate, count, &hKey); rv != pkcs11.CKR_OK {
+			t.Fatalf("%s: C_DeriveKey: got %s", name, RVTrace(uint(rv)))
+		}
+
+		if gotPRFType != pkcs11.CKM_SHA256_HMAC || gotWidth != 32 || !bytes.Equal(gotLabel, label) {
+			t.Errorf("%s: the module got PRF %d, counter width %d and label %q", name, gotPRFType, gotWidth, gotLabel)
+		}
+
+		var wantIV []byte
+		if tt.mech == CKM_SP800_108_FEEDBACK_KDF {
+			wantIV = iv
+		}
+
+		if !bytes.Equal(gotIV, wantIV) {
+			t.Errorf("%s: the module got IV %q, want %q", name, gotIV, wantIV)
+		}
+	}
+}
+
+func TestNativeParamsTLS12(t *testing.T) {
+	clientRandom := bytes.Repeat([]byte{0xc1}, 32)
+	serverRandom := bytes.Repeat([]byte{0x5e}, 32)
+	ivClient := make([]byte, 16)
+	ivServer := make([]byte, 16)
+
+	var (
+		version _Ctype_CK_VERSION
+		keyMat  _Ctype_CK_SSL3_KEY_MAT_OUT
+		pinner  runtime.Pinner
+	)
+
+	t.Cleanup(pinner.Unpin)
+	pinner.Pin(&clientRandom[0])
+	pinner.Pin(&serverRandom[0])
+	pinner.Pin(&ivClient[0])
+	pinner.Pin(&ivServer[0])
+	pinner.Pin(&version)
+	pinner.Pin(&keyMat)
+
+	keyMat.pIVClient = bytePtr(ivClient)
+	keyMat.pIVServer = bytePtr(ivServer)
+	randomInfo := _Ctype_CK_SSL3_RANDOM_DATA{
+		pClientRandom:     bytePtr(clientRandom),
+		ulClientRandomLen: ckULong(len(clientRandom)),
+		pServerRandom:     bytePtr(serverRandom),
+		ulServerRandomLen: ckULong(len(serverRandom)),
+	}
+
+	var gotClientRandom []byte
+
+	// The module fills in the output fields in the application's memory.
+	h := openTestSession(t, nativeParamsBackend{module: func(m *pkcs11.Mechanism) error {
+		if m.Mechanism == pkcs11.CKM_TLS12_MASTER_KEY_DERIVE {
+			params := nativeParam[_Ctype_CK_TLS12_MASTER_KEY_DERIVE_PARAMS](t, m)
+			gotClientRandom = bytes.Clone(unsafe.Slice((*byte)(unsafe.Pointer(params.RandomInfo.pClientRandom)), params.RandomInfo.ulClientRandomLen))
+			params.pVersion.major = 3
+			params.pVersion.minor = 3
+
+			return nil
+		}
+
+		params := nativeParam[_Ctype_CK_TLS12_KEY_MAT_PARAMS](t, m)
+		gotClientRandom = bytes.Clone(unsafe.Slice((*byte)(unsafe.Pointer(params.RandomInfo.pClientRandom)), params.RandomInfo.ulClientRandomLen))
+		out := params.pReturnedKeyMaterial
+		out.hClientMacSecret, out.hServerMacSecret, out.hClientKey, out.hServerKey = 11, 12, 13, 14
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(out.pIVClient)), 16), "client IV 012345")
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(out.pIVServer)), 16), "server IV 012345")
+
+		return nil
+	}})
+	pTemplate, count := testTemplate(t, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+	})
+
+	masterParams := &_Ctype_CK_TLS12_MASTER_KEY_DERIVE_PARAMS{
+		RandomInfo:       randomInfo,
+		pVersion:         &version,
+		prfHashMechanism: pkcs11.CKM_SHA256,
+	}
+
+	var hKey ckObjectHandle
+	if rv := goDeriveKey(h, testMechanism(t, pkcs11.CKM_TLS12_MASTER_KEY_DERIVE, unsafe.Pointer(masterParams), unsafe.Sizeof(*masterParams)), 1, pTemplate, count, &hKey); rv != pkcs11.CKR_OK {
+		t.Fatalf("CKM_TLS12_MASTER_KEY_DERIVE: C_DeriveKey: got %s", RVTrace(uint(rv)))
+	}
+
+	if !bytes.Equal(gotClientRandom, clientRandom) || version.major != 3 || version.minor != 3 {
+		t.Errorf("CKM_TLS12_MASTER_KEY_DERIVE: the module got client random %x, and the application got version %d.%d", gotClientRandom, version.major, version.minor)
+	}
+
+	keyMatParams := &_Ctype_CK_TLS12_KEY_MAT_PARAMS{
+		ulMacSizeInBits:      256,
+		ulKeySizeInBits:      128,
+		ulIVSizeInBits:       128,
+		RandomInfo:           randomInfo,
+		pReturnedKeyMaterial: &keyMat,
+		prfHashMechanism:     pkcs11.CKM_SHA256,
+	}
+
+	if rv := goDeriveKey(h, testMechanism(t, pkcs11.CKM_TLS12_KEY_AND_MAC_DERIVE, unsafe.Pointer(keyMatParams), unsafe.Sizeof(*keyMatParams)), 1, pTemplate, count, &hKey); rv != pkcs11.CKR_OK {
+		t.Fatalf("CKM_TLS12_KEY_AND_MAC_DERIVE: C_DeriveKey: got %s", RVTrace(uint(rv)))
+	}
+
+	if keyMat.hClientMacSecret != 11 || keyMat.hServerMacSecret != 12 || keyMat.hClientKey != 13 || keyMat.hServerKey != 14 {
+		t.Errorf("CKM_TLS12_KEY_AND_MAC_DERIVE: got key handles %d, %d, %d and %d", keyMat.hClientMacSecret, keyMat.hServerMacSecret, keyMat.hClientKey, keyMat.hServerKey)
+	}
+
+	if string(ivClient) != "client IV 012345" || string(ivServer) != "server IV 012345" {
+		t.Errorf("CKM_TLS12_KEY_AND_MAC_DERIVE: got IVs %q and %q", ivClient, ivServer)
+	}
+}
+
+func TestNativeParamsPBKDF2(t *testing.T) {
+	salt := []byte("NaCl")
+	password := []byte("correct horse")
+
+	var pinner runtime.Pinner
+
+	t.Cleanup(pinner.Unpin)
+	pinner.Pin(&salt[0])
+	pinner.Pin(&password[0])
+
+	var (
+		gotSalt, gotPassword []byte
+		gotIterations        ckULong
+	)
+
+	h := openTestSession(t, nativeParamsBackend{module: func(m *pkcs11.Mechanism) error {
+		params := nativeParam[_Ctype_CK_PKCS5_PBKD2_PARAMS2](t, m)
+		gotSalt = bytes.Clone(unsafe.Slice((*byte)(params.pSaltSourceData), params.ulSaltSourceDataLen))
+		gotPassword = bytes.Clone(unsafe.Slice((*byte)(unsafe.Pointer(params.pPassword)), params.ulPasswordLen))
+		gotIterations = params.iterations
+
+		return nil
+	}})
+
+	params := &_Ctype_CK_PKCS5_PBKD2_PARAMS2{
+		saltSource:          pkcs11.CKZ_SALT_SPECIFIED,
+		pSaltSourceData:     _Ctype_CK_VOID_PTR(unsafe.Pointer(&salt[0])),
+		ulSaltSourceDataLen: ckULong(len(salt)),
+		iterations:          4096,
+		prf:                 pkcs11.CKP_PKCS5_PBKD2_HMAC_SHA256,
+		pPassword:           (*_Ctype_CK_UTF8CHAR)(unsafe.Pointer(&password[0])),
+		ulPasswordLen:       ckULong(len(password)),
+	}
+	pTemplate, count := testTemplate(t, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+	})
+
+	var hKey ckObjectHandle
+	if rv := goGenerateKey(h, testMechanism(t, pkcs11.CKM_PKCS5_PBKD2, unsafe.Pointer(params), unsafe.Sizeof(*params)), pTemplate, count, &hKey); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_GenerateKey: got %s", RVTrace(uint(rv)))
+	}
+
+	if !bytes.Equal(gotSalt, salt) || !bytes.Equal(gotPassword, password) || gotIterations != 4096 {
+		t.Errorf("the module got salt %q, password %q and %d iterations", gotSalt, gotPassword, gotIterations)
+	}
+}
+
+func TestNativeParamsOTP(t *testing.T) {
+	counter := []byte{0, 0, 0, 0, 0, 0, 0, 42}
+	inputs := []_Ctype_CK_OTP_PARAM{{
+		_type:      pkcs11.CK_OTP_COUNTER,
+		pValue:     _Ctype_CK_VOID_PTR(unsafe.Pointer(&counter[0])),
+		ulValueLen: ckULong(len(counter)),
+	}}
+
+	var pinner runtime.Pinner
+
+	t.Cleanup(pinner.Unpin)
+	pinner.Pin(&counter[0])
+	pinner.Pin(&inputs[0])
+
+	var (
+		gotType    ckULong
+		gotCounter []byte
+	)
+
+	h := openTestSession(t, nativeParamsBackend{module: func(m *pkcs11.Mechanism) error {
+		params := nativeParam[_Ctype_CK_OTP_PARAMS](t, m)
+		if params.ulCount != 1 {
+			t.Fatalf("the module got %d OTP params, want 1", params.ulCount)
+		}
+
+		param := unsafe.Slice((*_Ctype_CK_OTP_PARAM)(params.pParams), params.ulCount)[0]
+		gotType = param._type
+		gotCounter = bytes.Clone(unsafe.Slice((*byte)(param.pValue), param.ulValueLen))
+
+		return nil
+	}})
+
+	params := &_Ctype_CK_OTP_PARAMS{pParams: &inputs[0], ulCount: ckULong(len(inputs))}
+	if rv := goSignInit(h, testMechanism(t, pkcs11.CKM_HOTP, unsafe.Pointer(params), unsafe.Sizeof(*params)), 1); rv != pkcs11.CKR_OK {
+		t.Fatalf("C_SignInit: got %s", RVTrace(uint(rv)))
+	}
+
+	if gotType != pkcs11.CK_OTP_COUNTER || !bytes.Equal(gotCounter, counter) {
+		t.Errorf("the module got OTP param %d = %x", gotType, gotCounter)
+	}
+
+	session, err := getSession(pkcs11.SessionHandle(h))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if session.signOTPSignatureInfo {
+		t.Error("the module's signature would be rewritten as a CK_OTP_SIGNATURE_INFO")
+	}
+}
+
+func TestNativeParamsPoly1305(t *testing.T) {
+	nonce := []byte("0123456789ab")
+	aad := []byte("header")
+
+	var pinner runtime.Pinner
+
+	t.Cleanup(pinner.Unpin)
+	pinner.Pin(&nonce[0])
+	pinner.Pin(&aad[0])
+
+	var gotNonce, gotAAD []byte
+
+	h := openTestSession(t, nativeParamsBackend{module: func(m *pkcs11.Mechanism) error {
+		params := nativeParam[_Ctype_CK_SALSA20_CHACHA20_POLY1305_PARAMS](t, m)
+		gotNonce = bytes.Clone(unsafe.Slice((*byte)(unsafe.Pointer(params.pNonce)), params.ulNonceLen))
+		gotAAD = bytes.Clone(unsafe.Slice((*byte)(unsafe.Pointer(params.pAAD)), params.ulAADLen))
+
+		return nil
+	}})
+
+	for _, mech := range []uint{CKM_CHACHA20_POLY1305, CKM_SALSA20_POLY1305} {
+		params := &_Ctype_CK_SALSA20_CHACHA20_POLY1305_PARAMS{
+			pNonce:     bytePtr(nonce),
+			ulNonceLen: ckULong(len(nonce)),
+			pAAD:       bytePtr(aad),
+			ulAADLen:   ckULong(len(aad)),
+		}
+
+		if rv := goEncryptInit(h, testMechanism(t, mech, unsafe.Pointer(params), unsafe.Sizeof(*params)), 2); rv != pkcs11.CKR_OK {
+			t.Fatalf("%s: C_EncryptInit: got %s", traceValueName(mech, strCKM), RVTrace(uint(rv)))
+		}
+
+		if !bytes.Equal(gotNonce, nonce) || !bytes.Equal(gotAAD, aad) {
+			t.Errorf("%s: the module got nonce %q and AAD %q", traceValueName(mech, strCKM), gotNonce, gotAAD)
+		}
+	}
+}
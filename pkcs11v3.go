@@ -0,0 +1,66 @@
+// pkcs11mod
+// Copyright (C) 2022  Namecoin Developers
+//
+// pkcs11mod is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// pkcs11mod is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with pkcs11mod; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+
+package pkcs11mod
+
+// PKCS#11 v3.0 constants that miekg/pkcs11 doesn't define yet.  The Makefile
+// picks up the names from this file when generating strings.go, so each
+// constant must be on its own line.
+const (
+	// CKA_UNIQUE_ID is a read-only, per-object unique identifier.  Backends
+	// must supply it for every object to comply with PKCS#11 v3.0.
+	CKA_UNIQUE_ID = 0x0000000A
+
+	CKK_EC_EDWARDS    = 0x00000040
+	CKK_EC_MONTGOMERY = 0x00000041
+
+	CKM_EC_EDWARDS_KEY_PAIR_GEN    = 0x00001055
+	CKM_EC_MONTGOMERY_KEY_PAIR_GEN = 0x00001056
+	CKM_EDDSA                      = 0x00001057
+
+	CKM_SP800_108_COUNTER_KDF         = 0x000003AC
+	CKM_SP800_108_FEEDBACK_KDF        = 0x000003AD
+	CKM_SP800_108_DOUBLE_PIPELINE_KDF = 0x000003AE
+
+	CKM_SALSA20           = 0x00004021
+	CKM_CHACHA20_POLY1305 = 0x00004022
+	CKM_SALSA20_POLY1305  = 0x00004023
+
+	// CK_PRF_DATA_TYPE values, i.e. the PRFDataParam types.
+	CK_SP800_108_ITERATION_VARIABLE = 0x00000001
+	CK_SP800_108_OPTIONAL_COUNTER   = 0x00000002
+	CK_SP800_108_DKM_LENGTH         = 0x00000003
+	CK_SP800_108_BYTE_ARRAY         = 0x00000004
+
+	CK_SP800_108_DKM_LENGTH_SUM_OF_KEYS     = 0x00000001
+	CK_SP800_108_DKM_LENGTH_SUM_OF_SEGMENTS = 0x00000002
+
+	// CKR_AEAD_DECRYPT_FAILED is returned when an AEAD tag doesn't verify.
+	// v2.40 tokens return CKR_ENCRYPTED_DATA_INVALID instead.
+	CKR_AEAD_DECRYPT_FAILED     = 0x00000035
+	CKR_TOKEN_RESOURCE_EXCEEDED = 0x00000201
+	CKR_OPERATION_CANCEL_FAILED = 0x00000202
+
+	CKG_MGF1_SHA3_224 = 0x00000006
+	CKG_MGF1_SHA3_256 = 0x00000007
+	CKG_MGF1_SHA3_384 = 0x00000008
+	CKG_MGF1_SHA3_512 = 0x00000009
+
+	// CKF_INTERFACE_FORK_SAFE is the CK_INTERFACE flag for interfaces that
+	// can be used after fork(); see RegisterInterface.
+	CKF_INTERFACE_FORK_SAFE = 0x00000001
+)
@@ -0,0 +1,152 @@
+// pkcs11mod
+// Copyright (C) 2022  Namecoin Developers
+//
+// pkcs11mod is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// pkcs11mod is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with pkcs11mod; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+
+// PKCS#11 v3.0 definitions that are missing from the v2.40 headers shipped
+// with miekg/pkcs11.  Everything is guarded so that this file can coexist with
+// newer headers.  It must be included after spec/pkcs11go.h (which has no
+// include guard, so it isn't included again here).
+
+#ifndef PKCS11V3_H_
+#define PKCS11V3_H_
+
+#ifndef CKM_EDDSA
+#define CKM_EDDSA                      0x00001057UL
+#endif
+
+#ifndef CKM_SP800_108_COUNTER_KDF
+#define CKM_SP800_108_COUNTER_KDF         0x000003ACUL
+#define CKM_SP800_108_FEEDBACK_KDF        0x000003ADUL
+#define CKM_SP800_108_DOUBLE_PIPELINE_KDF 0x000003AEUL
+#endif
+
+#ifndef CK_SP800_108_ITERATION_VARIABLE
+#define CK_SP800_108_ITERATION_VARIABLE 0x00000001UL
+#define CK_SP800_108_OPTIONAL_COUNTER   0x00000002UL
+#define CK_SP800_108_DKM_LENGTH         0x00000003UL
+#define CK_SP800_108_BYTE_ARRAY         0x00000004UL
+#endif
+
+#ifndef CKM_SALSA20
+#define CKM_SALSA20                    0x00004021UL
+#define CKM_CHACHA20_POLY1305          0x00004022UL
+#define CKM_SALSA20_POLY1305           0x00004023UL
+#endif
+
+#ifndef CKF_INTERFACE_FORK_SAFE
+#define CKF_INTERFACE_FORK_SAFE        0x00000001UL
+#endif
+
+#ifdef PACKED_STRUCTURES
+# pragma pack(push, 1)
+#endif
+
+#ifndef CK_INTERFACE_DEFINED
+#define CK_INTERFACE_DEFINED
+typedef struct CK_INTERFACE {
+	CK_CHAR     *pInterfaceName;
+	CK_VOID_PTR  pFunctionList;
+	CK_FLAGS     flags;
+} CK_INTERFACE;
+
+typedef CK_INTERFACE CK_PTR CK_INTERFACE_PTR;
+typedef CK_INTERFACE_PTR CK_PTR CK_INTERFACE_PTR_PTR;
+#endif
+
+#ifndef CK_EDDSA_PARAMS_DEFINED
+#define CK_EDDSA_PARAMS_DEFINED
+typedef struct CK_EDDSA_PARAMS {
+	CK_BBOOL     phFlag;
+	CK_ULONG     ulContextDataLen;
+	CK_BYTE_PTR  pContextData;
+} CK_EDDSA_PARAMS;
+
+typedef CK_EDDSA_PARAMS CK_PTR CK_EDDSA_PARAMS_PTR;
+#endif
+
+#ifndef CK_SP800_108_KDF_PARAMS_DEFINED
+#define CK_SP800_108_KDF_PARAMS_DEFINED
+typedef struct CK_PRF_DATA_PARAM {
+	CK_ULONG     type;
+	CK_VOID_PTR  pValue;
+	CK_ULONG     ulValueLen;
+} CK_PRF_DATA_PARAM;
+
+typedef CK_PRF_DATA_PARAM CK_PTR CK_PRF_DATA_PARAM_PTR;
+
+typedef struct CK_SP800_108_COUNTER_FORMAT {
+	CK_BBOOL  bLittleEndian;
+	CK_ULONG  ulWidthInBits;
+} CK_SP800_108_COUNTER_FORMAT;
+
+typedef CK_SP800_108_COUNTER_FORMAT CK_PTR CK_SP800_108_COUNTER_FORMAT_PTR;
+
+typedef struct CK_SP800_108_DKM_LENGTH_FORMAT {
+	CK_ULONG  dkmLengthMethod;
+	CK_BBOOL  bLittleEndian;
+	CK_ULONG  ulWidthInBits;
+} CK_SP800_108_DKM_LENGTH_FORMAT;
+
+typedef CK_SP800_108_DKM_LENGTH_FORMAT CK_PTR CK_SP800_108_DKM_LENGTH_FORMAT_PTR;
+
+typedef struct CK_DERIVED_KEY {
+	CK_ATTRIBUTE_PTR      pTemplate;
+	CK_ULONG              ulAttributeCount;
+	CK_OBJECT_HANDLE_PTR  phKey;
+} CK_DERIVED_KEY;
+
+typedef CK_DERIVED_KEY CK_PTR CK_DERIVED_KEY_PTR;
+
+typedef struct CK_SP800_108_KDF_PARAMS {
+	CK_MECHANISM_TYPE      prfType;
+	CK_ULONG               ulNumberOfDataParams;
+	CK_PRF_DATA_PARAM_PTR  pDataParams;
+	CK_ULONG               ulAdditionalDerivedKeys;
+	CK_DERIVED_KEY_PTR     pAdditionalDerivedKeys;
+} CK_SP800_108_KDF_PARAMS;
+
+typedef CK_SP800_108_KDF_PARAMS CK_PTR CK_SP800_108_KDF_PARAMS_PTR;
+
+typedef struct CK_SP800_108_FEEDBACK_KDF_PARAMS {
+	CK_MECHANISM_TYPE      prfType;
+	CK_ULONG               ulNumberOfDataParams;
+	CK_PRF_DATA_PARAM_PTR  pDataParams;
+	CK_ULONG               ulIVLen;
+	CK_BYTE_PTR            pIV;
+	CK_ULONG               ulAdditionalDerivedKeys;
+	CK_DERIVED_KEY_PTR     pAdditionalDerivedKeys;
+} CK_SP800_108_FEEDBACK_KDF_PARAMS;
+
+typedef CK_SP800_108_FEEDBACK_KDF_PARAMS CK_PTR CK_SP800_108_FEEDBACK_KDF_PARAMS_PTR;
+#endif
+
+#ifndef CK_SALSA20_CHACHA20_POLY1305_PARAMS_DEFINED
+#define CK_SALSA20_CHACHA20_POLY1305_PARAMS_DEFINED
+typedef struct CK_SALSA20_CHACHA20_POLY1305_PARAMS {
+	CK_BYTE_PTR  pNonce;
+	CK_ULONG     ulNonceLen;
+	CK_BYTE_PTR  pAAD;
+	CK_ULONG     ulAADLen;
+} CK_SALSA20_CHACHA20_POLY1305_PARAMS;
+
+typedef CK_SALSA20_CHACHA20_POLY1305_PARAMS CK_PTR CK_SALSA20_CHACHA20_POLY1305_PARAMS_PTR;
+#endif
+
+#ifdef PACKED_STRUCTURES
+# pragma pack(pop)
+#endif
+
+#endif
@@ -0,0 +1,578 @@
+// pkcs11mod
+// Copyright (C) 2022  Namecoin Developers
+//
+// pkcs11mod is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// pkcs11mod is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with pkcs11mod; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+
+package pkcs11mod
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// timingBackend wraps a Backend and logs how long each call into it takes.
+// SetBackend only installs it when PKCS11MOD_TRACE_TIMING is set, so the
+// timing has no cost when it's disabled.  Its methods for the optional
+// interfaces (SlotEventWaiter etc.) are only called if the wrapped Backend
+// implements them.
+type timingBackend struct {
+	b Backend
+}
+
+func logTiming(name, fields string, start time.Time, err error) {
+	took := time.Since(start)
+
+	if traceFuncs != nil && !traceFuncs[name] {
+		return
+	}
+
+	if traceJSON {
+		logTraceJSON(timingRecord(name, fields, took, RVTrace(uint(fromError(err)))))
+
+		return
+	}
+
+	if fields != "" {
+		fields += " "
+	}
+
+	traceLog().Printf("pkcs11mod %s: %stook=%s rv=%s", name, fields, took, RVTrace(uint(fromError(err))))
+}
+
+func timingMechanism(m []*pkcs11.Mechanism) string {
+	if len(m) == 0 || m[0] == nil {
+		return "none"
+	}
+
+	return traceValueName(m[0].Mechanism, strCKM)
+}
+
+func (t *timingBackend) Initialize() error {
+	start := time.Now()
+	err := t.b.Initialize()
+	logTiming("C_Initialize", "", start, err)
+
+	return err
+}
+
+func (t *timingBackend) Finalize() error {
+	start := time.Now()
+	err := t.b.Finalize()
+	logTiming("C_Finalize", "", start, err)
+
+	return err
+}
+
+func (t *timingBackend) GetInfo() (pkcs11.Info, error) {
+	start := time.Now()
+	info, err := t.b.GetInfo()
+	logTiming("C_GetInfo", "", start, err)
+
+	return info, err
+}
+
+func (t *timingBackend) GetSlotList(tokenPresent bool) ([]uint, error) {
+	start := time.Now()
+	ids, err := t.b.GetSlotList(tokenPresent)
+	logTiming("C_GetSlotList", "", start, err)
+
+	return ids, err
+}
+
+func (t *timingBackend) GetSlotInfo(slotID uint) (pkcs11.SlotInfo, error) {
+	start := time.Now()
+	info, err := t.b.GetSlotInfo(slotID)
+	logTiming("C_GetSlotInfo", "slot="+slotTrace(slotID), start, err)
+
+	return info, err
+}
+
+func (t *timingBackend) GetTokenInfo(slotID uint) (pkcs11.TokenInfo, error) {
+	start := time.Now()
+	info, err := t.b.GetTokenInfo(slotID)
+	logTiming("C_GetTokenInfo", "slot="+slotTrace(slotID), start, err)
+
+	return info, err
+}
+
+func (t *timingBackend) GetMechanismList(slotID uint) ([]*pkcs11.Mechanism, error) {
+	start := time.Now()
+	mechanisms, err := t.b.GetMechanismList(slotID)
+	logTiming("C_GetMechanismList", "slot="+slotTrace(slotID), start, err)
+
+	return mechanisms, err
+}
+
+func (t *timingBackend) GetMechanismInfo(slotID uint, m []*pkcs11.Mechanism) (pkcs11.MechanismInfo, error) {
+	start := time.Now()
+	info, err := t.b.GetMechanismInfo(slotID, m)
+	logTiming("C_GetMechanismInfo", fmt.Sprintf("slot=%s mechanism=%s", slotTrace(slotID), timingMechanism(m)), start, err)
+
+	return info, err
+}
+
+func (t *timingBackend) InitPIN(sh pkcs11.SessionHandle, pin string) error {
+	start := time.Now()
+	err := t.b.InitPIN(sh, pin)
+	logTiming("C_InitPIN", "session="+sessionTrace(sh), start, err)
+
+	return err
+}
+
+func (t *timingBackend) SetPIN(sh pkcs11.SessionHandle, oldPin string, newPin string) error {
+	start := time.Now()
+	err := t.b.SetPIN(sh, oldPin, newPin)
+	logTiming("C_SetPIN", "session="+sessionTrace(sh), start, err)
+
+	return err
+}
+
+func (t *timingBackend) OpenSession(slotID uint, flags uint) (pkcs11.SessionHandle, error) {
+	start := time.Now()
+	handle, err := t.b.OpenSession(slotID, flags)
+	logTiming("C_OpenSession", "slot="+slotTrace(slotID), start, err)
+
+	return handle, err
+}
+
+func (t *timingBackend) CloseSession(sh pkcs11.SessionHandle) error {
+	start := time.Now()
+	err := t.b.CloseSession(sh)
+	logTiming("C_CloseSession", "session="+sessionTrace(sh), start, err)
+
+	return err
+}
+
+func (t *timingBackend) CloseAllSessions(slotID uint) error {
+	start := time.Now()
+	err := t.b.CloseAllSessions(slotID)
+	logTiming("C_CloseAllSessions", "slot="+slotTrace(slotID), start, err)
+
+	return err
+}
+
+func (t *timingBackend) GetSessionInfo(sh pkcs11.SessionHandle) (pkcs11.SessionInfo, error) {
+	start := time.Now()
+	info, err := t.b.GetSessionInfo(sh)
+	logTiming("C_GetSessionInfo", "session="+sessionTrace(sh), start, err)
+
+	return info, err
+}
+
+func (t *timingBackend) GetOperationState(sh pkcs11.SessionHandle) ([]byte, error) {
+	start := time.Now()
+	result, err := t.b.(OperationStateManager).GetOperationState(sh)
+	logTiming("C_GetOperationState", "session="+sessionTrace(sh), start, err)
+
+	return result, err
+}
+
+func (t *timingBackend) SetOperationState(sh pkcs11.SessionHandle, state []byte, encryptKey pkcs11.ObjectHandle, authKey pkcs11.ObjectHandle) error {
+	start := time.Now()
+	err := t.b.(OperationStateManager).SetOperationState(sh, state, encryptKey, authKey)
+	logTiming("C_SetOperationState", "session="+sessionTrace(sh), start, err)
+
+	return err
+}
+
+func (t *timingBackend) Login(sh pkcs11.SessionHandle, userType uint, pin string) error {
+	start := time.Now()
+	err := t.b.Login(sh, userType, pin)
+	logTiming("C_Login", "session="+sessionTrace(sh), start, err)
+
+	return err
+}
+
+func (t *timingBackend) Logout(sh pkcs11.SessionHandle) error {
+	start := time.Now()
+	err := t.b.Logout(sh)
+	logTiming("C_Logout", "session="+sessionTrace(sh), start, err)
+
+	return err
+}
+
+func (t *timingBackend) CreateObject(sh pkcs11.SessionHandle, temp []*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	start := time.Now()
+	handle, err := t.b.CreateObject(sh, temp)
+	logTiming("C_CreateObject", "session="+sessionTrace(sh), start, err)
+
+	return handle, err
+}
+
+func (t *timingBackend) CopyObject(sh pkcs11.SessionHandle, o pkcs11.ObjectHandle, temp []*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	start := time.Now()
+	handle, err := t.b.CopyObject(sh, o, temp)
+	logTiming("C_CopyObject", "session="+sessionTrace(sh), start, err)
+
+	return handle, err
+}
+
+func (t *timingBackend) DestroyObject(sh pkcs11.SessionHandle, o pkcs11.ObjectHandle) error {
+	start := time.Now()
+	err := t.b.DestroyObject(sh, o)
+	logTiming("C_DestroyObject", "session="+sessionTrace(sh), start, err)
+
+	return err
+}
+
+func (t *timingBackend) GetObjectSize(sh pkcs11.SessionHandle, o pkcs11.ObjectHandle) (uint, error) {
+	start := time.Now()
+	size, err := t.b.GetObjectSize(sh, o)
+	logTiming("C_GetObjectSize", "session="+sessionTrace(sh), start, err)
+
+	return size, err
+}
+
+func (t *timingBackend) GetAttributeValue(sh pkcs11.SessionHandle, o pkcs11.ObjectHandle, a []*pkcs11.Attribute) ([]*pkcs11.Attribute, error) {
+	start := time.Now()
+	attrs, err := t.b.GetAttributeValue(sh, o, a)
+	logTiming("C_GetAttributeValue", "session="+sessionTrace(sh), start, err)
+
+	return attrs, err
+}
+
+func (t *timingBackend) SetAttributeValue(sh pkcs11.SessionHandle, o pkcs11.ObjectHandle, a []*pkcs11.Attribute) error {
+	start := time.Now()
+	err := t.b.SetAttributeValue(sh, o, a)
+	logTiming("C_SetAttributeValue", "session="+sessionTrace(sh), start, err)
+
+	return err
+}
+
+func (t *timingBackend) FindObjectsInit(sh pkcs11.SessionHandle, temp []*pkcs11.Attribute) error {
+	start := time.Now()
+	err := t.b.FindObjectsInit(sh, temp)
+	logTiming("C_FindObjectsInit", "session="+sessionTrace(sh), start, err)
+
+	return err
+}
+
+func (t *timingBackend) FindObjects(sh pkcs11.SessionHandle, max int) ([]pkcs11.ObjectHandle, bool, error) {
+	start := time.Now()
+	handles, more, err := t.b.FindObjects(sh, max)
+	logTiming("C_FindObjects", "session="+sessionTrace(sh), start, err)
+
+	return handles, more, err
+}
+
+func (t *timingBackend) FindObjectsFinal(sh pkcs11.SessionHandle) error {
+	start := time.Now()
+	err := t.b.FindObjectsFinal(sh)
+	logTiming("C_FindObjectsFinal", "session="+sessionTrace(sh), start, err)
+
+	return err
+}
+
+func (t *timingBackend) EncryptInit(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, o pkcs11.ObjectHandle) error {
+	start := time.Now()
+	err := t.b.EncryptInit(sh, m, o)
+	logTiming("C_EncryptInit", fmt.Sprintf("session=%s mechanism=%s", sessionTrace(sh), timingMechanism(m)), start, err)
+
+	return err
+}
+
+func (t *timingBackend) Encrypt(sh pkcs11.SessionHandle, message []byte) ([]byte, error) {
+	start := time.Now()
+	result, err := t.b.Encrypt(sh, message)
+	logTiming("C_Encrypt", "session="+sessionTrace(sh), start, err)
+
+	return result, err
+}
+
+func (t *timingBackend) EncryptUpdate(sh pkcs11.SessionHandle, plain []byte) ([]byte, error) {
+	start := time.Now()
+	result, err := t.b.EncryptUpdate(sh, plain)
+	logTiming("C_EncryptUpdate", "session="+sessionTrace(sh), start, err)
+
+	return result, err
+}
+
+func (t *timingBackend) EncryptFinal(sh pkcs11.SessionHandle) ([]byte, error) {
+	start := time.Now()
+	result, err := t.b.EncryptFinal(sh)
+	logTiming("C_EncryptFinal", "session="+sessionTrace(sh), start, err)
+
+	return result, err
+}
+
+func (t *timingBackend) DecryptInit(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, o pkcs11.ObjectHandle) error {
+	start := time.Now()
+	err := t.b.DecryptInit(sh, m, o)
+	logTiming("C_DecryptInit", fmt.Sprintf("session=%s mechanism=%s", sessionTrace(sh), timingMechanism(m)), start, err)
+
+	return err
+}
+
+func (t *timingBackend) Decrypt(sh pkcs11.SessionHandle, cipher []byte) ([]byte, error) {
+	start := time.Now()
+	result, err := t.b.Decrypt(sh, cipher)
+	logTiming("C_Decrypt", "session="+sessionTrace(sh), start, err)
+
+	return result, err
+}
+
+func (t *timingBackend) DecryptUpdate(sh pkcs11.SessionHandle, cipher []byte) ([]byte, error) {
+	start := time.Now()
+	result, err := t.b.DecryptUpdate(sh, cipher)
+	logTiming("C_DecryptUpdate", "session="+sessionTrace(sh), start, err)
+
+	return result, err
+}
+
+func (t *timingBackend) DecryptFinal(sh pkcs11.SessionHandle) ([]byte, error) {
+	start := time.Now()
+	result, err := t.b.DecryptFinal(sh)
+	logTiming("C_DecryptFinal", "session="+sessionTrace(sh), start, err)
+
+	return result, err
+}
+
+func (t *timingBackend) DigestInit(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism) error {
+	start := time.Now()
+	err := t.b.DigestInit(sh, m)
+	logTiming("C_DigestInit", fmt.Sprintf("session=%s mechanism=%s", sessionTrace(sh), timingMechanism(m)), start, err)
+
+	return err
+}
+
+func (t *timingBackend) Digest(sh pkcs11.SessionHandle, message []byte) ([]byte, error) {
+	start := time.Now()
+	result, err := t.b.Digest(sh, message)
+	logTiming("C_Digest", "session="+sessionTrace(sh), start, err)
+
+	return result, err
+}
+
+func (t *timingBackend) DigestUpdate(sh pkcs11.SessionHandle, message []byte) error {
+	start := time.Now()
+	err := t.b.DigestUpdate(sh, message)
+	logTiming("C_DigestUpdate", "session="+sessionTrace(sh), start, err)
+
+	return err
+}
+
+func (t *timingBackend) DigestKey(sh pkcs11.SessionHandle, key pkcs11.ObjectHandle) error {
+	start := time.Now()
+	err := t.b.DigestKey(sh, key)
+	logTiming("C_DigestKey", "session="+sessionTrace(sh), start, err)
+
+	return err
+}
+
+func (t *timingBackend) DigestFinal(sh pkcs11.SessionHandle) ([]byte, error) {
+	start := time.Now()
+	result, err := t.b.DigestFinal(sh)
+	logTiming("C_DigestFinal", "session="+sessionTrace(sh), start, err)
+
+	return result, err
+}
+
+func (t *timingBackend) SignInit(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, o pkcs11.ObjectHandle) error {
+	start := time.Now()
+	err := t.b.SignInit(sh, m, o)
+	logTiming("C_SignInit", fmt.Sprintf("session=%s mechanism=%s", sessionTrace(sh), timingMechanism(m)), start, err)
+
+	return err
+}
+
+func (t *timingBackend) Sign(sh pkcs11.SessionHandle, message []byte) ([]byte, error) {
+	start := time.Now()
+	result, err := t.b.Sign(sh, message)
+	logTiming("C_Sign", "session="+sessionTrace(sh), start, err)
+
+	return result, err
+}
+
+func (t *timingBackend) SignUpdate(sh pkcs11.SessionHandle, message []byte) error {
+	start := time.Now()
+	err := t.b.SignUpdate(sh, message)
+	logTiming("C_SignUpdate", "session="+sessionTrace(sh), start, err)
+
+	return err
+}
+
+func (t *timingBackend) SignFinal(sh pkcs11.SessionHandle) ([]byte, error) {
+	start := time.Now()
+	result, err := t.b.SignFinal(sh)
+	logTiming("C_SignFinal", "session="+sessionTrace(sh), start, err)
+
+	return result, err
+}
+
+func (t *timingBackend) SignRecoverInit(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, key pkcs11.ObjectHandle) error {
+	start := time.Now()
+	err := t.b.SignRecoverInit(sh, m, key)
+	logTiming("C_SignRecoverInit", fmt.Sprintf("session=%s mechanism=%s", sessionTrace(sh), timingMechanism(m)), start, err)
+
+	return err
+}
+
+func (t *timingBackend) SignRecover(sh pkcs11.SessionHandle, data []byte) ([]byte, error) {
+	start := time.Now()
+	result, err := t.b.SignRecover(sh, data)
+	logTiming("C_SignRecover", "session="+sessionTrace(sh), start, err)
+
+	return result, err
+}
+
+func (t *timingBackend) VerifyInit(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, key pkcs11.ObjectHandle) error {
+	start := time.Now()
+	err := t.b.VerifyInit(sh, m, key)
+	logTiming("C_VerifyInit", fmt.Sprintf("session=%s mechanism=%s", sessionTrace(sh), timingMechanism(m)), start, err)
+
+	return err
+}
+
+func (t *timingBackend) Verify(sh pkcs11.SessionHandle, data []byte, signature []byte) error {
+	start := time.Now()
+	err := t.b.Verify(sh, data, signature)
+	logTiming("C_Verify", "session="+sessionTrace(sh), start, err)
+
+	return err
+}
+
+func (t *timingBackend) VerifyUpdate(sh pkcs11.SessionHandle, part []byte) error {
+	start := time.Now()
+	err := t.b.VerifyUpdate(sh, part)
+	logTiming("C_VerifyUpdate", "session="+sessionTrace(sh), start, err)
+
+	return err
+}
+
+func (t *timingBackend) VerifyFinal(sh pkcs11.SessionHandle, signature []byte) error {
+	start := time.Now()
+	err := t.b.VerifyFinal(sh, signature)
+	logTiming("C_VerifyFinal", "session="+sessionTrace(sh), start, err)
+
+	return err
+}
+
+func (t *timingBackend) VerifyRecoverInit(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, key pkcs11.ObjectHandle) error {
+	start := time.Now()
+	err := t.b.VerifyRecoverInit(sh, m, key)
+	logTiming("C_VerifyRecoverInit", fmt.Sprintf("session=%s mechanism=%s", sessionTrace(sh), timingMechanism(m)), start, err)
+
+	return err
+}
+
+func (t *timingBackend) VerifyRecover(sh pkcs11.SessionHandle, signature []byte) ([]byte, error) {
+	start := time.Now()
+	result, err := t.b.VerifyRecover(sh, signature)
+	logTiming("C_VerifyRecover", "session="+sessionTrace(sh), start, err)
+
+	return result, err
+}
+
+func (t *timingBackend) DigestEncryptUpdate(sh pkcs11.SessionHandle, part []byte) ([]byte, error) {
+	start := time.Now()
+	result, err := t.b.DigestEncryptUpdate(sh, part)
+	logTiming("C_DigestEncryptUpdate", "session="+sessionTrace(sh), start, err)
+
+	return result, err
+}
+
+func (t *timingBackend) DecryptDigestUpdate(sh pkcs11.SessionHandle, cipher []byte) ([]byte, error) {
+	start := time.Now()
+	result, err := t.b.DecryptDigestUpdate(sh, cipher)
+	logTiming("C_DecryptDigestUpdate", "session="+sessionTrace(sh), start, err)
+
+	return result, err
+}
+
+func (t *timingBackend) SignEncryptUpdate(sh pkcs11.SessionHandle, part []byte) ([]byte, error) {
+	start := time.Now()
+	result, err := t.b.SignEncryptUpdate(sh, part)
+	logTiming("C_SignEncryptUpdate", "session="+sessionTrace(sh), start, err)
+
+	return result, err
+}
+
+func (t *timingBackend) DecryptVerifyUpdate(sh pkcs11.SessionHandle, cipher []byte) ([]byte, error) {
+	start := time.Now()
+	result, err := t.b.DecryptVerifyUpdate(sh, cipher)
+	logTiming("C_DecryptVerifyUpdate", "session="+sessionTrace(sh), start, err)
+
+	return result, err
+}
+
+func (t *timingBackend) GenerateKey(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, temp []*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	start := time.Now()
+	handle, err := t.b.GenerateKey(sh, m, temp)
+	logTiming("C_GenerateKey", fmt.Sprintf("session=%s mechanism=%s", sessionTrace(sh), timingMechanism(m)), start, err)
+
+	return handle, err
+}
+
+func (t *timingBackend) GenerateKeyPair(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, public []*pkcs11.Attribute, private []*pkcs11.Attribute) (pkcs11.ObjectHandle, pkcs11.ObjectHandle, error) {
+	start := time.Now()
+	pubHandle, privHandle, err := t.b.GenerateKeyPair(sh, m, public, private)
+	logTiming("C_GenerateKeyPair", fmt.Sprintf("session=%s mechanism=%s", sessionTrace(sh), timingMechanism(m)), start, err)
+
+	return pubHandle, privHandle, err
+}
+
+func (t *timingBackend) WrapKey(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, wrappingkey pkcs11.ObjectHandle, key pkcs11.ObjectHandle) ([]byte, error) {
+	start := time.Now()
+	result, err := t.b.WrapKey(sh, m, wrappingkey, key)
+	logTiming("C_WrapKey", fmt.Sprintf("session=%s mechanism=%s", sessionTrace(sh), timingMechanism(m)), start, err)
+
+	return result, err
+}
+
+func (t *timingBackend) UnwrapKey(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, unwrappingkey pkcs11.ObjectHandle, wrappedkey []byte, a []*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	start := time.Now()
+	handle, err := t.b.UnwrapKey(sh, m, unwrappingkey, wrappedkey, a)
+	logTiming("C_UnwrapKey", fmt.Sprintf("session=%s mechanism=%s", sessionTrace(sh), timingMechanism(m)), start, err)
+
+	return handle, err
+}
+
+func (t *timingBackend) DeriveKey(sh pkcs11.SessionHandle, m []*pkcs11.Mechanism, basekey pkcs11.ObjectHandle, a []*pkcs11.Attribute) (pkcs11.ObjectHandle, error) {
+	start := time.Now()
+	handle, err := t.b.DeriveKey(sh, m, basekey, a)
+	logTiming("C_DeriveKey", fmt.Sprintf("session=%s mechanism=%s", sessionTrace(sh), timingMechanism(m)), start, err)
+
+	return handle, err
+}
+
+func (t *timingBackend) SeedRandom(sh pkcs11.SessionHandle, seed []byte) error {
+	start := time.Now()
+	err := t.b.SeedRandom(sh, seed)
+	logTiming("C_SeedRandom", "session="+sessionTrace(sh), start, err)
+
+	return err
+}
+
+func (t *timingBackend) GenerateRandom(sh pkcs11.SessionHandle, length int) ([]byte, error) {
+	start := time.Now()
+	result, err := t.b.GenerateRandom(sh, length)
+	logTiming("C_GenerateRandom", "session="+sessionTrace(sh), start, err)
+
+	return result, err
+}
+
+func (t *timingBackend) SelfTest() error {
+	start := time.Now()
+	err := t.b.(SelfTester).SelfTest()
+	logTiming("pkcs11mod_SelfTest", "", start, err)
+
+	return err
+}
+
+func (t *timingBackend) WaitForSlotEvent(flags uint) chan pkcs11.SlotEvent {
+	return t.b.(SlotEventWaiter).WaitForSlotEvent(flags)
+}
@@ -0,0 +1,75 @@
+// pkcs11mod
+// Copyright (C) 2022  Namecoin Developers
+//
+// pkcs11mod is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// pkcs11mod is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with pkcs11mod; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+
+package pkcs11mod
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// slowSignBackend takes at least signDelay to sign.
+type slowSignBackend struct {
+	testBackend
+}
+
+const signDelay = 20 * time.Millisecond
+
+func (slowSignBackend) Sign(pkcs11.SessionHandle, []byte) ([]byte, error) {
+	time.Sleep(signDelay)
+
+	return []byte{0x01}, nil
+}
+
+func TestTimingRecordsDuration(t *testing.T) {
+	buf := captureTrace(t, false)
+	tb := &timingBackend{b: slowSignBackend{}}
+
+	if _, err := tb.Sign(testSessionHandle, []byte("message")); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+
+	m := regexp.MustCompile(`pkcs11mod C_Sign: session=\S+ took=(\S+) rv=CKR_OK\n`).FindStringSubmatch(buf.String())
+	if m == nil {
+		t.Fatalf("no timing line in the trace:\n%s", buf.String())
+	}
+
+	took, err := time.ParseDuration(m[1])
+	if err != nil {
+		t.Fatalf("can't parse the duration %q: %v", m[1], err)
+	}
+
+	if took < signDelay {
+		t.Errorf("recorded %s for a call that took at least %s", took, signDelay)
+	}
+}
+
+func TestTimingRecordsReturnCode(t *testing.T) {
+	buf := captureTrace(t, false)
+	tb := &timingBackend{b: failingSignInitBackend{}}
+
+	if err := tb.SignInit(testSessionHandle, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)}, 2); err == nil {
+		t.Fatal("SignInit succeeded")
+	}
+
+	if !regexp.MustCompile(`pkcs11mod C_SignInit: session=\S+ mechanism=CKM_ECDSA took=\S+ rv=CKR_DEVICE_ERROR\n`).MatchString(buf.String()) {
+		t.Errorf("no timing line with the return code by name in the trace:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,122 @@
+// pkcs11mod
+// Copyright (C) 2022  Namecoin Developers
+//
+// pkcs11mod is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// pkcs11mod is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with pkcs11mod; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+
+package pkcs11mod
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// traceRecord is one line of the trace in PKCS11MOD_TRACE_JSON mode.  Trace
+// lines that have no structured form are wrapped in Message.
+type traceRecord struct {
+	Time      string           `json:"time"`
+	Func      string           `json:"func,omitempty"`
+	Session   string           `json:"session,omitempty"`
+	Slot      string           `json:"slot,omitempty"`
+	Object    uint             `json:"object,omitempty"`
+	Mechanism string           `json:"mechanism,omitempty"`
+	Took      string           `json:"took,omitempty"`
+	RV        string           `json:"rv,omitempty"`
+	Template  []traceAttribute `json:"template,omitempty"`
+	Defaults  []traceAttribute `json:"defaults,omitempty"`
+	Message   string           `json:"message,omitempty"`
+}
+
+// traceAttribute is an attribute in a traceRecord, rendered as by AttrTrace.
+// Value is omitted if the attribute's value mustn't be traced.
+type traceAttribute struct {
+	Type  string `json:"type"`
+	Value string `json:"value,omitempty"`
+}
+
+func traceAttributes(template []*pkcs11.Attribute) []traceAttribute {
+	result := make([]traceAttribute, 0, len(template))
+
+	for _, a := range template {
+		v, _ := attrTraceValue(a)
+		result = append(result, traceAttribute{Type: traceValueName(a.Type, strCKA), Value: v})
+	}
+
+	return result
+}
+
+// traceJSONMutex keeps concurrent records from interleaving, since they're
+// written directly rather than through a log.Logger.
+var traceJSONMutex sync.Mutex
+
+// logTraceJSON writes r to the trace output as a single line.
+func logTraceJSON(r traceRecord) {
+	r.Time = time.Now().Format(time.RFC3339Nano)
+
+	line, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+
+	var w io.Writer = log.Writer()
+	if l := traceOutput.Load(); l != nil {
+		w = l.Writer()
+	}
+
+	traceJSONMutex.Lock()
+	defer traceJSONMutex.Unlock()
+
+	_, _ = w.Write(append(line, '\n'))
+}
+
+// traceJSONWriter wraps the free-text trace lines written through traceLog
+// in traceRecords.
+type traceJSONWriter struct{}
+
+// traceJSONLogger is the logger that traceLog returns in PKCS11MOD_TRACE_JSON
+// mode.
+var traceJSONLogger = log.New(traceJSONWriter{}, "", 0)
+
+func (traceJSONWriter) Write(p []byte) (int, error) {
+	logTraceJSON(traceRecord{Message: strings.TrimSuffix(string(p), "\n")})
+
+	return len(p), nil
+}
+
+// timingRecord builds the traceRecord for a logTiming line, whose fields are
+// the space-separated key=value pairs that timingBackend passes.
+func timingRecord(name, fields string, took time.Duration, rv string) traceRecord {
+	r := traceRecord{Func: name, Took: took.String(), RV: rv}
+
+	for _, field := range strings.Fields(fields) {
+		key, value, _ := strings.Cut(field, "=")
+
+		switch key {
+		case "session":
+			r.Session = value
+		case "slot":
+			r.Slot = value
+		case "mechanism":
+			r.Mechanism = value
+		}
+	}
+
+	return r
+}
@@ -0,0 +1,94 @@
+// pkcs11mod
+// Copyright (C) 2022  Namecoin Developers
+//
+// pkcs11mod is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// pkcs11mod is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with pkcs11mod; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+
+package pkcs11mod
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+)
+
+// metricsIndex returns the index in Metrics of the named PKCS#11 function,
+// which is how the C wrappers identify it to goTraceReturn.
+func metricsIndex(t *testing.T, function string) _Ctype_int {
+	t.Helper()
+
+	for i := _Ctype_int(0); i < _Cfunc_pkcs11mod_metrics_count(); i++ {
+		if _Cfunc_GoString(_Cfunc_pkcs11mod_metrics_name(i)) == function {
+			return i
+		}
+	}
+
+	t.Fatalf("%s isn't counted in Metrics", function)
+
+	return 0
+}
+
+func TestTraceReturnJSON(t *testing.T) {
+	sh := openTestSession(t, testBackend{})
+
+	oldTrace, oldTraceJSON := trace, traceJSON
+	trace, traceJSON = true, true
+
+	var buf bytes.Buffer
+
+	SetTraceOutput(&buf)
+
+	t.Cleanup(func() {
+		trace, traceJSON = oldTrace, oldTraceJSON
+
+		SetTraceOutput(nil)
+	})
+
+	mechanism := ckMechanism{mechanism: pkcs11.CKM_RSA_PKCS}
+	goTraceReturn(metricsIndex(t, "C_SignInit"), &sh, &mechanism, pkcs11.CKR_KEY_HANDLE_INVALID)
+	goTraceReturn(metricsIndex(t, "C_GetInfo"), nil, nil, pkcs11.CKR_OK)
+
+	lines := bytes.Split(bytes.TrimSuffix(buf.Bytes(), []byte("\n")), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("got %d trace lines, want 2:\n%s", len(lines), buf.String())
+	}
+
+	var record traceRecord
+	if err := json.Unmarshal(lines[0], &record); err != nil {
+		t.Fatalf("can't unmarshal %q: %v", lines[0], err)
+	}
+
+	if record.Func != "C_SignInit" || record.RV != "CKR_KEY_HANDLE_INVALID" {
+		t.Errorf("got func %q, rv %q; want C_SignInit, CKR_KEY_HANDLE_INVALID", record.Func, record.RV)
+	}
+
+	if want := sessionTrace(pkcs11.SessionHandle(sh)); record.Session != want {
+		t.Errorf("got session %q, want %q", record.Session, want)
+	}
+
+	if record.Mechanism != "CKM_RSA_PKCS" {
+		t.Errorf("got mechanism %q, want CKM_RSA_PKCS", record.Mechanism)
+	}
+
+	record = traceRecord{}
+	if err := json.Unmarshal(lines[1], &record); err != nil {
+		t.Fatalf("can't unmarshal %q: %v", lines[1], err)
+	}
+
+	if record.Func != "C_GetInfo" || record.RV != "CKR_OK" || record.Session != "" || record.Mechanism != "" {
+		t.Errorf("got %+v, want only func C_GetInfo and rv CKR_OK", record)
+	}
+}
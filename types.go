@@ -23,34 +23,86 @@ package pkcs11mod
 import "C"
 
 import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"errors"
 	"fmt"
-	"log"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 	"unsafe"
 
 	"github.com/miekg/pkcs11"
 )
 
-// fromList converts from a []uint to a C style array.
-func fromList(goList []uint, cList C.CK_ULONG_PTR, goSize uint) {
+// maxCKULong is the largest value representable as a CK_ULONG, which is only
+// 32 bits on some platforms (e.g. Windows) even where Go's uint is 64 bits.
+const maxCKULong = uint64(^C.CK_ULONG(0))
+
+// toCKULongs checks that every value fits in a CK_ULONG, so that the list
+// isn't silently truncated when it's copied to C.
+func toCKULongs(values []uint) error {
+	return checkULongs(values, maxCKULong)
+}
+
+// checkULongs is toCKULongs for a CK_ULONG whose largest value is max, so
+// that a 4-byte CK_ULONG can be tested on platforms where it's 8 bytes.
+func checkULongs(values []uint, max uint64) error {
+	for _, v := range values {
+		if uint64(v) > max {
+			if traceShared() {
+				traceLog().Printf("pkcs11mod: value %d doesn't fit in a CK_ULONG", v)
+			}
+
+			return fmt.Errorf("value %d overflows CK_ULONG", v)
+		}
+	}
+
+	return nil
+}
+
+// valueLenFits reports whether an attribute value of n bytes can be described
+// by a CK_ULONG whose largest value is max.  The largest value itself is
+// CK_UNAVAILABLE_INFORMATION, so it can't be used as a length.
+func valueLenFits(n int, max uint64) bool {
+	return uint64(n) < max
+}
+
+// fromList converts from a []uint to a C style array.  Nothing is written if
+// any value doesn't fit in a CK_ULONG.
+func fromList(goList []uint, cList C.CK_ULONG_PTR, goSize uint) error {
+	if err := toCKULongs(goList[:goSize]); err != nil {
+		return err
+	}
+
 	for i := 0; uint(i) < goSize; i++ {
 		C.SetIndex(cList, C.CK_ULONG(i), C.CK_ULONG(goList[i]))
 	}
+
+	return nil
 }
 
 // fromMechanismList converts from a []*pkcs11.Mechanism to a C style array of
-// mechanism types.
-func fromMechanismList(goList []*pkcs11.Mechanism, cList C.CK_ULONG_PTR, goSize uint) {
-	for i := 0; uint(i) < goSize; i++ {
-		C.SetIndex(cList, C.CK_ULONG(i), C.CK_ULONG(goList[i].Mechanism))
+// mechanism types.  Nothing is written if any type doesn't fit in a CK_ULONG.
+func fromMechanismList(goList []*pkcs11.Mechanism, cList C.CK_ULONG_PTR, goSize uint) error {
+	values := make([]uint, goSize)
+	for i := range values {
+		values[i] = goList[i].Mechanism
 	}
+
+	return fromList(values, cList, goSize)
 }
 
-// fromObjectHandleList converts from a []pkcs11.ObjectHandle to a C style array.
-func fromObjectHandleList(goList []pkcs11.ObjectHandle, cList C.CK_ULONG_PTR, goSize uint) {
-	for i := 0; uint(i) < goSize; i++ {
-		C.SetIndex(cList, C.CK_ULONG(i), C.CK_ULONG(goList[i]))
+// fromObjectHandleList converts from a []pkcs11.ObjectHandle to a C style
+// array.  Nothing is written if any handle doesn't fit in a CK_ULONG.
+func fromObjectHandleList(goList []pkcs11.ObjectHandle, cList C.CK_ULONG_PTR, goSize uint) error {
+	values := make([]uint, goSize)
+	for i := range values {
+		values[i] = uint(goList[i])
 	}
+
+	return fromList(values, cList, goSize)
 }
 
 // fromCBBool converts a CK_BBOOL to a bool.
@@ -101,6 +153,19 @@ func toTemplate(clist C.CK_ATTRIBUTE_PTR, size C.CK_ULONG) []*pkcs11.Attribute {
 	return l2
 }
 
+// templateIsLengthQuery reports whether every attribute in a
+// C_GetAttributeValue template has a NULL pValue, i.e. the caller is only
+// asking for the value lengths.
+func templateIsLengthQuery(clist C.CK_ATTRIBUTE_PTR, size C.CK_ULONG) bool {
+	for i := C.CK_ULONG(0); i < size; i++ {
+		if C.getAttributePval(C.IndexAttributePtr(clist, i)) != nil {
+			return false
+		}
+	}
+
+	return size > 0
+}
+
 // fromTemplate converts from a []*pkcs11.Attribute to a C style array that
 // already contains a template as is passed to C_GetAttributeValue.
 func fromTemplate(template []*pkcs11.Attribute, clist C.CK_ATTRIBUTE_PTR) error {
@@ -110,10 +175,15 @@ func fromTemplate(template []*pkcs11.Attribute, clist C.CK_ATTRIBUTE_PTR) error
 	}
 
 	bufferTooSmall := false
+	valueInvalid := false
+
+	if traceFunction("C_GetAttributeValue") && traceJSON {
+		logTraceJSON(traceRecord{Func: "C_GetAttributeValue", Template: traceAttributes(template)})
+	}
 
 	for i, x := range template {
-		if trace {
-			log.Printf("pkcs11mod fromTemplate: %s", AttrTrace(x))
+		if traceFunction("C_GetAttributeValue") && !traceJSON {
+			traceLog().Printf("pkcs11mod fromTemplate: %s", AttrTrace(x))
 		}
 
 		c := l1[i]
@@ -124,6 +194,15 @@ func fromTemplate(template []*pkcs11.Attribute, clist C.CK_ATTRIBUTE_PTR) error
 			continue
 		}
 
+		// Converting a length that doesn't fit would wrap around to a
+		// bogus length.
+		if !valueLenFits(len(x.Value), maxCKULong) {
+			c.ulValueLen = C.CK_UNAVAILABLE_INFORMATION
+			valueInvalid = true
+
+			continue
+		}
+
 		cLen := C.CK_ULONG(uint(len(x.Value)))
 
 		switch {
@@ -143,6 +222,10 @@ func fromTemplate(template []*pkcs11.Attribute, clist C.CK_ATTRIBUTE_PTR) error
 		}
 	}
 
+	if valueInvalid {
+		return pkcs11.Error(pkcs11.CKR_ATTRIBUTE_VALUE_INVALID)
+	}
+
 	if bufferTooSmall {
 		return pkcs11.Error(pkcs11.CKR_BUFFER_TOO_SMALL)
 	}
@@ -159,112 +242,1565 @@ func BytesToBool(arg []byte) (bool, error) {
 }
 
 func BytesToULong(arg []byte) (uint, error) {
-	// TODO: use cgo to get the actual size of ULong instead of guessing "at least 4"
-	if len(arg) < 4 {
+	if len(arg) < C.sizeof_CK_ULONG {
 		return 0, fmt.Errorf("invalid length: %d", len(arg))
 	}
 
 	return uint(*(*C.CK_ULONG)(unsafe.Pointer(&arg[0]))), nil
 }
 
-// toMechanism converts from a C pointer to a *pkcs11.Mechanism.
-// It doesn't free the input object.
-func toMechanism(pMechanism C.CK_MECHANISM_PTR) *pkcs11.Mechanism {
-	switch pMechanism.mechanism {
-	case C.CKM_RSA_PKCS_PSS, C.CKM_SHA1_RSA_PKCS_PSS,
-		C.CKM_SHA224_RSA_PKCS_PSS, C.CKM_SHA256_RSA_PKCS_PSS,
-		C.CKM_SHA384_RSA_PKCS_PSS, C.CKM_SHA512_RSA_PKCS_PSS,
-		C.CKM_SHA3_256_RSA_PKCS_PSS, C.CKM_SHA3_384_RSA_PKCS_PSS,
-		C.CKM_SHA3_512_RSA_PKCS_PSS, C.CKM_SHA3_224_RSA_PKCS_PSS:
-		pssParam := C.CK_RSA_PKCS_PSS_PARAMS_PTR(C.getMechanismParam(pMechanism))
-		goHashAlg := uint(pssParam.hashAlg)
-		goMgf := uint(pssParam.mgf)
-		goSLen := uint(pssParam.sLen)
+// AESCTRParams is the Go representation of CK_AES_CTR_PARAMS, used with
+// CKM_AES_CTR.
+type AESCTRParams struct {
+	// CounterBits is the number of bits of CounterBlock that are
+	// incremented, between 1 and 128.
+	CounterBits uint
+	// CounterBlock is the 16-byte initial counter block.
+	CounterBlock []byte
+}
 
-		return pkcs11.NewMechanism(uint(pMechanism.mechanism), pkcs11.NewPSSParams(goHashAlg, goMgf, goSLen))
-	case C.CKM_AES_GCM:
-		gcmParam := C.CK_GCM_PARAMS_PTR(C.getMechanismParam(pMechanism))
-		goIV := C.GoBytes(unsafe.Pointer(gcmParam.pIv), C.int(gcmParam.ulIvLen))
-		goAad := C.GoBytes(unsafe.Pointer(gcmParam.pAAD), C.int(gcmParam.ulAADLen))
-		goTag := int(gcmParam.ulTagBits)
-
-		return pkcs11.NewMechanism(uint(pMechanism.mechanism), pkcs11.NewGCMParams(goIV, goAad, goTag))
-	case C.CKM_RSA_PKCS_OAEP:
-		oaepParams := C.CK_RSA_PKCS_OAEP_PARAMS_PTR(C.getMechanismParam(pMechanism))
-		goHashAlg := uint(oaepParams.hashAlg)
-		goMgf := uint(oaepParams.mgf)
-		goSourceType := uint(oaepParams.source)
-		goSourceData := C.GoBytes(unsafe.Pointer(C.getOAEPSourceData(oaepParams)), C.int(oaepParams.ulSourceDataLen))
-
-		return pkcs11.NewMechanism(uint(pMechanism.mechanism), pkcs11.NewOAEPParams(goHashAlg, goMgf, goSourceType, goSourceData))
+// ParseAESCTRParams decodes the parameter of CKM_AES_CTR.  Since
+// CK_AES_CTR_PARAMS has no pointers, backends get the application's structure
+// as is (which is also what *pkcs11.Ctx passes on to a module), and
+// CounterBlock aliases it.
+func ParseAESCTRParams(param []byte) (*AESCTRParams, error) {
+	if len(param) != C.sizeof_CK_AES_CTR_PARAMS {
+		return nil, fmt.Errorf("invalid length: %d", len(param))
+	}
+
+	counterBits, err := BytesToULong(param)
+	if err != nil {
+		return nil, err
+	}
+
+	offset := unsafe.Offsetof(C.CK_AES_CTR_PARAMS{}.cb)
+
+	return &AESCTRParams{
+		CounterBits:  counterBits,
+		CounterBlock: param[offset : offset+16 : offset+16],
+	}, nil
+}
+
+// ulongAttributes are the attributes whose value is a plain CK_ULONG count
+// (as opposed to an enum or a handle).  AttrTrace renders them in decimal.
+var ulongAttributes = map[uint]bool{
+	pkcs11.CKA_VALUE_BITS:    true,
+	pkcs11.CKA_VALUE_LEN:     true,
+	pkcs11.CKA_MODULUS_BITS:  true,
+	pkcs11.CKA_PRIME_BITS:    true,
+	pkcs11.CKA_SUBPRIME_BITS: true,
+}
+
+// TemplateULong returns the value of the attrType attribute in template,
+// which must be one of the CK_ULONG count attributes (e.g. CKA_VALUE_BITS or
+// CKA_VALUE_LEN).  The boolean result is false if template doesn't contain
+// the attribute.
+func TemplateULong(template []*pkcs11.Attribute, attrType uint) (uint, bool, error) {
+	if !ulongAttributes[attrType] {
+		return 0, false, fmt.Errorf("not a CK_ULONG attribute: %d", attrType)
+	}
+
+	for _, a := range template {
+		if a.Type != attrType {
+			continue
+		}
+
+		vint, err := BytesToULong(a.Value)
+		if err != nil {
+			return 0, true, err
+		}
+
+		return vint, true, nil
+	}
+
+	return 0, false, nil
+}
+
+// DefaultPrivate returns the CKA_PRIVATE value that a backend should assume
+// for an object of the given class when the template doesn't specify one.
+// Private and secret keys default to CK_TRUE; everything else defaults to
+// CK_FALSE.
+func DefaultPrivate(class uint) bool {
+	switch class {
+	case pkcs11.CKO_PRIVATE_KEY, pkcs11.CKO_SECRET_KEY:
+		return true
 	default:
-		if uint(pMechanism.mechanism) <= uint(C.CKM_RSA_PKCS_OAEP_TPM_1_1) && uint(pMechanism.ulParameterLen) > 0 {
-			return pkcs11.NewMechanism(uint(pMechanism.mechanism), C.GoBytes(unsafe.Pointer(C.getMechanismParam(pMechanism)), C.int(pMechanism.ulParameterLen)))
-		} else {
-			return pkcs11.NewMechanism(uint(pMechanism.mechanism), nil)
+		return false
+	}
+}
+
+// DefaultToken returns the CKA_TOKEN value that a backend should assume for
+// an object of the given class when the template doesn't specify one.  The
+// spec defaults every storage object to a session object.
+func DefaultToken(class uint) bool {
+	return false
+}
+
+// toGCMMechanism converts a CKM_AES_GCM mechanism.  It also returns the
+// GCMParams, whose IV method reports the IV that the token behind the backend
+// actually used, if the backend passes the parameters on to a PKCS#11 module
+// (as pkcs11proxy does).  As with toMechanism, the IV and AAD are copied;
+// only fromGCMParams touches the caller's CK_GCM_PARAMS again.
+func toGCMMechanism(pMechanism C.CK_MECHANISM_PTR) (*pkcs11.Mechanism, *pkcs11.GCMParams, error) {
+	if pMechanism == nil {
+		return nil, nil, pkcs11.Error(pkcs11.CKR_ARGUMENTS_BAD)
+	}
+
+	if uint(pMechanism.ulParameterLen) != uint(C.sizeof_CK_GCM_PARAMS) || C.getMechanismParam(pMechanism) == nil {
+		return nil, nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+	}
+
+	gcmParam := C.CK_GCM_PARAMS_PTR(C.getMechanismParam(pMechanism))
+
+	goIV, err := toParamBytes(unsafe.Pointer(gcmParam.pIv), gcmParam.ulIvLen)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	goAad, err := toParamBytes(unsafe.Pointer(gcmParam.pAAD), gcmParam.ulAADLen)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Passed through as-is; see NormalizeGCMTagBits for applications that
+	// confuse bits and bytes.
+	goTag := int(gcmParam.ulTagBits)
+	goParams := pkcs11.NewGCMParams(goIV, goAad, goTag)
+
+	return pkcs11.NewMechanism(uint(pMechanism.mechanism), goParams), goParams, nil
+}
+
+// fromGCMParams copies the IV that the token used (which it may have
+// generated itself) back to the caller's CK_GCM_PARAMS.  It does nothing if
+// the backend never passed the parameters to a token.
+func fromGCMParams(goParams *pkcs11.GCMParams, pMechanism C.CK_MECHANISM_PTR) error {
+	goIV := goParams.IV()
+	if goIV == nil {
+		return nil
+	}
+
+	gcmParam := C.CK_GCM_PARAMS_PTR(C.getMechanismParam(pMechanism))
+	if uint64(len(goIV)) > uint64(gcmParam.ulIvLen) {
+		return pkcs11.Error(pkcs11.CKR_BUFFER_TOO_SMALL)
+	}
+
+	if len(goIV) == 0 {
+		return nil
+	}
+
+	goCallerIV := (*[1 << 30]byte)(unsafe.Pointer(gcmParam.pIv))[:len(goIV):len(goIV)]
+	copy(goCallerIV, goIV)
+
+	return nil
+}
+
+// poly1305TagLen is the length in bytes of the Poly1305 tag.
+const poly1305TagLen = 16
+
+// aeadTagLen returns the length in bytes of the tag that a single-part AEAD
+// operation (CKM_AES_GCM, CKM_CHACHA20_POLY1305 or CKM_SALSA20_POLY1305)
+// appends to the ciphertext, or 0 if goMechanism (the mechanism passed to the
+// backend) isn't one of them.
+func aeadTagLen(goMechanism *pkcs11.Mechanism, pMechanism C.CK_MECHANISM_PTR) int {
+	if goMechanism.Mechanism != uint(pMechanism.mechanism) {
+		return 0
+	}
+
+	switch goMechanism.Mechanism {
+	case pkcs11.CKM_AES_GCM:
+		gcmParam := C.CK_GCM_PARAMS_PTR(C.getMechanismParam(pMechanism))
+		if gcmParam == nil {
+			return 0
 		}
+
+		return int(NormalizeGCMTagBits(uint(gcmParam.ulTagBits)) / 8)
+	case CKM_CHACHA20_POLY1305, CKM_SALSA20_POLY1305:
+		return poly1305TagLen
+	default:
+		return 0
 	}
 }
 
-func attrTraceValueBool(value []byte) string {
-	vbool, err := BytesToBool(value)
-	if err == nil {
-		if vbool {
-			return "CK_TRUE"
+// fromMechanism copies the output fields of a mechanism parameter (which the
+// backend filled in) back to the caller's C structure, using the registered
+// MechanismEncoder for mechanisms without built-in support.  It's called after
+// the backend call using the mechanism succeeds, and does nothing for
+// mechanisms without output fields.
+func fromMechanism(goMechanism *pkcs11.Mechanism, pMechanism C.CK_MECHANISM_PTR) error {
+	if goMechanism.Mechanism != uint(pMechanism.mechanism) {
+		// A MechanismRewriter substituted another mechanism, so the
+		// backend never saw the caller's parameter.
+		return nil
+	}
+
+	if nativeParams && nativeParamsMechanisms[goMechanism.Mechanism] {
+		// The backend got the caller's structure, so the module behind
+		// it has already filled in the output fields.
+		return nil
+	}
+
+	switch pMechanism.mechanism {
+	case C.CKM_TLS_PRF:
+		goParams, err := ParseTLSPRFParams(goMechanism.Parameter)
+		if err != nil {
+			return err
 		}
 
-		return "CK_FALSE"
+		prfParams := C.CK_TLS_PRF_PARAMS_PTR(C.getMechanismParam(pMechanism))
+		pulOutputLen := C.getTLSPRFOutputLen(prfParams)
+
+		if uint64(len(goParams.Output)) > uint64(*pulOutputLen) {
+			return pkcs11.Error(pkcs11.CKR_BUFFER_TOO_SMALL)
+		}
+
+		goOutput := (*[1 << 30]byte)(unsafe.Pointer(C.getTLSPRFOutput(prfParams)))[:*pulOutputLen:*pulOutputLen]
+		copy(goOutput, goParams.Output)
+		*pulOutputLen = C.CK_ULONG(len(goParams.Output))
+	case C.CKM_TLS12_MASTER_KEY_DERIVE, C.CKM_TLS12_MASTER_KEY_DERIVE_DH:
+		goParams, err := ParseTLS12MasterKeyDeriveParams(goMechanism.Parameter)
+		if err != nil {
+			return err
+		}
+
+		masterParams := C.CK_TLS12_MASTER_KEY_DERIVE_PARAMS_PTR(C.getMechanismParam(pMechanism))
+		pVersion := C.getTLS12MasterKeyVersion(masterParams)
+
+		if pVersion == nil || goParams.Version == nil {
+			return nil
+		}
+
+		pVersion.major = C.CK_BYTE(goParams.Version[0])
+		pVersion.minor = C.CK_BYTE(goParams.Version[1])
+	case C.CKM_TLS12_KEY_AND_MAC_DERIVE:
+		goParams, err := ParseTLS12KeyMatParams(goMechanism.Parameter)
+		if err != nil {
+			return err
+		}
+
+		keyMatParams := C.CK_TLS12_KEY_MAT_PARAMS_PTR(C.getMechanismParam(pMechanism))
+		keyMat := C.getTLS12KeyMatReturnedKeyMaterial(keyMatParams)
+		ivLen := int(keyMatParams.ulIVSizeInBits / 8)
+
+		if len(goParams.IVClient) != ivLen || len(goParams.IVServer) != ivLen {
+			return pkcs11.Error(pkcs11.CKR_BUFFER_TOO_SMALL)
+		}
+
+		clientMacSecret, serverMacSecret, clientKey, serverKey := goParams.ReturnedKeys()
+		keyMat.hClientMacSecret = C.CK_OBJECT_HANDLE(clientMacSecret)
+		keyMat.hServerMacSecret = C.CK_OBJECT_HANDLE(serverMacSecret)
+		keyMat.hClientKey = C.CK_OBJECT_HANDLE(clientKey)
+		keyMat.hServerKey = C.CK_OBJECT_HANDLE(serverKey)
+
+		if ivLen > 0 {
+			copy((*[1 << 30]byte)(unsafe.Pointer(C.getSSL3KeyMatIVClient(keyMat)))[:ivLen:ivLen], goParams.IVClient)
+			copy((*[1 << 30]byte)(unsafe.Pointer(C.getSSL3KeyMatIVServer(keyMat)))[:ivLen:ivLen], goParams.IVServer)
+		}
+	case C.CKM_PBE_MD2_DES_CBC, C.CKM_PBE_MD5_DES_CBC, C.CKM_PBE_MD5_CAST_CBC,
+		C.CKM_PBE_MD5_CAST3_CBC, C.CKM_PBE_MD5_CAST128_CBC, C.CKM_PBE_SHA1_CAST128_CBC,
+		C.CKM_PBE_SHA1_RC4_128, C.CKM_PBE_SHA1_RC4_40, C.CKM_PBE_SHA1_DES3_EDE_CBC,
+		C.CKM_PBE_SHA1_DES2_EDE_CBC, C.CKM_PBE_SHA1_RC2_128_CBC, C.CKM_PBE_SHA1_RC2_40_CBC,
+		C.CKM_PBA_SHA1_WITH_SHA1_HMAC:
+		goParams, err := ParsePBEParams(goMechanism.Parameter)
+		if err != nil {
+			return err
+		}
+
+		pbeParams := C.CK_PBE_PARAMS_PTR(C.getMechanismParam(pMechanism))
+		pInitVector := C.getPBEInitVector(pbeParams)
+
+		if pInitVector == nil || goParams.InitVector == nil {
+			return nil
+		}
+
+		goInitVector := (*[1 << 30]byte)(unsafe.Pointer(pInitVector))[:pbeInitVectorLen:pbeInitVectorLen]
+		copy(goInitVector, goParams.InitVector)
+	default:
+		encode, ok := lookupMechanismEncoder(uint(pMechanism.mechanism))
+		if !ok {
+			return nil
+		}
+
+		var raw []byte
+		if C.getMechanismParam(pMechanism) != nil && pMechanism.ulParameterLen > 0 {
+			raw = (*[1 << 30]byte)(unsafe.Pointer(C.getMechanismParam(pMechanism)))[:pMechanism.ulParameterLen:pMechanism.ulParameterLen]
+		}
+
+		return encode(goMechanism, raw)
 	}
 
-	return fmt.Sprintf("%v", value)
+	return nil
 }
 
-func attrTraceValueCKO(value []byte) string {
-	vint, err := BytesToULong(value)
-	if err == nil {
-		vPretty, ok := strCKO[vint]
-		if ok {
-			return vPretty
+// toOAEPParams converts CK_RSA_PKCS_OAEP_PARAMS, on its own or embedded in
+// another mechanism's parameter.
+func toOAEPParams(oaepParams C.CK_RSA_PKCS_OAEP_PARAMS_PTR) (*pkcs11.OAEPParams, error) {
+	if oaepParams == nil || !isOAEPHashAlg(oaepParams.hashAlg) {
+		return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+	}
+
+	goHashAlg := uint(oaepParams.hashAlg)
+	goMgf := uint(oaepParams.mgf)
+
+	if mgfHashAlg, ok := MGFToHash(goMgf); ok && mgfHashAlg != goHashAlg {
+		// Windows CNG legitimately mixes e.g. an OAEP hash of SHA-256 with
+		// MGF1-SHA1.
+		if !oaepAllowMGFMismatch {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		if traceShared() {
+			traceLog().Printf("pkcs11mod toMechanism: OAEP hashAlg %d doesn't match MGF %d, passing both to backend", goHashAlg, goMgf)
 		}
 	}
 
-	return fmt.Sprintf("%v", value)
+	// The OAEP parameters are private to the resulting pkcs11.Mechanism,
+	// so MechTrace can't show them; trace them here instead.
+	if traceShared() && traceSensitive {
+		traceLog().Printf("pkcs11mod toMechanism: OAEP hashAlg %s, MGF %s", traceValueName(goHashAlg, strCKM), traceValueName(goMgf, strCKG))
+	}
+
+	goSourceType := uint(oaepParams.source)
+	goSourceData, err := toParamBytes(unsafe.Pointer(C.getOAEPSourceData(oaepParams)), oaepParams.ulSourceDataLen)
+	if err != nil {
+		return nil, err
+	}
+
+	return pkcs11.NewOAEPParams(goHashAlg, goMgf, goSourceType, goSourceData), nil
 }
 
-func attrTraceValueCKT(value []byte) string {
-	vint, err := BytesToULong(value)
-	if err == nil {
-		vPretty, ok := strCKT[vint]
-		if ok {
-			return vPretty
-		}
+// toParamBytes copies a variable-length buffer out of a mechanism parameter.
+// An empty buffer is nil, so that callers needn't call C.GoBytes on a NULL
+// pointer.  A NULL pointer with a nonzero length, or a length that doesn't
+// fit in the C.int that C.GoBytes takes, is CKR_MECHANISM_PARAM_INVALID.
+func toParamBytes(p unsafe.Pointer, length C.CK_ULONG) ([]byte, error) {
+	if length == 0 {
+		return nil, nil
 	}
 
-	return fmt.Sprintf("%v", value)
+	if p == nil || uint64(length) > math.MaxInt32 {
+		return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+	}
+
+	return C.GoBytes(p, C.int(length)), nil
 }
 
-func AttrTrace(a *pkcs11.Attribute) string {
-	t, ok := strCKA[a.Type]
-	if !ok {
-		t = fmt.Sprintf("%d", a.Type)
+// otpSignatureInfo reports whether goMechanism is an OTP mechanism whose
+// signature is a CK_OTP_SIGNATURE_INFO, i.e. without CKF_USER_FRIENDLY_OTP.
+func otpSignatureInfo(goMechanism *pkcs11.Mechanism) bool {
+	switch goMechanism.Mechanism {
+	case pkcs11.CKM_HOTP, pkcs11.CKM_SECURID, pkcs11.CKM_ACTI:
+	default:
+		return false
+	}
+
+	// Native backends get the module's signature through unchanged.
+	if nativeParams {
+		return false
+	}
+
+	goParams, err := ParseOTPParams(goMechanism.Parameter)
+	if err != nil {
+		return false
+	}
+
+	flags, err := goParams.Flags()
+
+	return err == nil && flags&pkcs11.CKF_USER_FRIENDLY_OTP == 0
+}
+
+// otpSignatureInfoLen returns the size of the CK_OTP_SIGNATURE_INFO that
+// fromOTPSignatureInfo lays out for params.
+func otpSignatureInfoLen(params []OTPParam) int {
+	size := C.sizeof_CK_OTP_SIGNATURE_INFO + len(params)*C.sizeof_CK_OTP_PARAM
+
+	for _, param := range params {
+		size += len(param.Value)
 	}
 
-	if traceSensitive {
-		if a.Type == pkcs11.CKA_TOKEN || a.Type == pkcs11.CKA_PRIVATE ||
-			a.Type == pkcs11.CKA_MODIFIABLE || a.Type == pkcs11.CKA_TRUST_STEP_UP_APPROVED {
-			return fmt.Sprintf("%s: %s", t, attrTraceValueBool(a.Value))
+	return size
+}
+
+// fromOTPSignatureInfo writes a CK_OTP_SIGNATURE_INFO for params to
+// pSignature, which must have room for otpSignatureInfoLen(params) bytes.
+// The CK_OTP_PARAM array and the values follow the structure in the same
+// buffer, so the application needn't free anything.
+func fromOTPSignatureInfo(params []OTPParam, pSignature C.CK_BYTE_PTR) {
+	pParams := C.CK_OTP_PARAM_PTR(unsafe.Add(unsafe.Pointer(pSignature), C.sizeof_CK_OTP_SIGNATURE_INFO))
+	pValue := unsafe.Add(unsafe.Pointer(pParams), len(params)*C.sizeof_CK_OTP_PARAM)
+
+	C.putOTPSignatureInfo(C.CK_OTP_SIGNATURE_INFO_PTR(unsafe.Pointer(pSignature)), pParams, C.CK_ULONG(len(params)))
+
+	for i, param := range params {
+		var pParamValue C.CK_VOID_PTR
+
+		if len(param.Value) > 0 {
+			pParamValue = C.CK_VOID_PTR(pValue)
+			copy((*[1 << 30]byte)(pValue)[:len(param.Value):len(param.Value)], param.Value)
+			pValue = unsafe.Add(pValue, len(param.Value))
 		}
 
-		if a.Type == pkcs11.CKA_CLASS {
-			return fmt.Sprintf("%s: %s", t, attrTraceValueCKO(a.Value))
+		C.putOTPParam(C.IndexOTPParamPtr(pParams, C.CK_ULONG(i)), C.CK_OTP_PARAM_TYPE(param.Type), pParamValue, C.CK_ULONG(len(param.Value)))
+	}
+}
+
+// toSSL3RandomData copies the client and server randoms of a TLS mechanism
+// parameter.
+func toSSL3RandomData(randomInfo *C.CK_SSL3_RANDOM_DATA) ([]byte, []byte, error) {
+	goClientRandom, err := toParamBytes(unsafe.Pointer(C.getSSL3ClientRandom(randomInfo)), randomInfo.ulClientRandomLen)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	goServerRandom, err := toParamBytes(unsafe.Pointer(C.getSSL3ServerRandom(randomInfo)), randomInfo.ulServerRandomLen)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return goClientRandom, goServerRandom, nil
+}
+
+// toPRFDataParams converts the CK_PRF_DATA_PARAM array of an SP 800-108 KDF.
+// Only the four data types defined by PKCS#11 v3.0 are supported: byte
+// arrays are copied, and the CK_SP800_108_COUNTER_FORMAT and
+// CK_SP800_108_DKM_LENGTH_FORMAT that the others point to are flattened into
+// the PRFDataParam.  An iteration variable has no format in the feedback and
+// double pipeline modes, but requires one in counter mode.
+func toPRFDataParams(pDataParams C.CK_PRF_DATA_PARAM_PTR, count C.CK_ULONG, counterMode bool) ([]PRFDataParam, error) {
+	if count == 0 || pDataParams == nil {
+		return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+	}
+
+	// count isn't trusted enough to preallocate result with.
+	var result []PRFDataParam
+
+	for i := C.CK_ULONG(0); i < count; i++ {
+		dataParam := C.IndexPRFDataParamPtr(pDataParams, i)
+		pValue := C.getPRFDataValue(dataParam)
+		goParam := PRFDataParam{Type: uint(dataParam._type)}
+
+		switch dataParam._type {
+		case C.CK_SP800_108_BYTE_ARRAY:
+			var err error
+
+			if goParam.Value, err = toParamBytes(unsafe.Pointer(pValue), dataParam.ulValueLen); err != nil {
+				return nil, err
+			}
+		case C.CK_SP800_108_ITERATION_VARIABLE, C.CK_SP800_108_OPTIONAL_COUNTER:
+			if pValue == nil && dataParam.ulValueLen == 0 &&
+				dataParam._type == C.CK_SP800_108_ITERATION_VARIABLE && !counterMode {
+				break
+			}
+
+			if pValue == nil || uint(dataParam.ulValueLen) != uint(C.sizeof_CK_SP800_108_COUNTER_FORMAT) {
+				return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+			}
+
+			format := C.CK_SP800_108_COUNTER_FORMAT_PTR(pValue)
+			goParam.LittleEndian = fromCBBool(format.bLittleEndian)
+			goParam.WidthInBits = uint(format.ulWidthInBits)
+		case C.CK_SP800_108_DKM_LENGTH:
+			if pValue == nil || uint(dataParam.ulValueLen) != uint(C.sizeof_CK_SP800_108_DKM_LENGTH_FORMAT) {
+				return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+			}
+
+			format := C.CK_SP800_108_DKM_LENGTH_FORMAT_PTR(pValue)
+			goParam.DKMLengthMethod = uint(format.dkmLengthMethod)
+			goParam.LittleEndian = fromCBBool(format.bLittleEndian)
+			goParam.WidthInBits = uint(format.ulWidthInBits)
+		default:
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
 		}
 
-		if a.Type >= pkcs11.CKA_TRUST_SERVER_AUTH && a.Type <= pkcs11.CKA_TRUST_EMAIL_PROTECTION {
-			return fmt.Sprintf("%s: %s", t, attrTraceValueCKT(a.Value))
+		result = append(result, goParam)
+	}
+
+	return result, nil
+}
+
+// isOAEPHashAlg reports whether hashAlg is a digest mechanism that can be
+// used as the hashAlg of CK_RSA_PKCS_OAEP_PARAMS.
+func isOAEPHashAlg(hashAlg C.CK_MECHANISM_TYPE) bool {
+	switch hashAlg {
+	case C.CKM_SHA_1, C.CKM_SHA224, C.CKM_SHA256, C.CKM_SHA384, C.CKM_SHA512,
+		C.CKM_SHA3_224, C.CKM_SHA3_256, C.CKM_SHA3_384, C.CKM_SHA3_512:
+		return true
+	default:
+		return false
+	}
+}
+
+// isPSSMechanism reports whether mech takes CK_RSA_PKCS_PSS_PARAMS.
+func isPSSMechanism(mech uint) bool {
+	switch mech {
+	case pkcs11.CKM_RSA_PKCS_PSS, pkcs11.CKM_SHA1_RSA_PKCS_PSS,
+		pkcs11.CKM_SHA224_RSA_PKCS_PSS, pkcs11.CKM_SHA256_RSA_PKCS_PSS,
+		pkcs11.CKM_SHA384_RSA_PKCS_PSS, pkcs11.CKM_SHA512_RSA_PKCS_PSS,
+		pkcs11.CKM_SHA3_256_RSA_PKCS_PSS, pkcs11.CKM_SHA3_384_RSA_PKCS_PSS,
+		pkcs11.CKM_SHA3_512_RSA_PKCS_PSS, pkcs11.CKM_SHA3_224_RSA_PKCS_PSS:
+		return true
+	default:
+		return false
+	}
+}
+
+// unwrapECPoint strips a DER OCTET STRING wrapper from an EC point, as sent
+// by some callers (e.g. Java) in CK_ECDH1_DERIVE_PARAMS.  Points that don't
+// parse as a single OCTET STRING are assumed to be raw and are returned
+// unchanged.
+//
+// A raw uncompressed point also begins with 0x04, so in rare cases a raw
+// point can look like a wrapped one.  This is why unwrapping is opt-in.
+func unwrapECPoint(point []byte) []byte {
+	var raw []byte
+
+	rest, err := asn1.Unmarshal(point, &raw)
+	if err != nil || len(rest) != 0 || len(raw) == 0 {
+		return point
+	}
+
+	return raw
+}
+
+// EncodeECPoint wraps an EC point (e.g. 0x04 || X || Y, or the encoding of
+// an Edwards or Montgomery public key) in the DER OCTET STRING that PKCS#11
+// requires for CKA_EC_POINT.
+func EncodeECPoint(point []byte) []byte {
+	// Marshaling a []byte can't fail.
+	value, _ := asn1.Marshal(point)
+
+	return value
+}
+
+// DecodeECPoint is the inverse of EncodeECPoint.  A value that isn't exactly
+// one non-empty DER OCTET STRING (e.g. a raw point from a non-compliant
+// token) is CKR_ATTRIBUTE_VALUE_INVALID.
+func DecodeECPoint(value []byte) ([]byte, error) {
+	var point []byte
+
+	rest, err := asn1.Unmarshal(value, &point)
+	if err != nil || len(rest) != 0 || len(point) == 0 {
+		return nil, pkcs11.Error(pkcs11.CKR_ATTRIBUTE_VALUE_INVALID)
+	}
+
+	return point, nil
+}
+
+// mgfHashes maps each MGF1 variant to the digest mechanism it uses.
+var mgfHashes = map[uint]uint{
+	pkcs11.CKG_MGF1_SHA1:   pkcs11.CKM_SHA_1,
+	pkcs11.CKG_MGF1_SHA224: pkcs11.CKM_SHA224,
+	pkcs11.CKG_MGF1_SHA256: pkcs11.CKM_SHA256,
+	pkcs11.CKG_MGF1_SHA384: pkcs11.CKM_SHA384,
+	pkcs11.CKG_MGF1_SHA512: pkcs11.CKM_SHA512,
+	CKG_MGF1_SHA3_224:      pkcs11.CKM_SHA3_224,
+	CKG_MGF1_SHA3_256:      pkcs11.CKM_SHA3_256,
+	CKG_MGF1_SHA3_384:      pkcs11.CKM_SHA3_384,
+	CKG_MGF1_SHA3_512:      pkcs11.CKM_SHA3_512,
+}
+
+// MGFToHash returns the digest mechanism (e.g. CKM_SHA256) used by an MGF1
+// variant (e.g. CKG_MGF1_SHA256), as found in CK_RSA_PKCS_PSS_PARAMS and
+// CK_RSA_PKCS_OAEP_PARAMS.
+func MGFToHash(mgf uint) (uint, bool) {
+	hash, ok := mgfHashes[mgf]
+
+	return hash, ok
+}
+
+// HashToMGF is the inverse of MGFToHash.
+func HashToMGF(hash uint) (uint, bool) {
+	for mgf, h := range mgfHashes {
+		if h == hash {
+			return mgf, true
 		}
+	}
+
+	return 0, false
+}
+
+// nativeParams is set by SetBackend for backends that receive native
+// parameters (see NativeParamsReceiver).
+var nativeParams bool
+
+// nativeParamsMechanisms are the mechanisms whose parameter toMechanism
+// encodes with one of the New*Params functions, and which backends that
+// receive native parameters get the application's C structure for instead.
+var nativeParamsMechanisms = map[uint]bool{
+	CKM_EDDSA:                             true,
+	pkcs11.CKM_TLS_PRF:                    true,
+	pkcs11.CKM_ARIA_CBC_ENCRYPT_DATA:      true,
+	pkcs11.CKM_SEED_CBC_ENCRYPT_DATA:      true,
+	pkcs11.CKM_PBE_MD2_DES_CBC:            true,
+	pkcs11.CKM_PBE_MD5_DES_CBC:            true,
+	pkcs11.CKM_PBE_MD5_CAST_CBC:           true,
+	pkcs11.CKM_PBE_MD5_CAST3_CBC:          true,
+	pkcs11.CKM_PBE_MD5_CAST128_CBC:        true,
+	pkcs11.CKM_PBE_SHA1_CAST128_CBC:       true,
+	pkcs11.CKM_PBE_SHA1_RC4_128:           true,
+	pkcs11.CKM_PBE_SHA1_RC4_40:            true,
+	pkcs11.CKM_PBE_SHA1_DES3_EDE_CBC:      true,
+	pkcs11.CKM_PBE_SHA1_DES2_EDE_CBC:      true,
+	pkcs11.CKM_PBE_SHA1_RC2_128_CBC:       true,
+	pkcs11.CKM_PBE_SHA1_RC2_40_CBC:        true,
+	pkcs11.CKM_PBA_SHA1_WITH_SHA1_HMAC:    true,
+	pkcs11.CKM_RSA_AES_KEY_WRAP:           true,
+	CKM_SP800_108_COUNTER_KDF:             true,
+	CKM_SP800_108_FEEDBACK_KDF:            true,
+	CKM_SP800_108_DOUBLE_PIPELINE_KDF:     true,
+	pkcs11.CKM_TLS12_MASTER_KEY_DERIVE:    true,
+	pkcs11.CKM_TLS12_MASTER_KEY_DERIVE_DH: true,
+	pkcs11.CKM_TLS12_KEY_AND_MAC_DERIVE:   true,
+	pkcs11.CKM_PKCS5_PBKD2:                true,
+	CKM_CHACHA20_POLY1305:                 true,
+	CKM_SALSA20_POLY1305:                  true,
+	pkcs11.CKM_HOTP:                       true,
+	pkcs11.CKM_SECURID:                    true,
+	pkcs11.CKM_ACTI:                       true,
+}
 
-		return fmt.Sprintf("%s: %v", t, a.Value)
+// toMechanism converts from a C pointer to a *pkcs11.Mechanism.
+// It doesn't free the input object.  Everything the parameter points to is
+// copied into Go memory, so backends may keep the result after the call
+// returns even if the application reuses or frees its CK_MECHANISM; no C
+// pointer may be retained here.  The exception is the parameter of the
+// nativeParamsMechanisms when nativeParams is set, which is checked as usual
+// but then passed on as the application's structure, pointers and all.  The
+// exported functions check for a NULL pMechanism themselves; the check here
+// only keeps a missed one from crashing the application.
+func toMechanism(pMechanism C.CK_MECHANISM_PTR) (*pkcs11.Mechanism, error) {
+	goMechanism, err := decodeMechanism(pMechanism)
+	if err != nil || !nativeParams || !nativeParamsMechanisms[uint(pMechanism.mechanism)] {
+		return goMechanism, err
+	}
+
+	raw, err := toParamBytes(unsafe.Pointer(C.getMechanismParam(pMechanism)), pMechanism.ulParameterLen)
+	if err != nil {
+		return nil, err
+	}
+
+	return pkcs11.NewMechanism(uint(pMechanism.mechanism), raw), nil
+}
+
+// decodeMechanism does the work of toMechanism, without regard to
+// nativeParams.
+func decodeMechanism(pMechanism C.CK_MECHANISM_PTR) (*pkcs11.Mechanism, error) {
+	if pMechanism == nil {
+		return nil, pkcs11.Error(pkcs11.CKR_ARGUMENTS_BAD)
 	}
 
-	return t
+	switch pMechanism.mechanism {
+	case C.CKM_RSA_PKCS_PSS, C.CKM_SHA1_RSA_PKCS_PSS,
+		C.CKM_SHA224_RSA_PKCS_PSS, C.CKM_SHA256_RSA_PKCS_PSS,
+		C.CKM_SHA384_RSA_PKCS_PSS, C.CKM_SHA512_RSA_PKCS_PSS,
+		C.CKM_SHA3_256_RSA_PKCS_PSS, C.CKM_SHA3_384_RSA_PKCS_PSS,
+		C.CKM_SHA3_512_RSA_PKCS_PSS, C.CKM_SHA3_224_RSA_PKCS_PSS:
+		if uint(pMechanism.ulParameterLen) != uint(C.sizeof_CK_RSA_PKCS_PSS_PARAMS) || C.getMechanismParam(pMechanism) == nil {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		pssParam := C.CK_RSA_PKCS_PSS_PARAMS_PTR(C.getMechanismParam(pMechanism))
+		goHashAlg := uint(pssParam.hashAlg)
+		goMgf := uint(pssParam.mgf)
+		goSLen := uint(pssParam.sLen)
+
+		return pkcs11.NewMechanism(uint(pMechanism.mechanism), pkcs11.NewPSSParams(goHashAlg, goMgf, goSLen)), nil
+	case C.CKM_AES_GCM:
+		goMechanism, _, err := toGCMMechanism(pMechanism)
+
+		return goMechanism, err
+	case CKM_CHACHA20_POLY1305, CKM_SALSA20_POLY1305:
+		if uint(pMechanism.ulParameterLen) != uint(C.sizeof_CK_SALSA20_CHACHA20_POLY1305_PARAMS) || C.getMechanismParam(pMechanism) == nil {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		aeadParams := C.CK_SALSA20_CHACHA20_POLY1305_PARAMS_PTR(C.getMechanismParam(pMechanism))
+		goNonce, err := toParamBytes(unsafe.Pointer(C.getPoly1305Nonce(aeadParams)), aeadParams.ulNonceLen)
+		if err != nil || goNonce == nil {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		goAAD, err := toParamBytes(unsafe.Pointer(C.getPoly1305AAD(aeadParams)), aeadParams.ulAADLen)
+		if err != nil {
+			return nil, err
+		}
+
+		return pkcs11.NewMechanism(uint(pMechanism.mechanism), NewPoly1305AEADParams(goNonce, goAAD)), nil
+	case C.CKM_RSA_PKCS_TPM_1_1:
+		return pkcs11.NewMechanism(uint(pMechanism.mechanism), nil), nil
+	case C.CKM_RSA_PKCS_OAEP, C.CKM_RSA_PKCS_OAEP_TPM_1_1:
+		if pMechanism.mechanism == C.CKM_RSA_PKCS_OAEP_TPM_1_1 && C.getMechanismParam(pMechanism) == nil {
+			// The TPM variant has implicit parameters, so callers may
+			// omit them.
+			return pkcs11.NewMechanism(uint(pMechanism.mechanism), nil), nil
+		}
+
+		if uint(pMechanism.ulParameterLen) != uint(C.sizeof_CK_RSA_PKCS_OAEP_PARAMS) {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		goParams, err := toOAEPParams(C.CK_RSA_PKCS_OAEP_PARAMS_PTR(C.getMechanismParam(pMechanism)))
+		if err != nil {
+			return nil, err
+		}
+
+		return pkcs11.NewMechanism(uint(pMechanism.mechanism), goParams), nil
+	case C.CKM_RSA_AES_KEY_WRAP:
+		if uint(pMechanism.ulParameterLen) != uint(C.sizeof_CK_RSA_AES_KEY_WRAP_PARAMS) || C.getMechanismParam(pMechanism) == nil {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		wrapParams := C.CK_RSA_AES_KEY_WRAP_PARAMS_PTR(C.getMechanismParam(pMechanism))
+
+		oaepParams := C.getRSAAESKeyWrapOAEPParams(wrapParams)
+		if oaepParams == nil {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		goOAEPParams, err := toOAEPParams(oaepParams)
+		if err != nil {
+			return nil, err
+		}
+
+		return pkcs11.NewMechanism(uint(pMechanism.mechanism), NewRSAAESKeyWrapParams(uint(wrapParams.ulAESKeyBits), goOAEPParams)), nil
+	case C.CKM_ECDH1_DERIVE, C.CKM_ECDH1_COFACTOR_DERIVE:
+		if uint(pMechanism.ulParameterLen) != uint(C.sizeof_CK_ECDH1_DERIVE_PARAMS) || C.getMechanismParam(pMechanism) == nil {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		ecdhParams := C.CK_ECDH1_DERIVE_PARAMS_PTR(C.getMechanismParam(pMechanism))
+		if C.getECDH1PublicData(ecdhParams) == nil || ecdhParams.ulPublicDataLen == 0 {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		goKdf := uint(ecdhParams.kdf)
+		if _, ok := strCKD[goKdf]; !ok {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		if traceShared() {
+			traceLog().Printf("pkcs11mod toMechanism: ECDH1 kdf %s", strCKD[goKdf])
+		}
+
+		goPublicData, err := toParamBytes(unsafe.Pointer(C.getECDH1PublicData(ecdhParams)), ecdhParams.ulPublicDataLen)
+		if err != nil {
+			return nil, err
+		}
+
+		// Shared data is usually absent (it must be with CKD_NULL); it's
+		// nil rather than empty in that case.
+		goSharedData, err := toParamBytes(unsafe.Pointer(C.getECDH1SharedData(ecdhParams)), ecdhParams.ulSharedDataLen)
+		if err != nil {
+			return nil, err
+		}
+
+		if ecdh1UnwrapPoint {
+			goPublicData = unwrapECPoint(goPublicData)
+		}
+
+		return pkcs11.NewMechanism(uint(pMechanism.mechanism), pkcs11.NewECDH1DeriveParams(goKdf, goSharedData, goPublicData)), nil
+	case C.CKM_MD2_KEY_DERIVATION, C.CKM_MD5_KEY_DERIVATION, C.CKM_SHA1_KEY_DERIVATION,
+		C.CKM_SHA224_KEY_DERIVATION, C.CKM_SHA256_KEY_DERIVATION, C.CKM_SHA384_KEY_DERIVATION,
+		C.CKM_SHA512_KEY_DERIVATION, C.CKM_SHA512_224_KEY_DERIVATION, C.CKM_SHA512_256_KEY_DERIVATION,
+		C.CKM_SHA3_224_KEY_DERIVE, C.CKM_SHA3_256_KEY_DERIVE, C.CKM_SHA3_384_KEY_DERIVE,
+		C.CKM_SHA3_512_KEY_DERIVE:
+		// No parameter; the key is derived by digesting the base key.
+		if pMechanism.ulParameterLen != 0 {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		return pkcs11.NewMechanism(uint(pMechanism.mechanism), nil), nil
+	case C.CKM_SHAKE_128_KEY_DERIVE, C.CKM_SHAKE_256_KEY_DERIVE:
+		// The optional parameter is the XOF output length, as a CK_ULONG.
+		// Backends can read it back with BytesToULong.
+		if pMechanism.ulParameterLen == 0 {
+			return pkcs11.NewMechanism(uint(pMechanism.mechanism), nil), nil
+		}
+
+		if uint(pMechanism.ulParameterLen) != uint(C.sizeof_CK_ULONG) || C.getMechanismParam(pMechanism) == nil {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		goLenParam := C.GoBytes(unsafe.Pointer(C.getMechanismParam(pMechanism)), C.int(pMechanism.ulParameterLen))
+
+		return pkcs11.NewMechanism(uint(pMechanism.mechanism), goLenParam), nil
+	case C.CKM_EDDSA:
+		eddsaParams := C.CK_EDDSA_PARAMS_PTR(C.getMechanismParam(pMechanism))
+		if pMechanism.ulParameterLen == 0 {
+			// Pure EdDSA without a context may omit the parameter.
+			return pkcs11.NewMechanism(uint(pMechanism.mechanism), nil), nil
+		}
+
+		if eddsaParams == nil || uint(pMechanism.ulParameterLen) != uint(C.sizeof_CK_EDDSA_PARAMS) {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		goPHFlag := fromCBBool(C.getEDDSAPHFlag(eddsaParams))
+		goContextDataLen := uint(C.getEDDSAContextDataLen(eddsaParams))
+		goContextDataPtr := C.getEDDSAContextData(eddsaParams)
+
+		// The context is at most 255 bytes, and is absent iff the
+		// pointer is NULL.
+		if goContextDataLen > 255 || (goContextDataLen == 0) != (goContextDataPtr == nil) {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		var goContextData []byte
+		if goContextDataLen > 0 {
+			goContextData = C.GoBytes(unsafe.Pointer(goContextDataPtr), C.int(goContextDataLen))
+		}
+
+		return pkcs11.NewMechanism(uint(pMechanism.mechanism), NewEDDSAParams(goPHFlag, goContextData)), nil
+	case C.CKM_AES_ECB, C.CKM_DES3_ECB, C.CKM_DES_ECB, C.CKM_ARIA_ECB, C.CKM_SEED_ECB, C.CKM_GOST28147_ECB:
+		// ECB modes have no IV and no other parameters.
+		if pMechanism.ulParameterLen != 0 {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		return pkcs11.NewMechanism(uint(pMechanism.mechanism), nil), nil
+	case C.CKM_AES_KEY_WRAP, C.CKM_AES_KEY_WRAP_PAD:
+		// The optional parameter is an 8-byte IV.  Without one, the
+		// Parameter is nil rather than empty, since backends may use the
+		// default IV in that case.
+		if pMechanism.ulParameterLen == 0 {
+			return pkcs11.NewMechanism(uint(pMechanism.mechanism), nil), nil
+		}
+
+		if pMechanism.ulParameterLen != 8 || C.getMechanismParam(pMechanism) == nil {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		goIV := C.GoBytes(unsafe.Pointer(C.getMechanismParam(pMechanism)), C.int(pMechanism.ulParameterLen))
+
+		return pkcs11.NewMechanism(uint(pMechanism.mechanism), goIV), nil
+	case C.CKM_AES_CTR:
+		if uint(pMechanism.ulParameterLen) != uint(C.sizeof_CK_AES_CTR_PARAMS) || C.getMechanismParam(pMechanism) == nil {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		ctrParams := C.CK_AES_CTR_PARAMS_PTR(C.getMechanismParam(pMechanism))
+		if ctrParams.ulCounterBits < 1 || ctrParams.ulCounterBits > 128 {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		// The structure has no pointers, so it's passed on as is; see
+		// ParseAESCTRParams.
+		goParam := C.GoBytes(unsafe.Pointer(ctrParams), C.int(pMechanism.ulParameterLen))
+
+		return pkcs11.NewMechanism(uint(pMechanism.mechanism), goParam), nil
+	case C.CKM_AES_CBC, C.CKM_AES_CBC_PAD, C.CKM_ARIA_CBC, C.CKM_ARIA_CBC_PAD,
+		C.CKM_SEED_CBC, C.CKM_SEED_CBC_PAD:
+		// The parameter is the 16-byte IV.  It's always copied, so an
+		// all-zero IV stays distinct from a nil Parameter.
+		if pMechanism.ulParameterLen != 16 || C.getMechanismParam(pMechanism) == nil {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		goIV := C.GoBytes(unsafe.Pointer(C.getMechanismParam(pMechanism)), C.int(pMechanism.ulParameterLen))
+
+		return pkcs11.NewMechanism(uint(pMechanism.mechanism), goIV), nil
+	case C.CKM_ARIA_CBC_ENCRYPT_DATA:
+		if uint(pMechanism.ulParameterLen) != uint(C.sizeof_CK_ARIA_CBC_ENCRYPT_DATA_PARAMS) {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		ariaParams := C.CK_ARIA_CBC_ENCRYPT_DATA_PARAMS_PTR(C.getMechanismParam(pMechanism))
+		if ariaParams == nil {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		goIV := C.GoBytes(unsafe.Pointer(&ariaParams.iv[0]), C.int(len(ariaParams.iv)))
+
+		goData, err := toParamBytes(unsafe.Pointer(C.getARIACBCEncryptData(ariaParams)), ariaParams.length)
+		if err != nil {
+			return nil, err
+		}
+
+		return pkcs11.NewMechanism(uint(pMechanism.mechanism), NewCBCEncryptDataParams(goIV, goData)), nil
+	case C.CKM_SEED_CBC_ENCRYPT_DATA:
+		if uint(pMechanism.ulParameterLen) != uint(C.sizeof_CK_SEED_CBC_ENCRYPT_DATA_PARAMS) {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		seedParams := C.CK_SEED_CBC_ENCRYPT_DATA_PARAMS_PTR(C.getMechanismParam(pMechanism))
+		if seedParams == nil {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		goIV := C.GoBytes(unsafe.Pointer(&seedParams.iv[0]), C.int(len(seedParams.iv)))
+
+		goData, err := toParamBytes(unsafe.Pointer(C.getSEEDCBCEncryptData(seedParams)), seedParams.length)
+		if err != nil {
+			return nil, err
+		}
+
+		return pkcs11.NewMechanism(uint(pMechanism.mechanism), NewCBCEncryptDataParams(goIV, goData)), nil
+	case CKM_EC_EDWARDS_KEY_PAIR_GEN, CKM_EC_MONTGOMERY_KEY_PAIR_GEN:
+		// No parameter; the curve is selected by CKA_EC_PARAMS in the
+		// public key template.
+		if pMechanism.ulParameterLen != 0 {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		return pkcs11.NewMechanism(uint(pMechanism.mechanism), nil), nil
+	case C.CKM_GOST28147, C.CKM_GOST28147_MAC, C.CKM_GOST28147_KEY_WRAP:
+		// The parameter is an 8-byte IV (or UKM, for key wrapping), which
+		// is optional except for CKM_GOST28147 itself.
+		if pMechanism.ulParameterLen == 0 && pMechanism.mechanism != C.CKM_GOST28147 {
+			return pkcs11.NewMechanism(uint(pMechanism.mechanism), nil), nil
+		}
+
+		if pMechanism.ulParameterLen != 8 || C.getMechanismParam(pMechanism) == nil {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		goIV := C.GoBytes(unsafe.Pointer(C.getMechanismParam(pMechanism)), C.int(pMechanism.ulParameterLen))
+
+		return pkcs11.NewMechanism(uint(pMechanism.mechanism), goIV), nil
+	case C.CKM_DES3_MAC, C.CKM_DES3_CMAC:
+		if pMechanism.ulParameterLen != 0 {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		return pkcs11.NewMechanism(uint(pMechanism.mechanism), nil), nil
+	case C.CKM_DES3_MAC_GENERAL, C.CKM_DES3_CMAC_GENERAL:
+		// The parameter is a CK_MAC_GENERAL_PARAMS, i.e. the MAC length as a
+		// CK_ULONG.  Backends can read it back with BytesToULong.
+		if uint(pMechanism.ulParameterLen) != uint(C.sizeof_CK_MAC_GENERAL_PARAMS) || C.getMechanismParam(pMechanism) == nil {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		goMacLenParam := C.GoBytes(unsafe.Pointer(C.getMechanismParam(pMechanism)), C.int(pMechanism.ulParameterLen))
+
+		return pkcs11.NewMechanism(uint(pMechanism.mechanism), goMacLenParam), nil
+	case C.CKM_TLS_PRF:
+		if uint(pMechanism.ulParameterLen) != uint(C.sizeof_CK_TLS_PRF_PARAMS) || C.getMechanismParam(pMechanism) == nil {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		prfParams := C.CK_TLS_PRF_PARAMS_PTR(C.getMechanismParam(pMechanism))
+		if C.getTLSPRFOutput(prfParams) == nil || C.getTLSPRFOutputLen(prfParams) == nil {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		goSeed, err := toParamBytes(unsafe.Pointer(C.getTLSPRFSeed(prfParams)), prfParams.ulSeedLen)
+		if err != nil {
+			return nil, err
+		}
+
+		goLabel, err := toParamBytes(unsafe.Pointer(C.getTLSPRFLabel(prfParams)), prfParams.ulLabelLen)
+		if err != nil {
+			return nil, err
+		}
+
+		if uint64(*C.getTLSPRFOutputLen(prfParams)) > math.MaxInt32 {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		goOutputLen := int(*C.getTLSPRFOutputLen(prfParams))
+
+		return pkcs11.NewMechanism(uint(pMechanism.mechanism), NewTLSPRFParams(goSeed, goLabel, goOutputLen)), nil
+	case C.CKM_TLS12_MASTER_KEY_DERIVE, C.CKM_TLS12_MASTER_KEY_DERIVE_DH:
+		// Only the TLS 1.2 structure is supported; the SSL 3.0 mechanisms
+		// (CK_SSL3_MASTER_KEY_DERIVE_PARAMS) are passed through raw.
+		if uint(pMechanism.ulParameterLen) != uint(C.sizeof_CK_TLS12_MASTER_KEY_DERIVE_PARAMS) || C.getMechanismParam(pMechanism) == nil {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		masterParams := C.CK_TLS12_MASTER_KEY_DERIVE_PARAMS_PTR(C.getMechanismParam(pMechanism))
+
+		goClientRandom, goServerRandom, err := toSSL3RandomData(&masterParams.RandomInfo)
+		if err != nil {
+			return nil, err
+		}
+
+		hasVersion := C.getTLS12MasterKeyVersion(masterParams) != nil
+
+		return pkcs11.NewMechanism(uint(pMechanism.mechanism), NewTLS12MasterKeyDeriveParams(goClientRandom, goServerRandom, uint(masterParams.prfHashMechanism), hasVersion)), nil
+	case C.CKM_TLS12_KEY_AND_MAC_DERIVE:
+		// Likewise, CK_SSL3_KEY_MAT_PARAMS isn't supported.
+		if uint(pMechanism.ulParameterLen) != uint(C.sizeof_CK_TLS12_KEY_MAT_PARAMS) || C.getMechanismParam(pMechanism) == nil {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		keyMatParams := C.CK_TLS12_KEY_MAT_PARAMS_PTR(C.getMechanismParam(pMechanism))
+
+		keyMat := C.getTLS12KeyMatReturnedKeyMaterial(keyMatParams)
+		if keyMat == nil || keyMatParams.ulIVSizeInBits%8 != 0 {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		if keyMatParams.ulIVSizeInBits > 0 && (C.getSSL3KeyMatIVClient(keyMat) == nil || C.getSSL3KeyMatIVServer(keyMat) == nil) {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		goClientRandom, goServerRandom, err := toSSL3RandomData(&keyMatParams.RandomInfo)
+		if err != nil {
+			return nil, err
+		}
+
+		goParams := NewTLS12KeyMatParams(uint(keyMatParams.ulMacSizeInBits), uint(keyMatParams.ulKeySizeInBits),
+			uint(keyMatParams.ulIVSizeInBits), fromCBBool(keyMatParams.bIsExport),
+			goClientRandom, goServerRandom, uint(keyMatParams.prfHashMechanism))
+
+		return pkcs11.NewMechanism(uint(pMechanism.mechanism), goParams), nil
+	case C.CKM_PBE_MD2_DES_CBC, C.CKM_PBE_MD5_DES_CBC, C.CKM_PBE_MD5_CAST_CBC,
+		C.CKM_PBE_MD5_CAST3_CBC, C.CKM_PBE_MD5_CAST128_CBC, C.CKM_PBE_SHA1_CAST128_CBC,
+		C.CKM_PBE_SHA1_RC4_128, C.CKM_PBE_SHA1_RC4_40, C.CKM_PBE_SHA1_DES3_EDE_CBC,
+		C.CKM_PBE_SHA1_DES2_EDE_CBC, C.CKM_PBE_SHA1_RC2_128_CBC, C.CKM_PBE_SHA1_RC2_40_CBC,
+		C.CKM_PBA_SHA1_WITH_SHA1_HMAC:
+		if uint(pMechanism.ulParameterLen) != uint(C.sizeof_CK_PBE_PARAMS) {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		pbeParams := C.CK_PBE_PARAMS_PTR(C.getMechanismParam(pMechanism))
+		if pbeParams == nil {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		goPassword, err := toParamBytes(unsafe.Pointer(C.getPBEPassword(pbeParams)), pbeParams.ulPasswordLen)
+		if err != nil {
+			return nil, err
+		}
+
+		goSalt, err := toParamBytes(unsafe.Pointer(C.getPBESalt(pbeParams)), pbeParams.ulSaltLen)
+		if err != nil {
+			return nil, err
+		}
+		hasInitVector := C.getPBEInitVector(pbeParams) != nil
+
+		return pkcs11.NewMechanism(uint(pMechanism.mechanism), NewPBEParams(hasInitVector, goPassword, goSalt, uint(pbeParams.ulIteration))), nil
+	case C.CKM_PKCS5_PBKD2:
+		// The original CK_PKCS5_PBKD2_PARAMS (whose ulPasswordLen is a
+		// pointer) has the same size except on 64-bit Windows, so it can't
+		// be told apart; only CK_PKCS5_PBKD2_PARAMS2 is supported.
+		if uint(pMechanism.ulParameterLen) != uint(C.sizeof_CK_PKCS5_PBKD2_PARAMS2) || C.getMechanismParam(pMechanism) == nil {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		pbkdf2Params := C.CK_PKCS5_PBKD2_PARAMS2_PTR(C.getMechanismParam(pMechanism))
+		if pbkdf2Params.saltSource != C.CKZ_SALT_SPECIFIED {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		goSalt, err := toParamBytes(unsafe.Pointer(C.getPBKD2SaltSourceData(pbkdf2Params)), pbkdf2Params.ulSaltSourceDataLen)
+		if err != nil {
+			return nil, err
+		}
+
+		goPrfData, err := toParamBytes(unsafe.Pointer(C.getPBKD2PrfData(pbkdf2Params)), pbkdf2Params.ulPrfDataLen)
+		if err != nil {
+			return nil, err
+		}
+
+		// A NULL pPassword means the password was supplied with C_Login,
+		// which isn't the same as an empty password.
+		var goPassword []byte
+		if pPassword := C.getPBKD2Password(pbkdf2Params); pPassword != nil {
+			if goPassword, err = toParamBytes(unsafe.Pointer(pPassword), pbkdf2Params.ulPasswordLen); err != nil {
+				return nil, err
+			}
+
+			if goPassword == nil {
+				goPassword = []byte{}
+			}
+		}
+
+		goParams := NewPBKDF2Params(goSalt, uint(pbkdf2Params.iterations), uint(pbkdf2Params.prf), goPrfData, goPassword)
+
+		return pkcs11.NewMechanism(uint(pMechanism.mechanism), goParams), nil
+	case C.CKM_HOTP, C.CKM_SECURID, C.CKM_ACTI:
+		if uint(pMechanism.ulParameterLen) != uint(C.sizeof_CK_OTP_PARAMS) || C.getMechanismParam(pMechanism) == nil {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		otpParams := C.CK_OTP_PARAMS_PTR(C.getMechanismParam(pMechanism))
+		pParams := C.getOTPParams(otpParams)
+
+		if pParams == nil && otpParams.ulCount > 0 {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		// ulCount isn't trusted enough to preallocate goParams with.
+		var goParams []OTPParam
+
+		for i := C.CK_ULONG(0); i < otpParams.ulCount; i++ {
+			otpParam := C.IndexOTPParamPtr(pParams, i)
+
+			goValue, err := toParamBytes(unsafe.Pointer(C.getOTPParamValue(otpParam)), otpParam.ulValueLen)
+			if err != nil {
+				return nil, err
+			}
+
+			goParams = append(goParams, OTPParam{Type: uint(otpParam._type), Value: goValue})
+		}
+
+		return pkcs11.NewMechanism(uint(pMechanism.mechanism), NewOTPParams(goParams)), nil
+	case CKM_SP800_108_COUNTER_KDF, CKM_SP800_108_DOUBLE_PIPELINE_KDF:
+		if uint(pMechanism.ulParameterLen) != uint(C.sizeof_CK_SP800_108_KDF_PARAMS) || C.getMechanismParam(pMechanism) == nil {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		kdfParams := C.CK_SP800_108_KDF_PARAMS_PTR(C.getMechanismParam(pMechanism))
+		if kdfParams.ulAdditionalDerivedKeys != 0 {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		counterMode := pMechanism.mechanism == CKM_SP800_108_COUNTER_KDF
+
+		goDataParams, err := toPRFDataParams(C.getSP800108DataParams(kdfParams), kdfParams.ulNumberOfDataParams, counterMode)
+		if err != nil {
+			return nil, err
+		}
+
+		return pkcs11.NewMechanism(uint(pMechanism.mechanism), NewSP800108KDFParams(uint(kdfParams.prfType), goDataParams, nil)), nil
+	case CKM_SP800_108_FEEDBACK_KDF:
+		if uint(pMechanism.ulParameterLen) != uint(C.sizeof_CK_SP800_108_FEEDBACK_KDF_PARAMS) || C.getMechanismParam(pMechanism) == nil {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		kdfParams := C.CK_SP800_108_FEEDBACK_KDF_PARAMS_PTR(C.getMechanismParam(pMechanism))
+		if kdfParams.ulAdditionalDerivedKeys != 0 {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		goDataParams, err := toPRFDataParams(C.getSP800108FeedbackDataParams(kdfParams), kdfParams.ulNumberOfDataParams, false)
+		if err != nil {
+			return nil, err
+		}
+
+		goIV, err := toParamBytes(unsafe.Pointer(C.getSP800108FeedbackIV(kdfParams)), kdfParams.ulIVLen)
+		if err != nil {
+			return nil, err
+		}
+
+		return pkcs11.NewMechanism(uint(pMechanism.mechanism), NewSP800108KDFParams(uint(kdfParams.prfType), goDataParams, goIV)), nil
+	case C.CKM_CONCATENATE_BASE_AND_KEY:
+		// The parameter is the handle of the second key, as a CK_OBJECT_HANDLE.
+		// Backends can read it back with BytesToULong.
+		if uint(pMechanism.ulParameterLen) != uint(C.sizeof_CK_OBJECT_HANDLE) || C.getMechanismParam(pMechanism) == nil {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		goKeyParam := C.GoBytes(unsafe.Pointer(C.getMechanismParam(pMechanism)), C.int(pMechanism.ulParameterLen))
+
+		return pkcs11.NewMechanism(uint(pMechanism.mechanism), goKeyParam), nil
+	case CKM_PKCS11MOD_ECDSA_DETERMINISTIC:
+		// Dispatched separately from CKM_ECDSA so that the backend knows to
+		// use RFC 6979 nonces, but otherwise identical (no parameter).
+		if pMechanism.ulParameterLen != 0 {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		return pkcs11.NewMechanism(uint(pMechanism.mechanism), nil), nil
+	default:
+		if decode, ok := lookupMechanismDecoder(uint(pMechanism.mechanism)); ok {
+			raw, err := toParamBytes(unsafe.Pointer(C.getMechanismParam(pMechanism)), pMechanism.ulParameterLen)
+			if err != nil {
+				return nil, err
+			}
+
+			goMechanism, err := decode(raw)
+			if err != nil {
+				return nil, err
+			}
+
+			if goMechanism == nil {
+				return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+			}
+
+			return goMechanism, nil
+		}
+
+		// Mechanisms without a decoder above (vendor-defined ones, and
+		// anything newer than we know about) have their parameters passed
+		// through intact for the backend to interpret.
+		raw, err := toParamBytes(unsafe.Pointer(C.getMechanismParam(pMechanism)), pMechanism.ulParameterLen)
+		if err != nil {
+			return nil, err
+		}
+
+		if raw == nil {
+			return pkcs11.NewMechanism(uint(pMechanism.mechanism), nil), nil
+		}
+
+		return pkcs11.NewMechanism(uint(pMechanism.mechanism), raw), nil
+	}
+}
+
+func attrTraceValueBool(value []byte) string {
+	vbool, err := BytesToBool(value)
+	if err == nil {
+		if vbool {
+			return "CK_TRUE"
+		}
+
+		return "CK_FALSE"
+	}
+
+	return fmt.Sprintf("%v", value)
+}
+
+func attrTraceValueULong(value []byte, names map[uint]string) string {
+	vint, err := BytesToULong(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+
+	return traceValueName(vint, names)
+}
+
+// traceValueName renders v symbolically if it's in names, and numerically
+// otherwise.
+func traceValueName(v uint, names map[uint]string) string {
+	if vPretty, ok := names[v]; ok {
+		return vPretty
+	}
+
+	return fmt.Sprintf("%d", v)
+}
+
+// attrTraceValueOTP renders the attributes of OTP key objects.
+func attrTraceValueOTP(a *pkcs11.Attribute) (string, bool) {
+	switch a.Type {
+	case pkcs11.CKA_OTP_FORMAT:
+		return attrTraceValueULong(a.Value, strOTPFormat), true
+	case pkcs11.CKA_OTP_LENGTH, pkcs11.CKA_OTP_TIME_INTERVAL:
+		return attrTraceValueULong(a.Value, nil), true
+	case pkcs11.CKA_OTP_USER_FRIENDLY_MODE:
+		return attrTraceValueBool(a.Value), true
+	case pkcs11.CKA_OTP_CHALLENGE_REQUIREMENT, pkcs11.CKA_OTP_TIME_REQUIREMENT,
+		pkcs11.CKA_OTP_COUNTER_REQUIREMENT, pkcs11.CKA_OTP_PIN_REQUIREMENT:
+		return attrTraceValueULong(a.Value, strOTPParam), true
+	case pkcs11.CKA_OTP_TIME, pkcs11.CKA_OTP_USER_IDENTIFIER,
+		pkcs11.CKA_OTP_SERVICE_IDENTIFIER, pkcs11.CKA_OTP_SERVICE_LOGO_TYPE:
+		return attrTraceValueString(a.Value), true
+	default:
+		return "", false
+	}
+}
+
+func attrTraceValueCKO(value []byte) string {
+	vint, err := BytesToULong(value)
+	if err == nil {
+		vPretty, ok := strCKO[vint]
+		if ok {
+			return vPretty
+		}
+	}
+
+	return fmt.Sprintf("%v", value)
+}
+
+// attrTraceValueCKK renders CKA_KEY_TYPE, falling back to the number for
+// unknown key types.
+func attrTraceValueCKK(value []byte) string {
+	return attrTraceValueULong(value, strCKK)
+}
+
+// attrTraceValueCKC renders CKA_CERTIFICATE_TYPE, falling back to the number
+// for unknown certificate types.
+func attrTraceValueCKC(value []byte) string {
+	return attrTraceValueULong(value, strCKC)
+}
+
+func attrTraceValueCKT(value []byte) string {
+	vint, err := BytesToULong(value)
+	if err == nil {
+		vPretty, ok := strCKT[vint]
+		if ok {
+			return vPretty
+		}
+	}
+
+	return fmt.Sprintf("%v", value)
+}
+
+// attrTraceULongArrays lists the attributes whose values are arrays of
+// CK_ULONG, along with the table used to name the elements (nil if the
+// elements should be rendered as plain numbers).
+var attrTraceULongArrays = map[uint]map[uint]string{
+	pkcs11.CKA_ALLOWED_MECHANISMS: strCKM,
+}
+
+func attrTraceValueULongArray(value []byte, names map[uint]string) string {
+	if len(value)%C.sizeof_CK_ULONG != 0 {
+		return fmt.Sprintf("%v", value)
+	}
+
+	elements := make([]string, 0, len(value)/C.sizeof_CK_ULONG)
+
+	for i := 0; i < len(value); i += C.sizeof_CK_ULONG {
+		// BytesToULong can't fail here, since the length was checked above.
+		vint, _ := BytesToULong(value[i : i+C.sizeof_CK_ULONG])
+
+		vPretty, ok := names[vint]
+		if !ok {
+			vPretty = fmt.Sprintf("%d", vint)
+		}
+
+		elements = append(elements, vPretty)
+	}
+
+	return "[" + strings.Join(elements, " ") + "]"
+}
+
+// attrTraceValueName renders a DER-encoded X.501 Name (as in CKA_SUBJECT and
+// CKA_ISSUER) as an RFC 2253 string, falling back to hex if it doesn't parse.
+func attrTraceValueName(value []byte) string {
+	var rdns pkix.RDNSequence
+
+	rest, err := asn1.Unmarshal(value, &rdns)
+	if err != nil || len(rest) != 0 {
+		return fmt.Sprintf("%x", value)
+	}
+
+	return fmt.Sprintf("%q", rdns.String())
+}
+
+// ecCurveNames names the curve OIDs that can appear in CKA_EC_PARAMS.
+var ecCurveNames = map[string]string{
+	"1.2.840.10045.3.1.7": "P-256",
+	"1.3.132.0.34":        "P-384",
+	"1.3.132.0.35":        "P-521",
+	"1.3.132.0.10":        "secp256k1",
+	"1.3.101.110":         "X25519",
+	"1.3.101.111":         "X448",
+	"1.3.101.112":         "Ed25519",
+	"1.3.101.113":         "Ed448",
+}
+
+// attrTraceValueECParams renders CKA_EC_PARAMS, which is either a named curve
+// OID or (for Edwards and Montgomery curves) a PrintableString curve name.
+func attrTraceValueECParams(value []byte) string {
+	var oid asn1.ObjectIdentifier
+
+	if rest, err := asn1.Unmarshal(value, &oid); err == nil && len(rest) == 0 {
+		if name, ok := ecCurveNames[oid.String()]; ok {
+			return name
+		}
+
+		return oid.String()
+	}
+
+	var name string
+
+	if rest, err := asn1.Unmarshal(value, &name); err == nil && len(rest) == 0 {
+		return fmt.Sprintf("%q", name)
+	}
+
+	return fmt.Sprintf("%x", value)
+}
+
+// attrTraceValueString renders value as a quoted string if it's printable
+// UTF-8, and as hex otherwise.
+func attrTraceValueString(value []byte) string {
+	if utf8.Valid(value) {
+		printable := true
+
+		for _, r := range string(value) {
+			if !unicode.IsPrint(r) {
+				printable = false
+
+				break
+			}
+		}
+
+		if printable {
+			return fmt.Sprintf("%q", value)
+		}
+	}
+
+	return fmt.Sprintf("%x", value)
+}
+
+// traceAlwaysShow and traceAlwaysRedact override traceSensitive for
+// individual attribute types; see SetTraceRedaction.
+var (
+	traceAlwaysShow = map[uint]bool{
+		pkcs11.CKA_CLASS:            true,
+		pkcs11.CKA_KEY_TYPE:         true,
+		pkcs11.CKA_CERTIFICATE_TYPE: true,
+	}
+	traceAlwaysRedact = map[uint]bool{
+		// The key material of secret keys, and of EC, DSA and DH private
+		// keys.
+		pkcs11.CKA_VALUE:            true,
+		pkcs11.CKA_PRIVATE_EXPONENT: true,
+		pkcs11.CKA_PRIME_1:          true,
+		pkcs11.CKA_PRIME_2:          true,
+		pkcs11.CKA_EXPONENT_1:       true,
+		pkcs11.CKA_EXPONENT_2:       true,
+		pkcs11.CKA_COEFFICIENT:      true,
+	}
+)
+
+// SetTraceRedaction replaces the attribute types whose values are traced
+// regardless of PKCS11MOD_TRACE_SENSITIVE.  Values of the alwaysShow types
+// are traced even when it's unset, and values of the alwaysRedact types are
+// never traced, even when it's set; alwaysRedact wins if a type is in both.
+// By default, CKA_CLASS, CKA_KEY_TYPE and CKA_CERTIFICATE_TYPE are always
+// shown, and CKA_VALUE and the RSA private key components are always
+// redacted.  It must be called before the module is initialized.
+func SetTraceRedaction(alwaysShow, alwaysRedact []uint) {
+	traceAlwaysShow = make(map[uint]bool, len(alwaysShow))
+	for _, attrType := range alwaysShow {
+		traceAlwaysShow[attrType] = true
+	}
+
+	traceAlwaysRedact = make(map[uint]bool, len(alwaysRedact))
+	for _, attrType := range alwaysRedact {
+		traceAlwaysRedact[attrType] = true
+	}
+}
+
+// traceAttributeValue reports whether AttrTrace includes the value of
+// attributes of type attrType.
+func traceAttributeValue(attrType uint) bool {
+	if traceAlwaysRedact[attrType] {
+		return false
+	}
+
+	return traceSensitive || traceAlwaysShow[attrType]
+}
+
+func AttrTrace(a *pkcs11.Attribute) string {
+	t := traceValueName(a.Type, strCKA)
+
+	v, ok := attrTraceValue(a)
+	if !ok {
+		return t
+	}
+
+	return fmt.Sprintf("%s: %s", t, v)
+}
+
+// attrTraceValue renders the value of an attribute for AttrTrace, or reports
+// false if the value mustn't be traced; see traceAttributeValue.
+func attrTraceValue(a *pkcs11.Attribute) (string, bool) {
+	if !traceAttributeValue(a.Type) {
+		return "", false
+	}
+
+	if a.Type == pkcs11.CKA_TOKEN || a.Type == pkcs11.CKA_PRIVATE ||
+		a.Type == pkcs11.CKA_MODIFIABLE || a.Type == pkcs11.CKA_TRUST_STEP_UP_APPROVED {
+		return attrTraceValueBool(a.Value), true
+	}
+
+	if a.Type == pkcs11.CKA_CLASS {
+		return attrTraceValueCKO(a.Value), true
+	}
+
+	if a.Type == pkcs11.CKA_KEY_TYPE {
+		return attrTraceValueCKK(a.Value), true
+	}
+
+	if a.Type == pkcs11.CKA_CERTIFICATE_TYPE {
+		return attrTraceValueCKC(a.Value), true
+	}
+
+	if ulongAttributes[a.Type] {
+		return attrTraceValueULong(a.Value, nil), true
+	}
+
+	if names, ok := attrTraceULongArrays[a.Type]; ok {
+		return attrTraceValueULongArray(a.Value, names), true
+	}
+
+	if a.Type == pkcs11.CKA_SUBJECT || a.Type == pkcs11.CKA_ISSUER {
+		return attrTraceValueName(a.Value), true
+	}
+
+	if a.Type == pkcs11.CKA_EC_PARAMS {
+		return attrTraceValueECParams(a.Value), true
+	}
+
+	if a.Type == pkcs11.CKA_EC_POINT {
+		return attrTraceValueECPoint(a.Value), true
+	}
+
+	if vPretty, ok := attrTraceValueOTP(a); ok {
+		return vPretty, true
+	}
+
+	if a.Type == CKA_UNIQUE_ID {
+		return attrTraceValueString(a.Value), true
+	}
+
+	if a.Type >= pkcs11.CKA_TRUST_SERVER_AUTH && a.Type <= pkcs11.CKA_TRUST_EMAIL_PROTECTION {
+		return attrTraceValueCKT(a.Value), true
+	}
+
+	return attrTraceValueHex(a.Value), true
+}
+
+// attrTraceValueECPoint renders a CKA_EC_POINT, noting whether it has the
+// DER OCTET STRING wrapper and, for Weierstrass curves, whether the point is
+// compressed.
+func attrTraceValueECPoint(value []byte) string {
+	point, err := DecodeECPoint(value)
+	if err != nil {
+		return fmt.Sprintf("not DER-wrapped %s", attrTraceValueHex(value))
+	}
+
+	switch {
+	case point[0] == 0x04 && len(point)%2 == 1:
+		return fmt.Sprintf("uncompressed %s", attrTraceValueHex(point))
+	case (point[0] == 0x02 || point[0] == 0x03) && len(point)%2 == 1:
+		return fmt.Sprintf("compressed %s", attrTraceValueHex(point))
+	default:
+		return attrTraceValueHex(point)
+	}
+}
+
+// attrTraceMaxHexBytes is the number of bytes of a value that
+// attrTraceValueHex shows before truncating it.
+const attrTraceMaxHexBytes = 64
+
+// attrTraceValueHex renders a value that has no symbolic decoder as its
+// length and hex encoding, truncated so that e.g. certificates don't flood the
+// log.
+func attrTraceValueHex(value []byte) string {
+	if len(value) > attrTraceMaxHexBytes {
+		return fmt.Sprintf("(%d bytes) %x...", len(value), value[:attrTraceMaxHexBytes])
+	}
+
+	return fmt.Sprintf("(%d bytes) %x", len(value), value)
+}
+
+// RVTrace renders a CK_RV for the trace log, e.g. "CKR_BUFFER_TOO_SMALL".
+// Vendor-defined values are rendered relative to CKR_VENDOR_DEFINED, and
+// other unknown values numerically.
+func RVTrace(rv uint) string {
+	if rv > pkcs11.CKR_VENDOR_DEFINED {
+		return fmt.Sprintf("CKR_VENDOR_DEFINED | 0x%x", rv-pkcs11.CKR_VENDOR_DEFINED)
+	}
+
+	if name, ok := strCKR[rv]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("0x%x", rv)
+}
+
+// MechTrace renders a mechanism for the trace log.  With
+// PKCS11MOD_TRACE_SENSITIVE set, the hash, MGF and salt length of RSA-PSS
+// mechanisms are included as well.
+func MechTrace(m *pkcs11.Mechanism) string {
+	if m == nil {
+		return "none"
+	}
+
+	t := traceValueName(m.Mechanism, strCKM)
+
+	if !traceSensitive || !isPSSMechanism(m.Mechanism) ||
+		len(m.Parameter) != int(C.sizeof_CK_RSA_PKCS_PSS_PARAMS) {
+		return t
+	}
+
+	pssParam := (*C.CK_RSA_PKCS_PSS_PARAMS)(unsafe.Pointer(&m.Parameter[0]))
+
+	return fmt.Sprintf("%s: hashAlg %s, MGF %s, sLen %d", t,
+		traceValueName(uint(pssParam.hashAlg), strCKM),
+		traceValueName(uint(pssParam.mgf), strCKG),
+		uint(pssParam.sLen))
 }
@@ -2,6 +2,7 @@
 #define TYPES_H_
 
 #include "spec/pkcs11go.h"
+#include "pkcs11v3.h"
 
 void SetIndex(CK_ULONG_PTR array, CK_ULONG i, CK_ULONG val)
 {
@@ -29,4 +30,187 @@ static inline CK_VOID_PTR getOAEPSourceData(CK_RSA_PKCS_OAEP_PARAMS_PTR params)
 	return params->pSourceData;
 }
 
+static inline CK_VOID_PTR getECDH1SharedData(CK_ECDH1_DERIVE_PARAMS_PTR params)
+{
+	return params->pSharedData;
+}
+
+static inline CK_VOID_PTR getECDH1PublicData(CK_ECDH1_DERIVE_PARAMS_PTR params)
+{
+	return params->pPublicData;
+}
+
+static inline CK_BBOOL getEDDSAPHFlag(CK_EDDSA_PARAMS_PTR params)
+{
+	return params->phFlag;
+}
+
+static inline CK_ULONG getEDDSAContextDataLen(CK_EDDSA_PARAMS_PTR params)
+{
+	return params->ulContextDataLen;
+}
+
+static inline CK_VOID_PTR getEDDSAContextData(CK_EDDSA_PARAMS_PTR params)
+{
+	return params->pContextData;
+}
+
+static inline CK_VOID_PTR getTLSPRFSeed(CK_TLS_PRF_PARAMS_PTR params)
+{
+	return params->pSeed;
+}
+
+static inline CK_VOID_PTR getTLSPRFLabel(CK_TLS_PRF_PARAMS_PTR params)
+{
+	return params->pLabel;
+}
+
+static inline CK_VOID_PTR getTLSPRFOutput(CK_TLS_PRF_PARAMS_PTR params)
+{
+	return params->pOutput;
+}
+
+static inline CK_ULONG_PTR getTLSPRFOutputLen(CK_TLS_PRF_PARAMS_PTR params)
+{
+	return params->pulOutputLen;
+}
+
+static inline CK_PRF_DATA_PARAM_PTR getSP800108DataParams(CK_SP800_108_KDF_PARAMS_PTR params)
+{
+	return params->pDataParams;
+}
+
+static inline CK_PRF_DATA_PARAM_PTR getSP800108FeedbackDataParams(CK_SP800_108_FEEDBACK_KDF_PARAMS_PTR params)
+{
+	return params->pDataParams;
+}
+
+static inline CK_BYTE_PTR getSP800108FeedbackIV(CK_SP800_108_FEEDBACK_KDF_PARAMS_PTR params)
+{
+	return params->pIV;
+}
+
+static inline CK_PRF_DATA_PARAM_PTR IndexPRFDataParamPtr(CK_PRF_DATA_PARAM_PTR array, CK_ULONG i)
+{
+	return &(array[i]);
+}
+
+static inline CK_VOID_PTR getPRFDataValue(CK_PRF_DATA_PARAM_PTR param)
+{
+	return param->pValue;
+}
+
+static inline CK_RSA_PKCS_OAEP_PARAMS_PTR getRSAAESKeyWrapOAEPParams(CK_RSA_AES_KEY_WRAP_PARAMS_PTR params)
+{
+	return params->pOAEPParams;
+}
+
+static inline CK_BYTE_PTR getSSL3ClientRandom(CK_SSL3_RANDOM_DATA *data)
+{
+	return data->pClientRandom;
+}
+
+static inline CK_BYTE_PTR getSSL3ServerRandom(CK_SSL3_RANDOM_DATA *data)
+{
+	return data->pServerRandom;
+}
+
+static inline CK_VERSION_PTR getTLS12MasterKeyVersion(CK_TLS12_MASTER_KEY_DERIVE_PARAMS_PTR params)
+{
+	return params->pVersion;
+}
+
+static inline CK_SSL3_KEY_MAT_OUT_PTR getTLS12KeyMatReturnedKeyMaterial(CK_TLS12_KEY_MAT_PARAMS_PTR params)
+{
+	return params->pReturnedKeyMaterial;
+}
+
+static inline CK_BYTE_PTR getSSL3KeyMatIVClient(CK_SSL3_KEY_MAT_OUT_PTR keyMat)
+{
+	return keyMat->pIVClient;
+}
+
+static inline CK_BYTE_PTR getSSL3KeyMatIVServer(CK_SSL3_KEY_MAT_OUT_PTR keyMat)
+{
+	return keyMat->pIVServer;
+}
+
+static inline CK_VOID_PTR getPBKD2SaltSourceData(CK_PKCS5_PBKD2_PARAMS2_PTR params)
+{
+	return params->pSaltSourceData;
+}
+
+static inline CK_VOID_PTR getPBKD2PrfData(CK_PKCS5_PBKD2_PARAMS2_PTR params)
+{
+	return params->pPrfData;
+}
+
+static inline CK_UTF8CHAR_PTR getPBKD2Password(CK_PKCS5_PBKD2_PARAMS2_PTR params)
+{
+	return params->pPassword;
+}
+
+static inline CK_BYTE_PTR getPoly1305Nonce(CK_SALSA20_CHACHA20_POLY1305_PARAMS_PTR params)
+{
+	return params->pNonce;
+}
+
+static inline CK_BYTE_PTR getPoly1305AAD(CK_SALSA20_CHACHA20_POLY1305_PARAMS_PTR params)
+{
+	return params->pAAD;
+}
+
+static inline CK_OTP_PARAM_PTR getOTPParams(CK_OTP_PARAMS_PTR params)
+{
+	return params->pParams;
+}
+
+static inline CK_OTP_PARAM_PTR IndexOTPParamPtr(CK_OTP_PARAM_PTR array, CK_ULONG i)
+{
+	return &(array[i]);
+}
+
+static inline CK_VOID_PTR getOTPParamValue(CK_OTP_PARAM_PTR param)
+{
+	return param->pValue;
+}
+
+static inline void putOTPParam(CK_OTP_PARAM_PTR param, CK_OTP_PARAM_TYPE type, CK_VOID_PTR pValue, CK_ULONG ulValueLen)
+{
+	param->type = type;
+	param->pValue = pValue;
+	param->ulValueLen = ulValueLen;
+}
+
+static inline void putOTPSignatureInfo(CK_OTP_SIGNATURE_INFO_PTR info, CK_OTP_PARAM_PTR pParams, CK_ULONG ulCount)
+{
+	info->pParams = pParams;
+	info->ulCount = ulCount;
+}
+
+static inline CK_BYTE_PTR getPBEInitVector(CK_PBE_PARAMS_PTR params)
+{
+	return params->pInitVector;
+}
+
+static inline CK_UTF8CHAR_PTR getPBEPassword(CK_PBE_PARAMS_PTR params)
+{
+	return params->pPassword;
+}
+
+static inline CK_BYTE_PTR getPBESalt(CK_PBE_PARAMS_PTR params)
+{
+	return params->pSalt;
+}
+
+static inline CK_VOID_PTR getARIACBCEncryptData(CK_ARIA_CBC_ENCRYPT_DATA_PARAMS_PTR params)
+{
+	return params->pData;
+}
+
+static inline CK_BYTE_PTR getSEEDCBCEncryptData(CK_SEED_CBC_ENCRYPT_DATA_PARAMS_PTR params)
+{
+	return params->pData;
+}
+
 #endif
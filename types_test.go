@@ -0,0 +1,1307 @@
+// pkcs11mod
+// Copyright (C) 2022  Namecoin Developers
+//
+// pkcs11mod is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// pkcs11mod is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with pkcs11mod; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+
+package pkcs11mod
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/miekg/pkcs11"
+)
+
+func TestToMechanismGOST28147IV(t *testing.T) {
+	iv := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	m, err := toMechanism(testMechanism(t, pkcs11.CKM_GOST28147, unsafe.Pointer(&iv[0]), uintptr(len(iv))))
+	if err != nil {
+		t.Fatalf("toMechanism: %v", err)
+	}
+
+	if !bytes.Equal(m.Parameter, iv) {
+		t.Errorf("got IV %x, want %x", m.Parameter, iv)
+	}
+
+	// A NULL pParameter with the right length must be rejected rather than
+	// dereferenced.
+	nullIV := testMechanism(t, pkcs11.CKM_GOST28147, nil, 0)
+	nullIV.ulParameterLen = 8
+
+	if _, err := toMechanism(nullIV); fromError(err) != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+		t.Errorf("NULL IV: got %v, want CKR_MECHANISM_PARAM_INVALID", err)
+	}
+}
+
+func TestToMechanismDES3MACGeneral(t *testing.T) {
+	for _, mech := range []uint{pkcs11.CKM_DES3_MAC_GENERAL, pkcs11.CKM_DES3_CMAC_GENERAL} {
+		macLen := ckULong(6)
+
+		m, err := toMechanism(testMechanism(t, mech, unsafe.Pointer(&macLen), unsafe.Sizeof(macLen)))
+		if err != nil {
+			t.Fatalf("%s: toMechanism: %v", strCKM[mech], err)
+		}
+
+		if got, err := BytesToULong(m.Parameter); err != nil || got != 6 {
+			t.Errorf("%s: got MAC length %d (%v), want 6", strCKM[mech], got, err)
+		}
+
+		nullParam := testMechanism(t, mech, nil, 0)
+		nullParam.ulParameterLen = ckULong(unsafe.Sizeof(macLen))
+
+		if _, err := toMechanism(nullParam); fromError(err) != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+			t.Errorf("%s: NULL parameter: got %v, want CKR_MECHANISM_PARAM_INVALID", strCKM[mech], err)
+		}
+	}
+}
+
+func TestToMechanismSHAKEOutputLength(t *testing.T) {
+	m, err := toMechanism(testMechanism(t, pkcs11.CKM_SHAKE_256_KEY_DERIVE, nil, 0))
+	if err != nil || m.Parameter != nil {
+		t.Errorf("no parameter: got %x (%v), want nil", m.Parameter, err)
+	}
+
+	outLen := ckULong(64)
+
+	m, err = toMechanism(testMechanism(t, pkcs11.CKM_SHAKE_128_KEY_DERIVE, unsafe.Pointer(&outLen), unsafe.Sizeof(outLen)))
+	if err != nil {
+		t.Fatalf("toMechanism: %v", err)
+	}
+
+	if got, err := BytesToULong(m.Parameter); err != nil || got != 64 {
+		t.Errorf("got output length %d (%v), want 64", got, err)
+	}
+
+	nullParam := testMechanism(t, pkcs11.CKM_SHAKE_128_KEY_DERIVE, nil, 0)
+	nullParam.ulParameterLen = ckULong(unsafe.Sizeof(outLen))
+
+	if _, err := toMechanism(nullParam); fromError(err) != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+		t.Errorf("NULL parameter: got %v, want CKR_MECHANISM_PARAM_INVALID", err)
+	}
+}
+
+func TestToMechanismConcatenateBaseAndKey(t *testing.T) {
+	// The handle is a native CK_OBJECT_HANDLE, so a wider or narrower
+	// parameter must be rejected.
+	key := ckObjectHandle(0x1234)
+
+	m, err := toMechanism(testMechanism(t, pkcs11.CKM_CONCATENATE_BASE_AND_KEY, unsafe.Pointer(&key), unsafe.Sizeof(key)))
+	if err != nil {
+		t.Fatalf("toMechanism: %v", err)
+	}
+
+	if got, err := BytesToULong(m.Parameter); err != nil || got != 0x1234 {
+		t.Errorf("got handle 0x%x (%v), want 0x1234", got, err)
+	}
+
+	short := testMechanism(t, pkcs11.CKM_CONCATENATE_BASE_AND_KEY, unsafe.Pointer(&key), unsafe.Sizeof(key)/2)
+	if _, err := toMechanism(short); fromError(err) != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+		t.Errorf("half-width handle: got %v, want CKR_MECHANISM_PARAM_INVALID", err)
+	}
+
+	nullParam := testMechanism(t, pkcs11.CKM_CONCATENATE_BASE_AND_KEY, nil, 0)
+	nullParam.ulParameterLen = ckULong(unsafe.Sizeof(key))
+
+	if _, err := toMechanism(nullParam); fromError(err) != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+		t.Errorf("NULL parameter: got %v, want CKR_MECHANISM_PARAM_INVALID", err)
+	}
+}
+
+func TestToMechanismUnknownParameterPassthrough(t *testing.T) {
+	// Neither mechanism is one that pkcs11mod knows: one from the standard
+	// range (well above CKM_RSA_PKCS_OAEP_TPM_1_1), and a vendor one.
+	param := []byte{0xde, 0xad, 0xbe, 0xef, 0, 1, 2, 3, 4, 5}
+
+	for _, mech := range []uint{0x7fff0042, pkcs11.CKM_VENDOR_DEFINED | 0x42} {
+		m, err := toMechanism(testMechanism(t, mech, unsafe.Pointer(&param[0]), uintptr(len(param))))
+		if err != nil {
+			t.Fatalf("0x%x: toMechanism: %v", mech, err)
+		}
+
+		if m.Mechanism != mech || !bytes.Equal(m.Parameter, param) {
+			t.Errorf("0x%x: got mechanism 0x%x with parameter %x, want %x", mech, m.Mechanism, m.Parameter, param)
+		}
+
+		// Without a parameter, the Parameter is nil rather than empty.
+		m, err = toMechanism(testMechanism(t, mech, nil, 0))
+		if err != nil || m.Parameter != nil {
+			t.Errorf("0x%x: no parameter: got %x (%v), want nil", mech, m.Parameter, err)
+		}
+	}
+}
+
+func TestTraceRedaction(t *testing.T) {
+	oldSensitive, oldShow, oldRedact := traceSensitive, traceAlwaysShow, traceAlwaysRedact
+
+	t.Cleanup(func() {
+		traceSensitive, traceAlwaysShow, traceAlwaysRedact = oldSensitive, oldShow, oldRedact
+	})
+
+	class := pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY)
+	label := pkcs11.NewAttribute(pkcs11.CKA_LABEL, "backup")
+	value := pkcs11.NewAttribute(pkcs11.CKA_VALUE, []byte{0x01, 0x02, 0x03, 0x04})
+	exponent := pkcs11.NewAttribute(pkcs11.CKA_PRIVATE_EXPONENT, []byte{0x05, 0x06})
+
+	for _, tt := range []struct {
+		sensitive bool
+		a         *pkcs11.Attribute
+		want      string
+	}{
+		{false, class, "CKA_CLASS: CKO_SECRET_KEY"},
+		{false, label, "CKA_LABEL"},
+		{false, value, "CKA_VALUE"},
+		{true, label, "CKA_LABEL: (6 bytes) 6261636b7570"},
+		{true, value, "CKA_VALUE"},
+		{true, exponent, "CKA_PRIVATE_EXPONENT"},
+	} {
+		traceSensitive = tt.sensitive
+		if got := AttrTrace(tt.a); got != tt.want {
+			t.Errorf("default policy, sensitive=%v: got %q, want %q", tt.sensitive, got, tt.want)
+		}
+	}
+
+	// A type in both lists is redacted.
+	SetTraceRedaction([]uint{pkcs11.CKA_LABEL, pkcs11.CKA_VALUE}, []uint{pkcs11.CKA_VALUE})
+
+	for _, tt := range []struct {
+		sensitive bool
+		a         *pkcs11.Attribute
+		want      string
+	}{
+		{false, label, "CKA_LABEL: (6 bytes) 6261636b7570"},
+		{false, class, "CKA_CLASS"},
+		{true, value, "CKA_VALUE"},
+		{true, exponent, "CKA_PRIVATE_EXPONENT: (2 bytes) 0506"},
+	} {
+		traceSensitive = tt.sensitive
+		if got := AttrTrace(tt.a); got != tt.want {
+			t.Errorf("custom policy, sensitive=%v: got %q, want %q", tt.sensitive, got, tt.want)
+		}
+	}
+}
+
+func TestToMechanismOAEPHashAlg(t *testing.T) {
+	params := _Ctype_CK_RSA_PKCS_OAEP_PARAMS{
+		hashAlg: pkcs11.CKM_SHA3_256,
+		mgf:     CKG_MGF1_SHA3_256,
+		source:  pkcs11.CKZ_DATA_SPECIFIED,
+	}
+
+	m := testMechanism(t, pkcs11.CKM_RSA_PKCS_OAEP, unsafe.Pointer(&params), unsafe.Sizeof(params))
+	if _, err := toMechanism(m); err != nil {
+		t.Errorf("CKM_SHA3_256: %v", err)
+	}
+
+	params.hashAlg = pkcs11.CKM_AES_GCM
+	if _, err := toMechanism(m); fromError(err) != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+		t.Errorf("CKM_AES_GCM: got %v, want CKR_MECHANISM_PARAM_INVALID", err)
+	}
+}
+
+func TestDefaultPrivateAndToken(t *testing.T) {
+	for _, tt := range []struct {
+		class   uint
+		private bool
+	}{
+		{pkcs11.CKO_PRIVATE_KEY, true},
+		{pkcs11.CKO_SECRET_KEY, true},
+		{pkcs11.CKO_PUBLIC_KEY, false},
+		{pkcs11.CKO_CERTIFICATE, false},
+		{pkcs11.CKO_DATA, false},
+	} {
+		if got := DefaultPrivate(tt.class); got != tt.private {
+			t.Errorf("DefaultPrivate(%s) = %v, want %v", traceValueName(tt.class, strCKO), got, tt.private)
+		}
+
+		if DefaultToken(tt.class) {
+			t.Errorf("DefaultToken(%s) = true, want false", traceValueName(tt.class, strCKO))
+		}
+	}
+
+	oldSensitive := traceSensitive
+	traceSensitive = true
+
+	t.Cleanup(func() { traceSensitive = oldSensitive })
+
+	if got := AttrTrace(pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, DefaultPrivate(pkcs11.CKO_PRIVATE_KEY))); got != "CKA_PRIVATE: CK_TRUE" {
+		t.Errorf("got %q, want CKA_PRIVATE: CK_TRUE", got)
+	}
+
+	if got := AttrTrace(pkcs11.NewAttribute(pkcs11.CKA_TOKEN, DefaultToken(pkcs11.CKO_PRIVATE_KEY))); got != "CKA_TOKEN: CK_FALSE" {
+		t.Errorf("got %q, want CKA_TOKEN: CK_FALSE", got)
+	}
+}
+
+// mechanismGenerator returns the structured parameters of m (e.g. its
+// *pkcs11.OAEPParams), which pkcs11.Mechanism keeps in an unexported field
+// until they're serialized for a token.
+func mechanismGenerator(m *pkcs11.Mechanism) reflect.Value {
+	return reflect.ValueOf(m).Elem().FieldByName("generator").Elem().Elem()
+}
+
+func TestToMechanismTPM11(t *testing.T) {
+	m, err := toMechanism(testMechanism(t, pkcs11.CKM_RSA_PKCS_TPM_1_1, nil, 0))
+	if err != nil || m.Mechanism != pkcs11.CKM_RSA_PKCS_TPM_1_1 || m.Parameter != nil {
+		t.Errorf("CKM_RSA_PKCS_TPM_1_1: got %+v (%v), want no parameter", m, err)
+	}
+
+	// The OAEP variant may omit its parameters.
+	m, err = toMechanism(testMechanism(t, pkcs11.CKM_RSA_PKCS_OAEP_TPM_1_1, nil, 0))
+	if err != nil || m.Mechanism != pkcs11.CKM_RSA_PKCS_OAEP_TPM_1_1 || m.Parameter != nil {
+		t.Errorf("CKM_RSA_PKCS_OAEP_TPM_1_1 without parameters: got %+v (%v)", m, err)
+	}
+
+	label := []byte("TCPA")
+	params := _Ctype_CK_RSA_PKCS_OAEP_PARAMS{
+		hashAlg:         pkcs11.CKM_SHA_1,
+		mgf:             pkcs11.CKG_MGF1_SHA1,
+		source:          pkcs11.CKZ_DATA_SPECIFIED,
+		pSourceData:     _Ctype_CK_VOID_PTR(&label[0]),
+		ulSourceDataLen: ckULong(len(label)),
+	}
+
+	var pinner runtime.Pinner
+	pinner.Pin(&label[0])
+	t.Cleanup(pinner.Unpin)
+
+	m, err = toMechanism(testMechanism(t, pkcs11.CKM_RSA_PKCS_OAEP_TPM_1_1, unsafe.Pointer(&params), unsafe.Sizeof(params)))
+	if err != nil {
+		t.Fatalf("CKM_RSA_PKCS_OAEP_TPM_1_1: %v", err)
+	}
+
+	oaep := mechanismGenerator(m)
+	if oaep.Type() != reflect.TypeOf(pkcs11.OAEPParams{}) {
+		t.Fatalf("CKM_RSA_PKCS_OAEP_TPM_1_1: got %s parameters, want pkcs11.OAEPParams", oaep.Type())
+	}
+
+	if oaep.FieldByName("HashAlg").Uint() != pkcs11.CKM_SHA_1 || oaep.FieldByName("MGF").Uint() != pkcs11.CKG_MGF1_SHA1 ||
+		!bytes.Equal(oaep.FieldByName("SourceData").Bytes(), label) {
+		t.Errorf("CKM_RSA_PKCS_OAEP_TPM_1_1: got %v", oaep)
+	}
+}
+
+// testECDH1Mechanism builds a CKM_ECDH1_DERIVE mechanism with the given KDF
+// and public data.
+func testECDH1Mechanism(t *testing.T, kdf uint, publicData []byte) *ckMechanism {
+	t.Helper()
+
+	var pinner runtime.Pinner
+
+	t.Cleanup(pinner.Unpin)
+	pinner.Pin(&publicData[0])
+
+	params := &_Ctype_CK_ECDH1_DERIVE_PARAMS{
+		kdf:             _Ctype_CK_EC_KDF_TYPE(kdf),
+		ulPublicDataLen: ckULong(len(publicData)),
+		pPublicData:     (*ckByte)(&publicData[0]),
+	}
+
+	return testMechanism(t, pkcs11.CKM_ECDH1_DERIVE, unsafe.Pointer(params), unsafe.Sizeof(*params))
+}
+
+// ecdh1PublicData returns the public data of a decoded CKM_ECDH1_DERIVE
+// mechanism.
+func ecdh1PublicData(t *testing.T, pMechanism *ckMechanism) []byte {
+	t.Helper()
+
+	m, err := toMechanism(pMechanism)
+	if err != nil {
+		t.Fatalf("toMechanism: %v", err)
+	}
+
+	return mechanismGenerator(m).FieldByName("PublicKeyData").Bytes()
+}
+
+func TestToMechanismECDH1PublicData(t *testing.T) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw := key.PublicKey().Bytes()
+	wrapped := EncodeECPoint(raw)
+
+	oldUnwrap := ecdh1UnwrapPoint
+
+	t.Cleanup(func() { ecdh1UnwrapPoint = oldUnwrap })
+
+	for _, unwrap := range []bool{false, true} {
+		ecdh1UnwrapPoint = unwrap
+
+		if got := ecdh1PublicData(t, testECDH1Mechanism(t, pkcs11.CKD_NULL, raw)); !bytes.Equal(got, raw) {
+			t.Errorf("raw point, unwrap=%v: got %x, want %x", unwrap, got, raw)
+		}
+
+		want := wrapped
+		if unwrap {
+			want = raw
+		}
+
+		if got := ecdh1PublicData(t, testECDH1Mechanism(t, pkcs11.CKD_NULL, wrapped)); !bytes.Equal(got, want) {
+			t.Errorf("DER-wrapped point, unwrap=%v: got %x, want %x", unwrap, got, want)
+		}
+	}
+}
+
+func TestAttrTraceULongArray(t *testing.T) {
+	oldSensitive := traceSensitive
+	traceSensitive = true
+
+	t.Cleanup(func() { traceSensitive = oldSensitive })
+
+	mechanisms := []ckULong{pkcs11.CKM_RSA_PKCS, pkcs11.CKM_ECDSA}
+	value := unsafe.Slice((*byte)(unsafe.Pointer(&mechanisms[0])), len(mechanisms)*int(unsafe.Sizeof(mechanisms[0])))
+
+	a := pkcs11.NewAttribute(pkcs11.CKA_ALLOWED_MECHANISMS, value)
+	if got, want := AttrTrace(a), "CKA_ALLOWED_MECHANISMS: [CKM_RSA_PKCS CKM_ECDSA]"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// A value that isn't a whole number of CK_ULONGs is dumped as is.
+	a = pkcs11.NewAttribute(pkcs11.CKA_ALLOWED_MECHANISMS, value[:len(value)-1])
+	if got := AttrTrace(a); strings.Contains(got, "CKM_") {
+		t.Errorf("truncated array: got %q", got)
+	}
+}
+
+// testEDDSAMechanism builds a CKM_EDDSA mechanism with CK_EDDSA_PARAMS.
+func testEDDSAMechanism(t *testing.T, phFlag bool, contextDataLen int, contextData []byte) *ckMechanism {
+	t.Helper()
+
+	params := &_Ctype_CK_EDDSA_PARAMS{ulContextDataLen: ckULong(contextDataLen)}
+	if phFlag {
+		params.phFlag = pkcs11.CK_TRUE
+	}
+
+	if len(contextData) != 0 {
+		var pinner runtime.Pinner
+
+		t.Cleanup(pinner.Unpin)
+		pinner.Pin(&contextData[0])
+
+		params.pContextData = (*ckByte)(&contextData[0])
+	}
+
+	return testMechanism(t, CKM_EDDSA, unsafe.Pointer(params), unsafe.Sizeof(*params))
+}
+
+func TestToMechanismEDDSA(t *testing.T) {
+	context := bytes.Repeat([]byte{0x5a}, 32)
+
+	for _, tt := range []struct {
+		name    string
+		phFlag  bool
+		context []byte
+	}{
+		{"Ed25519ph", true, nil},
+		{"Ed448 with a context", false, context},
+	} {
+		m, err := toMechanism(testEDDSAMechanism(t, tt.phFlag, len(tt.context), tt.context))
+		if err != nil {
+			t.Fatalf("%s: toMechanism: %v", tt.name, err)
+		}
+
+		params, err := ParseEDDSAParams(m.Parameter)
+		if err != nil {
+			t.Fatalf("%s: ParseEDDSAParams: %v", tt.name, err)
+		}
+
+		if params.PHFlag != tt.phFlag || !bytes.Equal(params.ContextData, tt.context) || (tt.context == nil) != (params.ContextData == nil) {
+			t.Errorf("%s: got phFlag %v and context %x, want %v and %x", tt.name, params.PHFlag, params.ContextData, tt.phFlag, tt.context)
+		}
+	}
+
+	long := make([]byte, 256)
+
+	for _, tt := range []struct {
+		name       string
+		contextLen int
+		context    []byte
+	}{
+		{"256-byte context", len(long), long},
+		{"length without a pointer", 32, nil},
+		{"pointer without a length", 0, context},
+	} {
+		if _, err := toMechanism(testEDDSAMechanism(t, false, tt.contextLen, tt.context)); fromError(err) != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+			t.Errorf("%s: got %v, want CKR_MECHANISM_PARAM_INVALID", tt.name, err)
+		}
+	}
+}
+
+func TestToMechanismECBRejectsParameters(t *testing.T) {
+	stray := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+	for _, mech := range []uint{pkcs11.CKM_AES_ECB, pkcs11.CKM_DES3_ECB} {
+		m, err := toMechanism(testMechanism(t, mech, nil, 0))
+		if err != nil || m.Mechanism != mech || m.Parameter != nil {
+			t.Errorf("%s without a parameter: got %+v (%v)", traceValueName(mech, strCKM), m, err)
+		}
+
+		_, err = toMechanism(testMechanism(t, mech, unsafe.Pointer(&stray[0]), uintptr(len(stray))))
+		if fromError(err) != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+			t.Errorf("%s with a parameter: got %v, want CKR_MECHANISM_PARAM_INVALID", traceValueName(mech, strCKM), err)
+		}
+	}
+}
+
+func TestToMechanismOAEPMGFMismatch(t *testing.T) {
+	oldAllow := oaepAllowMGFMismatch
+
+	t.Cleanup(func() { oaepAllowMGFMismatch = oldAllow })
+
+	// CNG pairs an OAEP hash of SHA-256 with MGF1-SHA1.
+	params := _Ctype_CK_RSA_PKCS_OAEP_PARAMS{
+		hashAlg: pkcs11.CKM_SHA256,
+		mgf:     pkcs11.CKG_MGF1_SHA1,
+		source:  pkcs11.CKZ_DATA_SPECIFIED,
+	}
+	m := testMechanism(t, pkcs11.CKM_RSA_PKCS_OAEP, unsafe.Pointer(&params), unsafe.Sizeof(params))
+
+	oaepAllowMGFMismatch = false
+	if _, err := toMechanism(m); fromError(err) != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+		t.Errorf("strict: got %v, want CKR_MECHANISM_PARAM_INVALID", err)
+	}
+
+	oaepAllowMGFMismatch = true
+
+	buf := captureTrace(t, false)
+
+	goMechanism, err := toMechanism(m)
+	if err != nil {
+		t.Fatalf("CNG compatibility: %v", err)
+	}
+
+	oaep := mechanismGenerator(goMechanism)
+	if oaep.FieldByName("HashAlg").Uint() != pkcs11.CKM_SHA256 || oaep.FieldByName("MGF").Uint() != pkcs11.CKG_MGF1_SHA1 {
+		t.Errorf("CNG compatibility: got %v, want both hashes passed through", oaep)
+	}
+
+	if !strings.Contains(buf.String(), "doesn't match MGF") {
+		t.Errorf("CNG compatibility: the mismatch wasn't traced:\n%s", buf.String())
+	}
+
+	// The hashAlg itself is still validated.
+	params.hashAlg = pkcs11.CKM_AES_GCM
+	if _, err := toMechanism(m); fromError(err) != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+		t.Errorf("CNG compatibility with a bogus hashAlg: got %v, want CKR_MECHANISM_PARAM_INVALID", err)
+	}
+}
+
+func TestMGFToHash(t *testing.T) {
+	for _, tt := range []struct {
+		mgf, hash uint
+	}{
+		{pkcs11.CKG_MGF1_SHA1, pkcs11.CKM_SHA_1},
+		{pkcs11.CKG_MGF1_SHA224, pkcs11.CKM_SHA224},
+		{pkcs11.CKG_MGF1_SHA256, pkcs11.CKM_SHA256},
+		{pkcs11.CKG_MGF1_SHA384, pkcs11.CKM_SHA384},
+		{pkcs11.CKG_MGF1_SHA512, pkcs11.CKM_SHA512},
+		{CKG_MGF1_SHA3_224, pkcs11.CKM_SHA3_224},
+		{CKG_MGF1_SHA3_256, pkcs11.CKM_SHA3_256},
+		{CKG_MGF1_SHA3_384, pkcs11.CKM_SHA3_384},
+		{CKG_MGF1_SHA3_512, pkcs11.CKM_SHA3_512},
+	} {
+		if hash, ok := MGFToHash(tt.mgf); !ok || hash != tt.hash {
+			t.Errorf("MGFToHash(%s) = %s, %v; want %s", traceValueName(tt.mgf, strCKG), traceValueName(hash, strCKM), ok, traceValueName(tt.hash, strCKM))
+		}
+
+		if mgf, ok := HashToMGF(tt.hash); !ok || mgf != tt.mgf {
+			t.Errorf("HashToMGF(%s) = %s, %v; want %s", traceValueName(tt.hash, strCKM), traceValueName(mgf, strCKG), ok, traceValueName(tt.mgf, strCKG))
+		}
+	}
+
+	if _, ok := MGFToHash(0); ok {
+		t.Error("MGFToHash(0) succeeded")
+	}
+
+	if _, ok := HashToMGF(pkcs11.CKM_MD5); ok {
+		t.Error("HashToMGF(CKM_MD5) succeeded")
+	}
+}
+
+func TestCheckULongsFourByteULong(t *testing.T) {
+	if unsafe.Sizeof(uint(0)) < 8 {
+		t.Skip("Go's uint can't hold a value above 2^32 here")
+	}
+
+	const maxFourByteULong = 1<<32 - 1
+
+	above := uint64(1) << 32
+	if err := checkULongs([]uint{1, uint(above), 3}, maxFourByteULong); err == nil {
+		t.Errorf("2^32 fit in a 4-byte CK_ULONG")
+	}
+
+	if err := checkULongs([]uint{1, maxFourByteULong}, maxFourByteULong); err != nil {
+		t.Errorf("2^32-1 didn't fit in a 4-byte CK_ULONG: %v", err)
+	}
+
+	// The largest real CK_ULONG is written in full.
+	values := []uint{uint(maxCKULong), 7}
+	list := make([]ckULong, len(values))
+
+	if err := fromList(values, &list[0], uint(len(values))); err != nil || uint64(list[0]) != maxCKULong || list[1] != 7 {
+		t.Errorf("fromList: got %v (%v), want %v", list, err, values)
+	}
+}
+
+func TestAttrTraceSubject(t *testing.T) {
+	subject, err := asn1.Marshal(pkix.Name{CommonName: "example.com"}.ToRDNSequence())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Names can identify people, so they're only shown with traceSensitive.
+	a := pkcs11.NewAttribute(pkcs11.CKA_SUBJECT, subject)
+	if got := AttrTrace(a); strings.Contains(got, "example.com") {
+		t.Errorf("without traceSensitive: got %q", got)
+	}
+
+	oldSensitive := traceSensitive
+	traceSensitive = true
+
+	t.Cleanup(func() { traceSensitive = oldSensitive })
+
+	if got, want := AttrTrace(a), `CKA_SUBJECT: "CN=example.com"`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// A value that doesn't parse is dumped as hex.
+	a = pkcs11.NewAttribute(pkcs11.CKA_ISSUER, subject[:len(subject)-1])
+	if got := AttrTrace(a); strings.Contains(got, "CN=") || !strings.Contains(got, fmt.Sprintf("%x", subject[:len(subject)-1])) {
+		t.Errorf("truncated name: got %q", got)
+	}
+}
+
+func TestToMechanismARIACBCIV(t *testing.T) {
+	iv := []byte("0123456789abcdef")
+
+	for _, mech := range []uint{pkcs11.CKM_ARIA_CBC, pkcs11.CKM_ARIA_CBC_PAD} {
+		m, err := toMechanism(testMechanism(t, mech, unsafe.Pointer(&iv[0]), uintptr(len(iv))))
+		if err != nil {
+			t.Fatalf("%s: toMechanism: %v", traceValueName(mech, strCKM), err)
+		}
+
+		if !bytes.Equal(m.Parameter, iv) {
+			t.Errorf("%s: got IV %x, want %x", traceValueName(mech, strCKM), m.Parameter, iv)
+		}
+
+		// ARIA has a 16-byte block, so an 8-byte IV is wrong.
+		if _, err := toMechanism(testMechanism(t, mech, unsafe.Pointer(&iv[0]), 8)); fromError(err) != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+			t.Errorf("%s with an 8-byte IV: got %v, want CKR_MECHANISM_PARAM_INVALID", traceValueName(mech, strCKM), err)
+		}
+
+		nullIV := testMechanism(t, mech, nil, 0)
+		nullIV.ulParameterLen = 16
+
+		if _, err := toMechanism(nullIV); fromError(err) != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+			t.Errorf("%s with a NULL IV: got %v, want CKR_MECHANISM_PARAM_INVALID", traceValueName(mech, strCKM), err)
+		}
+	}
+}
+
+func TestToMechanismSEEDCBCIV(t *testing.T) {
+	iv := []byte("fedcba9876543210")
+
+	for _, mech := range []uint{pkcs11.CKM_SEED_CBC, pkcs11.CKM_SEED_CBC_PAD} {
+		m, err := toMechanism(testMechanism(t, mech, unsafe.Pointer(&iv[0]), uintptr(len(iv))))
+		if err != nil {
+			t.Fatalf("%s: toMechanism: %v", traceValueName(mech, strCKM), err)
+		}
+
+		if !bytes.Equal(m.Parameter, iv) {
+			t.Errorf("%s: got IV %x, want %x", traceValueName(mech, strCKM), m.Parameter, iv)
+		}
+
+		// SEED has a 16-byte block too.
+		if _, err := toMechanism(testMechanism(t, mech, unsafe.Pointer(&iv[0]), 8)); fromError(err) != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+			t.Errorf("%s with an 8-byte IV: got %v, want CKR_MECHANISM_PARAM_INVALID", traceValueName(mech, strCKM), err)
+		}
+	}
+
+	if m, err := toMechanism(testMechanism(t, pkcs11.CKM_SEED_ECB, nil, 0)); err != nil || m.Parameter != nil {
+		t.Errorf("CKM_SEED_ECB: got %v, %v, want no parameter", m, err)
+	}
+}
+
+func TestToMechanismARIACBCEncryptData(t *testing.T) {
+	data := []byte("derivation data")
+
+	var pinner runtime.Pinner
+
+	t.Cleanup(pinner.Unpin)
+	pinner.Pin(&data[0])
+
+	params := &_Ctype_CK_ARIA_CBC_ENCRYPT_DATA_PARAMS{
+		pData:  bytePtr(data),
+		length: ckULong(len(data)),
+	}
+	for i := range params.iv {
+		params.iv[i] = ckByte(i)
+	}
+
+	m, err := toMechanism(testMechanism(t, pkcs11.CKM_ARIA_CBC_ENCRYPT_DATA, unsafe.Pointer(params), unsafe.Sizeof(*params)))
+	if err != nil {
+		t.Fatalf("toMechanism: %v", err)
+	}
+
+	goParams, err := ParseCBCEncryptDataParams(m.Parameter)
+	if err != nil {
+		t.Fatalf("ParseCBCEncryptDataParams: %v", err)
+	}
+
+	if want := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}; !bytes.Equal(goParams.IV, want) {
+		t.Errorf("got IV %x, want %x", goParams.IV, want)
+	}
+
+	if !bytes.Equal(goParams.Data, data) {
+		t.Errorf("got data %q, want %q", goParams.Data, data)
+	}
+}
+
+func TestAttrTraceOTPFormat(t *testing.T) {
+	oldSensitive := traceSensitive
+	traceSensitive = true
+
+	t.Cleanup(func() { traceSensitive = oldSensitive })
+
+	for _, tt := range []struct {
+		a    *pkcs11.Attribute
+		want string
+	}{
+		{pkcs11.NewAttribute(pkcs11.CKA_OTP_FORMAT, pkcs11.CK_OTP_FORMAT_ALPHANUMERIC), "CKA_OTP_FORMAT: CK_OTP_FORMAT_ALPHANUMERIC"},
+		{pkcs11.NewAttribute(pkcs11.CKA_OTP_FORMAT, 0x1234), "CKA_OTP_FORMAT: 4660"},
+		{pkcs11.NewAttribute(pkcs11.CKA_OTP_LENGTH, 6), "CKA_OTP_LENGTH: 6"},
+		{pkcs11.NewAttribute(pkcs11.CKA_OTP_USER_FRIENDLY_MODE, true), "CKA_OTP_USER_FRIENDLY_MODE: CK_TRUE"},
+	} {
+		if got := AttrTrace(tt.a); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestAttrTraceKeyType(t *testing.T) {
+	oldSensitive := traceSensitive
+	traceSensitive = true
+
+	t.Cleanup(func() { traceSensitive = oldSensitive })
+
+	for _, tt := range []struct {
+		a    *pkcs11.Attribute
+		want string
+	}{
+		{pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES), "CKA_KEY_TYPE: CKK_AES"},
+		{pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC), "CKA_KEY_TYPE: CKK_EC"},
+		{pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, 0x1234), "CKA_KEY_TYPE: 4660"},
+	} {
+		if got := AttrTrace(tt.a); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestTemplateULongValueBits(t *testing.T) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE_BITS, 2048),
+	}
+
+	bits, ok, err := TemplateULong(template, pkcs11.CKA_VALUE_BITS)
+	if err != nil || !ok || bits != 2048 {
+		t.Errorf("got %d, %v, %v, want 2048, true, nil", bits, ok, err)
+	}
+
+	if _, ok, err := TemplateULong(template, pkcs11.CKA_VALUE_LEN); err != nil || ok {
+		t.Errorf("missing CKA_VALUE_LEN: got %v, %v, want false, nil", ok, err)
+	}
+
+	if _, _, err := TemplateULong(template, pkcs11.CKA_CLASS); err == nil {
+		t.Error("CKA_CLASS isn't a count, but got no error")
+	}
+
+	oldSensitive := traceSensitive
+	traceSensitive = true
+
+	t.Cleanup(func() { traceSensitive = oldSensitive })
+
+	if got, want := AttrTrace(template[1]), "CKA_VALUE_BITS: 2048"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestValueLenFitsFourByteULong(t *testing.T) {
+	if unsafe.Sizeof(0) < 8 {
+		t.Skip("Go's int can't hold a length above 2^32 here")
+	}
+
+	const maxFourByteULong = 1<<32 - 1
+
+	// Allocating a 4 GiB value isn't practical, so only the length is
+	// checked.  The lengths are uint64s so that this compiles where int is
+	// 32 bits.
+	for _, tt := range []struct {
+		n    uint64
+		fits bool
+	}{
+		{0, true},
+		{maxFourByteULong - 1, true},
+		// 2^32-1 is CK_UNAVAILABLE_INFORMATION.
+		{maxFourByteULong, false},
+		{1 << 32, false},
+	} {
+		if fits := valueLenFits(int(tt.n), maxFourByteULong); fits != tt.fits {
+			t.Errorf("length %d: got %v, want %v", tt.n, fits, tt.fits)
+		}
+	}
+}
+
+func TestToMechanismAESCBCIV(t *testing.T) {
+	for _, iv := range [][]byte{[]byte("0123456789abcdef"), make([]byte, 16)} {
+		for _, mech := range []uint{pkcs11.CKM_AES_CBC, pkcs11.CKM_AES_CBC_PAD} {
+			m, err := toMechanism(testMechanism(t, mech, unsafe.Pointer(&iv[0]), uintptr(len(iv))))
+			if err != nil {
+				t.Fatalf("%s: toMechanism: %v", traceValueName(mech, strCKM), err)
+			}
+
+			// An all-zero IV mustn't turn into a nil Parameter.
+			if m.Parameter == nil || !bytes.Equal(m.Parameter, iv) {
+				t.Errorf("%s: got IV %#v, want %x", traceValueName(mech, strCKM), m.Parameter, iv)
+			}
+		}
+	}
+}
+
+func TestToMechanismAESCTR(t *testing.T) {
+	params := &_Ctype_CK_AES_CTR_PARAMS{ulCounterBits: 32}
+	for i := range params.cb {
+		params.cb[i] = ckByte(0xf0 + i)
+	}
+
+	m, err := toMechanism(testMechanism(t, pkcs11.CKM_AES_CTR, unsafe.Pointer(params), unsafe.Sizeof(*params)))
+	if err != nil {
+		t.Fatalf("toMechanism: %v", err)
+	}
+
+	goParams, err := ParseAESCTRParams(m.Parameter)
+	if err != nil {
+		t.Fatalf("ParseAESCTRParams: %v", err)
+	}
+
+	if goParams.CounterBits != 32 {
+		t.Errorf("got %d counter bits, want 32", goParams.CounterBits)
+	}
+
+	for i, b := range goParams.CounterBlock {
+		if b != byte(0xf0+i) {
+			t.Errorf("got counter block %x", goParams.CounterBlock)
+
+			break
+		}
+	}
+
+	for _, bits := range []ckULong{0, 129} {
+		bad := &_Ctype_CK_AES_CTR_PARAMS{ulCounterBits: bits}
+		if _, err := toMechanism(testMechanism(t, pkcs11.CKM_AES_CTR, unsafe.Pointer(bad), unsafe.Sizeof(*bad))); fromError(err) != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+			t.Errorf("%d counter bits: got %v, want CKR_MECHANISM_PARAM_INVALID", bits, err)
+		}
+	}
+}
+
+func TestRegisterMechanismDecoder(t *testing.T) {
+	// A made-up vendor mechanism whose parameter is a version byte (which
+	// must be 1) followed by the payload the backend wants.
+	const ckmVendorVersioned = pkcs11.CKM_VENDOR_DEFINED | 0x2001
+
+	var decoded []byte
+
+	RegisterMechanismDecoder(ckmVendorVersioned, func(raw []byte) (*pkcs11.Mechanism, error) {
+		decoded = raw
+		if len(raw) == 0 || raw[0] != 1 {
+			return nil, pkcs11.Error(pkcs11.CKR_MECHANISM_PARAM_INVALID)
+		}
+
+		return pkcs11.NewMechanism(ckmVendorVersioned, raw[1:]), nil
+	})
+	t.Cleanup(func() { RegisterMechanismDecoder(ckmVendorVersioned, nil) })
+
+	param := []byte{1, 'k', 'e', 'y'}
+
+	m, err := toMechanism(testMechanism(t, ckmVendorVersioned, unsafe.Pointer(&param[0]), uintptr(len(param))))
+	if err != nil {
+		t.Fatalf("toMechanism: %v", err)
+	}
+
+	if !bytes.Equal(decoded, param) {
+		t.Errorf("the decoder got %x, want %x", decoded, param)
+	}
+
+	if !bytes.Equal(m.Parameter, param[1:]) {
+		t.Errorf("got parameter %q, want %q", m.Parameter, param[1:])
+	}
+
+	badVersion := []byte{2, 'k', 'e', 'y'}
+	if _, err := toMechanism(testMechanism(t, ckmVendorVersioned, unsafe.Pointer(&badVersion[0]), uintptr(len(badVersion)))); fromError(err) != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+		t.Errorf("version 2: got %v, want the decoder's CKR_MECHANISM_PARAM_INVALID", err)
+	}
+
+	// Once unregistered, the parameter is passed through raw again.
+	RegisterMechanismDecoder(ckmVendorVersioned, nil)
+
+	decoded = nil
+	if m, err := toMechanism(testMechanism(t, ckmVendorVersioned, unsafe.Pointer(&param[0]), uintptr(len(param)))); err != nil || decoded != nil || !bytes.Equal(m.Parameter, param) {
+		t.Errorf("unregistered: got %v, decoder called=%v", err, decoded != nil)
+	}
+}
+
+// ecdh1TestPoint returns a fresh uncompressed P-256 point: 0x04 || X || Y.
+func ecdh1TestPoint(t *testing.T) []byte {
+	t.Helper()
+
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key.PublicKey().Bytes()
+}
+
+func TestToMechanismECDH1Params(t *testing.T) {
+	point := ecdh1TestPoint(t)
+	if len(point) != 65 || point[0] != 4 {
+		t.Fatalf("not an uncompressed P-256 point: %x", point)
+	}
+
+	m, err := toMechanism(testECDH1Mechanism(t, pkcs11.CKD_NULL, point))
+	if err != nil {
+		t.Fatalf("CKD_NULL: toMechanism: %v", err)
+	}
+
+	params := mechanismGenerator(m)
+	if kdf := params.FieldByName("KDF").Uint(); kdf != pkcs11.CKD_NULL {
+		t.Errorf("CKD_NULL: got KDF 0x%x", kdf)
+	}
+
+	if !params.FieldByName("SharedData").IsNil() {
+		t.Errorf("CKD_NULL: got shared data %x, want nil", params.FieldByName("SharedData").Bytes())
+	}
+
+	if got := params.FieldByName("PublicKeyData").Bytes(); !bytes.Equal(got, point) {
+		t.Errorf("CKD_NULL: got public data %x, want %x", got, point)
+	}
+
+	sharedData := []byte("shared info")
+
+	var pinner runtime.Pinner
+
+	t.Cleanup(pinner.Unpin)
+	pinner.Pin(&point[0])
+	pinner.Pin(&sharedData[0])
+
+	ecdhParams := &_Ctype_CK_ECDH1_DERIVE_PARAMS{
+		kdf:             pkcs11.CKD_SHA256_KDF,
+		ulSharedDataLen: ckULong(len(sharedData)),
+		pSharedData:     bytePtr(sharedData),
+		ulPublicDataLen: ckULong(len(point)),
+		pPublicData:     bytePtr(point),
+	}
+
+	m, err = toMechanism(testMechanism(t, pkcs11.CKM_ECDH1_DERIVE, unsafe.Pointer(ecdhParams), unsafe.Sizeof(*ecdhParams)))
+	if err != nil {
+		t.Fatalf("CKD_SHA256_KDF: toMechanism: %v", err)
+	}
+
+	params = mechanismGenerator(m)
+	if kdf := params.FieldByName("KDF").Uint(); kdf != pkcs11.CKD_SHA256_KDF {
+		t.Errorf("CKD_SHA256_KDF: got KDF 0x%x", kdf)
+	}
+
+	if got := params.FieldByName("SharedData").Bytes(); !bytes.Equal(got, sharedData) {
+		t.Errorf("CKD_SHA256_KDF: got shared data %q, want %q", got, sharedData)
+	}
+
+	// Without public data, there's nothing to agree with.
+	ecdhParams.pPublicData = nil
+	if _, err := toMechanism(testMechanism(t, pkcs11.CKM_ECDH1_DERIVE, unsafe.Pointer(ecdhParams), unsafe.Sizeof(*ecdhParams))); fromError(err) != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+		t.Errorf("no public data: got %v, want CKR_MECHANISM_PARAM_INVALID", err)
+	}
+}
+
+func TestToMechanismRSAAESKeyWrap(t *testing.T) {
+	label := []byte("label")
+
+	var pinner runtime.Pinner
+
+	t.Cleanup(pinner.Unpin)
+
+	oaepParams := &_Ctype_CK_RSA_PKCS_OAEP_PARAMS{
+		hashAlg:         pkcs11.CKM_SHA256,
+		mgf:             pkcs11.CKG_MGF1_SHA256,
+		source:          pkcs11.CKZ_DATA_SPECIFIED,
+		pSourceData:     _Ctype_CK_VOID_PTR(&label[0]),
+		ulSourceDataLen: ckULong(len(label)),
+	}
+	pinner.Pin(&label[0])
+	pinner.Pin(oaepParams)
+
+	params := &_Ctype_CK_RSA_AES_KEY_WRAP_PARAMS{
+		ulAESKeyBits: 256,
+		pOAEPParams:  oaepParams,
+	}
+
+	m, err := toMechanism(testMechanism(t, pkcs11.CKM_RSA_AES_KEY_WRAP, unsafe.Pointer(params), unsafe.Sizeof(*params)))
+	if err != nil {
+		t.Fatalf("toMechanism: %v", err)
+	}
+
+	goParams, err := ParseRSAAESKeyWrapParams(m.Parameter)
+	if err != nil {
+		t.Fatalf("ParseRSAAESKeyWrapParams: %v", err)
+	}
+
+	if goParams.AESKeyBits != 256 {
+		t.Errorf("got %d AES key bits, want 256", goParams.AESKeyBits)
+	}
+
+	if oaep := goParams.OAEP; oaep.HashAlg != pkcs11.CKM_SHA256 || oaep.MGF != pkcs11.CKG_MGF1_SHA256 ||
+		oaep.SourceType != pkcs11.CKZ_DATA_SPECIFIED || !bytes.Equal(oaep.SourceData, label) {
+		t.Errorf("got OAEP parameters %+v", oaep)
+	}
+
+	// The inner parameters are validated like those of CKM_RSA_PKCS_OAEP.
+	params.pOAEPParams = nil
+	if _, err := toMechanism(testMechanism(t, pkcs11.CKM_RSA_AES_KEY_WRAP, unsafe.Pointer(params), unsafe.Sizeof(*params))); fromError(err) != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+		t.Errorf("no OAEP parameters: got %v, want CKR_MECHANISM_PARAM_INVALID", err)
+	}
+}
+
+func TestToMechanismEDDSAPure(t *testing.T) {
+	// Pure Ed25519 usually passes no parameter at all.
+	m, err := toMechanism(testMechanism(t, CKM_EDDSA, nil, 0))
+	if err != nil || m.Mechanism != CKM_EDDSA || m.Parameter != nil {
+		t.Errorf("no parameter: got %+v (%v), want CKM_EDDSA without a parameter", m, err)
+	}
+
+	// A CK_EDDSA_PARAMS without context data keeps ContextData nil.
+	m, err = toMechanism(testEDDSAMechanism(t, false, 0, nil))
+	if err != nil {
+		t.Fatalf("no context: toMechanism: %v", err)
+	}
+
+	params, err := ParseEDDSAParams(m.Parameter)
+	if err != nil || params.PHFlag || params.ContextData != nil {
+		t.Errorf("no context: got %+v (%v)", params, err)
+	}
+
+	context := bytes.Repeat([]byte{0xc3}, 32)
+
+	m, err = toMechanism(testEDDSAMechanism(t, false, len(context), context))
+	if err != nil {
+		t.Fatalf("32-byte context: toMechanism: %v", err)
+	}
+
+	if params, err := ParseEDDSAParams(m.Parameter); err != nil || !bytes.Equal(params.ContextData, context) {
+		t.Errorf("32-byte context: got %+v (%v), want context %x", params, err, context)
+	}
+
+	// A parameter that isn't a CK_EDDSA_PARAMS is rejected rather than read
+	// past its end.  The buffer is a whole CK_EDDSA_PARAMS, so that -race's
+	// pointer checks don't trip over the conversion.
+	var short _Ctype_CK_EDDSA_PARAMS
+	if _, err := toMechanism(testMechanism(t, CKM_EDDSA, unsafe.Pointer(&short), 1)); fromError(err) != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+		t.Errorf("1-byte parameter: got %v, want CKR_MECHANISM_PARAM_INVALID", err)
+	}
+
+	// So is a NULL parameter that claims a length.
+	if _, err := toMechanism(testMechanism(t, CKM_EDDSA, nil, unsafe.Sizeof(short))); fromError(err) != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+		t.Errorf("NULL parameter with a length: got %v, want CKR_MECHANISM_PARAM_INVALID", err)
+	}
+}
+
+func TestToMechanismTLSPRFShort(t *testing.T) {
+	// A parameter shorter than CK_TLS_PRF_PARAMS is rejected rather than
+	// read past its end.
+	var short _Ctype_CK_TLS_PRF_PARAMS
+	if _, err := toMechanism(testMechanism(t, pkcs11.CKM_TLS_PRF, unsafe.Pointer(&short), 1)); fromError(err) != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+		t.Errorf("1-byte parameter: got %v, want CKR_MECHANISM_PARAM_INVALID", err)
+	}
+
+	if _, err := toMechanism(testMechanism(t, pkcs11.CKM_TLS_PRF, nil, unsafe.Sizeof(short))); fromError(err) != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+		t.Errorf("NULL parameter: got %v, want CKR_MECHANISM_PARAM_INVALID", err)
+	}
+}
+
+func TestToMechanismOTPCount(t *testing.T) {
+	// An absurd ulCount fails on the first invalid CK_OTP_PARAM rather than
+	// in an allocation sized by it.
+	value := []byte{0}
+	inputs := []_Ctype_CK_OTP_PARAM{{
+		_type:      pkcs11.CK_OTP_COUNTER,
+		pValue:     _Ctype_CK_VOID_PTR(unsafe.Pointer(&value[0])),
+		ulValueLen: math.MaxInt32 + 1,
+	}}
+
+	var pinner runtime.Pinner
+
+	t.Cleanup(pinner.Unpin)
+	pinner.Pin(&value[0])
+	pinner.Pin(&inputs[0])
+
+	params := &_Ctype_CK_OTP_PARAMS{pParams: &inputs[0], ulCount: ^ckULong(0)}
+	if _, err := toMechanism(testMechanism(t, pkcs11.CKM_HOTP, unsafe.Pointer(params), unsafe.Sizeof(*params))); fromError(err) != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+		t.Errorf("got %v, want CKR_MECHANISM_PARAM_INVALID", err)
+	}
+}
+
+func TestToMechanismSP800108IterationVariable(t *testing.T) {
+	label := []byte("label")
+	dataParams := []_Ctype_CK_PRF_DATA_PARAM{
+		{_type: CK_SP800_108_ITERATION_VARIABLE},
+		{_type: CK_SP800_108_BYTE_ARRAY, pValue: _Ctype_CK_VOID_PTR(unsafe.Pointer(&label[0])), ulValueLen: ckULong(len(label))},
+	}
+
+	var pinner runtime.Pinner
+
+	t.Cleanup(pinner.Unpin)
+	pinner.Pin(&label[0])
+	pinner.Pin(&dataParams[0])
+
+	params := &_Ctype_CK_SP800_108_KDF_PARAMS{
+		prfType:              pkcs11.CKM_SHA256_HMAC,
+		ulNumberOfDataParams: ckULong(len(dataParams)),
+		pDataParams:          &dataParams[0],
+	}
+
+	// In double-pipeline mode, the iteration variable is the output of the
+	// first pipeline and has no CK_SP800_108_COUNTER_FORMAT.
+	m, err := toMechanism(testMechanism(t, CKM_SP800_108_DOUBLE_PIPELINE_KDF, unsafe.Pointer(params), unsafe.Sizeof(*params)))
+	if err != nil {
+		t.Fatalf("double pipeline: toMechanism: %v", err)
+	}
+
+	got, err := ParseSP800108KDFParams(m.Parameter)
+	if err != nil {
+		t.Fatalf("double pipeline: ParseSP800108KDFParams: %v", err)
+	}
+
+	want := []PRFDataParam{
+		{Type: CK_SP800_108_ITERATION_VARIABLE},
+		{Type: CK_SP800_108_BYTE_ARRAY, Value: label},
+	}
+	if !reflect.DeepEqual(got.DataParams, want) {
+		t.Errorf("double pipeline: got data params %+v, want %+v", got.DataParams, want)
+	}
+
+	// In counter mode, it's the counter and needs a format.
+	if _, err := toMechanism(testMechanism(t, CKM_SP800_108_COUNTER_KDF, unsafe.Pointer(params), unsafe.Sizeof(*params))); fromError(err) != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+		t.Errorf("counter: got %v, want CKR_MECHANISM_PARAM_INVALID", err)
+	}
+}
+
+func TestToMechanismSP800108Count(t *testing.T) {
+	// An absurd ulNumberOfDataParams fails on the first invalid
+	// CK_PRF_DATA_PARAM rather than in an allocation sized by it.
+	dataParams := []_Ctype_CK_PRF_DATA_PARAM{{_type: 0x7fff}}
+
+	var pinner runtime.Pinner
+
+	t.Cleanup(pinner.Unpin)
+	pinner.Pin(&dataParams[0])
+
+	params := &_Ctype_CK_SP800_108_KDF_PARAMS{
+		prfType:              pkcs11.CKM_SHA256_HMAC,
+		ulNumberOfDataParams: ^ckULong(0),
+		pDataParams:          &dataParams[0],
+	}
+	if _, err := toMechanism(testMechanism(t, CKM_SP800_108_COUNTER_KDF, unsafe.Pointer(params), unsafe.Sizeof(*params))); fromError(err) != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+		t.Errorf("got %v, want CKR_MECHANISM_PARAM_INVALID", err)
+	}
+}
+
+func TestToMechanismECDH1KDF(t *testing.T) {
+	point := ecdh1TestPoint(t)
+	buf := captureTrace(t, false)
+
+	m, err := toMechanism(testECDH1Mechanism(t, pkcs11.CKD_SHA256_KDF, point))
+	if err != nil {
+		t.Fatalf("CKD_SHA256_KDF: toMechanism: %v", err)
+	}
+
+	if kdf := mechanismGenerator(m).FieldByName("KDF").Uint(); kdf != pkcs11.CKD_SHA256_KDF {
+		t.Errorf("CKD_SHA256_KDF: got KDF 0x%x", kdf)
+	}
+
+	if !strings.Contains(buf.String(), "kdf CKD_SHA256_KDF") {
+		t.Errorf("the trace doesn't name the KDF: %q", buf.String())
+	}
+
+	if _, err := toMechanism(testECDH1Mechanism(t, 0xdead, point)); fromError(err) != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+		t.Errorf("kdf 0xdead: got %v, want CKR_MECHANISM_PARAM_INVALID", err)
+	}
+}
+
+func TestToMechanismNullPSSAndOAEPParams(t *testing.T) {
+	var (
+		pss  _Ctype_CK_RSA_PKCS_PSS_PARAMS
+		oaep _Ctype_CK_RSA_PKCS_OAEP_PARAMS
+	)
+
+	for _, tt := range []struct {
+		name     string
+		mech     uint
+		paramLen uintptr
+	}{
+		{"PSS", pkcs11.CKM_RSA_PKCS_PSS, 0},
+		{"PSS with a length", pkcs11.CKM_SHA256_RSA_PKCS_PSS, unsafe.Sizeof(pss)},
+		{"OAEP", pkcs11.CKM_RSA_PKCS_OAEP, 0},
+		{"OAEP with a length", pkcs11.CKM_RSA_PKCS_OAEP, unsafe.Sizeof(oaep)},
+	} {
+		// A NULL pParameter must be rejected rather than dereferenced,
+		// whatever ulParameterLen claims.
+		m := testMechanism(t, tt.mech, nil, 0)
+		m.ulParameterLen = ckULong(tt.paramLen)
+
+		if _, err := toMechanism(m); fromError(err) != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+			t.Errorf("%s: got %v, want CKR_MECHANISM_PARAM_INVALID", tt.name, err)
+		}
+	}
+
+	// So must a parameter too short to be the structure.
+	short := make([]byte, 4)
+	if _, err := toMechanism(testMechanism(t, pkcs11.CKM_RSA_PKCS_PSS, unsafe.Pointer(&short[0]), uintptr(len(short)))); fromError(err) != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+		t.Errorf("short PSS parameter: got %v, want CKR_MECHANISM_PARAM_INVALID", err)
+	}
+}
+
+func TestToMechanismParamLengths(t *testing.T) {
+	// 1<<31 doesn't fit in the C.int that C.GoBytes takes; on a 32-bit build
+	// it used to wrap to a negative length.
+	const tooLong = 1 << 31
+
+	iv := make([]byte, 12)
+	buf := make([]byte, 1)
+
+	var pinner runtime.Pinner
+
+	t.Cleanup(pinner.Unpin)
+	pinner.Pin(&iv[0])
+	pinner.Pin(&buf[0])
+
+	gcmParams := _Ctype_CK_GCM_PARAMS{
+		pIv:       bytePtr(iv),
+		ulIvLen:   ckULong(len(iv)),
+		ulIvBits:  ckULong(len(iv) * 8),
+		ulTagBits: 128,
+	}
+
+	m := testMechanism(t, pkcs11.CKM_AES_GCM, unsafe.Pointer(&gcmParams), unsafe.Sizeof(gcmParams))
+
+	// A NULL AAD with zero length is fine.
+	if _, _, err := toGCMMechanism(m); err != nil {
+		t.Errorf("empty AAD: %v", err)
+	}
+
+	gcmParams.pAAD = bytePtr(buf)
+	gcmParams.ulAADLen = tooLong
+
+	if _, _, err := toGCMMechanism(m); fromError(err) != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+		t.Errorf("AAD length 1<<31: got %v, want CKR_MECHANISM_PARAM_INVALID", err)
+	}
+
+	oaepParams := _Ctype_CK_RSA_PKCS_OAEP_PARAMS{
+		hashAlg:         pkcs11.CKM_SHA256,
+		mgf:             pkcs11.CKG_MGF1_SHA256,
+		source:          pkcs11.CKZ_DATA_SPECIFIED,
+		pSourceData:     _Ctype_CK_VOID_PTR(&buf[0]),
+		ulSourceDataLen: tooLong,
+	}
+
+	m = testMechanism(t, pkcs11.CKM_RSA_PKCS_OAEP, unsafe.Pointer(&oaepParams), unsafe.Sizeof(oaepParams))
+	if _, err := toMechanism(m); fromError(err) != pkcs11.CKR_MECHANISM_PARAM_INVALID {
+		t.Errorf("OAEP source data length 1<<31: got %v, want CKR_MECHANISM_PARAM_INVALID", err)
+	}
+}
+
+func TestRVTrace(t *testing.T) {
+	for _, tt := range []struct {
+		rv   uint
+		want string
+	}{
+		{pkcs11.CKR_OK, "CKR_OK"},
+		{pkcs11.CKR_BUFFER_TOO_SMALL, "CKR_BUFFER_TOO_SMALL"},
+		{pkcs11.CKR_VENDOR_DEFINED + 0x42, "CKR_VENDOR_DEFINED | 0x42"},
+		{0x7fff, "0x7fff"},
+	} {
+		if got := RVTrace(tt.rv); got != tt.want {
+			t.Errorf("RVTrace(0x%x) = %q, want %q", tt.rv, got, tt.want)
+		}
+	}
+}
+
+func TestECPointEncoding(t *testing.T) {
+	oldSensitive := traceSensitive
+	traceSensitive = true
+
+	t.Cleanup(func() { traceSensitive = oldSensitive })
+
+	// A fixed key, since a random raw point can happen to parse as DER.
+	key, err := ecdh.P256().NewPrivateKey(bytes.Repeat([]byte{0x01}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uncompressed := key.PublicKey().Bytes()
+	x, y := uncompressed[1:33], uncompressed[33:]
+	compressed := append([]byte{0x02 | y[len(y)-1]&1}, x...)
+
+	for _, tt := range []struct {
+		name  string
+		point []byte
+	}{
+		{"uncompressed", uncompressed},
+		{"compressed", compressed},
+	} {
+		encoded := EncodeECPoint(tt.point)
+		if len(encoded) != len(tt.point)+2 || encoded[0] != asn1.TagOctetString {
+			t.Errorf("%s: EncodeECPoint: got %x", tt.name, encoded)
+		}
+
+		if point, err := DecodeECPoint(encoded); err != nil || !bytes.Equal(point, tt.point) {
+			t.Errorf("%s: DecodeECPoint: got %x, %v, want %x", tt.name, point, err, tt.point)
+		}
+
+		// Without the wrapper, as from a non-compliant token.
+		if _, err := DecodeECPoint(tt.point); fromError(err) != pkcs11.CKR_ATTRIBUTE_VALUE_INVALID {
+			t.Errorf("%s: DecodeECPoint of the raw point: got %v, want CKR_ATTRIBUTE_VALUE_INVALID", tt.name, err)
+		}
+
+		if got, want := AttrTrace(pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, encoded)), "CKA_EC_POINT: "+tt.name+" "; !strings.HasPrefix(got, want) {
+			t.Errorf("%s: AttrTrace: got %q, want prefix %q", tt.name, got, want)
+		}
+
+		if got, want := AttrTrace(pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, tt.point)), "CKA_EC_POINT: not DER-wrapped "; !strings.HasPrefix(got, want) {
+			t.Errorf("%s: AttrTrace of the raw point: got %q, want prefix %q", tt.name, got, want)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+// pkcs11mod
+// Copyright (C) 2022  Namecoin Developers
+//
+// pkcs11mod is free software; you can redistribute it and/or
+// modify it under the terms of the GNU Lesser General Public
+// License as published by the Free Software Foundation; either
+// version 2.1 of the License, or (at your option) any later version.
+//
+// pkcs11mod is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+// Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public
+// License along with pkcs11mod; if not, write to the Free Software
+// Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301  USA
+
+package pkcs11mod
+
+import (
+	"github.com/miekg/pkcs11"
+)
+
+// PKCS11MODCK_VENDOR is the vendor prefix ("pkm") of the vendor-defined
+// constants below, chosen to stay clear of the NSS and nCipher ranges.
+const PKCS11MODCK_VENDOR = 0x706B6D00
+
+// Vendor-defined mechanisms understood by pkcs11mod.  The Makefile picks up
+// the names from this file when generating strings.go, so each constant must
+// be on its own line.
+const (
+	// CKM_PKCS11MOD_ECDSA_DETERMINISTIC is CKM_ECDSA with deterministic
+	// (RFC 6979) nonces.  Like CKM_ECDSA, it takes no parameter and signs
+	// an already-hashed input.
+	CKM_PKCS11MOD_ECDSA_DETERMINISTIC = pkcs11.CKM_VENDOR_DEFINED | PKCS11MODCK_VENDOR | 0x01
+)